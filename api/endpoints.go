@@ -5,42 +5,117 @@ package api
 // transport.
 
 import (
+	"encoding/json"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
 	"github.com/go-kit/kit/endpoint"
 	"github.com/go-kit/kit/tracing/opentracing"
+	"github.com/microservices-demo/user/bulk"
 	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/logins"
 	"github.com/microservices-demo/user/users"
+	"github.com/microservices-demo/user/webhooks"
 	stdopentracing "github.com/opentracing/opentracing-go"
 	"golang.org/x/net/context"
 )
 
 // Endpoints collects the endpoints that comprise the Service.
 type Endpoints struct {
-	LoginEndpoint       endpoint.Endpoint
-	RegisterEndpoint    endpoint.Endpoint
-	UserGetEndpoint     endpoint.Endpoint
-	UserPostEndpoint    endpoint.Endpoint
-	AddressGetEndpoint  endpoint.Endpoint
-	AddressPostEndpoint endpoint.Endpoint
-	CardGetEndpoint     endpoint.Endpoint
-	CardPostEndpoint    endpoint.Endpoint
-	DeleteEndpoint      endpoint.Endpoint
-	HealthEndpoint      endpoint.Endpoint
+	LoginEndpoint         endpoint.Endpoint
+	LoginsGetEndpoint     endpoint.Endpoint
+	RegisterEndpoint      endpoint.Endpoint
+	AvailabilityEndpoint  endpoint.Endpoint
+	UserGetEndpoint       endpoint.Endpoint
+	UserPostEndpoint      endpoint.Endpoint
+	UserPutEndpoint       endpoint.Endpoint
+	UserPatchEndpoint     endpoint.Endpoint
+	PasswordEndpoint      endpoint.Endpoint
+	DefaultsEndpoint      endpoint.Endpoint
+	VerificationEndpoint  endpoint.Endpoint
+	VerifyEndpoint        endpoint.Endpoint
+	UsernameEndpoint      endpoint.Endpoint
+	UsernameGetEndpoint   endpoint.Endpoint
+	StatusEndpoint        endpoint.Endpoint
+	StatusGetEndpoint     endpoint.Endpoint
+	AddressGetEndpoint    endpoint.Endpoint
+	AddressPostEndpoint   endpoint.Endpoint
+	AddressPutEndpoint    endpoint.Endpoint
+	AddressPatchEndpoint  endpoint.Endpoint
+	CardGetEndpoint       endpoint.Endpoint
+	CardPostEndpoint      endpoint.Endpoint
+	CardPutEndpoint       endpoint.Endpoint
+	CardPatchEndpoint     endpoint.Endpoint
+	DeleteEndpoint        endpoint.Endpoint
+	RestoreEndpoint       endpoint.Endpoint
+	ChangesEndpoint       endpoint.Endpoint
+	WebhookGetEndpoint    endpoint.Endpoint
+	WebhookPostEndpoint   endpoint.Endpoint
+	WebhookDeleteEndpoint endpoint.Endpoint
+	DeadLettersEndpoint   endpoint.Endpoint
+	ReplayEndpoint        endpoint.Endpoint
+	ExportEndpoint        endpoint.Endpoint
+	ImportEndpoint        endpoint.Endpoint
+	CheckEndpoint         endpoint.Endpoint
+	GuestPostEndpoint     endpoint.Endpoint
+	GuestGetEndpoint      endpoint.Endpoint
+	GuestAddressEndpoint  endpoint.Endpoint
+	GuestCardEndpoint     endpoint.Endpoint
+	AccessPostEndpoint    endpoint.Endpoint
+	AccessGetEndpoint     endpoint.Endpoint
+	AccessArchiveEndpoint endpoint.Endpoint
+	HealthEndpoint        endpoint.Endpoint
 }
 
 // MakeEndpoints returns an Endpoints structure, where each endpoint is
 // backed by the given service.
 func MakeEndpoints(s Service, tracer stdopentracing.Tracer) Endpoints {
 	return Endpoints{
-		LoginEndpoint:       opentracing.TraceServer(tracer, "GET /login")(MakeLoginEndpoint(s)),
-		RegisterEndpoint:    opentracing.TraceServer(tracer, "POST /register")(MakeRegisterEndpoint(s)),
-		HealthEndpoint:      opentracing.TraceServer(tracer, "GET /health")(MakeHealthEndpoint(s)),
-		UserGetEndpoint:     opentracing.TraceServer(tracer, "GET /customers")(MakeUserGetEndpoint(s)),
-		UserPostEndpoint:    opentracing.TraceServer(tracer, "POST /customers")(MakeUserPostEndpoint(s)),
-		AddressGetEndpoint:  opentracing.TraceServer(tracer, "GET /addresses")(MakeAddressGetEndpoint(s)),
-		AddressPostEndpoint: opentracing.TraceServer(tracer, "POST /addresses")(MakeAddressPostEndpoint(s)),
-		CardGetEndpoint:     opentracing.TraceServer(tracer, "GET /cards")(MakeCardGetEndpoint(s)),
-		DeleteEndpoint:      opentracing.TraceServer(tracer, "DELETE /")(MakeDeleteEndpoint(s)),
-		CardPostEndpoint:    opentracing.TraceServer(tracer, "POST /cards")(MakeCardPostEndpoint(s)),
+		LoginEndpoint:         opentracing.TraceServer(tracer, "GET /login")(MakeLoginEndpoint(s)),
+		LoginsGetEndpoint:     opentracing.TraceServer(tracer, "GET /customers/logins")(MakeLoginsGetEndpoint(s)),
+		RegisterEndpoint:      opentracing.TraceServer(tracer, "POST /register")(MakeRegisterEndpoint(s)),
+		AvailabilityEndpoint:  opentracing.TraceServer(tracer, "GET /register/availability")(MakeAvailabilityEndpoint(s)),
+		HealthEndpoint:        opentracing.TraceServer(tracer, "GET /health")(MakeHealthEndpoint(s)),
+		UserGetEndpoint:       opentracing.TraceServer(tracer, "GET /customers")(MakeUserGetEndpoint(s)),
+		UserPostEndpoint:      opentracing.TraceServer(tracer, "POST /customers")(MakeUserPostEndpoint(s)),
+		AddressGetEndpoint:    opentracing.TraceServer(tracer, "GET /addresses")(MakeAddressGetEndpoint(s)),
+		AddressPostEndpoint:   opentracing.TraceServer(tracer, "POST /addresses")(MakeAddressPostEndpoint(s)),
+		CardGetEndpoint:       opentracing.TraceServer(tracer, "GET /cards")(MakeCardGetEndpoint(s)),
+		DeleteEndpoint:        opentracing.TraceServer(tracer, "DELETE /")(MakeDeleteEndpoint(s)),
+		RestoreEndpoint:       opentracing.TraceServer(tracer, "POST /restore")(MakeRestoreEndpoint(s)),
+		ChangesEndpoint:       opentracing.TraceServer(tracer, "GET /changes")(MakeChangesEndpoint(s)),
+		WebhookGetEndpoint:    opentracing.TraceServer(tracer, "GET /admin/webhooks")(MakeWebhookGetEndpoint(s)),
+		WebhookPostEndpoint:   opentracing.TraceServer(tracer, "POST /admin/webhooks")(MakeWebhookPostEndpoint(s)),
+		WebhookDeleteEndpoint: opentracing.TraceServer(tracer, "DELETE /admin/webhooks")(MakeWebhookDeleteEndpoint(s)),
+		DeadLettersEndpoint:   opentracing.TraceServer(tracer, "GET /admin/webhooks/dead-letters")(MakeDeadLettersEndpoint(s)),
+		ReplayEndpoint:        opentracing.TraceServer(tracer, "POST /admin/webhooks/dead-letters/replay")(MakeReplayEndpoint(s)),
+		ExportEndpoint:        opentracing.TraceServer(tracer, "GET /admin/export")(MakeExportEndpoint(s)),
+		ImportEndpoint:        opentracing.TraceServer(tracer, "POST /admin/import")(MakeImportEndpoint(s)),
+		GuestPostEndpoint:     opentracing.TraceServer(tracer, "POST /guest")(MakeGuestPostEndpoint(s)),
+		GuestGetEndpoint:      opentracing.TraceServer(tracer, "GET /guest")(MakeGuestGetEndpoint(s)),
+		GuestAddressEndpoint:  opentracing.TraceServer(tracer, "POST /guest/addresses")(MakeGuestAddressEndpoint(s)),
+		GuestCardEndpoint:     opentracing.TraceServer(tracer, "POST /guest/cards")(MakeGuestCardEndpoint(s)),
+		CheckEndpoint:         opentracing.TraceServer(tracer, "/admin/check")(MakeCheckEndpoint(s)),
+		AccessPostEndpoint:    opentracing.TraceServer(tracer, "POST /customers/access-requests")(MakeAccessPostEndpoint(s)),
+		AccessGetEndpoint:     opentracing.TraceServer(tracer, "GET /access-requests")(MakeAccessGetEndpoint(s)),
+		AccessArchiveEndpoint: opentracing.TraceServer(tracer, "GET /access-requests/archive")(MakeAccessArchiveEndpoint(s)),
+		CardPostEndpoint:      opentracing.TraceServer(tracer, "POST /cards")(MakeCardPostEndpoint(s)),
+		UserPutEndpoint:       opentracing.TraceServer(tracer, "PUT /customers")(MakeUserPutEndpoint(s)),
+		UserPatchEndpoint:     opentracing.TraceServer(tracer, "PATCH /customers")(MakeUserPatchEndpoint(s)),
+		PasswordEndpoint:      opentracing.TraceServer(tracer, "POST /customers/password")(MakePasswordEndpoint(s)),
+		DefaultsEndpoint:      opentracing.TraceServer(tracer, "PUT /customers/defaults")(MakeDefaultsEndpoint(s)),
+		VerificationEndpoint:  opentracing.TraceServer(tracer, "POST /customers/email-verification")(MakeVerificationEndpoint(s)),
+		VerifyEndpoint:        opentracing.TraceServer(tracer, "POST /email-verification")(MakeVerifyEndpoint(s)),
+		UsernameEndpoint:      opentracing.TraceServer(tracer, "PUT /customers/username")(MakeUsernameEndpoint(s)),
+		UsernameGetEndpoint:   opentracing.TraceServer(tracer, "GET /customers/username")(MakeUsernameGetEndpoint(s)),
+		StatusEndpoint:        opentracing.TraceServer(tracer, "POST /admin/customers/status")(MakeStatusEndpoint(s)),
+		StatusGetEndpoint:     opentracing.TraceServer(tracer, "GET /admin/customers/status")(MakeStatusGetEndpoint(s)),
+		AddressPutEndpoint:    opentracing.TraceServer(tracer, "PUT /addresses")(MakeAddressPutEndpoint(s)),
+		AddressPatchEndpoint:  opentracing.TraceServer(tracer, "PATCH /addresses")(MakeAddressPatchEndpoint(s)),
+		CardPutEndpoint:       opentracing.TraceServer(tracer, "PUT /cards")(MakeCardPutEndpoint(s)),
+		CardPatchEndpoint:     opentracing.TraceServer(tracer, "PATCH /cards")(MakeCardPatchEndpoint(s)),
 	}
 }
 
@@ -52,11 +127,24 @@ func MakeLoginEndpoint(s Service) endpoint.Endpoint {
 		span.SetTag("service", "user")
 		defer span.Finish()
 		req := request.(loginRequest)
-		u, err := s.Login(req.Username, req.Password)
+		u, err := s.Login(req.Username, req.Password, req.GuestToken, req.Client)
 		return userResponse{User: u}, err
 	}
 }
 
+// MakeLoginsGetEndpoint returns an endpoint via the given service.
+func MakeLoginsGetEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "get logins")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(loginsRequest)
+		ls, err := s.GetLogins(req.ID, req.Limit)
+		return EmbedStruct{Embed: loginsResponse{Logins: ls}}, err
+	}
+}
+
 // MakeRegisterEndpoint returns an endpoint via the given service.
 func MakeRegisterEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
@@ -65,7 +153,7 @@ func MakeRegisterEndpoint(s Service) endpoint.Endpoint {
 		span.SetTag("service", "user")
 		defer span.Finish()
 		req := request.(registerRequest)
-		id, err := s.Register(req.Username, req.Password, req.Email, req.FirstName, req.LastName)
+		id, err := s.Register(req.Username, req.Password, req.Email, req.FirstName, req.LastName, req.GuestToken)
 		return postResponse{ID: id}, err
 	}
 }
@@ -81,34 +169,74 @@ func MakeUserGetEndpoint(s Service) endpoint.Endpoint {
 		req := request.(GetRequest)
 
 		userspan := stdopentracing.StartSpan("users from db", stdopentracing.ChildOf(span.Context()))
-		usrs, err := s.GetUsers(req.ID)
+		usrs, page, err := s.GetUsers(req.ID, req.ListOptions)
 		userspan.Finish()
 		if req.ID == "" {
-			return EmbedStruct{usersResponse{Users: usrs}}, err
+			if len(req.Embed) > 0 {
+				return newPagedResponse(embeddedUsersResponse{Users: embedAttributes(usrs, req.ListOptions)}, "customers", req, page), err
+			}
+			return newPagedResponse(usersResponse{Users: usrs}, "customers", req, page), err
 		}
+		path := "customers/" + req.ID + "/" + req.Attr
 		if len(usrs) == 0 {
 			if req.Attr == "addresses" {
-				return EmbedStruct{addressesResponse{Addresses: make([]users.Address, 0)}}, err
+				return EmbedStruct{Embed: addressesResponse{Addresses: make([]users.Address, 0)}}, err
 			}
 			if req.Attr == "cards" {
-				return EmbedStruct{cardsResponse{Cards: make([]users.Card, 0)}}, err
+				return EmbedStruct{Embed: cardsResponse{Cards: make([]users.Card, 0)}}, err
 			}
 			return users.User{}, err
 		}
 		user := usrs[0]
+		page, err = pageAttributes(&user, req.Attr, req.ListOptions)
+		if err != nil {
+			return nil, err
+		}
 		attrspan := stdopentracing.StartSpan("attributes from db", stdopentracing.ChildOf(span.Context()))
 		db.GetUserAttributes(&user)
 		attrspan.Finish()
 		if req.Attr == "addresses" {
-			return EmbedStruct{addressesResponse{Addresses: user.Addresses}}, err
+			return newPagedResponse(addressesResponse{Addresses: user.Addresses}, path, req, page), err
 		}
 		if req.Attr == "cards" {
-			return EmbedStruct{cardsResponse{Cards: user.Cards}}, err
+			return newPagedResponse(cardsResponse{Cards: user.Cards}, path, req, page), err
 		}
 		return user, err
 	}
 }
 
+// pageAttributes narrows the address or card ids of the user down to the
+// requested page, so that only that page is loaded from the database.
+func pageAttributes(user *users.User, attr string, o db.ListOptions) (db.PageInfo, error) {
+	switch attr {
+	case "addresses":
+		ids := make([]string, 0, len(user.Addresses))
+		for _, a := range user.Addresses {
+			ids = append(ids, a.ID)
+		}
+		ids, page, err := db.PageIDs(ids, o)
+		user.Addresses = make([]users.Address, 0, len(ids))
+		for _, id := range ids {
+			user.Addresses = append(user.Addresses, users.Address{ID: id})
+		}
+		user.Cards = make([]users.Card, 0)
+		return page, err
+	case "cards":
+		ids := make([]string, 0, len(user.Cards))
+		for _, c := range user.Cards {
+			ids = append(ids, c.ID)
+		}
+		ids, page, err := db.PageIDs(ids, o)
+		user.Cards = make([]users.Card, 0, len(ids))
+		for _, id := range ids {
+			user.Cards = append(user.Cards, users.Card{ID: id})
+		}
+		user.Addresses = make([]users.Address, 0)
+		return page, err
+	}
+	return db.PageInfo{}, nil
+}
+
 // MakeUserPostEndpoint returns an endpoint via the given service.
 func MakeUserPostEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
@@ -122,6 +250,171 @@ func MakeUserPostEndpoint(s Service) endpoint.Endpoint {
 	}
 }
 
+// MakeUserPutEndpoint returns an endpoint via the given service.
+func MakeUserPutEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "put user")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(userPutRequest)
+		req.User.Version = req.Version
+		return s.UpdateUser(req.ID, req.User)
+	}
+}
+
+// MakeUserPatchEndpoint returns an endpoint via the given service.
+func MakeUserPatchEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "patch user")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(patchRequest)
+		usrs, _, err := s.GetUsers(req.ID, db.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		user := usrs[0]
+		version := req.basedOn(user.Version)
+		if err := patchUser(req.Patch, &user); err != nil {
+			return nil, err
+		}
+		user.Version = version
+		return s.UpdateUser(req.ID, user)
+	}
+}
+
+// patchUser patches a customer along with its email, which is not part of the
+// representation of a customer but can be changed
+func patchUser(p Patch, u *users.User) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return err
+	}
+	doc["email"] = u.Email
+	if err := applyPatch(p, &doc); err != nil {
+		return err
+	}
+	email, ok := doc["email"].(string)
+	if _, present := doc["email"]; present && !ok {
+		return patchErrorf("email must be a string")
+	}
+	if b, err = json.Marshal(doc); err != nil {
+		return err
+	}
+	*u = users.User{}
+	if err := json.Unmarshal(b, u); err != nil {
+		return patchErrorf("%v", err)
+	}
+	u.Email = email
+	return nil
+}
+
+// MakePasswordEndpoint returns an endpoint via the given service.
+func MakePasswordEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "change password")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(passwordRequest)
+		err = s.ChangePassword(req.ID, req.Current, req.Password)
+		return statusResponse{Status: err == nil}, err
+	}
+}
+
+// MakeDefaultsEndpoint returns an endpoint via the given service.
+func MakeDefaultsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "set defaults")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(defaultsRequest)
+		return s.SetDefaults(req.ID, req.Defaults)
+	}
+}
+
+// MakeVerificationEndpoint returns an endpoint via the given service.
+func MakeVerificationEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "start email verification")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(verificationRequest)
+		return s.StartEmailVerification(req.ID)
+	}
+}
+
+// MakeVerifyEndpoint returns an endpoint via the given service.
+func MakeVerifyEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "verify email")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(verificationRequest)
+		id, err := s.VerifyEmail(req.Token)
+		return postResponse{ID: id}, err
+	}
+}
+
+// MakeUsernameEndpoint returns an endpoint via the given service.
+func MakeUsernameEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "change username")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(usernameRequest)
+		return s.ChangeUsername(req.ID, req.Username)
+	}
+}
+
+// MakeUsernameGetEndpoint returns an endpoint via the given service.
+func MakeUsernameGetEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "get usernames")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(usernameRequest)
+		username, history, err := s.GetUsernames(req.ID)
+		return usernameResponse{Username: username, History: history}, err
+	}
+}
+
+// MakeStatusEndpoint returns an endpoint via the given service.
+func MakeStatusEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "set status")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(accountStatusRequest)
+		return s.SetStatus(req.ID, users.Transition{To: req.Status, Reason: req.Reason, Actor: req.Actor})
+	}
+}
+
+// MakeStatusGetEndpoint returns an endpoint via the given service.
+func MakeStatusGetEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "get status")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(accountStatusRequest)
+		status, history, err := s.GetStatus(req.ID)
+		return accountStatusResponse{Status: status, History: history}, err
+	}
+}
+
 // MakeAddressGetEndpoint returns an endpoint via the given service.
 func MakeAddressGetEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
@@ -130,11 +423,14 @@ func MakeAddressGetEndpoint(s Service) endpoint.Endpoint {
 		span.SetTag("service", "user")
 		defer span.Finish()
 		req := request.(GetRequest)
+		if req.Version != 0 {
+			return s.GetAddressVersion(req.ID, req.Version)
+		}
 		addrspan := stdopentracing.StartSpan("addresses from db", stdopentracing.ChildOf(span.Context()))
-		adds, err := s.GetAddresses(req.ID)
+		adds, page, err := s.GetAddresses(req.ID, req.ListOptions)
 		addrspan.Finish()
 		if req.ID == "" {
-			return EmbedStruct{addressesResponse{Addresses: adds}}, err
+			return newPagedResponse(addressesResponse{Addresses: adds}, "addresses", req, page), err
 		}
 		if len(adds) == 0 {
 			return users.Address{}, err
@@ -156,6 +452,41 @@ func MakeAddressPostEndpoint(s Service) endpoint.Endpoint {
 	}
 }
 
+// MakeAddressPutEndpoint returns an endpoint via the given service.
+func MakeAddressPutEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "put address")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(addressPutRequest)
+		req.Address.Version = req.Version
+		return s.UpdateAddress(req.ID, req.Address)
+	}
+}
+
+// MakeAddressPatchEndpoint returns an endpoint via the given service.
+func MakeAddressPatchEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "patch address")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(patchRequest)
+		adds, _, err := s.GetAddresses(req.ID, db.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		add := adds[0]
+		version := req.basedOn(add.Version)
+		if err := applyPatch(req.Patch, &add); err != nil {
+			return nil, err
+		}
+		add.Version = version
+		return s.UpdateAddress(req.ID, add)
+	}
+}
+
 // MakeUserGetEndpoint returns an endpoint via the given service.
 func MakeCardGetEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
@@ -164,11 +495,14 @@ func MakeCardGetEndpoint(s Service) endpoint.Endpoint {
 		span.SetTag("service", "user")
 		defer span.Finish()
 		req := request.(GetRequest)
+		if req.Version != 0 {
+			return s.GetCardVersion(req.ID, req.Version)
+		}
 		cardspan := stdopentracing.StartSpan("addresses from db", stdopentracing.ChildOf(span.Context()))
-		cards, err := s.GetCards(req.ID)
+		cards, page, err := s.GetCards(req.ID, req.ListOptions)
 		cardspan.Finish()
 		if req.ID == "" {
-			return EmbedStruct{cardsResponse{Cards: cards}}, err
+			return newPagedResponse(cardsResponse{Cards: cards}, "cards", req, page), err
 		}
 		if len(cards) == 0 {
 			return users.Card{}, err
@@ -190,6 +524,41 @@ func MakeCardPostEndpoint(s Service) endpoint.Endpoint {
 	}
 }
 
+// MakeCardPutEndpoint returns an endpoint via the given service.
+func MakeCardPutEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "put card")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(cardPutRequest)
+		req.Card.Version = req.Version
+		return s.UpdateCard(req.ID, req.Card)
+	}
+}
+
+// MakeCardPatchEndpoint returns an endpoint via the given service.
+func MakeCardPatchEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "patch card")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(patchRequest)
+		cards, _, err := s.GetCards(req.ID, db.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		card := cards[0]
+		version := req.basedOn(card.Version)
+		if err := applyPatch(req.Patch, &card); err != nil {
+			return nil, err
+		}
+		card.Version = version
+		return s.UpdateCard(req.ID, card)
+	}
+}
+
 // MakeLoginEndpoint returns an endpoint via the given service.
 func MakeDeleteEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
@@ -198,7 +567,7 @@ func MakeDeleteEndpoint(s Service) endpoint.Endpoint {
 		span.SetTag("service", "user")
 		defer span.Finish()
 		req := request.(deleteRequest)
-		err = s.Delete(req.Entity, req.ID)
+		err = s.Delete(req.Entity, req.ID, req.Version)
 		if err == nil {
 			return statusResponse{Status: true}, err
 		}
@@ -206,6 +575,259 @@ func MakeDeleteEndpoint(s Service) endpoint.Endpoint {
 	}
 }
 
+// MakeRestoreEndpoint returns an endpoint via the given service.
+func MakeRestoreEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "restore entity")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(restoreRequest)
+		err = s.Restore(req.Entity, req.ID)
+		return statusResponse{Status: err == nil}, err
+	}
+}
+
+// MakeAvailabilityEndpoint returns an endpoint via the given service.
+func MakeAvailabilityEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "check availability")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(availabilityRequest)
+		return s.Availability(req.Username, req.Email)
+	}
+}
+
+// MakeChangesEndpoint returns an endpoint via the given service.
+func MakeChangesEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "get changes")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(changesRequest)
+		changes, next, err := s.Changes(req.Since, req.Limit)
+		if err != nil {
+			return nil, err
+		}
+		// The next link is always there: it is where a consumer resumes,
+		// whether or not more changes are waiting
+		e := EmbedStruct{Embed: changesResponse{Changes: changes}}
+		params := url.Values{}
+		params.Set("since", next)
+		if req.Limit > 0 {
+			params.Set("limit", strconv.Itoa(req.Limit))
+		}
+		e.Links.AddPageLink("next", "changes", params)
+		return e, nil
+	}
+}
+
+// MakeWebhookGetEndpoint returns an endpoint via the given service.
+func MakeWebhookGetEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "get webhooks")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(webhookRequest)
+		subs, err := s.GetWebhooks(req.ID)
+		if err != nil {
+			return nil, err
+		}
+		if req.ID == "" {
+			return EmbedStruct{Embed: webhooksResponse{Webhooks: subs}}, nil
+		}
+		return subs[0], nil
+	}
+}
+
+// MakeWebhookPostEndpoint returns an endpoint via the given service.
+func MakeWebhookPostEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "post webhook")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		return s.CreateWebhook(request.(webhooks.Subscription))
+	}
+}
+
+// MakeWebhookDeleteEndpoint returns an endpoint via the given service.
+func MakeWebhookDeleteEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "delete webhook")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(webhookRequest)
+		err = s.DeleteWebhook(req.ID)
+		return statusResponse{Status: err == nil}, err
+	}
+}
+
+// MakeDeadLettersEndpoint returns an endpoint via the given service.
+func MakeDeadLettersEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "get dead letters")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(webhookRequest)
+		dead, err := s.DeadLetters(req.ID)
+		if err != nil {
+			return nil, err
+		}
+		return EmbedStruct{Embed: deadLettersResponse{Deliveries: dead}}, nil
+	}
+}
+
+// MakeReplayEndpoint returns an endpoint via the given service.
+func MakeReplayEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "replay dead letter")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(webhookRequest)
+		err = s.ReplayDeadLetter(req.ID, req.DeliveryID)
+		return statusResponse{Status: err == nil}, err
+	}
+}
+
+// MakeExportEndpoint returns an endpoint via the given service. The export
+// runs as the response is streamed to the client.
+func MakeExportEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "export customers")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(exportRequest)
+		r, w := io.Pipe()
+		go func() {
+			_, err := s.Export(w, req.Cards, req.Anonymize)
+			w.CloseWithError(err)
+		}()
+		return exportResponse{Records: r}, nil
+	}
+}
+
+// MakeImportEndpoint returns an endpoint via the given service.
+func MakeImportEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "import customers")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(importRequest)
+		return s.Import(req.Records, req.DryRun)
+	}
+}
+
+// MakeGuestPostEndpoint returns an endpoint via the given service.
+func MakeGuestPostEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "create guest")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		return s.CreateGuest()
+	}
+}
+
+// MakeGuestGetEndpoint returns an endpoint via the given service.
+func MakeGuestGetEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "get guest")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(guestRequest)
+		return s.GetGuest(req.Token)
+	}
+}
+
+// MakeGuestAddressEndpoint returns an endpoint via the given service.
+func MakeGuestAddressEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "post guest address")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(guestAddressRequest)
+		id, err := s.PostGuestAddress(req.Token, req.Address)
+		return postResponse{ID: id}, err
+	}
+}
+
+// MakeGuestCardEndpoint returns an endpoint via the given service.
+func MakeGuestCardEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "post guest card")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(guestCardRequest)
+		id, err := s.PostGuestCard(req.Token, req.Card)
+		return postResponse{ID: id}, err
+	}
+}
+
+// MakeCheckEndpoint returns an endpoint via the given service.
+func MakeCheckEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "check consistency")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(checkRequest)
+		return s.Check(req.Repair)
+	}
+}
+
+// MakeAccessPostEndpoint returns an endpoint via the given service.
+func MakeAccessPostEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "request access")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(accessRequest)
+		return s.RequestAccess(req.ID)
+	}
+}
+
+// MakeAccessGetEndpoint returns an endpoint via the given service.
+func MakeAccessGetEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "get access request")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(accessRequest)
+		return s.GetAccessRequest(req.ID)
+	}
+}
+
+// MakeAccessArchiveEndpoint returns an endpoint via the given service.
+func MakeAccessArchiveEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		var span stdopentracing.Span
+		span, ctx = stdopentracing.StartSpanFromContext(ctx, "get access archive")
+		span.SetTag("service", "user")
+		defer span.Finish()
+		req := request.(accessRequest)
+		archive, err := s.AccessArchive(req.ID)
+		if err != nil {
+			return nil, err
+		}
+		return archiveResponse{ID: req.ID, Archive: archive}, nil
+	}
+}
+
 // MakeHealthEndpoint returns current health of the given service.
 func MakeHealthEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
@@ -221,21 +843,112 @@ func MakeHealthEndpoint(s Service) endpoint.Endpoint {
 type GetRequest struct {
 	ID   string
 	Attr string
+	db.ListOptions
+	// Query and SortBy are the filter and sort as given by the client
+	Query  string
+	SortBy string
+	// Version pins an address or card to one of its versions
+	Version int64
 }
 
 type loginRequest struct {
+	Username   string
+	Password   string
+	GuestToken string
+	Client     logins.Client
+}
+
+type loginsRequest struct {
+	ID    string
+	Limit int
+}
+
+type loginsResponse struct {
+	Logins []logins.Login `json:"logins"`
+}
+
+type availabilityRequest struct {
 	Username string
-	Password string
+	Email    string
 }
 
 type userResponse struct {
 	User users.User `json:"user"`
 }
 
+type exportRequest struct {
+	Cards     bulk.Cards
+	Anonymize bool
+}
+
+type exportResponse struct {
+	Records io.ReadCloser
+}
+
+type importRequest struct {
+	Records io.Reader
+	DryRun  bool
+}
+
+type checkRequest struct {
+	Repair bool
+}
+
+type accessRequest struct {
+	ID string
+}
+
+type archiveResponse struct {
+	ID      string
+	Archive []byte
+}
+
 type usersResponse struct {
 	Users []users.User `json:"customer"`
 }
 
+type embeddedUsersResponse struct {
+	Users []embeddedUser `json:"customer"`
+}
+
+// embeddedUser is a customer carrying the attributes asked for with ?embed=
+type embeddedUser struct {
+	User     users.User
+	Embedded map[string]interface{}
+}
+
+// MarshalJSON adds the embedded attributes to the fields of the customer
+func (e embeddedUser) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(e.User)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	if fields["_embedded"], err = json.Marshal(e.Embedded); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+// embedAttributes attaches the loaded attributes to each customer of a page
+func embedAttributes(us []users.User, o db.ListOptions) []embeddedUser {
+	embedded := make([]embeddedUser, 0, len(us))
+	for _, u := range us {
+		e := embeddedUser{User: u, Embedded: make(map[string]interface{})}
+		if o.Embeds(db.EmbedAddresses) {
+			e.Embedded["address"] = u.Addresses
+		}
+		if o.Embeds(db.EmbedCards) {
+			e.Embedded["card"] = u.Cards
+		}
+		embedded = append(embedded, e)
+	}
+	return embedded
+}
+
 type addressPostRequest struct {
 	users.Address
 	UserID string `json:"userID"`
@@ -254,12 +967,101 @@ type cardsResponse struct {
 	Cards []users.Card `json:"card"`
 }
 
+// Version in the update and delete requests is the version given in If-Match,
+// zero when the client did not ask for a conditional request.
+
+type userPutRequest struct {
+	ID      string
+	Version int64
+	User    users.User
+}
+
+type addressPutRequest struct {
+	ID      string
+	Version int64
+	Address users.Address
+}
+
+type cardPutRequest struct {
+	ID      string
+	Version int64
+	Card    users.Card
+}
+
+type patchRequest struct {
+	ID      string
+	Version int64
+	Patch   Patch
+}
+
+// basedOn returns the version a patch applies to: the one the client asked
+// for, or else the one it was applied to
+func (p patchRequest) basedOn(loaded int64) int64 {
+	if p.Version != 0 {
+		return p.Version
+	}
+	return loaded
+}
+
+type passwordRequest struct {
+	ID       string `json:"-"`
+	Current  string `json:"current"`
+	Password string `json:"password"`
+}
+
+type defaultsRequest struct {
+	ID string
+	users.Defaults
+}
+
+type verificationRequest struct {
+	ID    string `json:"-"`
+	Token string `json:"token"`
+}
+
+type usernameRequest struct {
+	ID       string `json:"-"`
+	Username string `json:"username"`
+}
+
+type usernameResponse struct {
+	Username string                 `json:"username"`
+	History  []users.UsernameChange `json:"history"`
+}
+
+type accountStatusRequest struct {
+	ID     string `json:"-"`
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+	Actor  string `json:"actor"`
+}
+
+type accountStatusResponse struct {
+	Status  string             `json:"status"`
+	History []users.Transition `json:"history"`
+}
+
 type registerRequest struct {
-	Username  string `json:"username"`
-	Password  string `json:"password"`
-	Email     string `json:"email"`
-	FirstName string `json:"firstName"`
-	LastName  string `json:"lastName"`
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	Email      string `json:"email"`
+	FirstName  string `json:"firstName"`
+	LastName   string `json:"lastName"`
+	GuestToken string `json:"-"`
+}
+
+type guestRequest struct {
+	Token string
+}
+
+type guestAddressRequest struct {
+	Token   string
+	Address users.Address
+}
+
+type guestCardRequest struct {
+	Token string
+	Card  users.Card
 }
 
 type statusResponse struct {
@@ -271,10 +1073,38 @@ type postResponse struct {
 }
 
 type deleteRequest struct {
+	Entity  string
+	ID      string
+	Version int64
+}
+
+type changesRequest struct {
+	Since string
+	Limit int
+}
+
+type changesResponse struct {
+	Changes []db.Change `json:"change"`
+}
+
+type restoreRequest struct {
 	Entity string
 	ID     string
 }
 
+type webhookRequest struct {
+	ID         string
+	DeliveryID string
+}
+
+type webhooksResponse struct {
+	Webhooks []webhooks.Subscription `json:"webhook"`
+}
+
+type deadLettersResponse struct {
+	Deliveries []webhooks.Delivery `json:"delivery"`
+}
+
 type healthRequest struct {
 	//
 }
@@ -284,5 +1114,42 @@ type healthResponse struct {
 }
 
 type EmbedStruct struct {
-	Embed interface{} `json:"_embedded"`
+	Embed interface{}   `json:"_embedded"`
+	Links users.Links   `json:"_links,omitempty"`
+	Page  *pageResponse `json:"page,omitempty"`
+}
+
+type pageResponse struct {
+	Size          int    `json:"size"`
+	TotalElements *int64 `json:"totalElements,omitempty"`
+}
+
+// newPagedResponse embeds one page of a collection, linking to the pages
+// around it
+func newPagedResponse(embed interface{}, path string, req GetRequest, p db.PageInfo) EmbedStruct {
+	e := EmbedStruct{Embed: embed, Page: &pageResponse{Size: req.PageSize()}}
+	if p.Total >= 0 {
+		total := p.Total
+		e.Page.TotalElements = &total
+	}
+	params := url.Values{}
+	params.Set("limit", strconv.Itoa(req.PageSize()))
+	if req.Query != "" {
+		params.Set("q", req.Query)
+	}
+	if req.SortBy != "" {
+		params.Set("sort", req.SortBy)
+	}
+	if len(req.Embed) > 0 {
+		params.Set("embed", strings.Join(req.Embed, ","))
+	}
+	if p.Next != "" {
+		params.Set("cursor", p.Next)
+		e.Links.AddPageLink("next", path, params)
+	}
+	if p.Prev != "" {
+		params.Set("cursor", p.Prev)
+		e.Links.AddPageLink("prev", path, params)
+	}
+	return e
 }
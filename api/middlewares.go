@@ -1,11 +1,18 @@
 package api
 
 import (
+	"io"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/metrics"
+	"github.com/microservices-demo/user/bulk"
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/dsar"
+	"github.com/microservices-demo/user/guest"
+	"github.com/microservices-demo/user/logins"
 	"github.com/microservices-demo/user/users"
+	"github.com/microservices-demo/user/webhooks"
 )
 
 // Middleware decorates a service.
@@ -26,26 +33,41 @@ type loggingMiddleware struct {
 	logger log.Logger
 }
 
-func (mw loggingMiddleware) Login(username, password string) (user users.User, err error) {
+func (mw loggingMiddleware) Login(username, password, guestToken string, client logins.Client) (user users.User, err error) {
 	defer func(begin time.Time) {
 		mw.logger.Log(
 			"method", "Login",
+			"guest", guestToken != "",
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.Login(username, password)
+	return mw.next.Login(username, password, guestToken, client)
 }
 
-func (mw loggingMiddleware) Register(username, password, email, first, last string) (string, error) {
+func (mw loggingMiddleware) GetLogins(id string, limit int) (ls []logins.Login, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "GetLogins",
+			"id", id,
+			"result", len(ls),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.GetLogins(id, limit)
+}
+
+func (mw loggingMiddleware) Register(username, password, email, first, last, guestToken string) (string, error) {
 	defer func(begin time.Time) {
 		mw.logger.Log(
 			"method", "Register",
 			"username", username,
 			"email", email,
+			"guest", guestToken != "",
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.Register(username, password, email, first, last)
+	return mw.next.Register(username, password, email, first, last, guestToken)
 }
 
 func (mw loggingMiddleware) PostUser(user users.User) (id string, err error) {
@@ -61,7 +83,117 @@ func (mw loggingMiddleware) PostUser(user users.User) (id string, err error) {
 	return mw.next.PostUser(user)
 }
 
-func (mw loggingMiddleware) GetUsers(id string) (u []users.User, err error) {
+func (mw loggingMiddleware) UpdateUser(id string, user users.User) (u users.User, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "UpdateUser",
+			"id", id,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.UpdateUser(id, user)
+}
+
+func (mw loggingMiddleware) ChangePassword(id, current, password string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "ChangePassword",
+			"id", id,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.ChangePassword(id, current, password)
+}
+
+func (mw loggingMiddleware) SetDefaults(id string, d users.Defaults) (set users.Defaults, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "SetDefaults",
+			"id", id,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.SetDefaults(id, d)
+}
+
+func (mw loggingMiddleware) StartEmailVerification(id string) (v users.EmailVerification, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "StartEmailVerification",
+			"id", id,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.StartEmailVerification(id)
+}
+
+func (mw loggingMiddleware) VerifyEmail(token string) (id string, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "VerifyEmail",
+			"id", id,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.VerifyEmail(token)
+}
+
+func (mw loggingMiddleware) ChangeUsername(id, username string) (c users.UsernameChange, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "ChangeUsername",
+			"id", id,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.ChangeUsername(id, username)
+}
+
+func (mw loggingMiddleware) GetUsernames(id string) (username string, history []users.UsernameChange, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "GetUsernames",
+			"id", id,
+			"changes", len(history),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.GetUsernames(id)
+}
+
+func (mw loggingMiddleware) SetStatus(id string, t users.Transition) (made users.Transition, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "SetStatus",
+			"id", id,
+			"to", t.To,
+			"actor", t.Actor,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.SetStatus(id, t)
+}
+
+func (mw loggingMiddleware) GetStatus(id string) (status string, history []users.Transition, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "GetStatus",
+			"id", id,
+			"status", status,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.GetStatus(id)
+}
+
+func (mw loggingMiddleware) GetUsers(id string, o db.ListOptions) (u []users.User, p db.PageInfo, err error) {
 	defer func(begin time.Time) {
 		who := id
 		if who == "" {
@@ -70,11 +202,12 @@ func (mw loggingMiddleware) GetUsers(id string) (u []users.User, err error) {
 		mw.logger.Log(
 			"method", "GetUsers",
 			"id", who,
+			"cursor", o.Cursor,
 			"result", len(u),
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.GetUsers(id)
+	return mw.next.GetUsers(id, o)
 }
 
 func (mw loggingMiddleware) PostAddress(add users.Address, id string) (string, error) {
@@ -90,7 +223,20 @@ func (mw loggingMiddleware) PostAddress(add users.Address, id string) (string, e
 	return mw.next.PostAddress(add, id)
 }
 
-func (mw loggingMiddleware) GetAddresses(id string) (a []users.Address, err error) {
+func (mw loggingMiddleware) UpdateAddress(id string, add users.Address) (a users.Address, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "UpdateAddress",
+			"id", id,
+			"street", add.Street,
+			"number", add.Number,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.UpdateAddress(id, add)
+}
+
+func (mw loggingMiddleware) GetAddresses(id string, o db.ListOptions) (a []users.Address, p db.PageInfo, err error) {
 	defer func(begin time.Time) {
 		who := id
 		if who == "" {
@@ -99,11 +245,38 @@ func (mw loggingMiddleware) GetAddresses(id string) (a []users.Address, err erro
 		mw.logger.Log(
 			"method", "GetAddresses",
 			"id", who,
+			"cursor", o.Cursor,
 			"result", len(a),
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.GetAddresses(id)
+	return mw.next.GetAddresses(id, o)
+}
+
+func (mw loggingMiddleware) GetAddressVersion(id string, version int64) (a users.Address, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "GetAddressVersion",
+			"id", id,
+			"version", version,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.GetAddressVersion(id, version)
+}
+
+func (mw loggingMiddleware) GetCardVersion(id string, version int64) (c users.Card, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "GetCardVersion",
+			"id", id,
+			"version", version,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.GetCardVersion(id, version)
 }
 
 func (mw loggingMiddleware) PostCard(card users.Card, id string) (string, error) {
@@ -120,7 +293,70 @@ func (mw loggingMiddleware) PostCard(card users.Card, id string) (string, error)
 	return mw.next.PostCard(card, id)
 }
 
-func (mw loggingMiddleware) GetCards(id string) (a []users.Card, err error) {
+func (mw loggingMiddleware) CreateGuest() (session guest.Session, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "CreateGuest",
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.CreateGuest()
+}
+
+func (mw loggingMiddleware) GetGuest(token string) (session guest.Session, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "GetGuest",
+			"addresses", len(session.Addresses),
+			"cards", len(session.Cards),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.GetGuest(token)
+}
+
+func (mw loggingMiddleware) PostGuestAddress(token string, add users.Address) (id string, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "PostGuestAddress",
+			"street", add.Street,
+			"result", id,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.PostGuestAddress(token, add)
+}
+
+func (mw loggingMiddleware) PostGuestCard(token string, card users.Card) (id string, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "PostGuestCard",
+			"result", id,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.PostGuestCard(token, card)
+}
+
+func (mw loggingMiddleware) UpdateCard(id string, card users.Card) (c users.Card, err error) {
+	defer func(begin time.Time) {
+		cc := card
+		cc.MaskCC()
+		mw.logger.Log(
+			"method", "UpdateCard",
+			"id", id,
+			"card", cc.LongNum,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.UpdateCard(id, card)
+}
+
+func (mw loggingMiddleware) GetCards(id string, o db.ListOptions) (a []users.Card, p db.PageInfo, err error) {
 	defer func(begin time.Time) {
 		who := id
 		if who == "" {
@@ -129,23 +365,209 @@ func (mw loggingMiddleware) GetCards(id string) (a []users.Card, err error) {
 		mw.logger.Log(
 			"method", "GetCards",
 			"id", who,
+			"cursor", o.Cursor,
 			"result", len(a),
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.GetCards(id)
+	return mw.next.GetCards(id, o)
 }
 
-func (mw loggingMiddleware) Delete(entity, id string) (err error) {
+func (mw loggingMiddleware) Delete(entity, id string, version int64) (err error) {
 	defer func(begin time.Time) {
 		mw.logger.Log(
 			"method", "Delete",
 			"entity", entity,
 			"id", id,
+			"version", version,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.Delete(entity, id, version)
+}
+
+func (mw loggingMiddleware) Restore(entity, id string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Restore",
+			"entity", entity,
+			"id", id,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.Restore(entity, id)
+}
+
+func (mw loggingMiddleware) Availability(username, email string) (available map[string]bool, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Availability",
+			"username", username,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.Availability(username, email)
+}
+
+func (mw loggingMiddleware) Changes(since string, limit int) (changes []db.Change, next string, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Changes",
+			"since", since,
+			"result", len(changes),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.Changes(since, limit)
+}
+
+func (mw loggingMiddleware) CreateWebhook(sub webhooks.Subscription) (created webhooks.Subscription, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "CreateWebhook",
+			"url", sub.URL,
+			"result", created.ID,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.CreateWebhook(sub)
+}
+
+func (mw loggingMiddleware) GetWebhooks(id string) (subs []webhooks.Subscription, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "GetWebhooks",
+			"id", id,
+			"result", len(subs),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.GetWebhooks(id)
+}
+
+func (mw loggingMiddleware) DeleteWebhook(id string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "DeleteWebhook",
+			"id", id,
+			"err", err,
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.Delete(entity, id)
+	return mw.next.DeleteWebhook(id)
+}
+
+func (mw loggingMiddleware) DeadLetters(id string) (dead []webhooks.Delivery, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "DeadLetters",
+			"id", id,
+			"result", len(dead),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.DeadLetters(id)
+}
+
+func (mw loggingMiddleware) ReplayDeadLetter(id, deliveryID string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "ReplayDeadLetter",
+			"id", id,
+			"delivery", deliveryID,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.ReplayDeadLetter(id, deliveryID)
+}
+
+func (mw loggingMiddleware) Export(w io.Writer, cards bulk.Cards, anonymize bool) (n int, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Export",
+			"cards", cards,
+			"anonymize", anonymize,
+			"result", n,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.Export(w, cards, anonymize)
+}
+
+func (mw loggingMiddleware) Import(r io.Reader, dryRun bool) (report bulk.Report, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Import",
+			"dryRun", dryRun,
+			"records", report.Records,
+			"imported", report.Imported,
+			"failed", report.Failed,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.Import(r, dryRun)
+}
+
+func (mw loggingMiddleware) Check(repair bool) (report db.CheckReport, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Check",
+			"repair", repair,
+			"found", report.Found(),
+			"repaired", report.Repaired,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.Check(repair)
+}
+
+func (mw loggingMiddleware) RequestAccess(customerID string) (r dsar.Request, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "RequestAccess",
+			"customer", customerID,
+			"result", r.ID,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.RequestAccess(customerID)
+}
+
+func (mw loggingMiddleware) GetAccessRequest(id string) (r dsar.Request, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "GetAccessRequest",
+			"id", id,
+			"result", r.Status,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.GetAccessRequest(id)
+}
+
+func (mw loggingMiddleware) AccessArchive(id string) (archive []byte, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "AccessArchive",
+			"id", id,
+			"result", len(archive),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.AccessArchive(id)
 }
 
 func (mw loggingMiddleware) Health() (health []Health) {
@@ -174,22 +596,31 @@ func NewInstrumentingService(requestCount metrics.Counter, requestLatency metric
 	}
 }
 
-func (s *instrumentingService) Login(username, password string) (users.User, error) {
+func (s *instrumentingService) Login(username, password, guestToken string, client logins.Client) (users.User, error) {
 	defer func(begin time.Time) {
 		s.requestCount.With("method", "login").Add(1)
 		s.requestLatency.With("method", "login").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return s.Service.Login(username, password)
+	return s.Service.Login(username, password, guestToken, client)
+}
+
+func (s *instrumentingService) GetLogins(id string, limit int) ([]logins.Login, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "getLogins").Add(1)
+		s.requestLatency.With("method", "getLogins").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.GetLogins(id, limit)
 }
 
-func (s *instrumentingService) Register(username, password, email, first, last string) (string, error) {
+func (s *instrumentingService) Register(username, password, email, first, last, guestToken string) (string, error) {
 	defer func(begin time.Time) {
 		s.requestCount.With("method", "register").Add(1)
 		s.requestLatency.With("method", "register").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return s.Service.Register(username, password, email, first, last)
+	return s.Service.Register(username, password, email, first, last, guestToken)
 }
 
 func (s *instrumentingService) PostUser(user users.User) (string, error) {
@@ -201,13 +632,94 @@ func (s *instrumentingService) PostUser(user users.User) (string, error) {
 	return s.Service.PostUser(user)
 }
 
-func (s *instrumentingService) GetUsers(id string) (u []users.User, err error) {
+func (s *instrumentingService) UpdateUser(id string, user users.User) (users.User, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "updateUser").Add(1)
+		s.requestLatency.With("method", "updateUser").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.UpdateUser(id, user)
+}
+
+func (s *instrumentingService) SetDefaults(id string, d users.Defaults) (users.Defaults, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "setDefaults").Add(1)
+		s.requestLatency.With("method", "setDefaults").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.SetDefaults(id, d)
+}
+
+func (s *instrumentingService) StartEmailVerification(id string) (users.EmailVerification, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "startEmailVerification").Add(1)
+		s.requestLatency.With("method", "startEmailVerification").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.StartEmailVerification(id)
+}
+
+func (s *instrumentingService) VerifyEmail(token string) (string, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "verifyEmail").Add(1)
+		s.requestLatency.With("method", "verifyEmail").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.VerifyEmail(token)
+}
+
+func (s *instrumentingService) ChangeUsername(id, username string) (users.UsernameChange, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "changeUsername").Add(1)
+		s.requestLatency.With("method", "changeUsername").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.ChangeUsername(id, username)
+}
+
+func (s *instrumentingService) GetUsernames(id string) (string, []users.UsernameChange, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "getUsernames").Add(1)
+		s.requestLatency.With("method", "getUsernames").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.GetUsernames(id)
+}
+
+func (s *instrumentingService) SetStatus(id string, t users.Transition) (users.Transition, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "setStatus").Add(1)
+		s.requestLatency.With("method", "setStatus").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.SetStatus(id, t)
+}
+
+func (s *instrumentingService) GetStatus(id string) (string, []users.Transition, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "getStatus").Add(1)
+		s.requestLatency.With("method", "getStatus").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.GetStatus(id)
+}
+
+func (s *instrumentingService) ChangePassword(id, current, password string) error {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "changePassword").Add(1)
+		s.requestLatency.With("method", "changePassword").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.ChangePassword(id, current, password)
+}
+
+func (s *instrumentingService) GetUsers(id string, o db.ListOptions) (u []users.User, p db.PageInfo, err error) {
 	defer func(begin time.Time) {
 		s.requestCount.With("method", "getUsers").Add(1)
 		s.requestLatency.With("method", "getUsers").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return s.Service.GetUsers(id)
+	return s.Service.GetUsers(id, o)
 }
 
 func (s *instrumentingService) PostAddress(add users.Address, id string) (string, error) {
@@ -219,13 +731,22 @@ func (s *instrumentingService) PostAddress(add users.Address, id string) (string
 	return s.Service.PostAddress(add, id)
 }
 
-func (s *instrumentingService) GetAddresses(id string) ([]users.Address, error) {
+func (s *instrumentingService) UpdateAddress(id string, add users.Address) (users.Address, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "updateAddress").Add(1)
+		s.requestLatency.With("method", "updateAddress").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.UpdateAddress(id, add)
+}
+
+func (s *instrumentingService) GetAddresses(id string, o db.ListOptions) ([]users.Address, db.PageInfo, error) {
 	defer func(begin time.Time) {
 		s.requestCount.With("method", "getAddresses").Add(1)
 		s.requestLatency.With("method", "getAddresses").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return s.Service.GetAddresses(id)
+	return s.Service.GetAddresses(id, o)
 }
 
 func (s *instrumentingService) PostCard(card users.Card, id string) (string, error) {
@@ -237,22 +758,211 @@ func (s *instrumentingService) PostCard(card users.Card, id string) (string, err
 	return s.Service.PostCard(card, id)
 }
 
-func (s *instrumentingService) GetCards(id string) ([]users.Card, error) {
+func (s *instrumentingService) CreateGuest() (guest.Session, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "createGuest").Add(1)
+		s.requestLatency.With("method", "createGuest").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.CreateGuest()
+}
+
+func (s *instrumentingService) GetGuest(token string) (guest.Session, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "getGuest").Add(1)
+		s.requestLatency.With("method", "getGuest").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.GetGuest(token)
+}
+
+func (s *instrumentingService) PostGuestAddress(token string, add users.Address) (string, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "postGuestAddress").Add(1)
+		s.requestLatency.With("method", "postGuestAddress").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.PostGuestAddress(token, add)
+}
+
+func (s *instrumentingService) PostGuestCard(token string, card users.Card) (string, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "postGuestCard").Add(1)
+		s.requestLatency.With("method", "postGuestCard").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.PostGuestCard(token, card)
+}
+
+func (s *instrumentingService) UpdateCard(id string, card users.Card) (users.Card, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "updateCard").Add(1)
+		s.requestLatency.With("method", "updateCard").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.UpdateCard(id, card)
+}
+
+func (s *instrumentingService) GetAddressVersion(id string, version int64) (users.Address, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "getAddressVersion").Add(1)
+		s.requestLatency.With("method", "getAddressVersion").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.GetAddressVersion(id, version)
+}
+
+func (s *instrumentingService) GetCardVersion(id string, version int64) (users.Card, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "getCardVersion").Add(1)
+		s.requestLatency.With("method", "getCardVersion").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.GetCardVersion(id, version)
+}
+
+func (s *instrumentingService) GetCards(id string, o db.ListOptions) ([]users.Card, db.PageInfo, error) {
 	defer func(begin time.Time) {
 		s.requestCount.With("method", "getCards").Add(1)
 		s.requestLatency.With("method", "getCards").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return s.Service.GetCards(id)
+	return s.Service.GetCards(id, o)
 }
 
-func (s *instrumentingService) Delete(entity, id string) error {
+func (s *instrumentingService) Delete(entity, id string, version int64) error {
 	defer func(begin time.Time) {
 		s.requestCount.With("method", "delete").Add(1)
 		s.requestLatency.With("method", "delete").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return s.Service.Delete(entity, id)
+	return s.Service.Delete(entity, id, version)
+}
+
+func (s *instrumentingService) Restore(entity, id string) error {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "restore").Add(1)
+		s.requestLatency.With("method", "restore").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.Restore(entity, id)
+}
+
+func (s *instrumentingService) Availability(username, email string) (map[string]bool, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "availability").Add(1)
+		s.requestLatency.With("method", "availability").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.Availability(username, email)
+}
+
+func (s *instrumentingService) Changes(since string, limit int) ([]db.Change, string, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "changes").Add(1)
+		s.requestLatency.With("method", "changes").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.Changes(since, limit)
+}
+
+func (s *instrumentingService) CreateWebhook(sub webhooks.Subscription) (webhooks.Subscription, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "createWebhook").Add(1)
+		s.requestLatency.With("method", "createWebhook").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.CreateWebhook(sub)
+}
+
+func (s *instrumentingService) GetWebhooks(id string) ([]webhooks.Subscription, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "getWebhooks").Add(1)
+		s.requestLatency.With("method", "getWebhooks").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.GetWebhooks(id)
+}
+
+func (s *instrumentingService) DeleteWebhook(id string) error {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "deleteWebhook").Add(1)
+		s.requestLatency.With("method", "deleteWebhook").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.DeleteWebhook(id)
+}
+
+func (s *instrumentingService) DeadLetters(id string) ([]webhooks.Delivery, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "deadLetters").Add(1)
+		s.requestLatency.With("method", "deadLetters").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.DeadLetters(id)
+}
+
+func (s *instrumentingService) ReplayDeadLetter(id, deliveryID string) error {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "replayDeadLetter").Add(1)
+		s.requestLatency.With("method", "replayDeadLetter").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.ReplayDeadLetter(id, deliveryID)
+}
+
+func (s *instrumentingService) Export(w io.Writer, cards bulk.Cards, anonymize bool) (int, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "export").Add(1)
+		s.requestLatency.With("method", "export").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.Export(w, cards, anonymize)
+}
+
+func (s *instrumentingService) Import(r io.Reader, dryRun bool) (bulk.Report, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "import").Add(1)
+		s.requestLatency.With("method", "import").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.Import(r, dryRun)
+}
+
+func (s *instrumentingService) Check(repair bool) (db.CheckReport, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "check").Add(1)
+		s.requestLatency.With("method", "check").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.Check(repair)
+}
+
+func (s *instrumentingService) RequestAccess(customerID string) (dsar.Request, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "requestAccess").Add(1)
+		s.requestLatency.With("method", "requestAccess").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.RequestAccess(customerID)
+}
+
+func (s *instrumentingService) GetAccessRequest(id string) (dsar.Request, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "getAccessRequest").Add(1)
+		s.requestLatency.With("method", "getAccessRequest").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.GetAccessRequest(id)
+}
+
+func (s *instrumentingService) AccessArchive(id string) ([]byte, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "accessArchive").Add(1)
+		s.requestLatency.With("method", "accessArchive").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.AccessArchive(id)
 }
 
 func (s *instrumentingService) Health() []Health {
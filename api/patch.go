@@ -0,0 +1,300 @@
+package api
+
+// patch.go implements the two PATCH document formats accepted by the service:
+// JSON Merge Patch (RFC 7386) and JSON Patch (RFC 6902). Both work on the JSON
+// representation of an entity, which is decoded again once patched.
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+// Patch changes the JSON representation of an entity.
+type Patch interface {
+	Apply(doc []byte) ([]byte, error)
+}
+
+// PatchError is returned when a patch can not be applied to a document.
+type PatchError struct {
+	Msg string
+}
+
+func (e *PatchError) Error() string {
+	return "Invalid patch: " + e.Msg
+}
+
+func patchErrorf(format string, args ...interface{}) error {
+	return &PatchError{Msg: fmt.Sprintf(format, args...)}
+}
+
+// applyPatch patches the JSON representation of v in place.
+func applyPatch(p Patch, v interface{}) error {
+	doc, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	doc, err = p.Apply(doc)
+	if err != nil {
+		return err
+	}
+	// Start from the zero value so that removed fields end up empty
+	rv := reflect.ValueOf(v).Elem()
+	rv.Set(reflect.Zero(rv.Type()))
+	if err := json.Unmarshal(doc, v); err != nil {
+		return patchErrorf("%v", err)
+	}
+	return nil
+}
+
+// MergePatch is a JSON Merge Patch document.
+type MergePatch json.RawMessage
+
+// Apply implements Patch.
+func (p MergePatch) Apply(doc []byte) ([]byte, error) {
+	var target, patch interface{}
+	if err := json.Unmarshal(doc, &target); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(p, &patch); err != nil {
+		return nil, patchErrorf("%v", err)
+	}
+	return json.Marshal(mergeValue(target, patch))
+}
+
+func mergeValue(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergeValue(t[k], v)
+	}
+	return t
+}
+
+// JSONPatch is a JSON Patch document, a list of operations applied in order.
+type JSONPatch []PatchOperation
+
+// PatchOperation is a single JSON Patch operation.
+type PatchOperation struct {
+	Op    string           `json:"op"`
+	Path  string           `json:"path"`
+	From  string           `json:"from,omitempty"`
+	Value *json.RawMessage `json:"value,omitempty"`
+}
+
+// Apply implements Patch.
+func (p JSONPatch) Apply(doc []byte) ([]byte, error) {
+	var v interface{}
+	if err := json.Unmarshal(doc, &v); err != nil {
+		return nil, err
+	}
+	for _, op := range p {
+		var err error
+		v, err = op.apply(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(v)
+}
+
+func (op PatchOperation) apply(doc interface{}) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return nil, patchErrorf("%v %v needs a value", op.Op, op.Path)
+		}
+		var value interface{}
+		if err := json.Unmarshal(*op.Value, &value); err != nil {
+			return nil, patchErrorf("%v", err)
+		}
+		switch op.Op {
+		case "add":
+			return addValue(doc, path, value)
+		case "replace":
+			if len(path) == 0 {
+				return value, nil
+			}
+			doc, _, err := removeValue(doc, path)
+			if err != nil {
+				return nil, err
+			}
+			return addValue(doc, path, value)
+		}
+		current, err := getValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, value) {
+			return nil, patchErrorf("test of %v failed", op.Path)
+		}
+		return doc, nil
+	case "remove":
+		doc, _, err := removeValue(doc, path)
+		return doc, err
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		var value interface{}
+		if op.Op == "move" {
+			doc, value, err = removeValue(doc, from)
+		} else {
+			value, err = getValue(doc, from)
+			value = deepCopy(value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+	}
+	return nil, patchErrorf("unknown operation %q", op.Op)
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into its reference tokens.
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(p, "/") {
+		return nil, patchErrorf("invalid pointer %q", p)
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(t)
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses an array index token, allowing "-" and the length of the
+// array when appending.
+func arrayIndex(token string, length int, appending bool) (int, error) {
+	if appending && token == "-" {
+		return length, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > length || (i == length && !appending) {
+		return 0, patchErrorf("invalid array index %q", token)
+	}
+	return i, nil
+}
+
+func getValue(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			v, ok := d[token]
+			if !ok {
+				return nil, patchErrorf("no value at %q", token)
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(token, len(d), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = d[i]
+		default:
+			return nil, patchErrorf("no value at %q", token)
+		}
+	}
+	return doc, nil
+}
+
+func addValue(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	token, last := path[0], len(path) == 1
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		if last {
+			d[token] = value
+			return d, nil
+		}
+		child, ok := d[token]
+		if !ok {
+			return nil, patchErrorf("no value at %q", token)
+		}
+		child, err := addValue(child, path[1:], value)
+		d[token] = child
+		return d, err
+	case []interface{}:
+		i, err := arrayIndex(token, len(d), last)
+		if err != nil {
+			return nil, err
+		}
+		if last {
+			d = append(d, nil)
+			copy(d[i+1:], d[i:])
+			d[i] = value
+			return d, nil
+		}
+		d[i], err = addValue(d[i], path[1:], value)
+		return d, err
+	}
+	return nil, patchErrorf("can not add to %q", token)
+}
+
+func removeValue(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, patchErrorf("can not remove the whole document")
+	}
+	token, last := path[0], len(path) == 1
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		child, ok := d[token]
+		if !ok {
+			return nil, nil, patchErrorf("no value at %q", token)
+		}
+		if last {
+			delete(d, token)
+			return d, child, nil
+		}
+		child, removed, err := removeValue(child, path[1:])
+		d[token] = child
+		return d, removed, err
+	case []interface{}:
+		i, err := arrayIndex(token, len(d), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		if last {
+			removed := d[i]
+			return append(d[:i], d[i+1:]...), removed, nil
+		}
+		child, removed, err := removeValue(d[i], path[1:])
+		d[i] = child
+		return d, removed, err
+	}
+	return nil, nil, patchErrorf("no value at %q", token)
+}
+
+func deepCopy(v interface{}) interface{} {
+	b, _ := json.Marshal(v)
+	var c interface{}
+	json.Unmarshal(b, &c)
+	return c
+}
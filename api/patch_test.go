@@ -0,0 +1,86 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/microservices-demo/user/users"
+)
+
+func TestMergePatch(t *testing.T) {
+	doc := []byte(`{"a":"b","c":{"d":"e","f":"g"}}`)
+	patched, err := MergePatch(`{"a":"z","c":{"f":null}}`).Apply(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(patched) != `{"a":"z","c":{"d":"e"}}` {
+		t.Errorf("unexpected merge result %s", patched)
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	var p JSONPatch
+	err := json.Unmarshal([]byte(`[
+		{"op": "test", "path": "/street", "value": "street"},
+		{"op": "replace", "path": "/street", "value": "Main Street"},
+		{"op": "add", "path": "/tags", "value": ["a"]},
+		{"op": "add", "path": "/tags/0", "value": "b"},
+		{"op": "add", "path": "/tags/-", "value": "c"},
+		{"op": "copy", "from": "/city", "path": "/town"},
+		{"op": "move", "from": "/town", "path": "/place"},
+		{"op": "remove", "path": "/tags/1"}
+	]`), &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched, err := p.Apply([]byte(`{"street":"street","city":"Amsterdam"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"city":"Amsterdam","place":"Amsterdam","street":"Main Street","tags":["b","c"]}`
+	if string(patched) != expected {
+		t.Errorf("expected %s received %s", expected, patched)
+	}
+}
+
+func TestJSONPatchErrors(t *testing.T) {
+	for _, raw := range []string{
+		`[{"op": "test", "path": "/street", "value": "other"}]`,
+		`[{"op": "remove", "path": "/missing"}]`,
+		`[{"op": "replace", "path": "/street"}]`,
+		`[{"op": "add", "path": "street", "value": 1}]`,
+		`[{"op": "frobnicate", "path": "/street"}]`,
+	} {
+		var p JSONPatch
+		if err := json.Unmarshal([]byte(raw), &p); err != nil {
+			t.Fatal(err)
+		}
+		_, err := p.Apply([]byte(`{"street":"street"}`))
+		if _, ok := err.(*PatchError); !ok {
+			t.Errorf("expected patch error for %s received %v", raw, err)
+		}
+	}
+}
+
+func TestApplyPatch(t *testing.T) {
+	a := users.Address{Street: "street", City: "Amsterdam", ID: "test"}
+	if err := applyPatch(MergePatch(`{"city":"Rotterdam"}`), &a); err != nil {
+		t.Fatal(err)
+	}
+	if a.City != "Rotterdam" || a.Street != "street" || a.ID != "test" {
+		t.Errorf("unexpected patched address %+v", a)
+	}
+}
+
+func TestPatchUser(t *testing.T) {
+	u := users.User{FirstName: "Eve", Email: "eve@example.com", UserID: "test"}
+	if err := patchUser(MergePatch(`{"email":"eve@example.org"}`), &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Email != "eve@example.org" || u.FirstName != "Eve" || u.UserID != "test" {
+		t.Errorf("unexpected patched customer %+v", u)
+	}
+	if err := patchUser(MergePatch(`{"email":42}`), &u); err == nil {
+		t.Error("expected an email that is not a string to be refused")
+	}
+}
@@ -4,31 +4,79 @@ package api
 // user service. Everything here is agnostic to the transport (HTTP).
 
 import (
-	"crypto/sha1"
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 	"time"
 
+	"github.com/microservices-demo/user/attributes"
+	"github.com/microservices-demo/user/bulk"
 	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/dsar"
+	"github.com/microservices-demo/user/guest"
+	"github.com/microservices-demo/user/logins"
 	"github.com/microservices-demo/user/users"
+	"github.com/microservices-demo/user/webhooks"
 )
 
 var (
-	ErrUnauthorized = errors.New("Unauthorized")
+	ErrUnauthorized   = errors.New("Unauthorized")
+	ErrImmutableField = errors.New("Field can not be changed")
 )
 
+// ValidationError is returned when an entity fails validation
+type ValidationError struct {
+	Err error
+}
+
+func (e ValidationError) Error() string {
+	return e.Err.Error()
+}
+
 // Service is the user service, providing operations for users to login, register, and retrieve customer information.
 type Service interface {
-	Login(username, password string) (users.User, error) // GET /login
-	Register(username, password, email, first, last string) (string, error)
-	GetUsers(id string) ([]users.User, error)
+	Login(username, password, guestToken string, client logins.Client) (users.User, error) // GET /login
+	GetLogins(id string, limit int) ([]logins.Login, error)
+	Register(username, password, email, first, last, guestToken string) (string, error)
+	Availability(username, email string) (map[string]bool, error)
+	GetUsers(id string, o db.ListOptions) ([]users.User, db.PageInfo, error)
 	PostUser(u users.User) (string, error)
-	GetAddresses(id string) ([]users.Address, error)
+	UpdateUser(id string, u users.User) (users.User, error)
+	ChangePassword(id, current, password string) error
+	SetDefaults(id string, d users.Defaults) (users.Defaults, error)
+	StartEmailVerification(id string) (users.EmailVerification, error)
+	VerifyEmail(token string) (string, error)
+	ChangeUsername(id, username string) (users.UsernameChange, error)
+	GetUsernames(id string) (string, []users.UsernameChange, error)
+	SetStatus(id string, t users.Transition) (users.Transition, error)
+	GetStatus(id string) (string, []users.Transition, error)
+	GetAddresses(id string, o db.ListOptions) ([]users.Address, db.PageInfo, error)
 	PostAddress(u users.Address, userid string) (string, error)
-	GetCards(id string) ([]users.Card, error)
+	UpdateAddress(id string, a users.Address) (users.Address, error)
+	GetCards(id string, o db.ListOptions) ([]users.Card, db.PageInfo, error)
+	GetAddressVersion(id string, version int64) (users.Address, error)
+	GetCardVersion(id string, version int64) (users.Card, error)
 	PostCard(u users.Card, userid string) (string, error)
-	Delete(entity, id string) error
+	CreateGuest() (guest.Session, error)
+	GetGuest(token string) (guest.Session, error)
+	PostGuestAddress(token string, a users.Address) (string, error)
+	PostGuestCard(token string, c users.Card) (string, error)
+	UpdateCard(id string, c users.Card) (users.Card, error)
+	Delete(entity, id string, version int64) error
+	Restore(entity, id string) error
+	Changes(since string, limit int) ([]db.Change, string, error)
+	CreateWebhook(s webhooks.Subscription) (webhooks.Subscription, error)
+	GetWebhooks(id string) ([]webhooks.Subscription, error)
+	DeleteWebhook(id string) error
+	DeadLetters(id string) ([]webhooks.Delivery, error)
+	ReplayDeadLetter(id, deliveryID string) error
+	Export(w io.Writer, cards bulk.Cards, anonymize bool) (int, error)
+	Import(r io.Reader, dryRun bool) (bulk.Report, error)
+	Check(repair bool) (db.CheckReport, error)
+	RequestAccess(customerID string) (dsar.Request, error)
+	GetAccessRequest(id string) (dsar.Request, error)
+	AccessArchive(id string) ([]byte, error)
 	Health() []Health // GET /health
 }
 
@@ -45,13 +93,28 @@ type Health struct {
 	Time    string `json:"time"`
 }
 
-func (s *fixedService) Login(username, password string) (users.User, error) {
-	u, err := db.GetUserByName(username)
+// Login checks the password of a customer, found by username, a username it
+// changed away from within the grace period or verified email, and returns it
+// with its addresses and cards. Logging in with the token of a guest session takes over the
+// addresses and cards of the session. Successful and refused attempts are
+// recorded in the login history.
+func (s *fixedService) Login(username, password, guestToken string, client logins.Client) (users.User, error) {
+	u, err := authenticate(username, password)
+	if _, refused := err.(users.StatusError); err == nil || err == ErrUnauthorized || refused {
+		if err := recordLogin(username, u.UserID, err == nil, client); err != nil {
+			return users.New(), err
+		}
+	}
 	if err != nil {
 		return users.New(), err
 	}
-	if u.Password != calculatePassHash(password, u.Salt) {
-		return users.New(), ErrUnauthorized
+	if n, err := claimGuest(guestToken, u.UserID); err != nil {
+		return users.New(), err
+	} else if n > 0 {
+		// The customer now holds more addresses or cards
+		if u, err = db.GetUser(u.UserID); err != nil {
+			return users.New(), err
+		}
 	}
 	db.GetUserAttributes(&u)
 	u.MaskCCs()
@@ -59,50 +122,412 @@ func (s *fixedService) Login(username, password string) (users.User, error) {
 
 }
 
-func (s *fixedService) Register(username, password, email, first, last string) (string, error) {
+// authenticate returns the customer a username and password log in, or
+// ErrUnauthorized. A customer whose status does not let it log in is returned
+// along with the users.StatusError.
+func authenticate(username, password string) (users.User, error) {
+	u, err := db.GetUserByName(username)
+	if err == db.ErrNotFound {
+		u, err = getUserByPreviousName(username)
+	}
+	if err == db.ErrNotFound && strings.Contains(username, "@") {
+		u, err = getUserByEmail(username)
+	}
+	if err == db.ErrNotFound {
+		u, err = getUserBySeparatedName(username, password)
+	}
+	if err == db.ErrNotFound {
+		return users.User{}, ErrUnauthorized
+	}
+	if err != nil {
+		return users.User{}, err
+	}
+	if u.Password != calculatePassHash(password, u.Salt) {
+		separated, err := getUserBySeparatedName(username, password)
+		if err == db.ErrNotFound {
+			return u, ErrUnauthorized
+		}
+		if err != nil {
+			return users.User{}, err
+		}
+		u = separated
+	}
+	return u, users.CanLogin(u.Status)
+}
+
+// getUserBySeparatedName returns the customer that shares username with an
+// older one from before usernames were unique, told apart by its password
+func getUserBySeparatedName(username, password string) (users.User, error) {
+	store, err := db.Usernames()
+	if err == db.ErrUsernamesUnsupported {
+		return users.User{}, db.ErrNotFound
+	}
+	if err != nil {
+		return users.User{}, err
+	}
+	us, err := store.GetUsersBySeparatedName(username)
+	if err != nil {
+		return users.User{}, err
+	}
+	for _, u := range us {
+		if u.Password == calculatePassHash(password, u.Salt) {
+			return db.GetUser(u.UserID)
+		}
+	}
+	return users.User{}, db.ErrNotFound
+}
+
+// recordLogin adds an attempt to log in to the history, unless the database
+// keeps none
+func recordLogin(username, customerID string, success bool, client logins.Client) error {
+	store, err := db.Logins()
+	if err == db.ErrLoginsUnsupported {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	l := logins.New(username, client, time.Now().UTC())
+	l.CustomerID = customerID
+	l.Success = success
+	return store.RecordLogin(&l)
+}
+
+// maxLogins is the most logins GetLogins returns, and how many it returns
+// when not told
+const maxLogins = 100
+
+// GetLogins returns the login history of a customer, newest first
+func (s *fixedService) GetLogins(id string, limit int) ([]logins.Login, error) {
+	if limit <= 0 || limit > maxLogins {
+		limit = maxLogins
+	}
+	store, err := db.Logins()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.GetUser(id); err != nil {
+		return nil, err
+	}
+	return store.Logins(id, limit)
+}
+
+// getUserByPreviousName returns the customer that can still log in with a
+// username it changed away from. A database that can not change usernames
+// has none.
+func getUserByPreviousName(username string) (users.User, error) {
+	store, err := db.Usernames()
+	if err == db.ErrUsernamesUnsupported {
+		return users.User{}, db.ErrNotFound
+	}
+	if err != nil {
+		return users.User{}, err
+	}
+	u, err := store.GetUserByPreviousName(username, time.Now().UTC())
+	if err != nil {
+		return users.User{}, err
+	}
+	return db.GetUser(u.UserID)
+}
+
+// getUserByEmail returns the customer whose verified email is email. A
+// database that can not verify emails has none.
+func getUserByEmail(email string) (users.User, error) {
+	store, err := db.Emails()
+	if err == db.ErrEmailsUnsupported {
+		return users.User{}, db.ErrNotFound
+	}
+	if err != nil {
+		return users.User{}, err
+	}
+	u, err := store.GetUserByEmail(email)
+	if err != nil {
+		return users.User{}, err
+	}
+	// Read it again through the cache like a login by username
+	return db.GetUser(u.UserID)
+}
+
+// Register creates a customer. Registering with the token of a guest session
+// takes over the addresses and cards of the session.
+func (s *fixedService) Register(username, password, email, first, last, guestToken string) (string, error) {
 	u := users.New()
 	u.Username = username
 	u.Password = calculatePassHash(password, u.Salt)
 	u.Email = email
 	u.FirstName = first
 	u.LastName = last
-	err := db.CreateUser(&u)
+	u.Status = users.StatusActive
+	if err := db.CreateUser(&u); err != nil {
+		return u.UserID, err
+	}
+	_, err := claimGuest(guestToken, u.UserID)
 	return u.UserID, err
 }
 
-func (s *fixedService) GetUsers(id string) ([]users.User, error) {
+// claimGuest moves the addresses and cards of a guest session to a customer,
+// returning how many. A session that expired or was claimed before, or a
+// database without guest sessions, has nothing to move.
+func claimGuest(token, customerID string) (int, error) {
+	if token == "" {
+		return 0, nil
+	}
+	store, err := db.Guests()
+	if err == db.ErrGuestsUnsupported {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, err := store.ClaimGuest(token, customerID)
+	if err == guest.ErrInvalidToken {
+		return 0, nil
+	}
+	if n > 0 {
+		db.Invalidate("customers", customerID)
+	}
+	return n, err
+}
+
+// Availability reports for the given username and email whether they can
+// still be registered. Only the fields given are reported.
+func (s *fixedService) Availability(username, email string) (map[string]bool, error) {
+	usernameTaken, emailTaken, err := db.Taken(username, email)
+	if err != nil {
+		return nil, err
+	}
+	available := make(map[string]bool)
+	if username != "" {
+		available["username"] = !usernameTaken
+	}
+	if email != "" {
+		available["email"] = !emailTaken
+	}
+	return available, nil
+}
+
+func (s *fixedService) GetUsers(id string, o db.ListOptions) ([]users.User, db.PageInfo, error) {
 	if id == "" {
-		us, err := db.GetUsers()
+		us, p, err := db.GetUsers(o)
 		for k, u := range us {
 			u.AddLinks()
 			us[k] = u
 		}
-		return us, err
+		return us, p, err
 	}
 	u, err := db.GetUser(id)
 	u.AddLinks()
-	return []users.User{u}, err
+	return []users.User{u}, db.PageInfo{}, err
 }
 
+// PostUser creates a customer, active unless created pending
 func (s *fixedService) PostUser(u users.User) (string, error) {
+	switch u.Status {
+	case "":
+		u.Status = users.StatusActive
+	case users.StatusPending, users.StatusActive:
+	default:
+		return "", ValidationError{fmt.Errorf(users.ErrInvalidField, "Status")}
+	}
+	u.EmailVerified = false
+	if err := checkAttributes(&u); err != nil {
+		return "", err
+	}
 	u.NewSalt()
 	u.Password = calculatePassHash(u.Password, u.Salt)
 	err := db.CreateUser(&u)
 	return u.UserID, err
 }
 
-func (s *fixedService) GetAddresses(id string) ([]users.Address, error) {
+// UpdateUser replaces the profile of a user. The username, password, salt,
+// status and creation time can not be changed this way and are kept as
+// stored, as is the email when none is given. A non zero
+// Version must match the stored version.
+func (s *fixedService) UpdateUser(id string, u users.User) (users.User, error) {
+	current, err := db.GetUser(id)
+	if err != nil {
+		return users.User{}, err
+	}
+	if u.Version != 0 && u.Version != current.Version {
+		return users.User{}, db.ErrVersionConflict
+	}
+	u.Version = current.Version
+	u.CreatedAt = current.CreatedAt
+	if (u.UserID != "" && u.UserID != id) || (u.Username != "" && u.Username != current.Username) || (u.Status != "" && u.Status != current.Status) {
+		return users.User{}, ErrImmutableField
+	}
+	u.UserID = id
+	u.Username = current.Username
+	u.Password = current.Password
+	u.Salt = current.Salt
+	u.Defaults = current.Defaults
+	u.Status = current.Status
+	if u.Email == "" {
+		u.Email = current.Email
+	}
+	// A new email has to be verified again
+	u.EmailVerified = current.EmailVerified && users.Canonical(u.Email) == users.Canonical(current.Email)
+	if err := u.Validate(); err != nil {
+		return users.User{}, ValidationError{err}
+	}
+	if err := checkAttributes(&u); err != nil {
+		return users.User{}, err
+	}
+	err = db.UpdateUser(&u)
+	u.AddLinks()
+	return u, err
+}
+
+// SetDefaults sets the default shipping address, billing address and card of
+// a customer, choosing the ones left empty
+func (s *fixedService) SetDefaults(id string, d users.Defaults) (users.Defaults, error) {
+	err := db.SetDefaults(id, &d)
+	if err == db.ErrIneligibleDefault {
+		return users.Defaults{}, ValidationError{err}
+	}
+	return d, err
+}
+
+// StartEmailVerification starts a verification of the email of a customer,
+// returning the token to mail to it. The token is not shown again and
+// replaces the one returned before.
+func (s *fixedService) StartEmailVerification(id string) (users.EmailVerification, error) {
+	store, err := db.Emails()
+	if err != nil {
+		return users.EmailVerification{}, err
+	}
+	token, err := users.NewVerificationToken()
+	if err != nil {
+		return users.EmailVerification{}, err
+	}
+	v := users.EmailVerification{Token: token, ExpiresAt: time.Now().UTC().Add(users.VerificationTTL)}
+	if err := store.StartEmailVerification(id, users.HashVerificationToken(token), &v); err != nil {
+		return users.EmailVerification{}, err
+	}
+	return v, nil
+}
+
+// VerifyEmail completes the verification a token was returned for, returning
+// the id of the customer whose email is now verified
+func (s *fixedService) VerifyEmail(token string) (string, error) {
+	store, err := db.Emails()
+	if err != nil {
+		return "", err
+	}
+	id, err := store.VerifyEmail(users.HashVerificationToken(token), time.Now().UTC())
+	if err == nil {
+		db.Invalidate("customers", id)
+	}
+	return id, err
+}
+
+// ChangeUsername renames a customer. The username it had stays reserved for
+// it for users.UsernameReservation and logs it in for users.UsernameGrace.
+func (s *fixedService) ChangeUsername(id, username string) (users.UsernameChange, error) {
+	if users.Canonical(username) == "" {
+		return users.UsernameChange{}, ValidationError{fmt.Errorf(users.ErrMissingField, "Username")}
+	}
+	current, err := db.GetUser(id)
+	if err != nil {
+		return users.UsernameChange{}, err
+	}
+	if username == current.Username {
+		return users.UsernameChange{}, ValidationError{fmt.Errorf(users.ErrInvalidField, "Username")}
+	}
+	c := users.UsernameChange{To: username}
+	if err := db.ChangeUsername(id, &c); err != nil {
+		return users.UsernameChange{}, err
+	}
+	return c, nil
+}
+
+// GetUsernames returns the username of a customer and the changes that led to
+// it, oldest first
+func (s *fixedService) GetUsernames(id string) (string, []users.UsernameChange, error) {
+	if _, err := db.Usernames(); err != nil {
+		return "", nil, err
+	}
+	u, err := db.GetUser(id)
+	if err != nil {
+		return "", nil, err
+	}
+	history := u.UsernameChanges
+	if history == nil {
+		history = make([]users.UsernameChange, 0)
+	}
+	return u.Username, history, nil
+}
+
+// SetStatus moves a customer to another status, recording why and by whom
+func (s *fixedService) SetStatus(id string, t users.Transition) (users.Transition, error) {
+	if err := t.Validate(); err != nil {
+		return users.Transition{}, ValidationError{err}
+	}
+	if err := db.SetStatus(id, &t); err != nil {
+		return users.Transition{}, err
+	}
+	return t, nil
+}
+
+// GetStatus returns the status of a customer and the transitions that led to
+// it, oldest first
+func (s *fixedService) GetStatus(id string) (string, []users.Transition, error) {
+	store, err := db.Statuses()
+	if err != nil {
+		return "", nil, err
+	}
+	u, err := db.GetUser(id)
+	if err != nil {
+		return "", nil, err
+	}
+	history, err := store.StatusHistory(id)
+	return users.CurrentStatus(u.Status), history, err
+}
+
+// checkAttributes checks the attributes of a customer against the current
+// attributes schema, recording its version
+func checkAttributes(u *users.User) error {
+	if err := attributes.Current.Validate(u.Attributes); err != nil {
+		return ValidationError{err}
+	}
+	u.AttributesVersion = attributes.Current.Version
+	return nil
+}
+
+func (s *fixedService) ChangePassword(id, current, password string) error {
+	u, err := db.GetUser(id)
+	if err != nil {
+		return err
+	}
+	if u.Password != calculatePassHash(current, u.Salt) {
+		return ErrUnauthorized
+	}
+	if password == "" {
+		return ValidationError{fmt.Errorf(users.ErrMissingField, "Password")}
+	}
+	u.NewSalt()
+	u.Password = calculatePassHash(password, u.Salt)
+	return db.UpdateUser(&u)
+}
+
+func (s *fixedService) GetAddresses(id string, o db.ListOptions) ([]users.Address, db.PageInfo, error) {
 	if id == "" {
-		as, err := db.GetAddresses()
+		as, p, err := db.GetAddresses(o)
 		for k, a := range as {
 			a.AddLinks()
 			as[k] = a
 		}
-		return as, err
+		return as, p, err
 	}
 	a, err := db.GetAddress(id)
 	a.AddLinks()
-	return []users.Address{a}, err
+	return []users.Address{a}, db.PageInfo{}, err
+}
+
+// GetAddressVersion returns the given version of an address, which still
+// resolves after the address is edited or deleted
+func (s *fixedService) GetAddressVersion(id string, version int64) (users.Address, error) {
+	return db.GetAddressVersion(id, version)
 }
 
 func (s *fixedService) PostAddress(add users.Address, userid string) (string, error) {
@@ -110,27 +535,349 @@ func (s *fixedService) PostAddress(add users.Address, userid string) (string, er
 	return add.ID, err
 }
 
-func (s *fixedService) GetCards(id string) ([]users.Card, error) {
+func (s *fixedService) UpdateAddress(id string, a users.Address) (users.Address, error) {
+	if a.ID != "" && a.ID != id {
+		return users.Address{}, ErrImmutableField
+	}
+	current, err := db.GetAddress(id)
+	if err != nil {
+		return users.Address{}, err
+	}
+	if a.Version != 0 && a.Version != current.Version {
+		return users.Address{}, db.ErrVersionConflict
+	}
+	a.Version = current.Version
+	a.CreatedAt = current.CreatedAt
+	a.ID = id
+	if err := a.Validate(); err != nil {
+		return users.Address{}, ValidationError{err}
+	}
+	err = db.UpdateAddress(&a)
+	a.AddLinks()
+	return a, err
+}
+
+func (s *fixedService) GetCards(id string, o db.ListOptions) ([]users.Card, db.PageInfo, error) {
 	if id == "" {
-		cs, err := db.GetCards()
+		cs, p, err := db.GetCards(o)
 		for k, c := range cs {
 			c.AddLinks()
 			cs[k] = c
 		}
-		return cs, err
+		return cs, p, err
 	}
 	c, err := db.GetCard(id)
 	c.AddLinks()
-	return []users.Card{c}, err
+	return []users.Card{c}, db.PageInfo{}, err
+}
+
+// GetCardVersion returns the given version of a card, which still resolves
+// after the card is edited or deleted
+func (s *fixedService) GetCardVersion(id string, version int64) (users.Card, error) {
+	return db.GetCardVersion(id, version)
 }
 
 func (s *fixedService) PostCard(card users.Card, userid string) (string, error) {
+	if err := checkBillingAddress(card, userid); err != nil {
+		return "", err
+	}
 	err := db.CreateCard(&card, userid)
 	return card.ID, err
 }
 
-func (s *fixedService) Delete(entity, id string) error {
-	return db.Delete(entity, id)
+// CreateGuest starts a guest session, returning its token. The token is not
+// shown again.
+func (s *fixedService) CreateGuest() (guest.Session, error) {
+	store, err := db.Guests()
+	if err != nil {
+		return guest.Session{}, err
+	}
+	token, err := guest.NewToken()
+	if err != nil {
+		return guest.Session{}, err
+	}
+	at := time.Now().UTC()
+	session := guest.Session{
+		Token:     token,
+		CreatedAt: at,
+		ExpiresAt: at.Add(guest.TTL),
+		Addresses: make([]users.Address, 0),
+		Cards:     make([]users.Card, 0),
+	}
+	return session, store.CreateGuest(session)
+}
+
+// GetGuest returns a guest session with its addresses and cards, the card
+// numbers masked
+func (s *fixedService) GetGuest(token string) (guest.Session, error) {
+	store, err := db.Guests()
+	if err != nil {
+		return guest.Session{}, err
+	}
+	session, err := store.GetGuest(token)
+	if err != nil {
+		return guest.Session{}, err
+	}
+	for k, a := range session.Addresses {
+		a.AddLinks()
+		session.Addresses[k] = a
+	}
+	for k, c := range session.Cards {
+		c.MaskCC()
+		c.AddLinks()
+		session.Cards[k] = c
+	}
+	return session, nil
+}
+
+// PostGuestAddress adds an address to a guest session
+func (s *fixedService) PostGuestAddress(token string, add users.Address) (string, error) {
+	store, err := db.Guests()
+	if err != nil {
+		return "", err
+	}
+	err = store.CreateGuestAddress(token, &add)
+	return add.ID, err
+}
+
+// PostGuestCard adds a card to a guest session
+func (s *fixedService) PostGuestCard(token string, card users.Card) (string, error) {
+	store, err := db.Guests()
+	if err != nil {
+		return "", err
+	}
+	if err := checkBillingAddress(card, ""); err != nil {
+		return "", err
+	}
+	err = store.CreateGuestCard(token, &card)
+	return card.ID, err
+}
+
+func (s *fixedService) UpdateCard(id string, c users.Card) (users.Card, error) {
+	if c.ID != "" && c.ID != id {
+		return users.Card{}, ErrImmutableField
+	}
+	current, err := db.GetCard(id)
+	if err != nil {
+		return users.Card{}, err
+	}
+	if c.Version != 0 && c.Version != current.Version {
+		return users.Card{}, db.ErrVersionConflict
+	}
+	c.Version = current.Version
+	c.CreatedAt = current.CreatedAt
+	c.ID = id
+	if err := c.Validate(); err != nil {
+		return users.Card{}, ValidationError{err}
+	}
+	if err := checkBillingAddress(c, ""); err != nil {
+		return users.Card{}, err
+	}
+	err = db.UpdateCard(&c)
+	c.AddLinks()
+	return c, err
+}
+
+// checkBillingAddress makes sure the billing address of a card, if any, is a
+// live address that can be billed and, when the customer of the card is
+// given, one of theirs
+func checkBillingAddress(c users.Card, customerID string) error {
+	if c.BillingAddress == "" {
+		return nil
+	}
+	invalid := ValidationError{fmt.Errorf(users.ErrInvalidField, "BillingAddress")}
+	a, err := db.GetAddress(c.BillingAddress)
+	if err == db.ErrNotFound {
+		return invalid
+	}
+	if err != nil {
+		return err
+	}
+	if !a.Bills() {
+		return invalid
+	}
+	if customerID == "" {
+		return nil
+	}
+	u, err := db.GetUser(customerID)
+	if err != nil {
+		return err
+	}
+	for _, held := range u.Addresses {
+		if held.ID == a.ID {
+			return nil
+		}
+	}
+	return invalid
+}
+
+// Delete removes an entity. A non zero version must match the stored version.
+func (s *fixedService) Delete(entity, id string, version int64) error {
+	return db.Delete(entity, id, version)
+}
+
+// Restore brings back an entity deleted within the restore window.
+func (s *fixedService) Restore(entity, id string) error {
+	return db.Restore(entity, id)
+}
+
+// Changes returns the changes after the since token, and the token to resume
+// from.
+func (s *fixedService) Changes(since string, limit int) ([]db.Change, string, error) {
+	return db.Changes(since, limit)
+}
+
+// CreateWebhook subscribes an endpoint to events. The returned subscription
+// holds the secret deliveries are signed with, generated unless given; it is
+// not shown again.
+func (s *fixedService) CreateWebhook(sub webhooks.Subscription) (webhooks.Subscription, error) {
+	store, err := db.Webhooks()
+	if err != nil {
+		return sub, err
+	}
+	if err := sub.Validate(); err != nil {
+		return sub, ValidationError{err}
+	}
+	if sub.Secret == "" {
+		if sub.Secret, err = webhooks.NewSecret(); err != nil {
+			return sub, err
+		}
+	}
+	if sub.Events == nil {
+		sub.Events = make([]string, 0)
+	}
+	err = store.CreateSubscription(&sub)
+	return sub, err
+}
+
+// GetWebhooks returns a subscription, or all of them when id is empty,
+// without their secrets
+func (s *fixedService) GetWebhooks(id string) ([]webhooks.Subscription, error) {
+	store, err := db.Webhooks()
+	if err != nil {
+		return nil, err
+	}
+	var subs []webhooks.Subscription
+	if id == "" {
+		subs, err = store.GetSubscriptions()
+	} else {
+		var sub webhooks.Subscription
+		sub, err = store.GetSubscription(id)
+		subs = []webhooks.Subscription{sub}
+	}
+	if err != nil {
+		return nil, err
+	}
+	for k := range subs {
+		subs[k].Secret = ""
+	}
+	return subs, nil
+}
+
+// DeleteWebhook removes a subscription along with its pending deliveries
+func (s *fixedService) DeleteWebhook(id string) error {
+	store, err := db.Webhooks()
+	if err != nil {
+		return err
+	}
+	return store.DeleteSubscription(id)
+}
+
+// DeadLetters returns the deliveries to a subscription that were given up on
+func (s *fixedService) DeadLetters(id string) ([]webhooks.Delivery, error) {
+	store, err := db.Webhooks()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := store.GetSubscription(id); err != nil {
+		return nil, err
+	}
+	return store.DeadLetters(id)
+}
+
+// ReplayDeadLetter attempts a dead delivery again, from the first attempt
+func (s *fixedService) ReplayDeadLetter(id, deliveryID string) error {
+	store, err := db.Webhooks()
+	if err != nil {
+		return err
+	}
+	return store.ReplayDelivery(id, deliveryID, time.Now())
+}
+
+// Check looks for dangling references, orphans and addresses or cards shared
+// by customers, repairing them when asked to
+func (s *fixedService) Check(repair bool) (db.CheckReport, error) {
+	return db.Check(db.CheckOptions{Repair: repair, Grace: db.CheckGrace})
+}
+
+// RequestAccess asks for an archive of all the data held about a customer.
+// The archive is built in the background; the returned request links to
+// itself, where its status can be followed.
+func (s *fixedService) RequestAccess(customerID string) (dsar.Request, error) {
+	store, err := db.AccessRequests()
+	if err != nil {
+		return dsar.Request{}, err
+	}
+	if _, err := db.GetUser(customerID); err != nil {
+		return dsar.Request{}, err
+	}
+	r := dsar.Request{CustomerID: customerID}
+	if err := store.CreateAccessRequest(&r); err != nil {
+		return dsar.Request{}, err
+	}
+	r.AddLinks()
+	return r, nil
+}
+
+// GetAccessRequest returns the status of an access request
+func (s *fixedService) GetAccessRequest(id string) (dsar.Request, error) {
+	store, err := db.AccessRequests()
+	if err != nil {
+		return dsar.Request{}, err
+	}
+	r, err := store.GetAccessRequest(id)
+	if err != nil {
+		return dsar.Request{}, err
+	}
+	r.AddLinks()
+	return r, nil
+}
+
+// AccessArchive returns the zip archive of a finished access request
+func (s *fixedService) AccessArchive(id string) ([]byte, error) {
+	store, err := db.AccessRequests()
+	if err != nil {
+		return nil, err
+	}
+	return store.AccessArchive(id)
+}
+
+// Export writes every customer with its addresses and cards to w, one per
+// line, with cards masked or sealed with the card key. Anonymized exports
+// follow the configured anonymization rules instead.
+func (s *fixedService) Export(w io.Writer, cards bulk.Cards, anonymize bool) (int, error) {
+	o := bulk.ExportOptions{Cards: cards}
+	var err error
+	if anonymize {
+		if o.Anonymizer, err = bulk.Anonymize(); err != nil {
+			return 0, err
+		}
+	} else if cards == bulk.Encrypted {
+		if o.Key, err = bulk.CardKey(); err != nil {
+			return 0, err
+		}
+	}
+	return bulk.Export(w, db.GetUsers, o)
+}
+
+// Import upserts the customers read from r, or only checks them in a dry
+// run. Encrypted cards can only be imported with the card key.
+func (s *fixedService) Import(r io.Reader, dryRun bool) (bulk.Report, error) {
+	key, err := bulk.CardKey()
+	if err != nil && err != bulk.ErrNoKey {
+		return bulk.Report{}, err
+	}
+	return bulk.Import(r, db.UpsertUsers, bulk.Options{DryRun: dryRun, Key: key})
 }
 
 func (s *fixedService) Health() []Health {
@@ -152,8 +899,5 @@ func (s *fixedService) Health() []Health {
 }
 
 func calculatePassHash(pass, salt string) string {
-	h := sha1.New()
-	io.WriteString(h, salt)
-	io.WriteString(h, pass)
-	return fmt.Sprintf("%x", h.Sum(nil))
+	return users.PasswordHash(pass, salt)
 }
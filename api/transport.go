@@ -4,25 +4,59 @@ package api
 // In our case we just use a REST-y HTTP transport.
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/tracing/opentracing"
 	httptransport "github.com/go-kit/kit/transport/http"
 	"github.com/gorilla/mux"
+	"github.com/microservices-demo/user/bulk"
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/db/query"
+	"github.com/microservices-demo/user/dsar"
+	"github.com/microservices-demo/user/guest"
+	"github.com/microservices-demo/user/logins"
 	"github.com/microservices-demo/user/users"
+	"github.com/microservices-demo/user/webhooks"
 	stdopentracing "github.com/opentracing/opentracing-go"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/net/context"
 )
 
 var (
-	ErrInvalidRequest = errors.New("Invalid request")
+	ErrInvalidRequest       = errors.New("Invalid request")
+	ErrUnsupportedMediaType = errors.New("Unsupported media type")
+	ErrPreconditionRequired = errors.New("If-Match header required")
+	ErrForbidden            = errors.New("Forbidden")
 )
 
+var (
+	requireIfMatch    bool
+	adminToken        string
+	cardAdminToken    string
+	trustForwardedFor bool
+)
+
+func init() {
+	flag.BoolVar(&requireIfMatch, "require-if-match", os.Getenv("REQUIRE_IF_MATCH") == "true", "Reject updates and deletes without an If-Match header")
+	flag.StringVar(&adminToken, "admin-token", os.Getenv("ADMIN_TOKEN"), "Bearer token for the admin endpoints, exporting masked cards")
+	flag.StringVar(&cardAdminToken, "card-admin-token", os.Getenv("CARD_ADMIN_TOKEN"), "Bearer token for the admin endpoints, also exporting encrypted cards")
+	flag.BoolVar(&trustForwardedFor, "trust-forwarded-for", os.Getenv("TRUST_FORWARDED_FOR") == "true", "Take the address of clients logging in from X-Forwarded-For, set by a proxy in front")
+}
+
 // MakeHTTPHandler mounts the endpoints into a REST-y HTTP handler.
 func MakeHTTPHandler(ctx context.Context, e Endpoints, logger log.Logger, tracer stdopentracing.Tracer) *mux.Router {
 	r := mux.NewRouter().StrictSlash(false)
@@ -33,6 +67,7 @@ func MakeHTTPHandler(ctx context.Context, e Endpoints, logger log.Logger, tracer
 
 	// GET /login       Login
 	// GET /register    Register
+	// GET /register/availability  Username and email availability
 	// GET /health      Health Check
 
 	r.Methods("GET").Path("/login").Handler(httptransport.NewServer(
@@ -40,7 +75,10 @@ func MakeHTTPHandler(ctx context.Context, e Endpoints, logger log.Logger, tracer
 		e.LoginEndpoint,
 		decodeLoginRequest,
 		encodeResponse,
-		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "GET /login", logger)))...,
+		append(options,
+			httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "GET /login", logger), deviceFromCookie),
+			httptransport.ServerAfter(setDeviceCookie),
+		)...,
 	))
 	r.Methods("POST").Path("/register").Handler(httptransport.NewServer(
 		ctx,
@@ -49,27 +87,34 @@ func MakeHTTPHandler(ctx context.Context, e Endpoints, logger log.Logger, tracer
 		encodeResponse,
 		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "POST /register", logger)))...,
 	))
-	r.Methods("GET").PathPrefix("/customers").Handler(httptransport.NewServer(
+	r.Methods("GET").Path("/register/availability").Handler(httptransport.NewServer(
+		ctx,
+		e.AvailabilityEndpoint,
+		decodeAvailabilityRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "GET /register/availability", logger)))...,
+	))
+	r.Methods("GET").PathPrefix("/customers").Handler(conditional(httptransport.NewServer(
 		ctx,
 		e.UserGetEndpoint,
 		decodeGetRequest,
 		encodeResponse,
 		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "GET /customers", logger)))...,
-	))
-	r.Methods("GET").PathPrefix("/cards").Handler(httptransport.NewServer(
+	)))
+	r.Methods("GET").PathPrefix("/cards").Handler(conditional(httptransport.NewServer(
 		ctx,
 		e.CardGetEndpoint,
 		decodeGetRequest,
 		encodeResponse,
 		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "GET /cards", logger)))...,
-	))
-	r.Methods("GET").PathPrefix("/addresses").Handler(httptransport.NewServer(
+	)))
+	r.Methods("GET").PathPrefix("/addresses").Handler(conditional(httptransport.NewServer(
 		ctx,
 		e.AddressGetEndpoint,
 		decodeGetRequest,
 		encodeResponse,
 		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "GET /addresses", logger)))...,
-	))
+	)))
 	r.Methods("POST").Path("/customers").Handler(httptransport.NewServer(
 		ctx,
 		e.UserPostEndpoint,
@@ -91,6 +136,237 @@ func MakeHTTPHandler(ctx context.Context, e Endpoints, logger log.Logger, tracer
 		encodeResponse,
 		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "POST /cards", logger)))...,
 	))
+	r.Methods("PUT").Path("/customers/{id}").Handler(httptransport.NewServer(
+		ctx,
+		e.UserPutEndpoint,
+		decodeUserPutRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "PUT /customers", logger)))...,
+	))
+	r.Methods("PATCH").Path("/customers/{id}").Handler(httptransport.NewServer(
+		ctx,
+		e.UserPatchEndpoint,
+		decodePatchRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "PATCH /customers", logger)))...,
+	))
+	r.Methods("POST").Path("/customers/{id}/password").Handler(httptransport.NewServer(
+		ctx,
+		e.PasswordEndpoint,
+		decodePasswordRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "POST /customers/password", logger)))...,
+	))
+	r.Methods("PUT").Path("/customers/{id}/defaults").Handler(httptransport.NewServer(
+		ctx,
+		e.DefaultsEndpoint,
+		decodeDefaultsRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "PUT /customers/defaults", logger)))...,
+	))
+	r.Methods("POST").Path("/customers/{id}/email-verification").Handler(httptransport.NewServer(
+		ctx,
+		e.VerificationEndpoint,
+		decodeVerificationRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "POST /customers/email-verification", logger)))...,
+	))
+	r.Methods("POST").Path("/email-verification").Handler(httptransport.NewServer(
+		ctx,
+		e.VerifyEndpoint,
+		decodeVerificationRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "POST /email-verification", logger)))...,
+	))
+	r.Methods("GET").Path("/customers/{id}/logins").Handler(httptransport.NewServer(
+		ctx,
+		e.LoginsGetEndpoint,
+		decodeLoginsRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "GET /customers/logins", logger)))...,
+	))
+	r.Methods("PUT").Path("/customers/{id}/username").Handler(httptransport.NewServer(
+		ctx,
+		e.UsernameEndpoint,
+		decodeUsernameRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "PUT /customers/username", logger)))...,
+	))
+	r.Methods("GET").Path("/customers/{id}/username").Handler(httptransport.NewServer(
+		ctx,
+		e.UsernameGetEndpoint,
+		decodeUsernameRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "GET /customers/username", logger)))...,
+	))
+	r.Methods("PUT").Path("/addresses/{id}").Handler(httptransport.NewServer(
+		ctx,
+		e.AddressPutEndpoint,
+		decodeAddressPutRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "PUT /addresses", logger)))...,
+	))
+	r.Methods("PATCH").Path("/addresses/{id}").Handler(httptransport.NewServer(
+		ctx,
+		e.AddressPatchEndpoint,
+		decodePatchRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "PATCH /addresses", logger)))...,
+	))
+	r.Methods("PUT").Path("/cards/{id}").Handler(httptransport.NewServer(
+		ctx,
+		e.CardPutEndpoint,
+		decodeCardPutRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "PUT /cards", logger)))...,
+	))
+	r.Methods("PATCH").Path("/cards/{id}").Handler(httptransport.NewServer(
+		ctx,
+		e.CardPatchEndpoint,
+		decodePatchRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "PATCH /cards", logger)))...,
+	))
+	r.Methods("POST").Path("/{entity:customers|addresses|cards}/{id}/restore").Handler(httptransport.NewServer(
+		ctx,
+		e.RestoreEndpoint,
+		decodeRestoreRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "POST /restore", logger)))...,
+	))
+	r.Methods("GET").Path("/changes").Handler(httptransport.NewServer(
+		ctx,
+		e.ChangesEndpoint,
+		decodeChangesRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "GET /changes", logger)))...,
+	))
+	r.Methods("GET").Path("/admin/webhooks").Handler(httptransport.NewServer(
+		ctx,
+		e.WebhookGetEndpoint,
+		decodeWebhookRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "GET /admin/webhooks", logger)))...,
+	))
+	r.Methods("GET").Path("/admin/webhooks/{id}").Handler(httptransport.NewServer(
+		ctx,
+		e.WebhookGetEndpoint,
+		decodeWebhookRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "GET /admin/webhooks", logger)))...,
+	))
+	r.Methods("POST").Path("/admin/webhooks").Handler(httptransport.NewServer(
+		ctx,
+		e.WebhookPostEndpoint,
+		decodeWebhookPostRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "POST /admin/webhooks", logger)))...,
+	))
+	r.Methods("DELETE").Path("/admin/webhooks/{id}").Handler(httptransport.NewServer(
+		ctx,
+		e.WebhookDeleteEndpoint,
+		decodeWebhookRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "DELETE /admin/webhooks", logger)))...,
+	))
+	r.Methods("GET").Path("/admin/webhooks/{id}/dead-letters").Handler(httptransport.NewServer(
+		ctx,
+		e.DeadLettersEndpoint,
+		decodeWebhookRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "GET /admin/webhooks/dead-letters", logger)))...,
+	))
+	r.Methods("POST").Path("/admin/webhooks/{id}/dead-letters/{delivery}/replay").Handler(httptransport.NewServer(
+		ctx,
+		e.ReplayEndpoint,
+		decodeWebhookRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "POST /admin/webhooks/dead-letters/replay", logger)))...,
+	))
+	r.Methods("GET").Path("/admin/export").Handler(httptransport.NewServer(
+		ctx,
+		e.ExportEndpoint,
+		decodeExportRequest,
+		encodeExportResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "GET /admin/export", logger)))...,
+	))
+	r.Methods("POST").Path("/admin/import").Handler(httptransport.NewServer(
+		ctx,
+		e.ImportEndpoint,
+		decodeImportRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "POST /admin/import", logger)))...,
+	))
+	r.Methods("POST").Path("/guest").Handler(httptransport.NewServer(
+		ctx,
+		e.GuestPostEndpoint,
+		decodeNoRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "POST /guest", logger)))...,
+	))
+	r.Methods("GET").Path("/guest").Handler(httptransport.NewServer(
+		ctx,
+		e.GuestGetEndpoint,
+		decodeGuestRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "GET /guest", logger)))...,
+	))
+	r.Methods("POST").Path("/guest/addresses").Handler(httptransport.NewServer(
+		ctx,
+		e.GuestAddressEndpoint,
+		decodeGuestAddressRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "POST /guest/addresses", logger)))...,
+	))
+	r.Methods("POST").Path("/guest/cards").Handler(httptransport.NewServer(
+		ctx,
+		e.GuestCardEndpoint,
+		decodeGuestCardRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "POST /guest/cards", logger)))...,
+	))
+	r.Methods("POST").Path("/admin/customers/{id}/status").Handler(httptransport.NewServer(
+		ctx,
+		e.StatusEndpoint,
+		decodeAccountStatusRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "POST /admin/customers/status", logger)))...,
+	))
+	r.Methods("GET").Path("/admin/customers/{id}/status").Handler(httptransport.NewServer(
+		ctx,
+		e.StatusGetEndpoint,
+		decodeAccountStatusRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "GET /admin/customers/status", logger)))...,
+	))
+	r.Methods("GET", "POST").Path("/admin/check").Handler(httptransport.NewServer(
+		ctx,
+		e.CheckEndpoint,
+		decodeCheckRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "/admin/check", logger)))...,
+	))
+	r.Methods("POST").Path("/customers/{id}/access-requests").Handler(httptransport.NewServer(
+		ctx,
+		e.AccessPostEndpoint,
+		decodeAccessRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "POST /customers/access-requests", logger)))...,
+	))
+	r.Methods("GET").Path("/access-requests/{id}").Handler(httptransport.NewServer(
+		ctx,
+		e.AccessGetEndpoint,
+		decodeAccessRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "GET /access-requests", logger)))...,
+	))
+	r.Methods("GET").Path("/access-requests/{id}/archive").Handler(httptransport.NewServer(
+		ctx,
+		e.AccessArchiveEndpoint,
+		decodeAccessRequest,
+		encodeArchiveResponse,
+		append(options, httptransport.ServerBefore(opentracing.FromHTTPRequest(tracer, "GET /access-requests/archive", logger)))...,
+	))
 	r.Methods("DELETE").PathPrefix("/").Handler(httptransport.NewServer(
 		ctx,
 		e.DeleteEndpoint,
@@ -110,13 +386,12 @@ func MakeHTTPHandler(ctx context.Context, e Endpoints, logger log.Logger, tracer
 }
 
 func encodeError(_ context.Context, err error, w http.ResponseWriter) {
-	code := http.StatusInternalServerError
-	switch err {
-	case ErrUnauthorized:
-		code = http.StatusUnauthorized
+	if e, ok := err.(httptransport.Error); ok {
+		err = e.Err
 	}
-	w.WriteHeader(code)
+	code := errorStatus(err)
 	w.Header().Set("Content-Type", "application/hal+json")
+	w.WriteHeader(code)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"error":       err.Error(),
 		"status_code": code,
@@ -124,38 +399,293 @@ func encodeError(_ context.Context, err error, w http.ResponseWriter) {
 	})
 }
 
-func decodeLoginRequest(_ context.Context, r *http.Request) (interface{}, error) {
+// errorStatus maps service and transport errors to HTTP status codes
+func errorStatus(err error) int {
+	switch err {
+	case ErrUnauthorized, guest.ErrInvalidToken, db.ErrInvalidVerification:
+		return http.StatusUnauthorized
+	case ErrForbidden:
+		return http.StatusForbidden
+	case ErrInvalidRequest, db.ErrInvalidCursor:
+		return http.StatusBadRequest
+	case db.ErrNotFound:
+		return http.StatusNotFound
+	case ErrImmutableField:
+		return http.StatusUnprocessableEntity
+	case ErrUnsupportedMediaType:
+		return http.StatusUnsupportedMediaType
+	case db.ErrVersionConflict:
+		return http.StatusPreconditionFailed
+	case dsar.ErrNotReady:
+		return http.StatusConflict
+	case db.ErrWebhooksUnsupported, db.ErrAccessRequestsUnsupported, db.ErrCheckUnsupported, db.ErrGuestsUnsupported, db.ErrVersionsUnsupported, db.ErrDefaultsUnsupported, db.ErrStatusUnsupported, db.ErrEmailsUnsupported, db.ErrUsernamesUnsupported, db.ErrLoginsUnsupported, bulk.ErrNoKey, bulk.ErrNoSecret:
+		return http.StatusNotImplemented
+	case ErrPreconditionRequired:
+		return http.StatusPreconditionRequired
+	}
+	switch err.(type) {
+	case *query.SyntaxError, *PatchError:
+		return http.StatusBadRequest
+	case ValidationError:
+		return http.StatusUnprocessableEntity
+	case db.DuplicateError:
+		return http.StatusConflict
+	case users.StatusError:
+		// A transition the current status does not allow is a conflict,
+		// a write refused because of the status is forbidden
+		if err.(users.StatusError).To != "" {
+			return http.StatusConflict
+		}
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+func decodeLoginRequest(ctx context.Context, r *http.Request) (interface{}, error) {
 	u, p, ok := r.BasicAuth()
 	if !ok {
 		return loginRequest{}, ErrUnauthorized
 	}
 
+	d, _ := ctx.Value(deviceKey).(device)
 	return loginRequest{
-		Username: u,
-		Password: p,
+		Username:   u,
+		Password:   p,
+		GuestToken: r.Header.Get(guest.TokenHeader),
+		Client:     logins.Client{IP: clientIP(r), UserAgent: r.UserAgent(), Device: d.id},
 	}, nil
 }
 
+type contextKey int
+
+const deviceKey contextKey = iota
+
+// device is the device a client logs in from, new when it had no cookie
+type device struct {
+	id  string
+	new bool
+}
+
+// deviceFromCookie puts the device of the device cookie in the context,
+// making up one for clients without
+func deviceFromCookie(ctx context.Context, r *http.Request) context.Context {
+	if c, err := r.Cookie(logins.DeviceCookie); err == nil && c.Value != "" {
+		return context.WithValue(ctx, deviceKey, device{id: c.Value})
+	}
+	id, err := logins.NewDevice()
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, deviceKey, device{id: id, new: true})
+}
+
+// setDeviceCookie hands a device made up for a client logging in its cookie
+func setDeviceCookie(ctx context.Context, w http.ResponseWriter) context.Context {
+	if d, ok := ctx.Value(deviceKey).(device); ok && d.new {
+		http.SetCookie(w, &http.Cookie{
+			Name:     logins.DeviceCookie,
+			Value:    d.id,
+			Path:     "/",
+			MaxAge:   2 * 365 * 24 * 60 * 60,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return ctx
+}
+
+// clientIP returns the address of the client of a request. When the proxy in
+// front is trusted, that is the last address in X-Forwarded-For, the one the
+// proxy added; the ones before it are up to the client.
+func clientIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); trustForwardedFor && forwarded != "" {
+		addresses := strings.Split(forwarded, ",")
+		return strings.TrimSpace(addresses[len(addresses)-1])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// decodeLoginsRequest takes the admin token, as the history holds where the
+// customer logs in from
+func decodeLoginsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	if _, err := adminCards(r); err != nil {
+		return nil, err
+	}
+	req := loginsRequest{ID: mux.Vars(r)["id"]}
+	if l := r.URL.Query().Get("limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit < 0 {
+			return nil, ErrInvalidRequest
+		}
+		req.Limit = limit
+	}
+	return req, nil
+}
+
 func decodeRegisterRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	reg := registerRequest{}
 	err := json.NewDecoder(r.Body).Decode(&reg)
 	if err != nil {
 		return nil, err
 	}
+	reg.GuestToken = r.Header.Get(guest.TokenHeader)
 	return reg, nil
 }
 
+func decodeAvailabilityRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	q := r.URL.Query()
+	a := availabilityRequest{Username: q.Get("username"), Email: q.Get("email")}
+	if a.Username == "" && a.Email == "" {
+		return a, ErrInvalidRequest
+	}
+	return a, nil
+}
+
 func decodeDeleteRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	d := deleteRequest{}
 	u := strings.Split(r.URL.Path, "/")
 	if len(u) == 3 {
 		d.Entity = u[1]
 		d.ID = u[2]
-		return d, nil
+		var err error
+		d.Version, err = decodeIfMatch(r)
+		return d, err
 	}
 	return d, ErrInvalidRequest
 }
 
+func decodeChangesRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	q := r.URL.Query()
+	c := changesRequest{Since: q.Get("since")}
+	if l := q.Get("limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit < 0 {
+			return c, ErrInvalidRequest
+		}
+		c.Limit = limit
+	}
+	return c, nil
+}
+
+func decodeRestoreRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	return restoreRequest{Entity: vars["entity"], ID: vars["id"]}, nil
+}
+
+// decodeWebhookRequest admits admins only, as deliveries and dead letters
+// carry the customers in full
+func decodeWebhookRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	if _, err := adminCards(r); err != nil {
+		return nil, err
+	}
+	vars := mux.Vars(r)
+	return webhookRequest{ID: vars["id"], DeliveryID: vars["delivery"]}, nil
+}
+
+func decodeWebhookPostRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	if _, err := adminCards(r); err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	s := webhooks.Subscription{}
+	err := json.NewDecoder(r.Body).Decode(&s)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// decodeIfMatch returns the version required by the If-Match header of a
+// mutating request, or zero when any version will do
+func decodeIfMatch(r *http.Request) (int64, error) {
+	h := strings.TrimSpace(r.Header.Get("If-Match"))
+	switch {
+	case h == "" && requireIfMatch:
+		return 0, ErrPreconditionRequired
+	case h == "" || h == "*":
+		return 0, nil
+	}
+	// Only a single strong entity tag can name the version to update from
+	v, err := strconv.ParseInt(strings.Trim(h, `"`), 10, 64)
+	if err != nil || v <= 0 || !strings.HasPrefix(h, `"`) {
+		return 0, db.ErrVersionConflict
+	}
+	return v, nil
+}
+
+// etag returns the strong entity tag for a response holding a single entity
+func etag(response interface{}) string {
+	var version int64
+	switch r := response.(type) {
+	case users.User:
+		version = r.Version
+	case users.Address:
+		version = r.Version
+	case users.Card:
+		version = r.Version
+	}
+	if version == 0 {
+		return ""
+	}
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// conditional answers GET requests with 304 Not Modified when the entity tag
+// of the response matches one given in If-None-Match
+func conditional(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		match := r.Header.Get("If-None-Match")
+		if match == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &responseRecorder{header: w.Header(), code: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if rec.code == http.StatusOK && etagMatches(match, w.Header().Get("ETag")) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.WriteHeader(rec.code)
+		w.Write(rec.body.Bytes())
+	})
+}
+
+// etagMatches compares entity tags weakly, as If-None-Match requires
+func etagMatches(header, tag string) bool {
+	if tag == "" {
+		return false
+	}
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(tag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+type responseRecorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	r.code = code
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
+
 func decodeGetRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	g := GetRequest{}
 	u := strings.Split(r.URL.Path, "/")
@@ -165,9 +695,216 @@ func decodeGetRequest(_ context.Context, r *http.Request) (interface{}, error) {
 			g.Attr = u[3]
 		}
 	}
+	q := r.URL.Query()
+	if l := q.Get("limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit < 0 {
+			return g, ErrInvalidRequest
+		}
+		g.Limit = limit
+	}
+	g.Cursor = q.Get("cursor")
+	g.Query = q.Get("q")
+	g.SortBy = q.Get("sort")
+	if g.Query != "" || g.SortBy != "" {
+		// Only the customer listing can be searched
+		if u[1] != "customers" || g.ID != "" {
+			return g, ErrInvalidRequest
+		}
+		var err error
+		if g.Filter, err = query.Parse(g.Query); err != nil {
+			return g, err
+		}
+		if g.Sort, err = query.ParseSort(g.SortBy); err != nil {
+			return g, err
+		}
+	}
+	if v := q.Get("version"); v != "" {
+		// Only single addresses and cards are versioned
+		if u[1] == "customers" || g.ID == "" || g.Attr != "" {
+			return g, ErrInvalidRequest
+		}
+		version, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || version <= 0 {
+			return g, ErrInvalidRequest
+		}
+		g.Version = version
+	}
+	if e := q.Get("embed"); e != "" {
+		// Only the customer listing embeds attributes
+		if u[1] != "customers" || g.ID != "" {
+			return g, ErrInvalidRequest
+		}
+		for _, attr := range strings.Split(e, ",") {
+			if attr != db.EmbedAddresses && attr != db.EmbedCards {
+				return g, ErrInvalidRequest
+			}
+			if !g.Embeds(attr) {
+				g.Embed = append(g.Embed, attr)
+			}
+		}
+	}
 	return g, nil
 }
 
+// adminCards returns the cards an admin request may export: encrypted ones
+// with the card admin token, masked ones with the admin token
+func adminCards(r *http.Request) (bulk.Cards, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", ErrUnauthorized
+	}
+	token := []byte(strings.TrimPrefix(auth, "Bearer "))
+	if cardAdminToken != "" && subtle.ConstantTimeCompare(token, []byte(cardAdminToken)) == 1 {
+		return bulk.Encrypted, nil
+	}
+	if adminToken != "" && subtle.ConstantTimeCompare(token, []byte(adminToken)) == 1 {
+		return bulk.Masked, nil
+	}
+	return "", ErrUnauthorized
+}
+
+func decodeExportRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	allowed, err := adminCards(r)
+	if err != nil {
+		return nil, err
+	}
+	q := r.URL.Query()
+	cards, err := bulk.ParseCards(q.Get("cards"))
+	if err != nil {
+		return nil, ErrInvalidRequest
+	}
+	req := exportRequest{Cards: cards}
+	if a := q.Get("anonymize"); a != "" {
+		// Anonymized exports make up their own cards
+		if req.Anonymize, err = strconv.ParseBool(a); err != nil || (req.Anonymize && q.Get("cards") != "") {
+			return nil, ErrInvalidRequest
+		}
+	}
+	if cards == bulk.Encrypted && allowed != bulk.Encrypted {
+		return nil, ErrForbidden
+	}
+	return req, nil
+}
+
+// encodeExportResponse streams the records of an export. An export failing
+// before its first record is answered with the error; one failing later can
+// only cut the stream short, and is logged by the service.
+func encodeExportResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	records := response.(exportResponse).Records
+	defer records.Close()
+	br := bufio.NewReader(records)
+	if _, err := br.Peek(1); err != nil && err != io.EOF {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	io.Copy(w, br)
+	return nil
+}
+
+func decodeNoRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return struct{}{}, nil
+}
+
+// guestToken returns the guest session token a request is made with
+func guestToken(r *http.Request) (string, error) {
+	token := r.Header.Get(guest.TokenHeader)
+	if token == "" {
+		return "", ErrUnauthorized
+	}
+	return token, nil
+}
+
+func decodeGuestRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	token, err := guestToken(r)
+	return guestRequest{Token: token}, err
+}
+
+func decodeGuestAddressRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	token, err := guestToken(r)
+	if err != nil {
+		return nil, err
+	}
+	req := guestAddressRequest{Token: token}
+	if err := json.NewDecoder(r.Body).Decode(&req.Address); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func decodeGuestCardRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	token, err := guestToken(r)
+	if err != nil {
+		return nil, err
+	}
+	req := guestCardRequest{Token: token}
+	if err := json.NewDecoder(r.Body).Decode(&req.Card); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// decodeCheckRequest only checks on GET; POST repairs what is found
+func decodeCheckRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	if _, err := adminCards(r); err != nil {
+		return nil, err
+	}
+	return checkRequest{Repair: r.Method == "POST"}, nil
+}
+
+// decodeAccountStatusRequest reads the transition asked for on POST
+func decodeAccountStatusRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	if _, err := adminCards(r); err != nil {
+		return nil, err
+	}
+	req := accountStatusRequest{ID: mux.Vars(r)["id"]}
+	if r.Method != "POST" {
+		return req, nil
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, ErrInvalidRequest
+	}
+	return req, nil
+}
+
+// decodeAccessRequest takes the admin token, as an archive holds all the data
+// kept on a customer
+func decodeAccessRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	if _, err := adminCards(r); err != nil {
+		return nil, err
+	}
+	return accessRequest{ID: mux.Vars(r)["id"]}, nil
+}
+
+// encodeArchiveResponse sends an access archive as a zip file download
+func encodeArchiveResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	resp := response.(archiveResponse)
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "access-"+resp.ID+".zip"))
+	w.Header().Set("Content-Length", strconv.Itoa(len(resp.Archive)))
+	_, err := w.Write(resp.Archive)
+	return err
+}
+
+func decodeImportRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	if _, err := adminCards(r); err != nil {
+		return nil, err
+	}
+	req := importRequest{Records: r.Body}
+	if d := r.URL.Query().Get("dry-run"); d != "" {
+		dryRun, err := strconv.ParseBool(d)
+		if err != nil {
+			return nil, ErrInvalidRequest
+		}
+		req.DryRun = dryRun
+	}
+	return req, nil
+}
+
 func decodeUserRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	defer r.Body.Close()
 	u := users.User{}
@@ -198,6 +935,131 @@ func decodeCardRequest(_ context.Context, r *http.Request) (interface{}, error)
 	return c, nil
 }
 
+// decodeUserPutRequest reads the customer along with its email, which is not
+// part of the representation of a customer but can be changed
+func decodeUserPutRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	u := userPutRequest{ID: mux.Vars(r)["id"]}
+	var body json.RawMessage
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(body, &u.User); err != nil {
+		return nil, err
+	}
+	var email struct {
+		Email string `json:"email"`
+	}
+	if err := json.Unmarshal(body, &email); err != nil {
+		return nil, err
+	}
+	u.User.Email = email.Email
+	u.Version, err = decodeIfMatch(r)
+	return u, err
+}
+
+func decodeAddressPutRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	a := addressPutRequest{ID: mux.Vars(r)["id"]}
+	err := json.NewDecoder(r.Body).Decode(&a.Address)
+	if err != nil {
+		return nil, err
+	}
+	a.Version, err = decodeIfMatch(r)
+	return a, err
+}
+
+func decodeCardPutRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	c := cardPutRequest{ID: mux.Vars(r)["id"]}
+	err := json.NewDecoder(r.Body).Decode(&c.Card)
+	if err != nil {
+		return nil, err
+	}
+	c.Version, err = decodeIfMatch(r)
+	return c, err
+}
+
+// decodePatchRequest picks the patch format from the content type, plain JSON
+// being treated as a merge patch
+func decodePatchRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	p := patchRequest{ID: mux.Vars(r)["id"]}
+	var err error
+	p.Version, err = decodeIfMatch(r)
+	if err != nil {
+		return nil, err
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, ErrUnsupportedMediaType
+	}
+	switch mediaType {
+	case mergePatchType, "application/json":
+		var mp json.RawMessage
+		err = json.NewDecoder(r.Body).Decode(&mp)
+		p.Patch = MergePatch(mp)
+	case jsonPatchType:
+		var jp JSONPatch
+		err = json.NewDecoder(r.Body).Decode(&jp)
+		p.Patch = jp
+	default:
+		return nil, ErrUnsupportedMediaType
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func decodePasswordRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	p := passwordRequest{}
+	err := json.NewDecoder(r.Body).Decode(&p)
+	if err != nil {
+		return nil, err
+	}
+	p.ID = mux.Vars(r)["id"]
+	return p, nil
+}
+
+func decodeDefaultsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	d := defaultsRequest{ID: mux.Vars(r)["id"]}
+	if err := json.NewDecoder(r.Body).Decode(&d.Defaults); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// decodeUsernameRequest reads the username asked for on PUT
+func decodeUsernameRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := usernameRequest{ID: mux.Vars(r)["id"]}
+	if r.Method != "PUT" {
+		return req, nil
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, ErrInvalidRequest
+	}
+	return req, nil
+}
+
+// decodeVerificationRequest reads the token verifying an email, when the
+// verification of a customer is not being started instead
+func decodeVerificationRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	req := verificationRequest{ID: mux.Vars(r)["id"]}
+	if req.ID != "" {
+		return req, nil
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		return nil, ErrInvalidRequest
+	}
+	return req, nil
+}
+
 func decodeHealthRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	return struct{}{}, nil
 }
@@ -209,5 +1071,8 @@ func encodeHealthResponse(ctx context.Context, w http.ResponseWriter, response i
 func encodeResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
 	// All of our response objects are JSON serializable, so we just do that.
 	w.Header().Set("Content-Type", "application/hal+json")
+	if tag := etag(response); tag != "" {
+		w.Header().Set("ETag", tag)
+	}
 	return json.NewEncoder(w).Encode(response)
 }
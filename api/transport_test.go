@@ -0,0 +1,340 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/dsar"
+	"github.com/microservices-demo/user/guest"
+	"github.com/microservices-demo/user/logins"
+	"github.com/microservices-demo/user/users"
+	"github.com/microservices-demo/user/webhooks"
+	"golang.org/x/net/context"
+)
+
+func TestDecodeIfMatch(t *testing.T) {
+	r := httptest.NewRequest("PUT", "/addresses/test", nil)
+	if v, err := decodeIfMatch(r); v != 0 || err != nil {
+		t.Error("expected no precondition without If-Match")
+	}
+	requireIfMatch = true
+	if _, err := decodeIfMatch(r); err != ErrPreconditionRequired {
+		t.Error("expected precondition required error")
+	}
+	requireIfMatch = false
+
+	r.Header.Set("If-Match", `"3"`)
+	if v, err := decodeIfMatch(r); v != 3 || err != nil {
+		t.Errorf("expected version 3 received %v %v", v, err)
+	}
+	r.Header.Set("If-Match", `W/"3"`)
+	if _, err := decodeIfMatch(r); err != db.ErrVersionConflict {
+		t.Error("expected weak entity tag to fail the precondition")
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	if errorStatus(db.ErrVersionConflict) != http.StatusPreconditionFailed {
+		t.Error("expected 412 for version conflicts")
+	}
+	if errorStatus(ValidationError{ErrInvalidRequest}) != http.StatusUnprocessableEntity {
+		t.Error("expected 422 for validation errors")
+	}
+	if errorStatus(db.DuplicateError{Field: "username"}) != http.StatusConflict {
+		t.Error("expected 409 for taken usernames")
+	}
+	if errorStatus(db.ErrWebhooksUnsupported) != http.StatusNotImplemented {
+		t.Error("expected 501 without a webhook store")
+	}
+	if errorStatus(dsar.ErrNotReady) != http.StatusConflict {
+		t.Error("expected 409 for archives not built yet")
+	}
+	if errorStatus(guest.ErrInvalidToken) != http.StatusUnauthorized {
+		t.Error("expected 401 for unknown guest tokens")
+	}
+	if errorStatus(users.StatusError{Status: users.StatusSuspended}) != http.StatusForbidden {
+		t.Error("expected 403 for suspended accounts")
+	}
+	if errorStatus(users.StatusError{Status: users.StatusClosed, To: users.StatusActive}) != http.StatusConflict {
+		t.Error("expected 409 for transitions the status can not make")
+	}
+}
+
+func TestDecodeVerificationRequest(t *testing.T) {
+	r := httptest.NewRequest("POST", "/email-verification", strings.NewReader(`{}`))
+	if _, err := decodeVerificationRequest(context.Background(), r); err != ErrInvalidRequest {
+		t.Errorf("expected a missing token to be invalid, received %v", err)
+	}
+	r = httptest.NewRequest("POST", "/email-verification", strings.NewReader(`{"token": "abc"}`))
+	req, err := decodeVerificationRequest(context.Background(), r)
+	if err != nil || req.(verificationRequest).Token != "abc" {
+		t.Errorf("unexpected request %+v, %v", req, err)
+	}
+}
+
+func TestDecodeUserPutRequest(t *testing.T) {
+	r := httptest.NewRequest("PUT", "/customers/test", strings.NewReader(`{"firstName": "Eve", "email": "eve@example.com"}`))
+	req, err := decodeUserPutRequest(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := req.(userPutRequest).User; u.FirstName != "Eve" || u.Email != "eve@example.com" {
+		t.Errorf("unexpected customer %+v", u)
+	}
+}
+
+func TestDecodeUsernameRequest(t *testing.T) {
+	r := httptest.NewRequest("PUT", "/customers/test/username", strings.NewReader(`"eve"`))
+	if _, err := decodeUsernameRequest(context.Background(), r); err != ErrInvalidRequest {
+		t.Errorf("expected a malformed body to be invalid, received %v", err)
+	}
+	r = httptest.NewRequest("PUT", "/customers/test/username", strings.NewReader(`{"username": "eve"}`))
+	req, err := decodeUsernameRequest(context.Background(), r)
+	if err != nil || req.(usernameRequest).Username != "eve" {
+		t.Errorf("unexpected request %+v, %v", req, err)
+	}
+}
+
+func TestDecodeLoginRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/login", nil)
+	r.SetBasicAuth("eve", "secret")
+	r.Header.Set("User-Agent", "curl/8.0")
+	r.RemoteAddr = "192.0.2.1:1234"
+	ctx := deviceFromCookie(context.Background(), r)
+	req, err := decodeLoginRequest(ctx, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := req.(loginRequest).Client
+	if client.IP != "192.0.2.1" || client.UserAgent != "curl/8.0" || client.Device == "" {
+		t.Errorf("unexpected client %+v", client)
+	}
+	w := httptest.NewRecorder()
+	setDeviceCookie(ctx, w)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != logins.DeviceCookie || cookies[0].Value != client.Device {
+		t.Fatalf("expected the new device to be handed a cookie, received %v", cookies)
+	}
+
+	r.AddCookie(cookies[0])
+	ctx = deviceFromCookie(context.Background(), r)
+	req, _ = decodeLoginRequest(ctx, r)
+	if req.(loginRequest).Client.Device != client.Device {
+		t.Errorf("expected the device of the cookie, received %+v", req)
+	}
+	w = httptest.NewRecorder()
+	setDeviceCookie(ctx, w)
+	if len(w.Result().Cookies()) != 0 {
+		t.Error("expected a known device to keep its cookie")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	defer func() { trustForwardedFor = false }()
+	r := httptest.NewRequest("GET", "/login", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("X-Forwarded-For", "10.0.0.1, 198.51.100.1")
+	if ip := clientIP(r); ip != "192.0.2.1" {
+		t.Errorf("expected the remote address, received %v", ip)
+	}
+	trustForwardedFor = true
+	if ip := clientIP(r); ip != "198.51.100.1" {
+		t.Errorf("expected the address added by the proxy, received %v", ip)
+	}
+}
+
+func TestDecodeGuestRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/guest", nil)
+	if _, err := decodeGuestRequest(context.Background(), r); err != ErrUnauthorized {
+		t.Errorf("expected a missing token to be unauthorized, received %v", err)
+	}
+	r.Header.Set(guest.TokenHeader, "token")
+	req, err := decodeGuestRequest(context.Background(), r)
+	if err != nil || req.(guestRequest).Token != "token" {
+		t.Errorf("expected the token to be read, received %+v, %v", req, err)
+	}
+}
+
+func TestConditional(t *testing.T) {
+	h := conditional(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodeResponse(context.Background(), w, users.Address{ID: "test", Version: 2})
+	}))
+
+	r := httptest.NewRequest("GET", "/addresses/test", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"2"` {
+		t.Errorf("expected entity tag on response, received %v %v", w.Code, w.Header())
+	}
+
+	r.Header.Set("If-None-Match", `"1", "2"`)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("expected 304 without body, received %v", w.Code)
+	}
+
+	r.Header.Set("If-None-Match", `"1"`)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Errorf("expected full response for stale entity tag, received %v", w.Code)
+	}
+}
+
+func TestDecodeAvailabilityRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/register/availability", nil)
+	if _, err := decodeAvailabilityRequest(context.Background(), r); err != ErrInvalidRequest {
+		t.Error("expected invalid request without username or email")
+	}
+	r = httptest.NewRequest("GET", "/register/availability?username=eve", nil)
+	req, err := decodeAvailabilityRequest(context.Background(), r)
+	if err != nil || req.(availabilityRequest).Username != "eve" {
+		t.Errorf("expected username to be checked, received %v %v", req, err)
+	}
+}
+
+func TestDecodeChangesRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/changes?since=NDI&limit=10", nil)
+	req, err := decodeChangesRequest(context.Background(), r)
+	if err != nil || req.(changesRequest).Since != "NDI" || req.(changesRequest).Limit != 10 {
+		t.Errorf("unexpected request %v %v", req, err)
+	}
+	r = httptest.NewRequest("GET", "/changes?limit=many", nil)
+	if _, err := decodeChangesRequest(context.Background(), r); err != ErrInvalidRequest {
+		t.Error("expected invalid request for a bad limit")
+	}
+}
+
+func TestDecodeVersion(t *testing.T) {
+	r := httptest.NewRequest("GET", "/addresses/57a98d98e4b00679b4a830ad?version=2", nil)
+	req, err := decodeGetRequest(context.Background(), r)
+	if err != nil || req.(GetRequest).Version != 2 {
+		t.Errorf("expected version 2, received %v %v", req, err)
+	}
+	for _, path := range []string{"/addresses?version=2", "/customers/57a98d98e4b00679b4a830af?version=2", "/cards/57a98d98e4b00679b4a830ae?version=0", "/cards/57a98d98e4b00679b4a830ae?version=latest"} {
+		r := httptest.NewRequest("GET", path, nil)
+		if _, err := decodeGetRequest(context.Background(), r); err != ErrInvalidRequest {
+			t.Errorf("expected invalid request for %v, received %v", path, err)
+		}
+	}
+}
+
+func TestDecodeEmbed(t *testing.T) {
+	r := httptest.NewRequest("GET", "/customers?embed=cards,addresses,cards", nil)
+	req, err := decodeGetRequest(context.Background(), r)
+	if err != nil || len(req.(GetRequest).Embed) != 2 || !req.(GetRequest).Embeds(db.EmbedAddresses) {
+		t.Errorf("unexpected request %v %v", req, err)
+	}
+	for _, path := range []string{"/customers?embed=links", "/customers/57a98d98e4b00679b4a830af?embed=cards", "/cards?embed=cards"} {
+		r = httptest.NewRequest("GET", path, nil)
+		if _, err := decodeGetRequest(context.Background(), r); err != ErrInvalidRequest {
+			t.Errorf("expected %v to be invalid, received %v", path, err)
+		}
+	}
+}
+
+func TestDecodeExportRequest(t *testing.T) {
+	adminToken, cardAdminToken = "admin", "cards"
+	defer func() { adminToken, cardAdminToken = "", "" }()
+	for _, c := range []struct {
+		token, cards string
+		err          error
+	}{
+		{"", "", ErrUnauthorized},
+		{"other", "", ErrUnauthorized},
+		{"admin", "", nil},
+		{"admin", "encrypted", ErrForbidden},
+		{"cards", "encrypted", nil},
+		{"cards", "plain", ErrInvalidRequest},
+	} {
+		r := httptest.NewRequest("GET", "/admin/export?cards="+c.cards, nil)
+		if c.token != "" {
+			r.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		if _, err := decodeExportRequest(context.Background(), r); err != c.err {
+			t.Errorf("expected %v exporting %q cards with %q, received %v", c.err, c.cards, c.token, err)
+		}
+	}
+	r := httptest.NewRequest("GET", "/admin/export?anonymize=true", nil)
+	r.Header.Set("Authorization", "Bearer admin")
+	if req, err := decodeExportRequest(context.Background(), r); err != nil || !req.(exportRequest).Anonymize {
+		t.Errorf("expected an anonymized export, received %v %v", req, err)
+	}
+	r = httptest.NewRequest("GET", "/admin/export?anonymize=true&cards=masked", nil)
+	r.Header.Set("Authorization", "Bearer admin")
+	if _, err := decodeExportRequest(context.Background(), r); err != ErrInvalidRequest {
+		t.Errorf("expected anonymized exports not to take cards, received %v", err)
+	}
+}
+
+func TestDecodeWebhookRequest(t *testing.T) {
+	adminToken = "admin"
+	defer func() { adminToken = "" }()
+	for _, token := range []string{"", "other"} {
+		r := httptest.NewRequest("GET", "/admin/webhooks", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		if _, err := decodeWebhookRequest(context.Background(), r); err != ErrUnauthorized {
+			t.Errorf("expected listing webhooks with %q to be unauthorized, received %v", token, err)
+		}
+		r = httptest.NewRequest("POST", "/admin/webhooks", strings.NewReader(`{"url": "https://example.com"}`))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		if _, err := decodeWebhookPostRequest(context.Background(), r); err != ErrUnauthorized {
+			t.Errorf("expected subscribing with %q to be unauthorized, received %v", token, err)
+		}
+	}
+	r := httptest.NewRequest("POST", "/admin/webhooks", strings.NewReader(`{"url": "https://example.com"}`))
+	r.Header.Set("Authorization", "Bearer admin")
+	if req, err := decodeWebhookPostRequest(context.Background(), r); err != nil || req.(webhooks.Subscription).URL != "https://example.com" {
+		t.Errorf("unexpected subscription %+v, %v", req, err)
+	}
+}
+
+func TestDecodeLoginsRequest(t *testing.T) {
+	adminToken = "admin"
+	defer func() { adminToken = "" }()
+	r := httptest.NewRequest("GET", "/customers/57a98d98e4b00679b4a830af/logins?limit=20", nil)
+	if _, err := decodeLoginsRequest(context.Background(), r); err != ErrUnauthorized {
+		t.Errorf("expected the history without the token to be unauthorized, received %v", err)
+	}
+	r.Header.Set("Authorization", "Bearer admin")
+	if req, err := decodeLoginsRequest(context.Background(), r); err != nil || req.(loginsRequest).Limit != 20 {
+		t.Errorf("unexpected logins request %+v, %v", req, err)
+	}
+}
+
+func TestDecodeAccessRequest(t *testing.T) {
+	adminToken = "admin"
+	defer func() { adminToken = "" }()
+	r := httptest.NewRequest("GET", "/access-requests/r1/archive", nil)
+	if _, err := decodeAccessRequest(context.Background(), r); err != ErrUnauthorized {
+		t.Errorf("expected downloading an archive without the token to be unauthorized, received %v", err)
+	}
+	r.Header.Set("Authorization", "Bearer admin")
+	if _, err := decodeAccessRequest(context.Background(), r); err != nil {
+		t.Errorf("expected the admin token to be let through, received %v", err)
+	}
+}
+
+func TestEmbeddedUser(t *testing.T) {
+	u := users.User{UserID: "u1", Username: "eve", Addresses: []users.Address{{ID: "a1"}}}
+	e := embedAttributes([]users.User{u}, db.ListOptions{Embed: []string{db.EmbedAddresses}})
+	b, err := json.Marshal(e[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	json.Unmarshal(b, &fields)
+	embedded, _ := fields["_embedded"].(map[string]interface{})
+	if fields["username"] != "eve" || len(embedded["address"].([]interface{})) != 1 || embedded["card"] != nil {
+		t.Errorf("unexpected customer %s", b)
+	}
+}
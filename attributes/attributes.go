@@ -0,0 +1,320 @@
+// Package attributes governs the profile attributes of customers, such as a
+// phone number or a preferred language, with a JSON Schema document loaded at
+// start up. The schema names the attributes a customer may have and how their
+// values are checked; attributes it does not name are refused.
+//
+// Only the part of JSON Schema that describes a flat object is supported:
+//
+//	{
+//	  "x-version": 2,
+//	  "type": "object",
+//	  "properties": {
+//	    "phone": {"type": "string", "pattern": "^\\+?[0-9 ]+$", "maxLength": 20},
+//	    "dateOfBirth": {"type": "string", "format": "date"},
+//	    "language": {"type": "string", "enum": ["en", "nl", "de"]},
+//	    "loyaltyPoints": {"type": "integer", "minimum": 0}
+//	  },
+//	  "required": ["language"],
+//	  "additionalProperties": false
+//	}
+//
+// x-version numbers the schema. Every customer records the version its
+// attributes were last checked against, so that they can be migrated when the
+// schema changes.
+package attributes
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"net/mail"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/microservices-demo/user/db/query"
+)
+
+var (
+	schemaPath string
+	// Current is the schema attributes are checked against. Until one is
+	// loaded no attribute is allowed.
+	Current = &Schema{Version: 1, Properties: map[string]*Property{}}
+)
+
+func init() {
+	flag.StringVar(&schemaPath, "attributes-schema", os.Getenv("ATTRIBUTES_SCHEMA"), "JSON Schema file governing the profile attributes of customers, none allowed without one")
+}
+
+// Load makes the schema given by -attributes-schema, if any, Current and
+// lets customer searches filter on its attributes
+func Load() error {
+	if schemaPath == "" {
+		return nil
+	}
+	b, err := os.ReadFile(schemaPath)
+	if err != nil {
+		return err
+	}
+	s, err := Parse(b)
+	if err != nil {
+		return fmt.Errorf("%v: %v", schemaPath, err)
+	}
+	Current = s
+	for name, f := range s.QueryFields() {
+		query.Fields[name] = f
+	}
+	return nil
+}
+
+// Schema is a parsed schema document
+type Schema struct {
+	Schema               string               `json:"$schema"`
+	ID                   string               `json:"$id"`
+	Title                string               `json:"title"`
+	Description          string               `json:"description"`
+	Version              int64                `json:"x-version"`
+	Type                 string               `json:"type"`
+	Properties           map[string]*Property `json:"properties"`
+	Required             []string             `json:"required"`
+	AdditionalProperties *bool                `json:"additionalProperties"`
+}
+
+// Property describes one attribute
+type Property struct {
+	Title       string        `json:"title"`
+	Description string        `json:"description"`
+	Type        string        `json:"type"`
+	Enum        []interface{} `json:"enum"`
+	MinLength   *int          `json:"minLength"`
+	MaxLength   *int          `json:"maxLength"`
+	Pattern     string        `json:"pattern"`
+	Format      string        `json:"format"`
+	Minimum     *float64      `json:"minimum"`
+	Maximum     *float64      `json:"maximum"`
+
+	pattern *regexp.Regexp
+}
+
+// Parse reads a schema document, refusing the keywords it does not support
+func Parse(b []byte) (*Schema, error) {
+	var s Schema
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&s); err != nil {
+		return nil, err
+	}
+	if s.Type != "" && s.Type != "object" {
+		return nil, fmt.Errorf("type must be object, not %q", s.Type)
+	}
+	if s.AdditionalProperties != nil && *s.AdditionalProperties {
+		return nil, fmt.Errorf("additionalProperties can not be allowed")
+	}
+	if s.Version == 0 {
+		s.Version = 1
+	}
+	if s.Version < 0 {
+		return nil, fmt.Errorf("x-version must be positive")
+	}
+	if s.Properties == nil {
+		s.Properties = map[string]*Property{}
+	}
+	for name, p := range s.Properties {
+		if !validName.MatchString(name) {
+			return nil, fmt.Errorf("property name %q must be letters, digits and underscores", name)
+		}
+		switch p.Type {
+		case "string", "number", "integer", "boolean":
+		default:
+			return nil, fmt.Errorf("%v: type must be string, number, integer or boolean, not %q", name, p.Type)
+		}
+		switch p.Format {
+		case "", "date", "date-time", "email":
+		default:
+			return nil, fmt.Errorf("%v: unsupported format %q", name, p.Format)
+		}
+		if p.Pattern != "" {
+			var err error
+			if p.pattern, err = regexp.Compile(p.Pattern); err != nil {
+				return nil, fmt.Errorf("%v: %v", name, err)
+			}
+		}
+	}
+	for _, name := range s.Required {
+		if _, ok := s.Properties[name]; !ok {
+			return nil, fmt.Errorf("required property %q is not described", name)
+		}
+	}
+	return &s, nil
+}
+
+// validName keeps attribute names usable as fields of searches and documents
+var validName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// Error tells which attribute is invalid and why
+type Error struct {
+	Attribute string
+	Reason    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("Error invalid attributes.%v: %v", e.Attribute, e.Reason)
+}
+
+// Validate checks attributes against the schema
+func (s *Schema) Validate(attrs map[string]interface{}) error {
+	for _, name := range s.Required {
+		if _, ok := attrs[name]; !ok {
+			return &Error{Attribute: name, Reason: "missing"}
+		}
+	}
+	for _, name := range sortedNames(attrs) {
+		p, ok := s.Properties[name]
+		if !ok {
+			return &Error{Attribute: name, Reason: "not allowed"}
+		}
+		if reason := p.check(attrs[name]); reason != "" {
+			return &Error{Attribute: name, Reason: reason}
+		}
+	}
+	return nil
+}
+
+// Migrate returns the attributes that are valid under the schema, and the
+// names of the ones left out because the schema no longer allows them or
+// their values. Required attributes that are missing can not be made up, so
+// the attributes returned may still fail Validate.
+func (s *Schema) Migrate(attrs map[string]interface{}) (map[string]interface{}, []string) {
+	kept := make(map[string]interface{}, len(attrs))
+	dropped := make([]string, 0)
+	for _, name := range sortedNames(attrs) {
+		p, ok := s.Properties[name]
+		if !ok || p.check(attrs[name]) != "" {
+			dropped = append(dropped, name)
+			continue
+		}
+		kept[name] = attrs[name]
+	}
+	return kept, dropped
+}
+
+// QueryFields returns the attributes that customer searches can filter on,
+// as attributes.<name>. Dates are compared as the text they are stored as.
+func (s *Schema) QueryFields() map[string]query.Field {
+	fields := make(map[string]query.Field, len(s.Properties))
+	for name, p := range s.Properties {
+		f := query.Field{Name: "attributes." + name, Type: query.String}
+		switch p.Type {
+		case "number", "integer":
+			f.Type = query.Number
+		case "boolean":
+			f.Type = query.Bool
+		}
+		fields[f.Name] = f
+	}
+	return fields
+}
+
+// check returns why a value does not fit the property, or the empty string
+func (p *Property) check(v interface{}) string {
+	if len(p.Enum) > 0 && !inEnum(p.Enum, v) {
+		return "not one of the allowed values"
+	}
+	switch p.Type {
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			return "must be a string"
+		}
+		n := len([]rune(s))
+		if p.MinLength != nil && n < *p.MinLength {
+			return fmt.Sprintf("must be at least %d characters", *p.MinLength)
+		}
+		if p.MaxLength != nil && n > *p.MaxLength {
+			return fmt.Sprintf("must be at most %d characters", *p.MaxLength)
+		}
+		if p.pattern != nil && !p.pattern.MatchString(s) {
+			return "does not match " + p.Pattern
+		}
+		return checkFormat(p.Format, s)
+	case "number", "integer":
+		f, ok := number(v)
+		if !ok {
+			return "must be a number"
+		}
+		if p.Type == "integer" && f != math.Trunc(f) {
+			return "must be an integer"
+		}
+		if p.Minimum != nil && f < *p.Minimum {
+			return fmt.Sprintf("must be at least %v", *p.Minimum)
+		}
+		if p.Maximum != nil && f > *p.Maximum {
+			return fmt.Sprintf("must be at most %v", *p.Maximum)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return "must be true or false"
+		}
+	}
+	return ""
+}
+
+func checkFormat(format, s string) string {
+	var err error
+	switch format {
+	case "date":
+		_, err = time.Parse("2006-01-02", s)
+	case "date-time":
+		_, err = time.Parse(time.RFC3339, s)
+	case "email":
+		_, err = mail.ParseAddress(s)
+	}
+	if err != nil {
+		return "must be a valid " + format
+	}
+	return ""
+}
+
+// number returns v as a float, whether it was decoded from JSON or read back
+// from a database
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func inEnum(enum []interface{}, v interface{}) bool {
+	for _, e := range enum {
+		if e == v {
+			return true
+		}
+		if a, ok := number(e); ok {
+			if b, ok := number(v); ok && a == b {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func sortedNames(attrs map[string]interface{}) []string {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,108 @@
+package attributes
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/microservices-demo/user/db/query"
+)
+
+const schema = `{
+	"x-version": 2,
+	"type": "object",
+	"properties": {
+		"phone": {"type": "string", "pattern": "^\\+?[0-9 ]+$", "maxLength": 20},
+		"dateOfBirth": {"type": "string", "format": "date"},
+		"language": {"type": "string", "enum": ["en", "nl", "de"]},
+		"loyaltyPoints": {"type": "integer", "minimum": 0},
+		"newsletter": {"type": "boolean"}
+	},
+	"required": ["language"],
+	"additionalProperties": false
+}`
+
+func TestParse(t *testing.T) {
+	s, err := Parse([]byte(schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Version != 2 || len(s.Properties) != 5 {
+		t.Errorf("unexpected schema %+v", s)
+	}
+	for _, src := range []string{
+		`{"type": "array"}`,
+		`{"additionalProperties": true}`,
+		`{"properties": {"phone": {"type": "object"}}}`,
+		`{"properties": {"phone": {"type": "string", "format": "uri"}}}`,
+		`{"properties": {"phone": {"type": "string", "pattern": "("}}}`,
+		`{"properties": {"phone.number": {"type": "string"}}}`,
+		`{"properties": {"phone": {"type": "string", "oneOf": []}}}`,
+		`{"required": ["phone"]}`,
+		`{"x-version": -1}`,
+	} {
+		if _, err := Parse([]byte(src)); err == nil {
+			t.Errorf("expected %v to be refused", src)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	s, err := Parse([]byte(schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := map[string]interface{}{"language": "nl", "phone": "+31 20 123", "dateOfBirth": "1990-02-01", "loyaltyPoints": 10.0, "newsletter": true}
+	if err := s.Validate(valid); err != nil {
+		t.Errorf("expected attributes to be valid, received %v", err)
+	}
+	for _, c := range []struct {
+		attrs    map[string]interface{}
+		expected string
+	}{
+		{map[string]interface{}{"phone": "1"}, "language"},
+		{map[string]interface{}{"language": "fr"}, "language"},
+		{map[string]interface{}{"language": "en", "shoeSize": 42.0}, "shoeSize"},
+		{map[string]interface{}{"language": "en", "phone": "call me"}, "phone"},
+		{map[string]interface{}{"language": "en", "dateOfBirth": "01-02-1990"}, "dateOfBirth"},
+		{map[string]interface{}{"language": "en", "loyaltyPoints": 1.5}, "loyaltyPoints"},
+		{map[string]interface{}{"language": "en", "loyaltyPoints": -1.0}, "loyaltyPoints"},
+		{map[string]interface{}{"language": "en", "newsletter": "yes"}, "newsletter"},
+	} {
+		err := s.Validate(c.attrs)
+		if e, ok := err.(*Error); !ok || e.Attribute != c.expected {
+			t.Errorf("expected %v to be refused for %v, received %v", c.attrs, c.expected, err)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	s, err := Parse([]byte(schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, dropped := s.Migrate(map[string]interface{}{"language": "en", "shoeSize": 42.0, "loyaltyPoints": int64(-5), "phone": "+31 20"})
+	if !reflect.DeepEqual(kept, map[string]interface{}{"language": "en", "phone": "+31 20"}) {
+		t.Errorf("unexpected attributes kept %v", kept)
+	}
+	if !reflect.DeepEqual(dropped, []string{"loyaltyPoints", "shoeSize"}) {
+		t.Errorf("unexpected attributes dropped %v", dropped)
+	}
+}
+
+func TestQueryFields(t *testing.T) {
+	s, err := Parse([]byte(schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := s.QueryFields()
+	for name, expected := range map[string]query.Type{
+		"attributes.phone":         query.String,
+		"attributes.dateOfBirth":   query.String,
+		"attributes.loyaltyPoints": query.Number,
+		"attributes.newsletter":    query.Bool,
+	} {
+		if f, ok := fields[name]; !ok || f.Type != expected || f.Name != name {
+			t.Errorf("unexpected field %v: %+v", name, f)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package bulk
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/microservices-demo/user/users"
+)
+
+var ErrNoSecret = errors.New("No anonymization secret configured")
+
+var anonymizeRules, anonymizeSecret string
+
+func init() {
+	flag.StringVar(&anonymizeRules, "anonymize-rules", os.Getenv("ANONYMIZE_RULES"), "JSON file of rules for anonymized exports, the default rules without one")
+	flag.StringVar(&anonymizeSecret, "anonymize-secret", os.Getenv("ANONYMIZE_SECRET"), "Secret keying the pseudonyms of anonymized exports")
+}
+
+// Anonymize returns the anonymizer configured by -anonymize-rules and
+// -anonymize-secret, or ErrNoSecret without a secret
+func Anonymize() (*Anonymizer, error) {
+	if anonymizeSecret == "" {
+		return nil, ErrNoSecret
+	}
+	rules := DefaultRules()
+	if anonymizeRules != "" {
+		var err error
+		if rules, err = LoadRules(anonymizeRules); err != nil {
+			return nil, err
+		}
+	}
+	return NewAnonymizer(rules, anonymizeSecret)
+}
+
+// Rules name the strategy anonymizing each field of the customers, addresses
+// and cards of an export:
+//
+//	keep       the value as it is
+//	redact     the empty string
+//	hash       a hex digest of the value
+//	format     digits and letters replaced by others, keeping the layout
+//	firstName, lastName, street, city
+//	           a realistic name picked from a list
+//	username   a unique username
+//	email      a unique address at example.com
+//	testPan    for card numbers, a Luhn valid number of the same brand
+//	reset      for passwords, Password hashed with the salt of the customer
+//
+// Every strategy but redact is deterministic: a value anonymizes the same in
+// every customer and every export with the same secret.
+type Rules struct {
+	Customer map[string]string `json:"customer"`
+	Address  map[string]string `json:"address"`
+	Card     map[string]string `json:"card"`
+	// Password is what the reset strategy sets passwords to
+	Password string `json:"password"`
+}
+
+// DefaultRules pseudonymize names, usernames, emails and streets, replace
+// house numbers, postcodes and card numbers and reset every password to
+// "password"
+func DefaultRules() Rules {
+	return Rules{
+		Customer: map[string]string{
+			"firstName": "firstName",
+			"lastName":  "lastName",
+			"username":  "username",
+			"email":     "email",
+			"password":  "reset",
+		},
+		Address: map[string]string{
+			"street":   "street",
+			"number":   "format",
+			"city":     "keep",
+			"postcode": "format",
+			"country":  "keep",
+		},
+		Card: map[string]string{
+			"longNum": "testPan",
+			"expires": "keep",
+			"ccv":     "format",
+		},
+		Password: "password",
+	}
+}
+
+// LoadRules reads rules from a JSON file. The fields it leaves out keep their
+// default rule.
+func LoadRules(path string) (Rules, error) {
+	rules := DefaultRules()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return rules, err
+	}
+	var file Rules
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return rules, fmt.Errorf("%v: %v", path, err)
+	}
+	for _, part := range []struct{ from, to map[string]string }{
+		{file.Customer, rules.Customer},
+		{file.Address, rules.Address},
+		{file.Card, rules.Card},
+	} {
+		for field, strategy := range part.from {
+			part.to[field] = strategy
+		}
+	}
+	if file.Password != "" {
+		rules.Password = file.Password
+	}
+	return rules, nil
+}
+
+// strategies replace a non empty value. The field scopes the pseudonym, so
+// that a value anonymizes differently in different fields.
+var strategies = map[string]func(a *Anonymizer, field, value string) string{
+	"keep":   func(_ *Anonymizer, _, value string) string { return value },
+	"redact": func(_ *Anonymizer, _, _ string) string { return "" },
+	"hash": func(a *Anonymizer, field, value string) string {
+		return hex.EncodeToString(a.digest(field, value)[:16])
+	},
+	"format":    (*Anonymizer).format,
+	"firstName": pick(firstNames),
+	"lastName":  pick(lastNames),
+	"street":    pick(streets),
+	"city":      pick(cities),
+	"username": func(a *Anonymizer, field, value string) string {
+		return "user" + hex.EncodeToString(a.digest(field, users.Canonical(value))[:6])
+	},
+	"email": func(a *Anonymizer, field, value string) string {
+		return hex.EncodeToString(a.digest(field, users.Canonical(value))[:6]) + "@example.com"
+	},
+	"testPan": func(a *Anonymizer, field, value string) string { return testPAN(a.digest(field, value), value) },
+}
+
+// the fields rules can be given for, with the strategies each one allows
+// beyond the common ones
+var (
+	anonymizedFields = map[string]map[string]bool{
+		"customer": {"firstName": true, "lastName": true, "username": true, "email": true, "password": true},
+		"address":  {"street": true, "number": true, "city": true, "postcode": true, "country": true},
+		"card":     {"longNum": true, "expires": true, "ccv": true},
+	}
+	// Card numbers are never kept, so that an anonymized export holds none
+	restricted = map[string][]string{
+		"card.longNum":      {"testPan", "redact"},
+		"customer.password": {"keep", "reset", "redact"},
+	}
+)
+
+// Anonymizer pseudonymizes customers following rules, keyed by a secret
+type Anonymizer struct {
+	rules  Rules
+	secret []byte
+}
+
+// NewAnonymizer checks the rules and returns their anonymizer
+func NewAnonymizer(rules Rules, secret string) (*Anonymizer, error) {
+	if secret == "" {
+		return nil, ErrNoSecret
+	}
+	for part, fields := range map[string]map[string]string{"customer": rules.Customer, "address": rules.Address, "card": rules.Card} {
+		for field, strategy := range fields {
+			name := part + "." + field
+			if !anonymizedFields[part][field] {
+				return nil, fmt.Errorf("no rule can be given for %v", name)
+			}
+			allowed, ok := restricted[name]
+			if !ok {
+				if _, ok := strategies[strategy]; ok && strategy != "testPan" {
+					continue
+				}
+				return nil, fmt.Errorf("unknown strategy %q for %v", strategy, name)
+			}
+			found := false
+			for _, a := range allowed {
+				found = found || a == strategy
+			}
+			if !found {
+				return nil, fmt.Errorf("%v must be anonymized with one of %v", name, strings.Join(allowed, ", "))
+			}
+		}
+	}
+	if _, ok := rules.Card["longNum"]; !ok {
+		return nil, errors.New("card.longNum needs a rule")
+	}
+	return &Anonymizer{rules: rules, secret: []byte(secret)}, nil
+}
+
+// User returns an anonymized copy of a customer and its addresses and cards.
+// Ids, times and the links between them are kept.
+func (a *Anonymizer) User(u users.User) users.User {
+	v := u
+	v.FirstName = a.apply(a.rules.Customer, "firstName", u.FirstName)
+	v.LastName = a.apply(a.rules.Customer, "lastName", u.LastName)
+	v.Username = a.apply(a.rules.Customer, "username", u.Username)
+	v.Email = a.apply(a.rules.Customer, "email", u.Email)
+	switch a.rules.Customer["password"] {
+	case "reset":
+		v.Password = users.PasswordHash(a.rules.Password, u.Salt)
+	case "redact":
+		v.Password = ""
+	}
+	// Attributes are personal data no rule describes
+	v.Attributes = nil
+	// Previous usernames are anonymized like the username, which they
+	// then still chain up to
+	v.UsernameChanges = make([]users.UsernameChange, 0, len(u.UsernameChanges))
+	for _, c := range u.UsernameChanges {
+		c.From = a.apply(a.rules.Customer, "username", c.From)
+		c.To = a.apply(a.rules.Customer, "username", c.To)
+		v.UsernameChanges = append(v.UsernameChanges, c)
+	}
+	v.Addresses = make([]users.Address, 0, len(u.Addresses))
+	for _, address := range u.Addresses {
+		address.Street = a.apply(a.rules.Address, "street", address.Street)
+		address.Number = a.apply(a.rules.Address, "number", address.Number)
+		address.City = a.apply(a.rules.Address, "city", address.City)
+		address.PostCode = a.apply(a.rules.Address, "postcode", address.PostCode)
+		address.Country = a.apply(a.rules.Address, "country", address.Country)
+		v.Addresses = append(v.Addresses, address)
+	}
+	v.Cards = make([]users.Card, 0, len(u.Cards))
+	for _, card := range u.Cards {
+		card.LongNum = a.apply(a.rules.Card, "longNum", card.LongNum)
+		card.Expires = a.apply(a.rules.Card, "expires", card.Expires)
+		card.CCV = a.apply(a.rules.Card, "ccv", card.CCV)
+		v.Cards = append(v.Cards, card)
+	}
+	return v
+}
+
+// apply anonymizes a value with the rule of its field, keeping fields
+// without a rule and empty values as they are
+func (a *Anonymizer) apply(rules map[string]string, field, value string) string {
+	strategy, ok := rules[field]
+	if !ok || value == "" {
+		return value
+	}
+	return strategies[strategy](a, field, value)
+}
+
+// digest is the keyed hash pseudonyms are derived from
+func (a *Anonymizer) digest(field, value string) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(field))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+// format replaces every digit by a digit and every letter by a letter of the
+// same case, leaving the rest of the value as it is
+func (a *Anonymizer) format(field, value string) string {
+	d := a.digest(field, value)
+	out := []rune(value)
+	for i, r := range out {
+		b := d[i%len(d)]
+		switch {
+		case unicode.IsDigit(r):
+			out[i] = rune('0' + b%10)
+		case unicode.IsUpper(r):
+			out[i] = rune('A' + b%26)
+		case unicode.IsLetter(r):
+			out[i] = rune('a' + b%26)
+		}
+	}
+	return string(out)
+}
+
+func pick(words []string) func(a *Anonymizer, field, value string) string {
+	return func(a *Anonymizer, field, value string) string {
+		return words[binary.BigEndian.Uint32(a.digest(field, value))%uint32(len(words))]
+	}
+}
+
+// testPAN returns a Luhn valid card number of the length and brand of number,
+// its remaining digits taken from d
+func testPAN(d []byte, number string) string {
+	digits := strings.Map(func(r rune) rune {
+		if r < '0' || r > '9' {
+			return -1
+		}
+		return r
+	}, number)
+	length := len(digits)
+	if length < 12 {
+		length = 16
+	}
+	pan := []byte(brandPrefix(digits))
+	for i := 0; len(pan) < length-1; i++ {
+		pan = append(pan, '0'+d[i%len(d)]%10)
+	}
+	return string(append(pan, luhnDigit(pan)))
+}
+
+// brandPrefix returns the leading digits identifying the brand of a card
+// number
+func brandPrefix(n string) string {
+	between := func(lo, hi string) bool {
+		return len(n) >= len(lo) && n[:len(lo)] >= lo && n[:len(lo)] <= hi
+	}
+	switch {
+	case between("34", "34"), between("37", "37"): // American Express
+		return n[:2]
+	case between("4", "4"): // Visa
+		return "4"
+	case between("51", "55"): // Mastercard
+		return n[:2]
+	case between("2221", "2720"): // Mastercard 2-series
+		return n[:4]
+	case between("6011", "6011"): // Discover
+		return n[:4]
+	case between("644", "649"):
+		return n[:3]
+	case between("65", "65"):
+		return n[:2]
+	case between("3528", "3589"): // JCB
+		return n[:4]
+	case len(n) > 0:
+		return n[:1]
+	}
+	return "4"
+}
+
+// luhnDigit returns the check digit making payload Luhn valid
+func luhnDigit(payload []byte) byte {
+	sum := 0
+	double := true
+	for i := len(payload) - 1; i >= 0; i-- {
+		d := int(payload[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+var (
+	firstNames = []string{"Alex", "Bea", "Cam", "Dana", "Eli", "Fay", "Gus", "Hana", "Ivo", "Jo", "Kai", "Lea", "Max", "Nia", "Oli", "Pia", "Quin", "Rae", "Sol", "Tess", "Uma", "Vic", "Wren", "Yara", "Zed"}
+	lastNames  = []string{"Abbott", "Barlow", "Carver", "Dalton", "Ellis", "Fraser", "Garner", "Hale", "Irwin", "Jarvis", "Keller", "Lowe", "Mercer", "Nolan", "Osborne", "Parks", "Quinn", "Reyes", "Sutton", "Tate", "Vance", "Walsh", "Young"}
+	streets    = []string{"Acacia Avenue", "Birch Lane", "Cedar Road", "Dale Street", "Elm Grove", "Fern Close", "Glen Drive", "Hill Street", "Ivy Way", "Juniper Court", "Kings Road", "Lime Walk", "Mill Lane", "North Street", "Oak Terrace", "Park Road", "Queens Drive", "River View", "Station Road", "Tower Hill"}
+	cities     = []string{"Ashford", "Brampton", "Castleton", "Dunmore", "Eastfield", "Fairview", "Greenville", "Harbour Town", "Kingsbridge", "Lakeside", "Millbrook", "Newport", "Oakham", "Riverside", "Springfield", "Westwood"}
+)
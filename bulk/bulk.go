@@ -0,0 +1,200 @@
+// Package bulk moves customers, with their addresses and cards, in and out of
+// the service as newline delimited JSON, one customer per line. Exports
+// either mask card numbers or seal them with a key, so that only holders of
+// the key can import them into another environment.
+package bulk
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/microservices-demo/user/users"
+)
+
+var (
+	ErrInvalidCards = errors.New("Cards must be exported masked or encrypted")
+	ErrMaskedCard   = errors.New("Masked card numbers can not be imported")
+)
+
+// Cards says how an export writes card numbers
+type Cards string
+
+const (
+	// Masked cards keep the last four digits of their number and no CCV
+	Masked Cards = "masked"
+	// Encrypted cards carry their number and CCV sealed with the card key
+	Encrypted Cards = "encrypted"
+	// anonymized cards carry the test number and CCV made up by an
+	// anonymizer in clear
+	anonymized Cards = "anonymized"
+)
+
+// ParseCards returns the card mode named s, masked when s is empty
+func ParseCards(s string) (Cards, error) {
+	switch Cards(s) {
+	case "", Masked:
+		return Masked, nil
+	case Encrypted:
+		return Encrypted, nil
+	}
+	return "", ErrInvalidCards
+}
+
+// Record is one line of an export. Unlike the API it carries the email,
+// password hash and salt, so that customers can still log in once imported.
+type Record struct {
+	ID            string          `json:"id"`
+	FirstName     string          `json:"firstName"`
+	LastName      string          `json:"lastName"`
+	Username      string          `json:"username"`
+	Email         string          `json:"email"`
+	EmailVerified bool            `json:"emailVerified,omitempty"`
+	Password      string          `json:"password"`
+	Salt          string          `json:"salt"`
+	CreatedAt     time.Time       `json:"createdAt"`
+	UpdatedAt     time.Time       `json:"updatedAt"`
+	Addresses     []users.Address `json:"addresses"`
+	Cards         []Card          `json:"cards"`
+	Defaults      users.Defaults  `json:"defaults"`
+	Status        string          `json:"status,omitempty"`
+	// UsernameChanges keep the previous usernames reserved once imported
+	UsernameChanges []users.UsernameChange `json:"usernameChanges,omitempty"`
+	// Attributes are imported as they are, to be migrated when they were
+	// checked against another version of the attributes schema
+	Attributes        map[string]interface{} `json:"attributes,omitempty"`
+	AttributesVersion int64                  `json:"attributesVersion,omitempty"`
+}
+
+// Card is a card of a record. LongNum holds the masked number of masked
+// cards and the test number of anonymized ones, Sealed the number and CCV of
+// encrypted ones.
+type Card struct {
+	ID        string    `json:"id"`
+	LongNum   string    `json:"longNum,omitempty"`
+	CCV       string    `json:"ccv,omitempty"`
+	Sealed    string    `json:"sealed,omitempty"`
+	Expires   string    `json:"expires"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// BillingAddress is the id of the address the card bills to, if known
+	BillingAddress string `json:"billingAddress,omitempty"`
+}
+
+// NewRecord returns the record of a customer and its loaded addresses and
+// cards, writing card numbers as asked
+func NewRecord(u users.User, cards Cards, key *Key) (Record, error) {
+	r := Record{
+		ID:                u.UserID,
+		FirstName:         u.FirstName,
+		LastName:          u.LastName,
+		Username:          u.Username,
+		Email:             u.Email,
+		EmailVerified:     u.EmailVerified,
+		Password:          u.Password,
+		Salt:              u.Salt,
+		CreatedAt:         u.CreatedAt,
+		UpdatedAt:         u.UpdatedAt,
+		Addresses:         make([]users.Address, 0, len(u.Addresses)),
+		Cards:             make([]Card, 0, len(u.Cards)),
+		Defaults:          u.Defaults,
+		Status:            u.Status,
+		UsernameChanges:   u.UsernameChanges,
+		Attributes:        u.Attributes,
+		AttributesVersion: u.AttributesVersion,
+	}
+	for _, a := range u.Addresses {
+		a.Links = nil
+		r.Addresses = append(r.Addresses, a)
+	}
+	for _, c := range u.Cards {
+		card := Card{ID: c.ID, Expires: c.Expires, CreatedAt: c.CreatedAt, UpdatedAt: c.UpdatedAt, BillingAddress: c.BillingAddress}
+		switch cards {
+		case Encrypted:
+			if key == nil {
+				return r, ErrNoKey
+			}
+			sealed, err := key.seal(c)
+			if err != nil {
+				return r, err
+			}
+			card.Sealed = sealed
+		case anonymized:
+			card.LongNum, card.CCV = c.LongNum, c.CCV
+		default:
+			card.LongNum = mask(c.LongNum)
+		}
+		r.Cards = append(r.Cards, card)
+	}
+	return r, nil
+}
+
+// mask hides all but the last four digits of a card number
+func mask(number string) string {
+	if len(number) <= 4 {
+		return strings.Repeat("*", len(number))
+	}
+	c := users.Card{LongNum: number}
+	c.MaskCC()
+	return c.LongNum
+}
+
+// User returns the customer of a record, opening its cards with key, and
+// checks that it can be imported
+func (r Record) User(key *Key) (users.User, error) {
+	u := users.User{
+		UserID:            r.ID,
+		FirstName:         r.FirstName,
+		LastName:          r.LastName,
+		Username:          r.Username,
+		Email:             r.Email,
+		EmailVerified:     r.EmailVerified,
+		Password:          r.Password,
+		Salt:              r.Salt,
+		CreatedAt:         r.CreatedAt,
+		UpdatedAt:         r.UpdatedAt,
+		Addresses:         make([]users.Address, 0, len(r.Addresses)),
+		Cards:             make([]users.Card, 0, len(r.Cards)),
+		Defaults:          r.Defaults,
+		Status:            r.Status,
+		UsernameChanges:   r.UsernameChanges,
+		Attributes:        r.Attributes,
+		AttributesVersion: r.AttributesVersion,
+	}
+	if err := u.Validate(); err != nil {
+		return u, err
+	}
+	if u.Salt == "" {
+		return u, fmt.Errorf(users.ErrMissingField, "Salt")
+	}
+	if !users.ValidStatus(u.Status) {
+		return u, fmt.Errorf(users.ErrInvalidField, "Status")
+	}
+	for i, a := range r.Addresses {
+		if err := a.Validate(); err != nil {
+			return u, fmt.Errorf("address %d: %v", i+1, err)
+		}
+		a.Links = nil
+		u.Addresses = append(u.Addresses, a)
+	}
+	for i, c := range r.Cards {
+		card := users.Card{ID: c.ID, LongNum: c.LongNum, CCV: c.CCV, Expires: c.Expires, CreatedAt: c.CreatedAt, UpdatedAt: c.UpdatedAt, BillingAddress: c.BillingAddress}
+		if c.Sealed != "" {
+			if key == nil {
+				return u, fmt.Errorf("card %d: %v", i+1, ErrNoKey)
+			}
+			var err error
+			if card.LongNum, card.CCV, err = key.open(c.Sealed); err != nil {
+				return u, fmt.Errorf("card %d: %v", i+1, err)
+			}
+		} else if strings.Contains(card.LongNum, "*") {
+			return u, fmt.Errorf("card %d: %v", i+1, ErrMaskedCard)
+		}
+		if err := card.Validate(); err != nil {
+			return u, fmt.Errorf("card %d: %v", i+1, err)
+		}
+		u.Cards = append(u.Cards, card)
+	}
+	return u, nil
+}
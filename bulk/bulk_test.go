@@ -0,0 +1,243 @@
+package bulk
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/users"
+)
+
+var testKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+
+func customer(id string) users.User {
+	return users.User{
+		UserID: id, FirstName: "Eve", LastName: "Berger", Username: "eve" + id, Email: "eve" + id + "@example.com",
+		Password: "hash", Salt: "salt",
+		Addresses: []users.Address{{ID: "a" + id, Street: "Whitelees Road", City: "Glasgow", Country: "United Kingdom"}},
+		Cards:     []users.Card{{ID: "c" + id, LongNum: "4111111111111111", Expires: "08/30", CCV: "958"}},
+	}
+}
+
+func TestKey(t *testing.T) {
+	if _, err := NewKey("c2hvcnQ="); err != ErrInvalidKey {
+		t.Errorf("expected a short key to be invalid, received %v", err)
+	}
+	key, err := NewKey(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, _ := key.seal(users.Card{LongNum: "4111111111111111", CCV: "958"})
+	if strings.Contains(sealed, "4111") {
+		t.Error("expected the card number to be sealed")
+	}
+	number, ccv, err := key.open(sealed)
+	if err != nil || number != "4111111111111111" || ccv != "958" {
+		t.Errorf("expected the card to be opened, received %v %v %v", number, ccv, err)
+	}
+	other, _ := NewKey(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{8}, 32)))
+	if _, _, err := other.open(sealed); err != ErrInvalidSealed {
+		t.Errorf("expected another key not to open the card, received %v", err)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	key, _ := NewKey(testKey)
+	u := customer("1")
+	u.Addresses[0].AddLinks()
+
+	masked, err := NewRecord(u, Masked, nil)
+	if err != nil || masked.Cards[0].LongNum != "************1111" || masked.Cards[0].Sealed != "" {
+		t.Errorf("expected a masked card, received %+v %v", masked.Cards, err)
+	}
+	if masked.Addresses[0].Links != nil {
+		t.Error("expected links to be left out")
+	}
+	if _, err := masked.User(key); err == nil || !strings.Contains(err.Error(), ErrMaskedCard.Error()) {
+		t.Errorf("expected a masked card not to be imported, received %v", err)
+	}
+
+	if _, err := NewRecord(u, Encrypted, nil); err != ErrNoKey {
+		t.Errorf("expected encrypting without a key to fail, received %v", err)
+	}
+	encrypted, _ := NewRecord(u, Encrypted, key)
+	if _, err := encrypted.User(nil); err == nil || !strings.Contains(err.Error(), ErrNoKey.Error()) {
+		t.Errorf("expected an encrypted card not to be imported without the key, received %v", err)
+	}
+	imported, err := encrypted.User(key)
+	if err != nil || imported.Cards[0].LongNum != u.Cards[0].LongNum || imported.Cards[0].CCV != "958" || imported.Salt != "salt" {
+		t.Errorf("expected the customer back, received %+v %v", imported, err)
+	}
+}
+
+func TestExport(t *testing.T) {
+	pages := map[string][]users.User{"": {customer("1"), customer("2")}, "next": {customer("3")}}
+	list := func(o db.ListOptions) ([]users.User, db.PageInfo, error) {
+		if !o.Embeds(db.EmbedAddresses) || !o.Embeds(db.EmbedCards) {
+			t.Error("expected the attributes to be embedded")
+		}
+		if o.Cursor == "" {
+			return pages[""], db.PageInfo{Next: "next"}, nil
+		}
+		return pages[o.Cursor], db.PageInfo{}, nil
+	}
+	var buf bytes.Buffer
+	n, err := Export(&buf, list, ExportOptions{})
+	if err != nil || n != 3 || strings.Count(buf.String(), "\n") != 3 {
+		t.Errorf("expected 3 lines, received %v %v %q", n, err, buf.String())
+	}
+	if strings.Contains(buf.String(), "4111111111111111") || strings.Contains(buf.String(), "958") {
+		t.Error("expected card numbers to be masked")
+	}
+}
+
+func TestImport(t *testing.T) {
+	key, _ := NewKey(testKey)
+	var buf bytes.Buffer
+	Export(&buf, func(db.ListOptions) ([]users.User, db.PageInfo, error) {
+		return []users.User{customer("1"), customer("2"), customer("3")}, db.PageInfo{}, nil
+	}, ExportOptions{Cards: Encrypted, Key: key})
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	input := strings.Join([]string{
+		lines[0],
+		"",
+		`{"id": "4", "unknown": true}`,
+		`{"id": "5", "firstName": "Eve"}`,
+		lines[1],
+		lines[2],
+	}, "\n")
+
+	var batches [][]users.User
+	upsert := func(us []users.User) ([]error, error) {
+		batches = append(batches, us)
+		errs := make([]error, len(us))
+		for i, u := range us {
+			if u.UserID == "3" {
+				errs[i] = db.DuplicateError{Field: "username"}
+			}
+		}
+		return errs, nil
+	}
+	report, err := Import(strings.NewReader(input), upsert, Options{Batch: 2, Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Records != 5 || report.Imported != 2 || report.Failed != 3 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if len(batches) != 2 || len(batches[0]) != 2 || batches[0][0].Cards[0].CCV != "958" {
+		t.Errorf("expected two batches, received %v", batches)
+	}
+	for i, line := range []int{3, 4, 6} {
+		if report.Errors[i].Line != line {
+			t.Errorf("expected line %v to fail, received %+v", line, report.Errors[i])
+		}
+	}
+	if report.Errors[1].ID != "5" || report.Errors[2].Error != "username is already taken" {
+		t.Errorf("unexpected errors %+v", report.Errors)
+	}
+
+	batches = nil
+	report, _ = Import(strings.NewReader(input), upsert, Options{DryRun: true, Key: key})
+	if len(batches) != 0 || report.Imported != 3 || !report.DryRun {
+		t.Errorf("expected a dry run not to write, received %+v", report)
+	}
+
+	failure := errors.New("unreachable")
+	_, err = Import(strings.NewReader(lines[0]), func([]users.User) ([]error, error) { return nil, failure }, Options{Key: key})
+	if err != failure {
+		t.Errorf("expected a failed batch to stop the import, received %v", err)
+	}
+}
+
+func luhnValid(number string) bool {
+	return len(number) > 1 && luhnDigit([]byte(number[:len(number)-1])) == number[len(number)-1]
+}
+
+func TestTestPAN(t *testing.T) {
+	for number, prefix := range map[string]string{
+		"4111111111111111": "4",
+		"378282246310005":  "37",
+		"5555555555554444": "55",
+		"2223003122003222": "2223",
+		"6011111111111117": "6011",
+		"3530111333300000": "3530",
+		"1234":             "1",
+	} {
+		pan := testPAN(bytes.Repeat([]byte{3, 9, 12}, 11), number)
+		if !strings.HasPrefix(pan, prefix) || !luhnValid(pan) {
+			t.Errorf("expected a Luhn valid number starting with %v for %v, received %v", prefix, number, pan)
+		}
+		if len(number) >= 12 && len(pan) != len(number) {
+			t.Errorf("expected %v to keep the length of %v", pan, number)
+		}
+	}
+}
+
+func TestAnonymizer(t *testing.T) {
+	a, err := NewAnonymizer(DefaultRules(), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := customer("1")
+	v := a.User(u)
+	if v.UserID != u.UserID || v.Addresses[0].ID != "a1" || v.Cards[0].ID != "c1" {
+		t.Errorf("expected ids to be kept, received %+v", v)
+	}
+	if v.FirstName == u.FirstName || v.Username == u.Username || strings.Contains(v.Email, "eve") || v.Addresses[0].Street == u.Addresses[0].Street {
+		t.Errorf("expected personal data to be replaced, received %+v", v)
+	}
+	if v.Addresses[0].City != u.Addresses[0].City || u.Addresses[0].Street != "Whitelees Road" {
+		t.Errorf("expected kept fields to be kept and the original left alone, received %+v", v.Addresses)
+	}
+	if !strings.HasPrefix(v.Cards[0].LongNum, "4") || !luhnValid(v.Cards[0].LongNum) || v.Cards[0].LongNum == u.Cards[0].LongNum {
+		t.Errorf("expected a test Visa number, received %v", v.Cards[0].LongNum)
+	}
+	if v.Password != users.PasswordHash("password", u.Salt) {
+		t.Error("expected the password to be reset")
+	}
+
+	other := customer("2")
+	other.Username = " EVE1 "
+	if w := a.User(other); w.Username != v.Username || w.Cards[0].LongNum != v.Cards[0].LongNum {
+		t.Error("expected equal values to be anonymized alike")
+	}
+	if b, _ := NewAnonymizer(DefaultRules(), "another"); b.User(u).Username == v.Username {
+		t.Error("expected another secret to give other pseudonyms")
+	}
+
+	r, _ := NewRecord(v, anonymized, nil)
+	if imported, err := r.User(nil); err != nil || imported.Cards[0].LongNum != v.Cards[0].LongNum {
+		t.Errorf("expected an anonymized record to be importable, received %v", err)
+	}
+}
+
+func TestRules(t *testing.T) {
+	for _, change := range []func(*Rules){
+		func(r *Rules) { r.Card["longNum"] = "keep" },
+		func(r *Rules) { r.Customer["password"] = "hash" },
+		func(r *Rules) { r.Address["street"] = "testPan" },
+		func(r *Rules) { r.Address["phone"] = "keep" },
+		func(r *Rules) { r.Customer["email"] = "scramble" },
+	} {
+		rules := DefaultRules()
+		change(&rules)
+		if _, err := NewAnonymizer(rules, "secret"); err == nil {
+			t.Errorf("expected rules %+v to be rejected", rules)
+		}
+	}
+	if _, err := NewAnonymizer(DefaultRules(), ""); err != ErrNoSecret {
+		t.Errorf("expected a secret to be required, received %v", err)
+	}
+
+	path := t.TempDir() + "/rules.json"
+	os.WriteFile(path, []byte(`{"address": {"city": "city"}, "password": "staging"}`), 0600)
+	rules, err := LoadRules(path)
+	if err != nil || rules.Address["city"] != "city" || rules.Address["street"] != "street" || rules.Password != "staging" {
+		t.Errorf("expected the file to override the default rules, received %+v %v", rules, err)
+	}
+}
@@ -0,0 +1,62 @@
+package bulk
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/users"
+)
+
+// Lister returns a page of customers, as db.GetUsers does
+type Lister func(db.ListOptions) ([]users.User, db.PageInfo, error)
+
+// ExportOptions say how customers are exported
+type ExportOptions struct {
+	// Cards is how card numbers are written, masked by default
+	Cards Cards
+	// Key seals encrypted cards
+	Key *Key
+	// Anonymizer, when set, anonymizes every customer. Cards are then
+	// written with the test numbers it made up, whatever Cards says.
+	Anonymizer *Anonymizer
+}
+
+// Export writes a record for every customer to w, reading them a page at a
+// time with their addresses and cards embedded. It returns the number of
+// records written.
+func Export(w io.Writer, list Lister, o ExportOptions) (int, error) {
+	cards := o.Cards
+	if o.Anonymizer != nil {
+		cards = anonymized
+	} else if cards == Encrypted && o.Key == nil {
+		return 0, ErrNoKey
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	lo := db.ListOptions{Limit: db.MaxPageSize, Embed: []string{db.EmbedAddresses, db.EmbedCards}}
+	n := 0
+	for {
+		us, page, err := list(lo)
+		if err != nil {
+			return n, err
+		}
+		for _, u := range us {
+			if o.Anonymizer != nil {
+				u = o.Anonymizer.User(u)
+			}
+			r, err := NewRecord(u, cards, o.Key)
+			if err != nil {
+				return n, err
+			}
+			if err := enc.Encode(r); err != nil {
+				return n, err
+			}
+			n++
+		}
+		if page.Next == "" {
+			return n, nil
+		}
+		lo.Cursor = page.Next
+	}
+}
@@ -0,0 +1,122 @@
+package bulk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/microservices-demo/user/users"
+)
+
+// MaxErrors is the number of line errors an import reports; later failures
+// are only counted
+var MaxErrors = 1000
+
+// Upsert creates or replaces a batch of customers, as db.UpsertUsers does
+type Upsert func([]users.User) ([]error, error)
+
+// Options tune an import
+type Options struct {
+	// Batch is the number of customers upserted at once, 100 by default
+	Batch int
+	// DryRun checks every record without writing any
+	DryRun bool
+	// Key opens encrypted cards
+	Key *Key
+}
+
+// Report is the outcome of an import. In a dry run Imported counts the
+// records that passed the checks.
+type Report struct {
+	DryRun   bool        `json:"dryRun"`
+	Records  int         `json:"records"`
+	Imported int         `json:"imported"`
+	Failed   int         `json:"failed"`
+	Errors   []LineError `json:"errors"`
+}
+
+// LineError is the reason why the record on a line was not imported
+type LineError struct {
+	Line  int    `json:"line"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error"`
+}
+
+func (r *Report) fail(line int, id string, err error) {
+	r.Failed++
+	if len(r.Errors) < MaxErrors {
+		r.Errors = append(r.Errors, LineError{Line: line, ID: id, Error: err.Error()})
+	}
+}
+
+// Import reads records from r, one per line, and upserts the ones that pass
+// validation in batches. A record that fails is reported with its line and
+// does not stop the import; only reading r or a batch failing as a whole
+// does.
+func Import(r io.Reader, upsert Upsert, o Options) (Report, error) {
+	report := Report{DryRun: o.DryRun, Errors: make([]LineError, 0)}
+	size := o.Batch
+	if size <= 0 {
+		size = 100
+	}
+	var batch []users.User
+	var lines []int
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if o.DryRun {
+			report.Imported += len(batch)
+		} else {
+			errs, err := upsert(batch)
+			if err != nil {
+				return err
+			}
+			for i, err := range errs {
+				if err != nil {
+					report.fail(lines[i], batch[i].UserID, err)
+				} else {
+					report.Imported++
+				}
+			}
+		}
+		batch, lines = make([]users.User, 0, size), make([]int, 0, size)
+		return nil
+	}
+
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, readErr := br.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return report, readErr
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			report.Records++
+			if u, err := decode(line, o.Key); err != nil {
+				report.fail(n, u.UserID, err)
+			} else {
+				batch, lines = append(batch, u), append(lines, n)
+			}
+			if len(batch) >= size {
+				if err := flush(); err != nil {
+					return report, err
+				}
+			}
+		}
+		if readErr == io.EOF {
+			return report, flush()
+		}
+	}
+}
+
+// decode parses and checks the record on one line
+func decode(line []byte, key *Key) (users.User, error) {
+	var r Record
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&r); err != nil {
+		return users.User{}, err
+	}
+	return r.User(key)
+}
@@ -0,0 +1,93 @@
+package bulk
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+
+	"github.com/microservices-demo/user/users"
+)
+
+var (
+	ErrNoKey         = errors.New("No card key configured")
+	ErrInvalidKey    = errors.New("Card key must be 32 bytes, base64 encoded")
+	ErrInvalidSealed = errors.New("Sealed card can not be opened with the card key")
+)
+
+var cardKey string
+
+func init() {
+	flag.StringVar(&cardKey, "card-key", os.Getenv("CARD_KEY"), "Base64 encoded 32 byte key sealing card numbers in encrypted exports")
+}
+
+// CardKey returns the key given by -card-key, or ErrNoKey without one
+func CardKey() (*Key, error) {
+	if cardKey == "" {
+		return nil, ErrNoKey
+	}
+	return NewKey(cardKey)
+}
+
+// Key seals card numbers with AES-256-GCM
+type Key struct {
+	aead cipher.AEAD
+}
+
+// NewKey returns the key of a base64 encoded 32 byte secret
+func NewKey(encoded string) (*Key, error) {
+	secret, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(secret) != 32 {
+		return nil, ErrInvalidKey
+	}
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{aead: aead}, nil
+}
+
+// sealedCard is what is sealed of a card
+type sealedCard struct {
+	LongNum string `json:"longNum"`
+	CCV     string `json:"ccv"`
+}
+
+// seal returns the base64 encoded nonce and ciphertext of the number and CCV
+// of a card
+func (k *Key) seal(c users.Card) (string, error) {
+	plain, err := json.Marshal(sealedCard{LongNum: c.LongNum, CCV: c.CCV})
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(k.aead.Seal(nonce, nonce, plain, nil)), nil
+}
+
+// open returns the number and CCV sealed by seal
+func (k *Key) open(sealed string) (string, string, error) {
+	b, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(b) < k.aead.NonceSize() {
+		return "", "", ErrInvalidSealed
+	}
+	plain, err := k.aead.Open(nil, b[:k.aead.NonceSize()], b[k.aead.NonceSize():], nil)
+	if err != nil {
+		return "", "", ErrInvalidSealed
+	}
+	var c sealedCard
+	if err := json.Unmarshal(plain, &c); err != nil {
+		return "", "", ErrInvalidSealed
+	}
+	return c.LongNum, c.CCV, nil
+}
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/microservices-demo/user/attributes"
+	"github.com/microservices-demo/user/users"
+)
+
+// ErrAttributesUnsupported is returned when the selected database can not migrate attributes
+var ErrAttributesUnsupported = errors.New("Database does not support attribute migrations")
+
+// AttributeStore is implemented by databases that can migrate the profile
+// attributes of customers to a new version of the attributes schema
+type AttributeStore interface {
+	// StaleAttributes returns up to limit live customers, in the order of
+	// their ids and following the customer with id after, holding
+	// attributes last checked against another schema version
+	StaleAttributes(version int64, after string, limit int) ([]users.User, error)
+	// MigrateAttributes replaces the attributes of a customer, provided it
+	// did not change since it was read, and records them as checked against
+	// version. It returns ErrVersionConflict when the customer changed.
+	MigrateAttributes(u users.User, attrs map[string]interface{}, version int64) error
+}
+
+// AttributesReport tells what a migration of attributes did. Dropped counts
+// the attributes left out by name, Incomplete lists customers still missing
+// a required attribute.
+type AttributesReport struct {
+	Version    int64          `json:"version"`
+	Customers  int            `json:"customers"`
+	Migrated   int            `json:"migrated"`
+	Skipped    int            `json:"skipped"`
+	Dropped    map[string]int `json:"dropped"`
+	Incomplete []string       `json:"incomplete"`
+}
+
+// MigrateAttributes migrates the attributes of the customers of DefaultDb to
+// the given schema, batch customers at a time. Attributes the schema no longer
+// allows are dropped; customers changed meanwhile are skipped, as they were
+// checked against the schema when they changed.
+func MigrateAttributes(s *attributes.Schema, batch int) (AttributesReport, error) {
+	report := AttributesReport{Version: s.Version, Dropped: map[string]int{}, Incomplete: make([]string, 0)}
+	store, ok := Unwrap(DefaultDb).(AttributeStore)
+	if !ok {
+		return report, ErrAttributesUnsupported
+	}
+	if batch <= 0 {
+		batch = 100
+	}
+	after := ""
+	for {
+		us, err := store.StaleAttributes(s.Version, after, batch)
+		if err != nil {
+			return report, err
+		}
+		if len(us) == 0 {
+			return report, nil
+		}
+		for _, u := range us {
+			after = u.UserID
+			report.Customers++
+			kept, dropped := s.Migrate(u.Attributes)
+			err := store.MigrateAttributes(u, kept, s.Version)
+			if err == ErrVersionConflict || err == ErrNotFound {
+				report.Skipped++
+				continue
+			}
+			if err != nil {
+				return report, err
+			}
+			Invalidate("customers", u.UserID)
+			report.Migrated++
+			for _, name := range dropped {
+				report.Dropped[name]++
+			}
+			if s.Validate(kept) != nil && len(report.Incomplete) < MaxIssues {
+				report.Incomplete = append(report.Incomplete, u.UserID)
+			}
+		}
+	}
+}
@@ -0,0 +1,556 @@
+// Package cache decorates a database with a read-through cache of customers
+// and their addresses and cards, the reads behind login and GET
+// /customers/{id}. Writes through the cache invalidate what they change;
+// writes by other replicas reach it through Invalidate, fed by Follow from
+// the change feed.
+package cache
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/users"
+)
+
+// attributes are the addresses and cards of a customer loaded so far, by ID.
+// Callers load some of them at a time, such as a page, and an ID mapped to
+// nil was asked for but not found.
+type attributes struct {
+	addresses map[string]*users.Address
+	cards     map[string]*users.Card
+	expires   time.Time
+}
+
+// get returns the addresses and cards with the given IDs, in order, and
+// whether all of them were loaded before
+func (a *attributes) get(addressIDs, cardIDs []string) ([]users.Address, []users.Card, bool) {
+	addresses := make([]users.Address, 0, len(addressIDs))
+	for _, id := range addressIDs {
+		address, ok := a.addresses[id]
+		if !ok {
+			return nil, nil, false
+		}
+		if address != nil {
+			addresses = append(addresses, *address)
+		}
+	}
+	cards := make([]users.Card, 0, len(cardIDs))
+	for _, id := range cardIDs {
+		card, ok := a.cards[id]
+		if !ok {
+			return nil, nil, false
+		}
+		if card != nil {
+			cards = append(cards, *card)
+		}
+	}
+	return copyAddresses(addresses), copyCards(cards), true
+}
+
+// customer is what the cache holds for one customer. The user and its
+// attributes are loaded, and expire, separately.
+type customer struct {
+	id          string
+	user        *users.User
+	userExpires time.Time
+	attributes  *attributes
+}
+
+// Cache is a db.Database caching customers by ID and username. Methods that
+// are not overridden go straight to the wrapped database.
+type Cache struct {
+	db.Database
+	// TTL bounds how long a customer is served from the cache, and so how
+	// stale it can be when an invalidation is missed
+	TTL time.Duration
+	// Lookups counts reads by kind (user or attributes) and result (hit or
+	// miss)
+	Lookups metrics.Counter
+
+	mtx       sync.Mutex
+	customers *lru
+	// names maps canonical usernames, owners address and card IDs, to the
+	// customers cached with them
+	names  map[string]string
+	owners map[string]string
+	// generation changes with every invalidation, so that a load started
+	// before one is not cached
+	generation uint64
+	loads      group
+	now        func() time.Time
+}
+
+var _ db.Database = &Cache{}
+
+// New returns a cache of up to size customers in front of next
+func New(next db.Database, size int, ttl time.Duration, lookups metrics.Counter) *Cache {
+	c := &Cache{
+		Database: next,
+		TTL:      ttl,
+		Lookups:  lookups,
+		names:    make(map[string]string),
+		owners:   make(map[string]string),
+		now:      time.Now,
+	}
+	c.customers = newLRU(size, c.unindex)
+	return c
+}
+
+// Unwrap returns the cached database
+func (c *Cache) Unwrap() db.Database {
+	return c.Database
+}
+
+// GetUser returns a customer by ID
+func (c *Cache) GetUser(id string) (users.User, error) {
+	c.mtx.Lock()
+	cust, ok := c.customers.get(id)
+	if ok && cust.user != nil && c.now().Before(cust.userExpires) {
+		u := copyUser(*cust.user)
+		c.mtx.Unlock()
+		c.Lookups.With("kind", "user", "result", "hit").Add(1)
+		return u, nil
+	}
+	c.mtx.Unlock()
+	c.Lookups.With("kind", "user", "result", "miss").Add(1)
+	return c.loadUser("id:"+id, func() (users.User, error) {
+		return c.Database.GetUser(id)
+	})
+}
+
+// GetUserByName returns a customer by username
+func (c *Cache) GetUserByName(name string) (users.User, error) {
+	key := users.Canonical(name)
+	c.mtx.Lock()
+	cust, ok := c.customers.get(c.names[key])
+	// The name stays indexed until the customer is invalidated, so it is
+	// checked against the username cached
+	if ok && cust.user != nil && c.now().Before(cust.userExpires) && users.Canonical(cust.user.Username) == key {
+		u := copyUser(*cust.user)
+		c.mtx.Unlock()
+		c.Lookups.With("kind", "user", "result", "hit").Add(1)
+		return u, nil
+	}
+	c.mtx.Unlock()
+	c.Lookups.With("kind", "user", "result", "miss").Add(1)
+	return c.loadUser("name:"+key, func() (users.User, error) {
+		return c.Database.GetUserByName(name)
+	})
+}
+
+// GetUserAttributes loads the addresses and cards of a customer that u
+// holds the IDs of
+func (c *Cache) GetUserAttributes(u *users.User) error {
+	if u.UserID == "" {
+		return c.Database.GetUserAttributes(u)
+	}
+	addressIDs := make([]string, 0, len(u.Addresses))
+	for _, a := range u.Addresses {
+		addressIDs = append(addressIDs, a.ID)
+	}
+	cardIDs := make([]string, 0, len(u.Cards))
+	for _, card := range u.Cards {
+		cardIDs = append(cardIDs, card.ID)
+	}
+
+	c.mtx.Lock()
+	cust, ok := c.customers.get(u.UserID)
+	if ok && cust.attributes != nil && c.now().Before(cust.attributes.expires) {
+		if addresses, cards, ok := cust.attributes.get(addressIDs, cardIDs); ok {
+			u.Addresses, u.Cards = addresses, cards
+			c.mtx.Unlock()
+			c.Lookups.With("kind", "attributes", "result", "hit").Add(1)
+			return nil
+		}
+	}
+	c.mtx.Unlock()
+	c.Lookups.With("kind", "attributes", "result", "miss").Add(1)
+
+	key := "attributes:" + u.UserID + ":" + strings.Join(addressIDs, ",") + ":" + strings.Join(cardIDs, ",")
+	v, err, _ := c.loads.do(key, func() (interface{}, error) {
+		generation := c.currentGeneration()
+		loaded := users.User{UserID: u.UserID, Addresses: copyAddresses(u.Addresses), Cards: copyCards(u.Cards)}
+		if err := c.Database.GetUserAttributes(&loaded); err != nil {
+			return nil, err
+		}
+		c.storeAttributes(generation, u.UserID, addressIDs, cardIDs, loaded)
+		return loaded, nil
+	})
+	if err != nil {
+		return err
+	}
+	loaded := v.(users.User)
+	u.Addresses, u.Cards = copyAddresses(loaded.Addresses), copyCards(loaded.Cards)
+	return nil
+}
+
+// loadUser loads a customer once for all concurrent callers asking with the
+// same key, caching it unless invalidated meanwhile
+func (c *Cache) loadUser(key string, load func() (users.User, error)) (users.User, error) {
+	v, err, _ := c.loads.do(key, func() (interface{}, error) {
+		generation := c.currentGeneration()
+		u, err := load()
+		if err != nil {
+			return u, err
+		}
+		c.storeUser(generation, u)
+		return u, nil
+	})
+	return copyUser(v.(users.User)), err
+}
+
+// UpdateUser updates a customer, invalidating it
+func (c *Cache) UpdateUser(u *users.User) error {
+	defer c.Invalidate("customers", u.UserID)
+	return c.Database.UpdateUser(u)
+}
+
+// UpsertUsers writes customers, invalidating them and the customers that
+// held their addresses and cards before
+func (c *Cache) UpsertUsers(us []users.User) ([]error, error) {
+	defer func() {
+		for _, u := range us {
+			c.Invalidate("customers", u.UserID)
+			for _, a := range u.Addresses {
+				c.Invalidate("addresses", a.ID)
+			}
+			for _, card := range u.Cards {
+				c.Invalidate("cards", card.ID)
+			}
+		}
+	}()
+	return c.Database.UpsertUsers(us)
+}
+
+// CreateAddress adds an address, invalidating its customer
+func (c *Cache) CreateAddress(a *users.Address, userID string) error {
+	defer c.Invalidate("customers", userID)
+	return c.Database.CreateAddress(a, userID)
+}
+
+// UpdateAddress updates an address, invalidating its customer
+func (c *Cache) UpdateAddress(a *users.Address) error {
+	defer c.Invalidate("addresses", a.ID)
+	return c.Database.UpdateAddress(a)
+}
+
+// CreateCard adds a card, invalidating its customer
+func (c *Cache) CreateCard(card *users.Card, userID string) error {
+	defer c.Invalidate("customers", userID)
+	return c.Database.CreateCard(card, userID)
+}
+
+// UpdateCard updates a card, invalidating its customer
+func (c *Cache) UpdateCard(card *users.Card) error {
+	defer c.Invalidate("cards", card.ID)
+	return c.Database.UpdateCard(card)
+}
+
+// Delete deletes an entity, invalidating its customer
+func (c *Cache) Delete(entity, id string, version int64) error {
+	defer c.Invalidate(entity, id)
+	return c.Database.Delete(entity, id, version)
+}
+
+// Restore restores an entity, invalidating its customer
+func (c *Cache) Restore(entity, id string, since time.Time) error {
+	defer c.Invalidate(entity, id)
+	return c.Database.Restore(entity, id, since)
+}
+
+// Purge removes deleted entities for good, emptying the cache when any were
+func (c *Cache) Purge(before time.Time) (int, error) {
+	n, err := c.Database.Purge(before)
+	if n > 0 {
+		c.Clear()
+	}
+	return n, err
+}
+
+// Invalidate drops the customer holding the given customer, address or card.
+// Writes through the cache call it after writing; it is the hook for writes
+// made elsewhere.
+func (c *Cache) Invalidate(entity, id string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.generation++
+	switch entity {
+	case "customers":
+		c.customers.remove(id)
+	case "addresses", "cards":
+		if owner, ok := c.owners[id]; ok {
+			c.customers.remove(owner)
+		}
+	}
+}
+
+// Clear drops every customer
+func (c *Cache) Clear() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.generation++
+	c.customers.clear()
+}
+
+// Len returns the number of customers cached
+func (c *Cache) Len() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.customers.len()
+}
+
+func (c *Cache) currentGeneration() uint64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.generation
+}
+
+func (c *Cache) storeUser(generation uint64, u users.User) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if generation != c.generation {
+		return
+	}
+	cust := c.entry(u.UserID)
+	if cust.user != nil {
+		delete(c.names, users.Canonical(cust.user.Username))
+	}
+	stored := copyUser(u)
+	cust.user, cust.userExpires = &stored, c.now().Add(c.TTL)
+	c.names[users.Canonical(u.Username)] = u.UserID
+	c.own(u.UserID, u.Addresses, u.Cards)
+	c.customers.add(cust)
+}
+
+// storeAttributes adds the addresses and cards loaded for the given IDs to
+// those cached for the customer
+func (c *Cache) storeAttributes(generation uint64, id string, addressIDs, cardIDs []string, loaded users.User) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if generation != c.generation {
+		return
+	}
+	cust := c.entry(id)
+	a := cust.attributes
+	if a == nil || !c.now().Before(a.expires) {
+		a = &attributes{
+			addresses: make(map[string]*users.Address),
+			cards:     make(map[string]*users.Card),
+			expires:   c.now().Add(c.TTL),
+		}
+		cust.attributes = a
+	}
+	for _, addressID := range addressIDs {
+		a.addresses[addressID] = nil
+		c.owners[addressID] = id
+	}
+	for _, address := range copyAddresses(loaded.Addresses) {
+		address := address
+		a.addresses[address.ID] = &address
+	}
+	for _, cardID := range cardIDs {
+		a.cards[cardID] = nil
+		c.owners[cardID] = id
+	}
+	for _, card := range copyCards(loaded.Cards) {
+		card := card
+		a.cards[card.ID] = &card
+	}
+	c.customers.add(cust)
+}
+
+// entry returns the cached customer with the given id, or a new one
+func (c *Cache) entry(id string) *customer {
+	if cust, ok := c.customers.get(id); ok {
+		return cust
+	}
+	return &customer{id: id}
+}
+
+// own indexes addresses and cards under their customer
+func (c *Cache) own(id string, addresses []users.Address, cards []users.Card) {
+	for _, a := range addresses {
+		c.owners[a.ID] = id
+	}
+	for _, card := range cards {
+		c.owners[card.ID] = id
+	}
+}
+
+// unindex forgets the names and attributes of a customer leaving the cache
+func (c *Cache) unindex(cust *customer) {
+	forget := func(addresses []users.Address, cards []users.Card) {
+		for _, a := range addresses {
+			if c.owners[a.ID] == cust.id {
+				delete(c.owners, a.ID)
+			}
+		}
+		for _, card := range cards {
+			if c.owners[card.ID] == cust.id {
+				delete(c.owners, card.ID)
+			}
+		}
+	}
+	if cust.user != nil {
+		if key := users.Canonical(cust.user.Username); c.names[key] == cust.id {
+			delete(c.names, key)
+		}
+		forget(cust.user.Addresses, cust.user.Cards)
+	}
+	if cust.attributes != nil {
+		for addressID := range cust.attributes.addresses {
+			if c.owners[addressID] == cust.id {
+				delete(c.owners, addressID)
+			}
+		}
+		for cardID := range cust.attributes.cards {
+			if c.owners[cardID] == cust.id {
+				delete(c.owners, cardID)
+			}
+		}
+	}
+}
+
+// Feed reads the change feed from a token, as db.Changes does
+type Feed func(token string, limit int) ([]db.Change, string, error)
+
+// Follow invalidates the entities in the change feed every interval until
+// stop is closed, so that writes by other replicas do not stay cached. It
+// starts at the end of the feed, as the cache holds nothing older.
+func (c *Cache) Follow(feed Feed, interval time.Duration, logger log.Logger, stop <-chan struct{}) {
+	token, err := end(feed)
+	for err != nil {
+		logger.Log("err", err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+		token, err = end(feed)
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		for {
+			changes, next, err := feed(token, db.MaxPageSize)
+			if err != nil {
+				logger.Log("err", err)
+				break
+			}
+			for _, change := range changes {
+				c.Invalidate(change.Entity, change.ID)
+			}
+			token = next
+			if len(changes) < db.MaxPageSize {
+				break
+			}
+		}
+	}
+}
+
+// end returns the token at the end of the feed. Sequence numbers only grow,
+// so rather than reading the whole feed the last one is searched for, by
+// doubling then halving the sequence number probed. Ending up short of the
+// end only means reading a few changes again.
+func end(feed Feed) (string, error) {
+	after := func(seq int64) (bool, error) {
+		changes, _, err := feed(db.EncodeChangeToken(seq), 1)
+		return len(changes) > 0, err
+	}
+	// There are changes after lo and none after hi
+	lo, hi := int64(0), int64(1)
+	if ok, err := after(lo); err != nil || !ok {
+		return db.EncodeChangeToken(lo), err
+	}
+	for {
+		ok, err := after(hi)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			break
+		}
+		lo, hi = hi, hi*2
+	}
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		ok, err := after(mid)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return db.EncodeChangeToken(hi), nil
+}
+
+// copyUser returns a copy of u sharing nothing that callers change, such as
+// the links they add or the cards they mask
+func copyUser(u users.User) users.User {
+	u.Addresses = copyAddresses(u.Addresses)
+	u.Cards = copyCards(u.Cards)
+	u.Links = copyLinks(u.Links)
+	u.Attributes = copyAttributes(u.Attributes)
+	if u.UsernameChanges != nil {
+		u.UsernameChanges = append([]users.UsernameChange(nil), u.UsernameChanges...)
+	}
+	return u
+}
+
+func copyAttributes(attrs map[string]interface{}) map[string]interface{} {
+	if attrs == nil {
+		return nil
+	}
+	cp := make(map[string]interface{}, len(attrs))
+	for k, v := range attrs {
+		cp[k] = v
+	}
+	return cp
+}
+
+func copyAddresses(as []users.Address) []users.Address {
+	if as == nil {
+		return nil
+	}
+	cp := make([]users.Address, len(as))
+	for k, a := range as {
+		a.Links = copyLinks(a.Links)
+		cp[k] = a
+	}
+	return cp
+}
+
+func copyCards(cs []users.Card) []users.Card {
+	if cs == nil {
+		return nil
+	}
+	cp := make([]users.Card, len(cs))
+	for k, c := range cs {
+		c.Links = copyLinks(c.Links)
+		cp[k] = c
+	}
+	return cp
+}
+
+func copyLinks(l users.Links) users.Links {
+	if l == nil {
+		return nil
+	}
+	cp := make(users.Links, len(l))
+	for k, v := range l {
+		cp[k] = v
+	}
+	return cp
+}
@@ -0,0 +1,277 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/users"
+)
+
+// fakeDB serves one customer with two addresses, counting the loads
+type fakeDB struct {
+	db.Database
+	mtx        sync.Mutex
+	user       users.User
+	addresses  map[string]users.Address
+	loads      int32
+	attributes int32
+	// block, when set, holds loads until closed
+	block chan struct{}
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{
+		user: users.User{UserID: "u1", Username: "Eve_Berger", Addresses: []users.Address{{ID: "a1"}, {ID: "a2"}}},
+		addresses: map[string]users.Address{
+			"a1": {ID: "a1", Street: "Whitelees Road"},
+			"a2": {ID: "a2", Street: "Crown Street"},
+		},
+	}
+}
+
+func (f *fakeDB) GetUser(id string) (users.User, error) {
+	atomic.AddInt32(&f.loads, 1)
+	if f.block != nil {
+		<-f.block
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if id != f.user.UserID {
+		return users.User{}, db.ErrNotFound
+	}
+	return f.user, nil
+}
+
+func (f *fakeDB) GetUserByName(name string) (users.User, error) {
+	atomic.AddInt32(&f.loads, 1)
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if users.Canonical(name) != users.Canonical(f.user.Username) {
+		return users.User{}, db.ErrNotFound
+	}
+	return f.user, nil
+}
+
+func (f *fakeDB) GetUserAttributes(u *users.User) error {
+	atomic.AddInt32(&f.attributes, 1)
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	addresses := make([]users.Address, 0)
+	for _, a := range u.Addresses {
+		if address, ok := f.addresses[a.ID]; ok {
+			addresses = append(addresses, address)
+		}
+	}
+	u.Addresses = addresses
+	u.Cards = []users.Card{}
+	return nil
+}
+
+func (f *fakeDB) UpdateUser(u *users.User) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.user.Username = u.Username
+	return nil
+}
+
+func (f *fakeDB) UpdateAddress(a *users.Address) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.addresses[a.ID] = *a
+	return nil
+}
+
+type counter struct {
+	mtx    *sync.Mutex
+	labels []string
+	counts map[string]float64
+}
+
+func newCounter() *counter {
+	return &counter{mtx: &sync.Mutex{}, counts: make(map[string]float64)}
+}
+
+func (c *counter) With(labelValues ...string) metrics.Counter {
+	return &counter{mtx: c.mtx, labels: labelValues, counts: c.counts}
+}
+
+func (c *counter) Add(delta float64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.counts[c.labels[1]+" "+c.labels[3]] += delta
+}
+
+func TestGetUser(t *testing.T) {
+	f := newFakeDB()
+	lookups := newCounter()
+	c := New(f, 10, time.Minute, lookups)
+
+	u, _ := c.GetUser("u1")
+	u.AddLinks()
+	u, _ = c.GetUser("u1")
+	if f.loads != 1 {
+		t.Errorf("expected the second read to be cached, loaded %v times", f.loads)
+	}
+	if u.Links != nil {
+		t.Error("expected changes to a cached customer not to be shared")
+	}
+	if _, err := c.GetUserByName(" eve_berger"); err != nil || f.loads != 1 {
+		t.Errorf("expected the customer cached by ID to be found by name, loaded %v times", f.loads)
+	}
+	if _, err := c.GetUser("u2"); err != db.ErrNotFound {
+		t.Errorf("expected not found, received %v", err)
+	}
+	if lookups.counts["user hit"] != 2 || lookups.counts["user miss"] != 2 {
+		t.Errorf("unexpected lookups %v", lookups.counts)
+	}
+}
+
+func TestInvalidation(t *testing.T) {
+	f := newFakeDB()
+	c := New(f, 10, time.Minute, newCounter())
+
+	u, _ := c.GetUser("u1")
+	c.GetUserAttributes(&u)
+	c.UpdateAddress(&users.Address{ID: "a1", Street: "Bank Street"})
+	u, _ = c.GetUser("u1")
+	c.GetUserAttributes(&u)
+	if u.Addresses[0].Street != "Bank Street" || f.attributes != 2 {
+		t.Errorf("expected the address update to invalidate its customer, received %v", u.Addresses)
+	}
+
+	c.UpdateUser(&users.User{UserID: "u1", Username: "eve"})
+	if _, err := c.GetUserByName("Eve_Berger"); err != db.ErrNotFound {
+		t.Errorf("expected the old username to be gone, received %v", err)
+	}
+	if u, _ := c.GetUserByName("eve"); u.UserID != "u1" {
+		t.Errorf("expected the new username to be found, received %v", u)
+	}
+
+	c.GetUser("u1")
+	loads := f.loads
+	c.Invalidate("customers", "u1")
+	c.GetUser("u1")
+	if f.loads != loads+1 {
+		t.Error("expected an invalidated customer to be loaded again")
+	}
+}
+
+func TestPagedAttributes(t *testing.T) {
+	f := newFakeDB()
+	c := New(f, 10, time.Minute, newCounter())
+
+	first := users.User{UserID: "u1", Addresses: []users.Address{{ID: "a1"}}}
+	c.GetUserAttributes(&first)
+	second := users.User{UserID: "u1", Addresses: []users.Address{{ID: "a2"}}}
+	c.GetUserAttributes(&second)
+	if len(second.Addresses) != 1 || second.Addresses[0].ID != "a2" || f.attributes != 2 {
+		t.Errorf("expected the second page to be loaded, received %v", second.Addresses)
+	}
+	both := users.User{UserID: "u1", Addresses: []users.Address{{ID: "a2"}, {ID: "a1"}, {ID: "a3"}}}
+	delete(f.addresses, "a3")
+	c.GetUserAttributes(&both)
+	c.GetUserAttributes(&both)
+	if len(both.Addresses) != 2 || both.Addresses[0].ID != "a2" || f.attributes != 3 {
+		t.Errorf("expected both pages and a missing address to be cached, received %v after %v loads", both.Addresses, f.attributes)
+	}
+}
+
+func TestInvalidationDuringLoad(t *testing.T) {
+	f := newFakeDB()
+	f.block = make(chan struct{})
+	c := New(f, 10, time.Minute, newCounter())
+
+	done := make(chan struct{})
+	go func() {
+		c.GetUser("u1")
+		close(done)
+	}()
+	for atomic.LoadInt32(&f.loads) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	c.Invalidate("customers", "u1")
+	close(f.block)
+	<-done
+	if c.Len() != 0 {
+		t.Error("expected a load started before an invalidation not to be cached")
+	}
+}
+
+func TestConcurrentMisses(t *testing.T) {
+	f := newFakeDB()
+	f.block = make(chan struct{})
+	c := New(f, 10, time.Minute, newCounter())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if u, err := c.GetUser("u1"); err != nil || u.UserID != "u1" {
+				t.Errorf("unexpected customer %v %v", u, err)
+			}
+		}()
+	}
+	for atomic.LoadInt32(&f.loads) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(f.block)
+	wg.Wait()
+	if f.loads != 1 {
+		t.Errorf("expected concurrent misses to load once, loaded %v times", f.loads)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	f := newFakeDB()
+	c := New(f, 10, time.Minute, newCounter())
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	c.GetUser("u1")
+	now = now.Add(time.Minute)
+	c.GetUser("u1")
+	if f.loads != 2 {
+		t.Errorf("expected an expired customer to be loaded again, loaded %v times", f.loads)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	c := New(newFakeDB(), 2, time.Minute, newCounter())
+	for _, id := range []string{"u1", "u2", "u3"} {
+		c.storeUser(0, users.User{UserID: id, Username: id, Addresses: []users.Address{{ID: "a" + id}}})
+	}
+	if c.Len() != 2 {
+		t.Errorf("expected the cache to hold 2 customers, holds %v", c.Len())
+	}
+	if _, ok := c.names["u1"]; ok {
+		t.Error("expected the evicted customer to be unindexed")
+	}
+	if _, ok := c.owners["au1"]; ok {
+		t.Error("expected the addresses of the evicted customer to be unindexed")
+	}
+}
+
+func TestEnd(t *testing.T) {
+	for _, last := range []int64{0, 1, 2, 7, 8, 1000} {
+		feed := func(token string, limit int) ([]db.Change, string, error) {
+			since, _ := db.DecodeChangeToken(token)
+			if since >= last {
+				return nil, token, nil
+			}
+			return []db.Change{{Seq: since + 1}}, db.EncodeChangeToken(since + 1), nil
+		}
+		token, err := end(feed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq, _ := db.DecodeChangeToken(token); seq != last {
+			t.Errorf("expected the end of a feed of %v changes, received %v", last, seq)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package cache
+
+import "container/list"
+
+// lru holds up to size customers, evicting the least recently used
+type lru struct {
+	size    int
+	order   *list.List
+	items   map[string]*list.Element
+	onEvict func(*customer)
+}
+
+func newLRU(size int, onEvict func(*customer)) *lru {
+	return &lru{size: size, order: list.New(), items: make(map[string]*list.Element), onEvict: onEvict}
+}
+
+// get returns the customer with the given id, marking it recently used
+func (l *lru) get(id string) (*customer, bool) {
+	e, ok := l.items[id]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(e)
+	return e.Value.(*customer), true
+}
+
+// add inserts a customer, evicting the oldest when full
+func (l *lru) add(c *customer) {
+	if e, ok := l.items[c.id]; ok {
+		l.order.MoveToFront(e)
+		e.Value = c
+		return
+	}
+	l.items[c.id] = l.order.PushFront(c)
+	for l.order.Len() > l.size {
+		l.remove(l.order.Back().Value.(*customer).id)
+	}
+}
+
+// remove drops a customer, if present
+func (l *lru) remove(id string) {
+	e, ok := l.items[id]
+	if !ok {
+		return
+	}
+	l.order.Remove(e)
+	delete(l.items, id)
+	l.onEvict(e.Value.(*customer))
+}
+
+// clear drops every customer
+func (l *lru) clear() {
+	for id := range l.items {
+		l.remove(id)
+	}
+}
+
+func (l *lru) len() int {
+	return l.order.Len()
+}
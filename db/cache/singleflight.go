@@ -0,0 +1,43 @@
+package cache
+
+import "sync"
+
+// call is a load in flight, or done
+type call struct {
+	wg    sync.WaitGroup
+	value interface{}
+	err   error
+}
+
+// group collapses concurrent loads of the same key into one
+type group struct {
+	mtx   sync.Mutex
+	calls map[string]*call
+}
+
+// do runs fn once for all callers asking for key at the same time, returning
+// its result to each of them. The boolean reports whether the result came
+// from the call of another caller.
+func (g *group) do(key string, fn func() (interface{}, error)) (interface{}, error, bool) {
+	g.mtx.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mtx.Unlock()
+		c.wg.Wait()
+		return c.value, c.err, true
+	}
+	c := &call{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mtx.Unlock()
+
+	c.value, c.err = fn()
+	c.wg.Done()
+
+	g.mtx.Lock()
+	delete(g.calls, key)
+	g.mtx.Unlock()
+	return c.value, c.err, false
+}
@@ -0,0 +1,74 @@
+package db
+
+import (
+	"encoding/base64"
+	"strconv"
+	"time"
+)
+
+// Change operations
+const (
+	ChangeCreated  = "created"
+	ChangeUpdated  = "updated"
+	ChangeDeleted  = "deleted"
+	ChangeRestored = "restored"
+	ChangePurged   = "purged"
+	ChangeStatus   = "status"
+)
+
+// ChangeSettle is how long a gap in the sequence of changes is waited on
+// before the feed moves past it. Sequence numbers are taken before the write
+// commits, so a change can become visible after a later one; a gap that does
+// not fill within ChangeSettle belongs to a write that was rolled back.
+var ChangeSettle = 5 * time.Second
+
+// Change records one write to a customer, address or card. Seq orders the
+// changes of all entities.
+type Change struct {
+	Seq    int64     `json:"seq" bson:"_id"`
+	Entity string    `json:"entity" bson:"entity"`
+	ID     string    `json:"id" bson:"id"`
+	Op     string    `json:"op" bson:"op"`
+	At     time.Time `json:"at" bson:"at"`
+	// Status changes also record the transition made. Only the new
+	// status is in the feed; why and by whom it was made is audit data.
+	Status string `json:"status,omitempty" bson:"status,omitempty"`
+	From   string `json:"-" bson:"from,omitempty"`
+	Reason string `json:"-" bson:"reason,omitempty"`
+	Actor  string `json:"-" bson:"actor,omitempty"`
+}
+
+// EncodeChangeToken returns the token resuming the feed after seq
+func EncodeChangeToken(seq int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(seq, 10)))
+}
+
+// DecodeChangeToken returns the sequence number a token resumes after. The
+// empty token starts at the beginning of the feed.
+func DecodeChangeToken(token string) (int64, error) {
+	if token == "" {
+		return 0, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+	seq, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil || seq < 0 {
+		return 0, ErrInvalidCursor
+	}
+	return seq, nil
+}
+
+// settled returns the leading changes that follow since without a gap that
+// may still fill, so that a consumer resuming from the last one misses none
+func settled(changes []Change, since int64, now time.Time) []Change {
+	next := since + 1
+	for i, c := range changes {
+		if c.Seq != next && now.Sub(c.At) < ChangeSettle {
+			return changes[:i]
+		}
+		next = c.Seq + 1
+	}
+	return changes
+}
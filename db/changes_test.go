@@ -0,0 +1,38 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChangeTokenRoundTrip(t *testing.T) {
+	seq, err := DecodeChangeToken(EncodeChangeToken(42))
+	if err != nil || seq != 42 {
+		t.Errorf("expected 42 received %v %v", seq, err)
+	}
+	if seq, err := DecodeChangeToken(""); seq != 0 || err != nil {
+		t.Error("expected the empty token to start at the beginning")
+	}
+	if _, err := DecodeChangeToken("not a token"); err != ErrInvalidCursor {
+		t.Errorf("expected invalid cursor received %v", err)
+	}
+}
+
+func TestSettled(t *testing.T) {
+	now := time.Now()
+	recent := now.Add(-time.Second)
+	old := now.Add(-time.Minute)
+
+	cs := settled([]Change{{Seq: 4, At: recent}, {Seq: 5, At: recent}, {Seq: 7, At: recent}}, 3, now)
+	if len(cs) != 2 {
+		t.Errorf("expected to stop at the recent gap, received %v", cs)
+	}
+	cs = settled([]Change{{Seq: 4, At: recent}, {Seq: 5, At: recent}}, 2, now)
+	if len(cs) != 0 {
+		t.Errorf("expected to wait for the missing first change, received %v", cs)
+	}
+	cs = settled([]Change{{Seq: 4, At: old}, {Seq: 6, At: old}, {Seq: 7, At: recent}}, 2, now)
+	if len(cs) != 3 {
+		t.Errorf("expected to skip gaps that are settled, received %v", cs)
+	}
+}
@@ -0,0 +1,107 @@
+package db
+
+import (
+	"errors"
+	"flag"
+	"time"
+)
+
+// Kinds of inconsistency between customers and their addresses and cards
+const (
+	// Dangling is a customer referencing an address or card that is not
+	// stored. Repairing takes the reference out of the customer.
+	Dangling = "dangling"
+	// Orphan is a live address or card no customer references. Repairing
+	// deletes it, so it is purged after the restore window.
+	Orphan = "orphan"
+	// Duplicate is an address or card referenced by several customers.
+	// Repairing leaves it with the customer created first.
+	Duplicate = "duplicate"
+)
+
+// MaxIssues is the number of inconsistencies listed in a check report; all
+// of them are counted
+const MaxIssues = 1000
+
+var (
+	//ErrCheckUnsupported is returned when the selected database can not be checked
+	ErrCheckUnsupported = errors.New("Database does not support consistency checks")
+	//CheckGrace is how recent a change is left out of consistency checks
+	CheckGrace = time.Hour
+)
+
+func init() {
+	flag.DurationVar(&CheckGrace, "check-grace", CheckGrace, "How recent a change is left out of consistency checks")
+}
+
+// CheckOptions configure a consistency check
+type CheckOptions struct {
+	// Repair fixes what is found, Batch inconsistencies per unit of work
+	Repair bool
+	Batch  int
+	// Grace leaves out what changed more recently, as writes in progress
+	// pass through states that look inconsistent
+	Grace time.Duration
+}
+
+// Inconsistency is one problem found by a check. Customers are the customers
+// referencing the address or card, the one kept first for duplicates.
+type Inconsistency struct {
+	Kind      string   `json:"kind"`
+	Entity    string   `json:"entity"`
+	ID        string   `json:"id"`
+	Customers []string `json:"customers,omitempty"`
+}
+
+// CheckReport tells what a check found and, when repairing, fixed. Repaired
+// counts the references taken out of customers and the orphans deleted.
+type CheckReport struct {
+	Repair     bool            `json:"repair"`
+	Customers  int64           `json:"customers"`
+	Addresses  int64           `json:"addresses"`
+	Cards      int64           `json:"cards"`
+	Dangling   int             `json:"dangling"`
+	Orphans    int             `json:"orphans"`
+	Duplicates int             `json:"duplicates"`
+	Repaired   int             `json:"repaired"`
+	Issues     []Inconsistency `json:"issues"`
+}
+
+// Found returns the number of inconsistencies found
+func (r CheckReport) Found() int {
+	return r.Dangling + r.Orphans + r.Duplicates
+}
+
+// Add counts an inconsistency, listing it while there is room
+func (r *CheckReport) Add(i Inconsistency) {
+	switch i.Kind {
+	case Dangling:
+		r.Dangling++
+	case Orphan:
+		r.Orphans++
+	case Duplicate:
+		r.Duplicates++
+	}
+	if len(r.Issues) < MaxIssues {
+		r.Issues = append(r.Issues, i)
+	}
+}
+
+// Checker is implemented by databases that can look for and repair
+// references between customers, addresses and cards that went wrong
+type Checker interface {
+	Check(CheckOptions) (CheckReport, error)
+}
+
+// Check checks the consistency of DefaultDb. Repairs are recorded in the change
+// feed, which is how caches learn about them.
+func Check(o CheckOptions) (CheckReport, error) {
+	c, ok := Unwrap(DefaultDb).(Checker)
+	if !ok {
+		return CheckReport{}, ErrCheckUnsupported
+	}
+	if o.Batch <= 0 {
+		o.Batch = 100
+	}
+	return c.Check(o)
+}
@@ -0,0 +1,50 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/microservices-demo/user/users"
+)
+
+func TestCheckReport(t *testing.T) {
+	r := CheckReport{}
+	for i := 0; i < MaxIssues+1; i++ {
+		r.Add(Inconsistency{Kind: Orphan, Entity: "addresses", ID: "1"})
+	}
+	r.Add(Inconsistency{Kind: Dangling, Entity: "cards", ID: "2", Customers: []string{"3"}})
+	r.Add(Inconsistency{Kind: Duplicate, Entity: "cards", ID: "4", Customers: []string{"3", "5"}})
+	if r.Orphans != MaxIssues+1 || r.Dangling != 1 || r.Duplicates != 1 || r.Found() != MaxIssues+3 {
+		t.Errorf("expected every inconsistency counted, received %+v", r)
+	}
+	if len(r.Issues) != MaxIssues {
+		t.Errorf("expected %v inconsistencies listed, received %v", MaxIssues, len(r.Issues))
+	}
+}
+
+func TestVersionsUnsupported(t *testing.T) {
+	DefaultDb = wrapper{fake{}}
+	if _, err := GetAddressVersion("57a98d98e4b00679b4a830ad", 1); err != ErrVersionsUnsupported {
+		t.Errorf("expected %v, received %v", ErrVersionsUnsupported, err)
+	}
+}
+
+func TestCheckUnsupported(t *testing.T) {
+	DefaultDb = wrapper{fake{}}
+	if _, err := Check(CheckOptions{}); err != ErrCheckUnsupported {
+		t.Errorf("expected %v, received %v", ErrCheckUnsupported, err)
+	}
+}
+
+func TestStatusUnsupported(t *testing.T) {
+	DefaultDb = wrapper{fake{}}
+	if err := SetStatus("57a98d98e4b00679b4a830ad", &users.Transition{To: users.StatusSuspended}); err != ErrStatusUnsupported {
+		t.Errorf("expected %v, received %v", ErrStatusUnsupported, err)
+	}
+}
+
+func TestUsernamesUnsupported(t *testing.T) {
+	DefaultDb = wrapper{fake{}}
+	if err := ChangeUsername("57a98d98e4b00679b4a830ad", &users.UsernameChange{To: "eve"}); err != ErrUsernamesUnsupported {
+		t.Errorf("expected %v, received %v", ErrUsernamesUnsupported, err)
+	}
+}
@@ -5,8 +5,13 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 
+	"github.com/microservices-demo/user/db/migrate"
+	"github.com/microservices-demo/user/dsar"
+	"github.com/microservices-demo/user/guest"
 	"github.com/microservices-demo/user/users"
+	"github.com/microservices-demo/user/webhooks"
 )
 
 // Database represents a simple interface so we can switch to a new system easily
@@ -15,21 +20,48 @@ type Database interface {
 	Init() error
 	GetUserByName(string) (users.User, error)
 	GetUser(string) (users.User, error)
-	GetUsers() ([]users.User, error)
+	GetUsers(ListOptions) ([]users.User, PageInfo, error)
 	CreateUser(*users.User) error
+	UpdateUser(*users.User) error
 	GetUserAttributes(*users.User) error
+	UpsertUsers([]users.User) ([]error, error)
+	Taken(username, email string) (usernameTaken, emailTaken bool, err error)
 	GetAddress(string) (users.Address, error)
-	GetAddresses() ([]users.Address, error)
+	GetAddresses(ListOptions) ([]users.Address, PageInfo, error)
 	CreateAddress(*users.Address, string) error
+	UpdateAddress(*users.Address) error
 	GetCard(string) (users.Card, error)
-	GetCards() ([]users.Card, error)
-	Delete(string, string) error
+	GetCards(ListOptions) ([]users.Card, PageInfo, error)
+	Delete(string, string, int64) error
+	Restore(string, string, time.Time) error
+	Purge(time.Time) (int, error)
+	Changes(since int64, limit int) ([]Change, error)
 	CreateCard(*users.Card, string) error
+	UpdateCard(*users.Card) error
 	Ping() error
 }
 
+// DuplicateError is returned when a customer would get the username or email
+// of another customer
+type DuplicateError struct {
+	Field string
+}
+
+func (e DuplicateError) Error() string {
+	return e.Field + " is already taken"
+}
+
+// Migrator is implemented by databases whose schema evolves through versioned
+// migrations
+type Migrator interface {
+	Migrations() []migrate.Migration
+	MigrationStore() migrate.Store
+}
+
 var (
 	database string
+	//RestoreWindow is how long a deleted entity can be restored before it is purged
+	RestoreWindow = 30 * 24 * time.Hour
 	//DefaultDb is the database set for the microservice
 	DefaultDb Database
 	//DBTypes is a map of DB interfaces that can be used for this service
@@ -38,10 +70,23 @@ var (
 	ErrNoDatabaseFound = "No database with name %v registered"
 	//ErrNoDatabaseSelected is returned when no database was designated in the flag or env
 	ErrNoDatabaseSelected = errors.New("No DB selected")
+	//ErrNotFound is returned when the requested entity does not exist
+	ErrNotFound = errors.New("Not found")
+	//ErrMigrationsUnsupported is returned when the selected database has no migrations
+	ErrMigrationsUnsupported = errors.New("Database does not support migrations")
+	//ErrWebhooksUnsupported is returned when the selected database can not keep webhooks
+	ErrWebhooksUnsupported = errors.New("Database does not support webhooks")
+	//ErrAccessRequestsUnsupported is returned when the selected database can not keep access requests
+	ErrAccessRequestsUnsupported = errors.New("Database does not support access requests")
+	//ErrGuestsUnsupported is returned when the selected database can not keep guest sessions
+	ErrGuestsUnsupported = errors.New("Database does not support guest sessions")
+	//ErrVersionConflict is returned when an entity changed since the version an update is based on
+	ErrVersionConflict = errors.New("Version conflict")
 )
 
 func init() {
 	flag.StringVar(&database, "database", os.Getenv("USER_DATABASE"), "Database to use, Mongodb or ...")
+	flag.DurationVar(&RestoreWindow, "restore-window", RestoreWindow, "How long deleted customers, addresses and cards can be restored")
 
 }
 
@@ -71,11 +116,72 @@ func Register(name string, db Database) {
 	DBTypes[name] = db
 }
 
+//Unwrap returns the database under any decorators of d, such as a cache,
+//which is where optional capabilities like migrations are implemented
+func Unwrap(d Database) Database {
+	for {
+		w, ok := d.(interface{ Unwrap() Database })
+		if !ok {
+			return d
+		}
+		d = w.Unwrap()
+	}
+}
+
+//Migrations returns a runner for the migrations of DefaultDb
+func Migrations() (*migrate.Runner, error) {
+	m, ok := Unwrap(DefaultDb).(Migrator)
+	if !ok {
+		return nil, ErrMigrationsUnsupported
+	}
+	return migrate.NewRunner(m.MigrationStore(), m.Migrations()), nil
+}
+
+//Webhooks returns the webhook store of DefaultDb
+func Webhooks() (webhooks.Store, error) {
+	s, ok := Unwrap(DefaultDb).(webhooks.Store)
+	if !ok {
+		return nil, ErrWebhooksUnsupported
+	}
+	return s, nil
+}
+
+//AccessRequests returns the access request store of DefaultDb
+func AccessRequests() (dsar.Store, error) {
+	s, ok := Unwrap(DefaultDb).(dsar.Store)
+	if !ok {
+		return nil, ErrAccessRequestsUnsupported
+	}
+	return s, nil
+}
+
+//Guests returns the guest session store of DefaultDb
+func Guests() (guest.Store, error) {
+	s, ok := Unwrap(DefaultDb).(guest.Store)
+	if !ok {
+		return nil, ErrGuestsUnsupported
+	}
+	return s, nil
+}
+
+//Invalidate tells the decorators of DefaultDb caching customers, if any, about
+//a write to a customer, address or card made through one of its capabilities
+func Invalidate(entity, id string) {
+	if c, ok := DefaultDb.(interface{ Invalidate(entity, id string) }); ok {
+		c.Invalidate(entity, id)
+	}
+}
+
 //CreateUser invokes DefaultDb method
 func CreateUser(u *users.User) error {
 	return DefaultDb.CreateUser(u)
 }
 
+//UpdateUser invokes DefaultDb method
+func UpdateUser(u *users.User) error {
+	return DefaultDb.UpdateUser(u)
+}
+
 //GetUserByName invokes DefaultDb method
 func GetUserByName(n string) (users.User, error) {
 	u, err := DefaultDb.GetUserByName(n)
@@ -95,12 +201,35 @@ func GetUser(n string) (users.User, error) {
 }
 
 //GetUsers invokes DefaultDb method
-func GetUsers() ([]users.User, error) {
-	us, err := DefaultDb.GetUsers()
+func GetUsers(o ListOptions) ([]users.User, PageInfo, error) {
+	us, p, err := DefaultDb.GetUsers(o)
 	for k, _ := range us {
 		us[k].AddLinks()
+		if o.Embeds(EmbedAddresses) {
+			for i := range us[k].Addresses {
+				us[k].Addresses[i].AddLinks()
+			}
+		}
+		if o.Embeds(EmbedCards) {
+			for i := range us[k].Cards {
+				us[k].Cards[i].AddLinks()
+			}
+		}
 	}
-	return us, err
+	return us, p, err
+}
+
+//UpsertUsers invokes DefaultDb method, creating or replacing customers with
+//their addresses and cards under the ids they hold. It returns the error of
+//each customer that could not be written, nil for the others, and an error
+//when the batch failed as a whole.
+func UpsertUsers(us []users.User) ([]error, error) {
+	return DefaultDb.UpsertUsers(us)
+}
+
+//Taken invokes DefaultDb method
+func Taken(username, email string) (bool, bool, error) {
+	return DefaultDb.Taken(username, email)
 }
 
 //GetUserAttributes invokes DefaultDb method
@@ -123,6 +252,11 @@ func CreateAddress(a *users.Address, userid string) error {
 	return DefaultDb.CreateAddress(a, userid)
 }
 
+//UpdateAddress invokes DefaultDb method
+func UpdateAddress(a *users.Address) error {
+	return DefaultDb.UpdateAddress(a)
+}
+
 //GetAddress invokes DefaultDb method
 func GetAddress(n string) (users.Address, error) {
 	a, err := DefaultDb.GetAddress(n)
@@ -133,12 +267,12 @@ func GetAddress(n string) (users.Address, error) {
 }
 
 //GetAddresses invokes DefaultDb method
-func GetAddresses() ([]users.Address, error) {
-	as, err := DefaultDb.GetAddresses()
+func GetAddresses(o ListOptions) ([]users.Address, PageInfo, error) {
+	as, p, err := DefaultDb.GetAddresses(o)
 	for k, _ := range as {
 		as[k].AddLinks()
 	}
-	return as, err
+	return as, p, err
 }
 
 //CreateCard invokes DefaultDb method
@@ -146,23 +280,60 @@ func CreateCard(c *users.Card, userid string) error {
 	return DefaultDb.CreateCard(c, userid)
 }
 
+//UpdateCard invokes DefaultDb method
+func UpdateCard(c *users.Card) error {
+	return DefaultDb.UpdateCard(c)
+}
+
 //GetCard invokes DefaultDb method
 func GetCard(n string) (users.Card, error) {
 	return DefaultDb.GetCard(n)
 }
 
 //GetCards invokes DefaultDb method
-func GetCards() ([]users.Card, error) {
-	cs, err := DefaultDb.GetCards()
+func GetCards(o ListOptions) ([]users.Card, PageInfo, error) {
+	cs, p, err := DefaultDb.GetCards(o)
 	for k, _ := range cs {
 		cs[k].AddLinks()
 	}
-	return cs, err
+	return cs, p, err
 }
 
-//Delete invokes DefaultDb method
-func Delete(entity, id string) error {
-	return DefaultDb.Delete(entity, id)
+//Delete invokes DefaultDb method, failing with ErrVersionConflict unless a non
+//zero version matches the stored one
+func Delete(entity, id string, version int64) error {
+	return DefaultDb.Delete(entity, id, version)
+}
+
+//Restore invokes DefaultDb method, restoring entities deleted within the RestoreWindow
+func Restore(entity, id string) error {
+	return DefaultDb.Restore(entity, id, time.Now().Add(-RestoreWindow))
+}
+
+//Purge invokes DefaultDb method, removing entities deleted before the RestoreWindow
+func Purge() (int, error) {
+	return DefaultDb.Purge(time.Now().Add(-RestoreWindow))
+}
+
+//Changes invokes DefaultDb method, returning up to a page of changes after
+//the token and the token to resume from
+func Changes(token string, limit int) ([]Change, string, error) {
+	since, err := DecodeChangeToken(token)
+	if err != nil {
+		return nil, token, err
+	}
+	if limit <= 0 || limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+	cs, err := DefaultDb.Changes(since, limit)
+	if err != nil {
+		return nil, token, err
+	}
+	cs = settled(cs, since, time.Now())
+	if len(cs) == 0 {
+		return cs, EncodeChangeToken(since), nil
+	}
+	return cs, EncodeChangeToken(cs[len(cs)-1].Seq), nil
 }
 
 //Ping invokes DefaultDB method
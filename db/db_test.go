@@ -4,6 +4,7 @@ import (
 	"errors"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/microservices-demo/user/users"
 )
@@ -101,6 +102,23 @@ func TestPing(t *testing.T) {
 
 }
 
+type wrapper struct {
+	Database
+}
+
+func (w wrapper) Unwrap() Database {
+	return w.Database
+}
+
+func TestUnwrap(t *testing.T) {
+	if _, ok := Unwrap(wrapper{wrapper{fake{}}}).(fake); !ok {
+		t.Error("expected the database under the decorators")
+	}
+	if _, ok := Unwrap(fake{}).(fake); !ok {
+		t.Error("expected an undecorated database to be returned as is")
+	}
+}
+
 type fake struct{}
 
 func (f fake) Init() error {
@@ -113,47 +131,79 @@ func (f fake) GetUser(id string) (users.User, error) {
 	return users.User{}, ErrFakeError
 }
 
-func (f fake) GetUsers() ([]users.User, error) {
-	return make([]users.User, 0), ErrFakeError
+func (f fake) GetUsers(o ListOptions) ([]users.User, PageInfo, error) {
+	return make([]users.User, 0), PageInfo{}, ErrFakeError
 }
 
 func (f fake) CreateUser(*users.User) error {
 	return ErrFakeError
 }
 
+func (f fake) UpdateUser(*users.User) error {
+	return ErrFakeError
+}
+
 func (f fake) GetUserAttributes(u *users.User) error {
 	u.Addresses = append(u.Addresses, TestAddress)
 	return nil
 }
 
+func (f fake) UpsertUsers(us []users.User) ([]error, error) {
+	return nil, ErrFakeError
+}
+
 func (f fake) GetCard(id string) (users.Card, error) {
 	return users.Card{}, ErrFakeError
 }
 
-func (f fake) GetCards() ([]users.Card, error) {
-	return make([]users.Card, 0), ErrFakeError
+func (f fake) GetCards(o ListOptions) ([]users.Card, PageInfo, error) {
+	return make([]users.Card, 0), PageInfo{}, ErrFakeError
 }
 
 func (f fake) CreateCard(c *users.Card, id string) error {
 	return ErrFakeError
 }
 
+func (f fake) UpdateCard(c *users.Card) error {
+	return ErrFakeError
+}
+
 func (f fake) GetAddress(id string) (users.Address, error) {
 	return users.Address{}, ErrFakeError
 }
 
-func (f fake) GetAddresses() ([]users.Address, error) {
-	return make([]users.Address, 0), ErrFakeError
+func (f fake) GetAddresses(o ListOptions) ([]users.Address, PageInfo, error) {
+	return make([]users.Address, 0), PageInfo{}, ErrFakeError
 }
 
 func (f fake) CreateAddress(u *users.Address, id string) error {
 	return ErrFakeError
 }
 
-func (f fake) Delete(entity, id string) error {
+func (f fake) UpdateAddress(a *users.Address) error {
+	return ErrFakeError
+}
+
+func (f fake) Delete(entity, id string, version int64) error {
+	return ErrFakeError
+}
+
+func (f fake) Restore(entity, id string, since time.Time) error {
 	return ErrFakeError
 }
 
+func (f fake) Purge(before time.Time) (int, error) {
+	return 0, ErrFakeError
+}
+
+func (f fake) Taken(username, email string) (bool, bool, error) {
+	return false, false, ErrFakeError
+}
+
+func (f fake) Changes(since int64, limit int) ([]Change, error) {
+	return nil, ErrFakeError
+}
+
 func (f fake) Ping() error {
 	return ErrFakeError
 }
@@ -0,0 +1,36 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/microservices-demo/user/users"
+)
+
+var (
+	//ErrDefaultsUnsupported is returned when the selected database can not keep default addresses and cards
+	ErrDefaultsUnsupported = errors.New("Database does not support default addresses and cards")
+	//ErrIneligibleDefault is returned for a default the customer does not hold or that does not fit its use
+	ErrIneligibleDefault = errors.New("Default is not a live address or card of the customer fitting its use")
+)
+
+// DefaultsSetter is implemented by databases that keep the default shipping
+// address, billing address and card of customers. The database keeps them
+// pointing at addresses and cards the customer holds: when a default is
+// deleted, or an address changes to a type that no longer fits, the first
+// address or card that fits takes its place.
+type DefaultsSetter interface {
+	// SetDefaults replaces the defaults of a customer. Empty ids are chosen
+	// by the database; d is set to the defaults stored.
+	SetDefaults(customerID string, d *users.Defaults) error
+}
+
+//SetDefaults sets the defaults of a customer in DefaultDb
+func SetDefaults(customerID string, d *users.Defaults) error {
+	s, ok := Unwrap(DefaultDb).(DefaultsSetter)
+	if !ok {
+		return ErrDefaultsUnsupported
+	}
+	err := s.SetDefaults(customerID, d)
+	Invalidate("customers", customerID)
+	return err
+}
@@ -0,0 +1,41 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/microservices-demo/user/users"
+)
+
+var (
+	//ErrEmailsUnsupported is returned when the selected database can not verify emails
+	ErrEmailsUnsupported = errors.New("Database does not support email verification")
+	//ErrInvalidVerification is returned for an email verification token that is unknown, expired or for another email
+	ErrInvalidVerification = errors.New("Email verification not found or expired")
+)
+
+// EmailVerifier is implemented by databases that can verify the emails of
+// customers and find customers by their verified email. Verification tokens
+// are kept as their users.HashVerificationToken.
+type EmailVerifier interface {
+	// StartEmailVerification keeps a verification of the current email of
+	// a live customer until v.ExpiresAt, replacing the one started before,
+	// and sets v.Email
+	StartEmailVerification(customerID, hash string, v *users.EmailVerification) error
+	// VerifyEmail marks the email a verification was started for as
+	// verified, provided it is still the customer's, returning the id of
+	// the customer
+	VerifyEmail(hash string, at time.Time) (string, error)
+	// GetUserByEmail returns the live customer whose verified email is
+	// canonically the same as email
+	GetUserByEmail(email string) (users.User, error)
+}
+
+// Emails returns the email verifier of DefaultDb
+func Emails() (EmailVerifier, error) {
+	s, ok := Unwrap(DefaultDb).(EmailVerifier)
+	if !ok {
+		return nil, ErrEmailsUnsupported
+	}
+	return s, nil
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+
+	"github.com/microservices-demo/user/db/query"
+)
+
+var (
+	// MaxPageSize is the largest page a listing will return, whatever the client asks for
+	MaxPageSize = 100
+	// ErrInvalidCursor is returned when a cursor can not be decoded
+	ErrInvalidCursor = errors.New("Invalid cursor")
+)
+
+func init() {
+	flag.IntVar(&MaxPageSize, "max-page-size", MaxPageSize, "Maximum number of items returned in one page")
+}
+
+// The attributes that can be embedded in a customer listing
+const (
+	EmbedAddresses = "addresses"
+	EmbedCards     = "cards"
+)
+
+// ListOptions describes which page of a listing to return. Filter, Sort and
+// Embed are only honoured by customer listings. Embed names the attributes
+// loaded along with each customer of the page.
+type ListOptions struct {
+	Limit  int
+	Cursor string
+	Filter query.Expr
+	Sort   []query.Sort
+	Embed  []string
+}
+
+// Embeds reports whether the attribute is to be loaded along with each
+// customer of the page
+func (o ListOptions) Embeds(attr string) bool {
+	for _, e := range o.Embed {
+		if e == attr {
+			return true
+		}
+	}
+	return false
+}
+
+// PageSize returns the requested limit clamped to MaxPageSize
+func (o ListOptions) PageSize() int {
+	if o.Limit <= 0 || o.Limit > MaxPageSize {
+		return MaxPageSize
+	}
+	return o.Limit
+}
+
+// PageInfo carries the cursors around a returned page. Total is -1 when the
+// backend can not count the listing cheaply.
+type PageInfo struct {
+	Next  string
+	Prev  string
+	Total int64
+}
+
+// Cursor is the decoded form of an opaque page cursor. ID is the key of the
+// item the page starts after, or before when Before is set, and Keys hold the
+// values of that item's sort fields when the listing is sorted.
+type Cursor struct {
+	ID     string        `json:"id"`
+	Keys   []interface{} `json:"k,omitempty"`
+	Before bool          `json:"b,omitempty"`
+}
+
+// Encode returns the opaque string form of the cursor
+func (c Cursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeCursor parses an opaque cursor, the empty string is the first page
+func DecodeCursor(s string) (Cursor, error) {
+	var c Cursor
+	if s == "" {
+		return c, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(b, &c); err != nil || c.ID == "" {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// PageIDs pages through an ordered list of ids, used for listings that are
+// already held in memory such as the addresses and cards of a customer.
+func PageIDs(ids []string, o ListOptions) ([]string, PageInfo, error) {
+	info := PageInfo{Total: int64(len(ids))}
+	c, err := DecodeCursor(o.Cursor)
+	if err != nil {
+		return nil, info, err
+	}
+	size := o.PageSize()
+	start, end := 0, len(ids)
+	if c.ID != "" {
+		pos := -1
+		for i, id := range ids {
+			if id == c.ID {
+				pos = i
+				break
+			}
+		}
+		if pos < 0 {
+			return nil, info, ErrInvalidCursor
+		}
+		if c.Before {
+			end = pos
+		} else {
+			start = pos + 1
+		}
+	}
+	if c.Before {
+		if end-size > start {
+			start = end - size
+		}
+	} else if start+size < end {
+		end = start + size
+	}
+	if start > 0 && start < len(ids) {
+		info.Prev = Cursor{ID: ids[start], Before: true}.Encode()
+	}
+	if end < len(ids) && end > 0 {
+		info.Next = Cursor{ID: ids[end-1]}.Encode()
+	}
+	return ids[start:end], info, nil
+}
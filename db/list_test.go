@@ -0,0 +1,69 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	c := Cursor{ID: "57a98d98e4b00679b4a830af", Before: true}
+	d, err := DecodeCursor(c.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d, c) {
+		t.Errorf("expected %v received %v", c, d)
+	}
+	if _, err := DecodeCursor("not a cursor"); err != ErrInvalidCursor {
+		t.Error("expected invalid cursor error")
+	}
+}
+
+func TestPageSize(t *testing.T) {
+	if (ListOptions{}).PageSize() != MaxPageSize {
+		t.Error("expected default page size to be the maximum")
+	}
+	if (ListOptions{Limit: MaxPageSize + 1}).PageSize() != MaxPageSize {
+		t.Error("expected page size to be clamped")
+	}
+	if (ListOptions{Limit: 3}).PageSize() != 3 {
+		t.Error("expected requested page size")
+	}
+}
+
+func TestPageIDs(t *testing.T) {
+	ids := []string{"a", "b", "c", "d", "e"}
+	page, info, err := PageIDs(ids, ListOptions{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page, []string{"a", "b"}) || info.Prev != "" || info.Total != 5 {
+		t.Errorf("unexpected first page %v %+v", page, info)
+	}
+
+	page, info, err = PageIDs(ids, ListOptions{Limit: 2, Cursor: info.Next})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page, []string{"c", "d"}) {
+		t.Errorf("unexpected second page %v", page)
+	}
+
+	last, lastInfo, _ := PageIDs(ids, ListOptions{Limit: 2, Cursor: info.Next})
+	if !reflect.DeepEqual(last, []string{"e"}) || lastInfo.Next != "" {
+		t.Errorf("unexpected last page %v %+v", last, lastInfo)
+	}
+
+	page, _, err = PageIDs(ids, ListOptions{Limit: 2, Cursor: info.Prev})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page, []string{"a", "b"}) {
+		t.Errorf("unexpected previous page %v", page)
+	}
+
+	_, _, err = PageIDs(ids, ListOptions{Cursor: Cursor{ID: "z"}.Encode()})
+	if err != ErrInvalidCursor {
+		t.Error("expected invalid cursor error for unknown id")
+	}
+}
@@ -0,0 +1,19 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/microservices-demo/user/logins"
+)
+
+// ErrLoginsUnsupported is returned when the selected database can not keep the login history
+var ErrLoginsUnsupported = errors.New("Database does not support login history")
+
+// Logins returns the login history store of DefaultDb
+func Logins() (logins.Store, error) {
+	s, ok := Unwrap(DefaultDb).(logins.Store)
+	if !ok {
+		return nil, ErrLoginsUnsupported
+	}
+	return s, nil
+}
@@ -0,0 +1,173 @@
+// Package migrate runs versioned schema migrations against the user database.
+// Migrations are ordered by version, recorded once applied and must be
+// idempotent, since a migration interrupted half way is run again in full.
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrLocked is returned when another process holds the migration lock
+	// for longer than the runner is willing to wait
+	ErrLocked = errors.New("Migrations are locked by another process")
+)
+
+// Migration is one step in the evolution of the schema
+type Migration struct {
+	Version     int
+	Description string
+	Up          func() error
+}
+
+// Record is an applied migration
+type Record struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"appliedAt"`
+}
+
+// Store keeps track of applied migrations and the lock that makes sure only
+// one process migrates at a time
+type Store interface {
+	Applied() ([]Record, error)
+	Record(Record) error
+	// Lock takes the lock for owner, returning false when someone else holds
+	// it. A lock older than ttl is considered abandoned and taken over.
+	Lock(owner string, ttl time.Duration) (bool, error)
+	Unlock(owner string) error
+}
+
+// Status describes a known migration and when it was applied, if it was
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Runner applies migrations to a store
+type Runner struct {
+	Store      Store
+	Migrations []Migration
+	// Owner identifies the process holding the lock
+	Owner string
+	// LockTTL is how long a lock is honoured before it is taken over
+	LockTTL time.Duration
+	// Wait is how long Up waits for another process to release the lock
+	Wait time.Duration
+	// Poll is how often Up checks whether the lock was released
+	Poll time.Duration
+}
+
+// NewRunner returns a runner for the given migrations with default lock
+// settings
+func NewRunner(store Store, migrations []Migration) *Runner {
+	return &Runner{
+		Store:      store,
+		Migrations: migrations,
+		Owner:      fmt.Sprintf("migrate-%d", time.Now().UnixNano()),
+		LockTTL:    10 * time.Minute,
+		Wait:       time.Minute,
+		Poll:       time.Second,
+	}
+}
+
+// sorted returns the migrations ordered by version, rejecting duplicates
+func (r *Runner) sorted() ([]Migration, error) {
+	ms := append([]Migration{}, r.Migrations...)
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Version < ms[j].Version })
+	for i := 1; i < len(ms); i++ {
+		if ms[i].Version == ms[i-1].Version {
+			return nil, fmt.Errorf("duplicate migration version %d", ms[i].Version)
+		}
+	}
+	return ms, nil
+}
+
+// Status lists every known migration in order
+func (r *Runner) Status() ([]Status, error) {
+	ms, err := r.sorted()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := r.applied()
+	if err != nil {
+		return nil, err
+	}
+	status := make([]Status, 0, len(ms))
+	for _, m := range ms {
+		s := Status{Migration: m}
+		if rec, ok := applied[m.Version]; ok {
+			at := rec.AppliedAt
+			s.AppliedAt = &at
+		}
+		status = append(status, s)
+	}
+	return status, nil
+}
+
+// Up applies the pending migrations in order and returns the ones it applied.
+// It stops at the first migration that fails.
+func (r *Runner) Up() ([]Migration, error) {
+	ms, err := r.sorted()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.lock(); err != nil {
+		return nil, err
+	}
+	defer r.Store.Unlock(r.Owner)
+
+	// Read what was applied only once the lock is held, another process
+	// may just have finished migrating
+	applied, err := r.applied()
+	if err != nil {
+		return nil, err
+	}
+	done := make([]Migration, 0)
+	for _, m := range ms {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if err := m.Up(); err != nil {
+			return done, fmt.Errorf("migration %d (%v): %v", m.Version, m.Description, err)
+		}
+		rec := Record{Version: m.Version, Description: m.Description, AppliedAt: time.Now().UTC()}
+		if err := r.Store.Record(rec); err != nil {
+			return done, err
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+func (r *Runner) lock() error {
+	deadline := time.Now().Add(r.Wait)
+	for {
+		ok, err := r.Store.Lock(r.Owner, r.LockTTL)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return ErrLocked
+		}
+		time.Sleep(r.Poll)
+	}
+}
+
+func (r *Runner) applied() (map[int]Record, error) {
+	recs, err := r.Store.Applied()
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]Record, len(recs))
+	for _, rec := range recs {
+		applied[rec.Version] = rec
+	}
+	return applied, nil
+}
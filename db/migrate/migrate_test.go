@@ -0,0 +1,104 @@
+package migrate
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type memoryStore struct {
+	records []Record
+	owner   string
+}
+
+func (s *memoryStore) Applied() ([]Record, error) {
+	return s.records, nil
+}
+
+func (s *memoryStore) Record(r Record) error {
+	s.records = append(s.records, r)
+	return nil
+}
+
+func (s *memoryStore) Lock(owner string, ttl time.Duration) (bool, error) {
+	if s.owner != "" && s.owner != owner {
+		return false, nil
+	}
+	s.owner = owner
+	return true, nil
+}
+
+func (s *memoryStore) Unlock(owner string) error {
+	if s.owner == owner {
+		s.owner = ""
+	}
+	return nil
+}
+
+func TestUp(t *testing.T) {
+	var ran []int
+	step := func(v int) Migration {
+		return Migration{Version: v, Up: func() error {
+			ran = append(ran, v)
+			return nil
+		}}
+	}
+	store := &memoryStore{records: []Record{{Version: 1}}}
+	r := NewRunner(store, []Migration{step(3), step(1), step(2)})
+
+	done, err := r.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 2 || len(ran) != 2 || ran[0] != 2 || ran[1] != 3 {
+		t.Errorf("expected migrations 2 and 3 to run in order, ran %v", ran)
+	}
+	if store.owner != "" {
+		t.Error("expected the lock to be released")
+	}
+
+	done, err = r.Up()
+	if err != nil || len(done) != 0 {
+		t.Errorf("expected nothing left to migrate, applied %v %v", done, err)
+	}
+
+	status, err := r.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range status {
+		if s.AppliedAt == nil {
+			t.Errorf("expected migration %d to be applied", s.Version)
+		}
+	}
+}
+
+func TestUpStopsAtFailure(t *testing.T) {
+	store := &memoryStore{}
+	r := NewRunner(store, []Migration{
+		{Version: 1, Up: func() error { return errors.New("failed") }},
+		{Version: 2, Up: func() error { return nil }},
+	})
+	if _, err := r.Up(); err == nil {
+		t.Error("expected the failing migration to be reported")
+	}
+	if len(store.records) != 0 {
+		t.Errorf("expected no migration to be recorded, recorded %v", store.records)
+	}
+}
+
+func TestUpLocked(t *testing.T) {
+	store := &memoryStore{owner: "other"}
+	r := NewRunner(store, []Migration{{Version: 1, Up: func() error { return nil }}})
+	r.Wait = 0
+	if _, err := r.Up(); err != ErrLocked {
+		t.Errorf("expected lock error, received %v", err)
+	}
+}
+
+func TestDuplicateVersion(t *testing.T) {
+	r := NewRunner(&memoryStore{}, []Migration{{Version: 1}, {Version: 1}})
+	if _, err := r.Status(); err == nil {
+		t.Error("expected duplicate versions to be rejected")
+	}
+}
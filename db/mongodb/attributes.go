@@ -0,0 +1,69 @@
+package mongodb
+
+import (
+	"context"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/users"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var _ db.AttributeStore = &Mongo{}
+
+// StaleAttributes returns the live customers after the given one holding
+// attributes checked against another schema version, in the order of their ids
+func (m *Mongo) StaleAttributes(version int64, after string, limit int) ([]users.User, error) {
+	filter := bson.M{"deletedAt": nil, "attributes": bson.M{"$exists": true}, "attributesVersion": bson.M{"$ne": version}}
+	if after != "" {
+		id, err := primitive.ObjectIDFromHex(after)
+		if err != nil {
+			return nil, err
+		}
+		filter["_id"] = bson.M{"$gt": id}
+	}
+	findOptions := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(int64(limit))
+	cur, err := m.Client.Database(mongoDatabase).Collection("customers").Find(context.Background(), filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	var docs []MongoUser
+	if err := cur.All(context.Background(), &docs); err != nil {
+		return nil, err
+	}
+	us := make([]users.User, 0, len(docs))
+	for _, mu := range docs {
+		mu.AddUserIDs()
+		us = append(us, mu.User)
+	}
+	return us, nil
+}
+
+// MigrateAttributes replaces the attributes of a customer still at the
+// version it was read at
+func (m *Mongo) MigrateAttributes(user users.User, attrs map[string]interface{}, version int64) error {
+	id, err := primitive.ObjectIDFromHex(user.UserID)
+	if err != nil {
+		return db.ErrNotFound
+	}
+	current := storedVersion(user.Version)
+	at := now()
+	update := bson.M{"$set": bson.M{"attributesVersion": version, "version": current + 1, "updatedAt": at}}
+	if len(attrs) > 0 {
+		update["$set"].(bson.M)["attributes"] = attrs
+	} else {
+		update["$unset"] = bson.M{"attributes": ""}
+	}
+	return m.atomically(func(u *unitOfWork) error {
+		res, err := u.collection("customers").UpdateOne(u.ctx, bson.M{"_id": id, "version": versionFilter(current), "deletedAt": nil}, update)
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 0 {
+			return m.conflict("customers", id)
+		}
+		return u.record("customers", db.ChangeUpdated, at, id)
+	})
+}
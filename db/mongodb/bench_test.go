@@ -0,0 +1,136 @@
+package mongodb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/users"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// The benchmarks and the tests against a database need a running Mongo, given
+// as for the service by MONGODB_CONNECTION_STRING, and are skipped without
+// one. They use and drop a database of their own.
+//
+//	MONGODB_CONNECTION_STRING=mongodb://localhost:27017 go test -run - -bench . ./db/mongodb
+func liveMongo(tb testing.TB, database string) *Mongo {
+	if os.Getenv("MONGODB_CONNECTION_STRING") == "" {
+		tb.Skip("MONGODB_CONNECTION_STRING is not set")
+	}
+	name := mongoDatabase
+	mongoDatabase = database
+	m := &Mongo{}
+	if err := m.Init(); err != nil {
+		tb.Skip(err)
+	}
+	if err := m.Ping(); err != nil {
+		tb.Skip(err)
+	}
+	tb.Cleanup(func() {
+		m.Client.Database(mongoDatabase).Drop(context.Background())
+		mongoDatabase = name
+	})
+	m.Client.Database(mongoDatabase).Drop(context.Background())
+	return m
+}
+
+func benchMongo(b *testing.B, customers int) *Mongo {
+	m := liveMongo(b, "users_bench")
+	for i := 0; i < customers; i++ {
+		u := users.New()
+		u.Username = fmt.Sprintf("bench%v", i)
+		u.Email = u.Username + "@example.com"
+		u.Addresses = []users.Address{{Street: "Whitelees Road"}, {Street: "Crown Street"}}
+		u.Cards = []users.Card{{LongNum: "4111111111111111", Expires: "12/30"}}
+		if err := m.CreateUser(&u); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return m
+}
+
+// findAttributes is how the attributes of a customer were loaded before the
+// aggregation, with one query for each collection
+func (m *Mongo) findAttributes(user *users.User) error {
+	addressIds, err := objectIDs(len(user.Addresses), func(i int) string { return user.Addresses[i].ID })
+	if err != nil {
+		return err
+	}
+	cur, err := m.Client.Database(mongoDatabase).Collection("addresses").Find(context.Background(), bson.M{"_id": bson.M{"$in": addressIds}, "deletedAt": nil})
+	if err != nil {
+		return err
+	}
+	var addresses []MongoAddress
+	if err := cur.All(context.Background(), &addresses); err != nil {
+		return err
+	}
+	cardIds, err := objectIDs(len(user.Cards), func(i int) string { return user.Cards[i].ID })
+	if err != nil {
+		return err
+	}
+	cur, err = m.Client.Database(mongoDatabase).Collection("cards").Find(context.Background(), bson.M{"_id": bson.M{"$in": cardIds}, "deletedAt": nil})
+	if err != nil {
+		return err
+	}
+	var cards []MongoCard
+	if err := cur.All(context.Background(), &cards); err != nil {
+		return err
+	}
+	mongoEmbedded{AddressDocs: addresses, CardDocs: cards}.embed(user, true, true)
+	return nil
+}
+
+func benchmarkLogin(b *testing.B, attributes func(*Mongo, *users.User) error) {
+	m := benchMongo(b, 1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		u, err := m.GetUserByName("bench0")
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := attributes(m, &u); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLoginFind(b *testing.B) {
+	benchmarkLogin(b, (*Mongo).findAttributes)
+}
+
+func BenchmarkLoginAggregate(b *testing.B) {
+	benchmarkLogin(b, (*Mongo).GetUserAttributes)
+}
+
+// BenchmarkListAttributesEach loads a page of customers and then the
+// attributes of each customer, as a client of the listing had to
+func BenchmarkListAttributesEach(b *testing.B) {
+	m := benchMongo(b, 50)
+	o := db.ListOptions{Limit: 50}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		us, _, err := m.GetUsers(o)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for k := range us {
+			if err := m.GetUserAttributes(&us[k]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkListEmbedded(b *testing.B) {
+	m := benchMongo(b, 50)
+	o := db.ListOptions{Limit: 50, Embed: []string{db.EmbedAddresses, db.EmbedCards}}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := m.GetUsers(o); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
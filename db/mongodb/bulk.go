@@ -0,0 +1,219 @@
+package mongodb
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/users"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// upserts is one bulk write of documents to a collection, remembering the
+// customer each document belongs to
+type upserts struct {
+	collectionName string
+	models         []mongo.WriteModel
+	ids            []primitive.ObjectID
+	owners         []int
+}
+
+// add queues the upsert of doc under id, for the customer at index owner.
+// The version is bumped and a deleted document comes back to life.
+func (w *upserts) add(id primitive.ObjectID, doc interface{}, owner int) error {
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	var set bson.M
+	if err := bson.Unmarshal(b, &set); err != nil {
+		return err
+	}
+	delete(set, "_id")
+	delete(set, "version")
+	delete(set, "deletedAt")
+	w.models = append(w.models, mongo.NewUpdateOneModel().
+		SetFilter(bson.M{"_id": id}).
+		SetUpdate(bson.M{"$set": set, "$inc": bson.M{"version": 1}, "$unset": bson.M{"deletedAt": ""}}).
+		SetUpsert(true))
+	w.ids = append(w.ids, id)
+	w.owners = append(w.owners, owner)
+	return nil
+}
+
+// write runs the upserts unordered, setting the error of the customers whose
+// documents failed. It returns the ids created and the ids updated.
+func (w *upserts) write(database *mongo.Database, errs []error, describe func(error) error) ([]primitive.ObjectID, []primitive.ObjectID, error) {
+	if len(w.models) == 0 {
+		return nil, nil, nil
+	}
+	res, err := database.Collection(w.collectionName).BulkWrite(context.Background(), w.models, options.BulkWrite().SetOrdered(false))
+	failed := make(map[int]bool)
+	if bwe, ok := err.(mongo.BulkWriteException); ok && bwe.WriteConcernError == nil {
+		for _, we := range bwe.WriteErrors {
+			failed[we.Index] = true
+			if errs[w.owners[we.Index]] == nil {
+				errs[w.owners[we.Index]] = describe(we.WriteError)
+			}
+		}
+	} else if err != nil {
+		return nil, nil, err
+	}
+	var created, updated []primitive.ObjectID
+	for i, id := range w.ids {
+		if failed[i] {
+			continue
+		}
+		if _, ok := res.UpsertedIDs[int64(i)]; ok {
+			created = append(created, id)
+		} else {
+			updated = append(updated, id)
+		}
+	}
+	return created, updated, nil
+}
+
+// objectID parses the id of an imported document, making up one for new
+// documents without an id
+func objectID(id string) (primitive.ObjectID, error) {
+	if id == "" {
+		return primitive.NewObjectID(), nil
+	}
+	return primitive.ObjectIDFromHex(id)
+}
+
+// UpsertUsers creates or replaces customers with their addresses and cards,
+// keeping the ids they hold, with one unordered bulk write per collection.
+// Customers are written first, and only the attributes of those written are;
+// a customer whose address or card fails is reported although it was written,
+// and upserting it again completes it.
+// The writes are recorded in the change feed but publish no events, as the
+// customers are not new to the business. The ids made up for new customers,
+// addresses and cards are set on us.
+func (m *Mongo) UpsertUsers(us []users.User) ([]error, error) {
+	errs := make([]error, len(us))
+	at := now()
+	customers := upserts{collectionName: "customers"}
+	for i := range us {
+		u := &us[i]
+		mu := New()
+		mu.User = *u
+		var err error
+		if mu.ID, err = objectID(u.UserID); err != nil {
+			errs[i] = fmt.Errorf("invalid id %q", u.UserID)
+			continue
+		}
+		stamp(&mu.CreatedAt, &mu.UpdatedAt, at)
+		mu.UsernameKey = users.Canonical(u.Username)
+		mu.UsernameKeys = users.ReservedNames(u.Username, u.UsernameChanges, at)
+		mu.EmailKey = users.Canonical(u.Email)
+		mu.Status = users.CurrentStatus(u.Status)
+		for j := range u.Addresses {
+			id, err := objectID(u.Addresses[j].ID)
+			if err != nil {
+				errs[i] = fmt.Errorf("address %d: invalid id %q", j+1, u.Addresses[j].ID)
+				break
+			}
+			u.Addresses[j].ID = id.Hex()
+			mu.AddressIDs = append(mu.AddressIDs, id)
+		}
+		for j := range u.Cards {
+			id, err := objectID(u.Cards[j].ID)
+			if err != nil {
+				errs[i] = fmt.Errorf("card %d: invalid id %q", j+1, u.Cards[j].ID)
+				break
+			}
+			u.Cards[j].ID = id.Hex()
+			mu.CardIDs = append(mu.CardIDs, id)
+		}
+		if errs[i] != nil {
+			continue
+		}
+		u.UserID = mu.ID.Hex()
+		held := make([]heldAddress, 0, len(u.Addresses))
+		for j, a := range u.Addresses {
+			held = append(held, heldAddress{ID: mu.AddressIDs[j], Type: a.Type})
+		}
+		mu.DefaultIDs = chooseDefaults(parseDefaults(u.Defaults), held, mu.CardIDs)
+		u.Defaults = mu.DefaultIDs.defaults()
+		if err := customers.add(mu.ID, mu, i); err != nil {
+			errs[i] = err
+		}
+	}
+
+	database := m.Client.Database(mongoDatabase)
+	createdCustomers, updatedCustomers, err := customers.write(database, errs, duplicate)
+	if err != nil {
+		return errs, err
+	}
+
+	addresses := upserts{collectionName: "addresses"}
+	cards := upserts{collectionName: "cards"}
+	for i, u := range us {
+		if errs[i] != nil {
+			continue
+		}
+		for _, a := range u.Addresses {
+			ma := MongoAddress{Address: a}
+			ma.ID, _ = primitive.ObjectIDFromHex(a.ID)
+			stamp(&ma.CreatedAt, &ma.UpdatedAt, at)
+			if err := addresses.add(ma.ID, ma, i); err != nil {
+				errs[i] = err
+			}
+		}
+		for _, c := range u.Cards {
+			mc := MongoCard{Card: c}
+			mc.ID, _ = primitive.ObjectIDFromHex(c.ID)
+			stamp(&mc.CreatedAt, &mc.UpdatedAt, at)
+			if err := cards.add(mc.ID, mc, i); err != nil {
+				errs[i] = err
+			}
+		}
+	}
+	attribute := func(name string) func(error) error {
+		return func(err error) error { return fmt.Errorf("%v: %v", name, err) }
+	}
+	createdAddresses, updatedAddresses, err := addresses.write(database, errs, attribute("address"))
+	if err != nil {
+		return errs, err
+	}
+	createdCards, updatedCards, err := cards.write(database, errs, attribute("card"))
+	if err != nil {
+		return errs, err
+	}
+
+	return errs, m.atomically(func(u *unitOfWork) error {
+		for _, changes := range []struct {
+			collectionName, op string
+			ids                []primitive.ObjectID
+		}{
+			{"cards", db.ChangeCreated, createdCards},
+			{"cards", db.ChangeUpdated, updatedCards},
+			{"addresses", db.ChangeCreated, createdAddresses},
+			{"addresses", db.ChangeUpdated, updatedAddresses},
+			{"customers", db.ChangeCreated, createdCustomers},
+			{"customers", db.ChangeUpdated, updatedCustomers},
+		} {
+			if err := u.record(changes.collectionName, changes.op, at, changes.ids...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// stamp sets the creation and update times of an imported document that has
+// none
+func stamp(createdAt, updatedAt *time.Time, at time.Time) {
+	if createdAt.IsZero() {
+		*createdAt = at
+	}
+	if updatedAt.IsZero() {
+		*updatedAt = at
+	}
+}
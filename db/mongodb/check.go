@@ -0,0 +1,284 @@
+package mongodb
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/events"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var _ db.Checker = &Mongo{}
+
+// reference is an address or card id held by a customer
+type reference struct {
+	attr  string
+	id    primitive.ObjectID
+	owner primitive.ObjectID
+}
+
+// Check looks for customers referencing addresses and cards that are not
+// stored, addresses and cards referenced by several customers, and live
+// addresses and cards no customer references. Each is found by one
+// aggregation per collection, so nothing is loaded into the service but
+// what is wrong. Repairs are written in batches, each a unit of work.
+func (m *Mongo) Check(o db.CheckOptions) (db.CheckReport, error) {
+	report := db.CheckReport{Repair: o.Repair, Issues: make([]db.Inconsistency, 0)}
+	database := m.Client.Database(mongoDatabase)
+	for collectionName, count := range map[string]*int64{"customers": &report.Customers, "addresses": &report.Addresses, "cards": &report.Cards} {
+		n, err := database.Collection(collectionName).CountDocuments(context.Background(), bson.M{})
+		if err != nil {
+			return report, err
+		}
+		*count = n
+	}
+
+	before := now().Add(-o.Grace)
+	pulls := make([]reference, 0)
+	orphans := make(map[string][]primitive.ObjectID)
+	for _, attr := range []string{"addresses", "cards"} {
+		dangling, err := m.danglingReferences(attr, before)
+		if err != nil {
+			return report, err
+		}
+		for _, r := range dangling {
+			report.Add(db.Inconsistency{Kind: db.Dangling, Entity: attr, ID: r.id.Hex(), Customers: []string{r.owner.Hex()}})
+			pulls = append(pulls, r)
+		}
+
+		duplicates, err := m.duplicateReferences(attr)
+		if err != nil {
+			return report, err
+		}
+		for id, owners := range duplicates {
+			customers := make([]string, 0, len(owners))
+			for k, owner := range owners {
+				customers = append(customers, owner.Hex())
+				if k > 0 {
+					pulls = append(pulls, reference{attr: attr, id: id, owner: owner})
+				}
+			}
+			report.Add(db.Inconsistency{Kind: db.Duplicate, Entity: attr, ID: id.Hex(), Customers: customers})
+		}
+
+		if orphans[attr], err = m.orphans(attr, before); err != nil {
+			return report, err
+		}
+		for _, id := range orphans[attr] {
+			report.Add(db.Inconsistency{Kind: db.Orphan, Entity: attr, ID: id.Hex()})
+		}
+	}
+	if !o.Repair {
+		return report, nil
+	}
+
+	n, err := m.pullReferences(pulls, o.Batch)
+	report.Repaired += n
+	if err != nil {
+		return report, err
+	}
+	for _, attr := range []string{"addresses", "cards"} {
+		n, err := m.deleteOrphans(attr, orphans[attr], o.Batch)
+		report.Repaired += n
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// danglingReferences returns the attr references of customers last changed
+// before the given time to documents that are not stored, deleted or not
+func (m *Mongo) danglingReferences(attr string, before time.Time) ([]reference, error) {
+	cur, err := m.Client.Database(mongoDatabase).Collection("customers").Aggregate(context.Background(), []bson.M{
+		{"$match": bson.M{"updatedAt": bson.M{"$lt": before}}},
+		{"$project": bson.M{attr: 1}},
+		{"$unwind": "$" + attr},
+		{"$lookup": bson.M{
+			"from":         attr,
+			"localField":   attr,
+			"foreignField": "_id",
+			"pipeline":     []bson.M{{"$project": bson.M{"_id": 1}}},
+			"as":           "found",
+		}},
+		{"$match": bson.M{"found": bson.M{"$size": 0}}},
+		{"$project": bson.M{"_id": 0, "owner": "$_id", "id": "$" + attr}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, err
+	}
+	var docs []struct {
+		ID    primitive.ObjectID `bson:"id"`
+		Owner primitive.ObjectID `bson:"owner"`
+	}
+	if err := cur.All(context.Background(), &docs); err != nil {
+		return nil, err
+	}
+	refs := make([]reference, 0, len(docs))
+	for _, d := range docs {
+		refs = append(refs, reference{attr: attr, id: d.ID, owner: d.Owner})
+	}
+	return refs, nil
+}
+
+// duplicateReferences returns the attr documents referenced by more than one
+// customer, with their customers oldest first
+func (m *Mongo) duplicateReferences(attr string) (map[primitive.ObjectID][]primitive.ObjectID, error) {
+	cur, err := m.Client.Database(mongoDatabase).Collection("customers").Aggregate(context.Background(), []bson.M{
+		{"$project": bson.M{attr: 1}},
+		{"$unwind": "$" + attr},
+		{"$group": bson.M{"_id": "$" + attr, "owners": bson.M{"$addToSet": "$_id"}}},
+		{"$match": bson.M{"owners.1": bson.M{"$exists": true}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, err
+	}
+	var docs []struct {
+		ID     primitive.ObjectID   `bson:"_id"`
+		Owners []primitive.ObjectID `bson:"owners"`
+	}
+	if err := cur.All(context.Background(), &docs); err != nil {
+		return nil, err
+	}
+	duplicates := make(map[primitive.ObjectID][]primitive.ObjectID, len(docs))
+	for _, d := range docs {
+		duplicates[d.ID] = oldestFirst(d.Owners)
+	}
+	return duplicates, nil
+}
+
+// oldestFirst sorts ObjectIDs by the time they were made
+func oldestFirst(ids []primitive.ObjectID) []primitive.ObjectID {
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Hex() < ids[j].Hex() })
+	return ids
+}
+
+// orphans returns the live attr documents created before the given time
+// that no customer references, deleted or not, and no guest session holds
+func (m *Mongo) orphans(attr string, before time.Time) ([]primitive.ObjectID, error) {
+	cur, err := m.Client.Database(mongoDatabase).Collection(attr).Aggregate(context.Background(), []bson.M{
+		{"$match": bson.M{"deletedAt": nil, "guest": nil, "createdAt": bson.M{"$lt": before}}},
+		{"$project": bson.M{"_id": 1}},
+		{"$lookup": bson.M{
+			"from":         "customers",
+			"localField":   "_id",
+			"foreignField": attr,
+			"pipeline":     []bson.M{{"$project": bson.M{"_id": 1}}},
+			"as":           "owners",
+		}},
+		{"$match": bson.M{"owners": bson.M{"$size": 0}}},
+		{"$project": bson.M{"_id": 1}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, err
+	}
+	var docs []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cur.All(context.Background(), &docs); err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, 0, len(docs))
+	for _, d := range docs {
+		ids = append(ids, d.ID)
+	}
+	return ids, nil
+}
+
+// pullReferences takes references out of their customers, batch references
+// per unit of work, recording the customers changed. It returns the number
+// of references taken out.
+func (m *Mongo) pullReferences(refs []reference, batch int) (int, error) {
+	pulled := 0
+	for start := 0; start < len(refs); start += batch {
+		end := start + batch
+		if end > len(refs) {
+			end = len(refs)
+		}
+		n := 0
+		err := m.atomically(func(u *unitOfWork) error {
+			n = 0
+			changed := make([]primitive.ObjectID, 0)
+			seen := make(map[primitive.ObjectID]bool)
+			for _, r := range refs[start:end] {
+				ids, err := u.update("customers",
+					bson.M{"_id": r.owner, r.attr: r.id},
+					bson.M{"$pull": bson.M{r.attr: r.id}},
+					bson.M{"$addToSet": bson.M{r.attr: r.id}})
+				if err != nil {
+					return err
+				}
+				n += len(ids)
+				if len(ids) > 0 && !seen[r.owner] {
+					seen[r.owner] = true
+					changed = append(changed, r.owner)
+				}
+			}
+			if err := u.record("customers", db.ChangeUpdated, now(), changed...); err != nil {
+				return err
+			}
+			return u.settleDefaults(now(), changed...)
+		})
+		if err != nil {
+			return pulled, err
+		}
+		pulled += n
+	}
+	return pulled, nil
+}
+
+// deleteOrphans deletes attr documents, batch per unit of work, skipping
+// the ones a customer took up since they were found. It returns the number
+// deleted.
+func (m *Mongo) deleteOrphans(attr string, ids []primitive.ObjectID, batch int) (int, error) {
+	deleted := 0
+	for start := 0; start < len(ids); start += batch {
+		end := start + batch
+		if end > len(ids) {
+			end = len(ids)
+		}
+		n := 0
+		err := m.atomically(func(u *unitOfWork) error {
+			held, err := u.collection("customers").Distinct(u.ctx, attr, bson.M{attr: bson.M{"$in": ids[start:end]}})
+			if err != nil {
+				return err
+			}
+			taken := make(map[primitive.ObjectID]bool, len(held))
+			for _, h := range held {
+				if id, ok := h.(primitive.ObjectID); ok {
+					taken[id] = true
+				}
+			}
+			orphans := make([]primitive.ObjectID, 0, end-start)
+			for _, id := range ids[start:end] {
+				if !taken[id] {
+					orphans = append(orphans, id)
+				}
+			}
+			at := now()
+			removed, err := u.updateAndRecord(attr, bson.M{"_id": bson.M{"$in": orphans}, "deletedAt": nil},
+				bson.M{"$set": bson.M{"deletedAt": at, "updatedAt": at}},
+				bson.M{"$unset": bson.M{"deletedAt": ""}},
+				db.ChangeDeleted, at)
+			if err != nil {
+				return err
+			}
+			n = len(removed)
+			published := make([]events.Payload, 0, len(removed))
+			for _, id := range removed {
+				published = append(published, events.Removed(attr, id.Hex(), "", false))
+			}
+			return u.publish(at, published...)
+		})
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
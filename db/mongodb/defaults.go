@@ -0,0 +1,260 @@
+package mongodb
+
+import (
+	"time"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/users"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var _ db.DefaultsSetter = &Mongo{}
+
+// mongoDefaults are the default addresses and card of a customer
+type mongoDefaults struct {
+	ShippingAddress *primitive.ObjectID `bson:"defaultShippingAddress,omitempty"`
+	BillingAddress  *primitive.ObjectID `bson:"defaultBillingAddress,omitempty"`
+	Card            *primitive.ObjectID `bson:"defaultCard,omitempty"`
+}
+
+// fields returns the defaults by the field they are stored in
+func (d mongoDefaults) fields() map[string]*primitive.ObjectID {
+	return map[string]*primitive.ObjectID{
+		"defaultShippingAddress": d.ShippingAddress,
+		"defaultBillingAddress":  d.BillingAddress,
+		"defaultCard":            d.Card,
+	}
+}
+
+func (d mongoDefaults) equal(o mongoDefaults) bool {
+	same := func(a, b *primitive.ObjectID) bool {
+		return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+	}
+	return same(d.ShippingAddress, o.ShippingAddress) && same(d.BillingAddress, o.BillingAddress) && same(d.Card, o.Card)
+}
+
+// defaults returns the defaults as ids
+func (d mongoDefaults) defaults() users.Defaults {
+	hex := func(id *primitive.ObjectID) string {
+		if id == nil {
+			return ""
+		}
+		return id.Hex()
+	}
+	return users.Defaults{ShippingAddress: hex(d.ShippingAddress), BillingAddress: hex(d.BillingAddress), Card: hex(d.Card)}
+}
+
+// parseDefaults returns ids as defaults, leaving out the ones that are not
+// ObjectIDs
+func parseDefaults(d users.Defaults) mongoDefaults {
+	parse := func(id string) *primitive.ObjectID {
+		if objectId, err := primitive.ObjectIDFromHex(id); err == nil {
+			return &objectId
+		}
+		return nil
+	}
+	return mongoDefaults{ShippingAddress: parse(d.ShippingAddress), BillingAddress: parse(d.BillingAddress), Card: parse(d.Card)}
+}
+
+// heldAddress is a live address a customer holds with its type
+type heldAddress struct {
+	ID   primitive.ObjectID `bson:"_id"`
+	Type string             `bson:"type"`
+}
+
+// chooseDefaults keeps the defaults that are held and fit their use and
+// replaces the others with the first address or card that does, in the order
+// the customer holds them. A default nothing fits is left out.
+func chooseDefaults(d mongoDefaults, addresses []heldAddress, cards []primitive.ObjectID) mongoDefaults {
+	address := func(current *primitive.ObjectID, fits func(users.Address) bool) *primitive.ObjectID {
+		var first *primitive.ObjectID
+		for i, a := range addresses {
+			if !fits(users.Address{Type: a.Type}) {
+				continue
+			}
+			if current != nil && *current == a.ID {
+				return current
+			}
+			if first == nil {
+				first = &addresses[i].ID
+			}
+		}
+		return first
+	}
+	chosen := mongoDefaults{
+		ShippingAddress: address(d.ShippingAddress, users.Address.Ships),
+		BillingAddress:  address(d.BillingAddress, users.Address.Bills),
+	}
+	for i, id := range cards {
+		if d.Card != nil && *d.Card == id {
+			chosen.Card = d.Card
+			break
+		}
+		if chosen.Card == nil {
+			chosen.Card = &cards[i]
+		}
+	}
+	return chosen
+}
+
+// SetDefaults replaces the defaults of a customer, choosing the ones left
+// empty
+func (m *Mongo) SetDefaults(customerID string, d *users.Defaults) error {
+	owner, err := primitive.ObjectIDFromHex(customerID)
+	if err != nil {
+		return db.ErrNotFound
+	}
+	given := parseDefaults(*d)
+	if (d.ShippingAddress != "" && given.ShippingAddress == nil) || (d.BillingAddress != "" && given.BillingAddress == nil) || (d.Card != "" && given.Card == nil) {
+		return db.ErrIneligibleDefault
+	}
+	var chosen mongoDefaults
+	err = m.atomically(func(u *unitOfWork) error {
+		if err := u.writable(customerID); err != nil {
+			return err
+		}
+		var err error
+		chosen, err = u.setDefaults(owner, &given, now())
+		return err
+	})
+	if err == nil {
+		*d = chosen.defaults()
+	}
+	return err
+}
+
+// settleDefaults has the defaults of customers point at live addresses and
+// cards they hold that fit, after these changed
+func (u *unitOfWork) settleDefaults(at time.Time, owners ...primitive.ObjectID) error {
+	for _, owner := range owners {
+		if _, err := u.setDefaults(owner, nil, at); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// settle settles the defaults of the customer with the given hex id, if any,
+// as returned by owner
+func (u *unitOfWork) settle(owner string, at time.Time) error {
+	if owner == "" {
+		return nil
+	}
+	id, err := primitive.ObjectIDFromHex(owner)
+	if err != nil {
+		return err
+	}
+	return u.settleDefaults(at, id)
+}
+
+// setDefaults chooses the defaults of a live customer, starting from the
+// given ones or, when nil, the stored ones, and stores them if they changed.
+// A given default the customer does not hold or that does not fit is
+// refused.
+func (u *unitOfWork) setDefaults(owner primitive.ObjectID, given *mongoDefaults, at time.Time) (mongoDefaults, error) {
+	var mu struct {
+		AddressIDs    []primitive.ObjectID `bson:"addresses"`
+		CardIDs       []primitive.ObjectID `bson:"cards"`
+		Version       int64                `bson:"version"`
+		mongoDefaults `bson:",inline"`
+	}
+	err := u.collection("customers").FindOne(u.ctx, bson.M{"_id": owner, "deletedAt": nil}).Decode(&mu)
+	if err == mongo.ErrNoDocuments && given == nil {
+		return mongoDefaults{}, nil
+	}
+	if err != nil {
+		return mongoDefaults{}, notFound(err)
+	}
+	addresses, cards, err := u.held(mu.AddressIDs, mu.CardIDs)
+	if err != nil {
+		return mongoDefaults{}, err
+	}
+	current := mu.mongoDefaults
+	if given != nil {
+		current = *given
+	}
+	chosen := chooseDefaults(current, addresses, cards)
+	if given != nil {
+		kept := chosen.fields()
+		for field, id := range given.fields() {
+			if id != nil && (kept[field] == nil || *kept[field] != *id) {
+				return mongoDefaults{}, db.ErrIneligibleDefault
+			}
+		}
+	}
+	if chosen.equal(mu.mongoDefaults) {
+		return chosen, nil
+	}
+
+	version := storedVersion(mu.Version)
+	change := bson.M{"$set": bson.M{"version": version + 1, "updatedAt": at}}
+	revert := bson.M{"$set": bson.M{"version": version}}
+	for _, op := range []struct {
+		update bson.M
+		fields map[string]*primitive.ObjectID
+	}{{change, chosen.fields()}, {revert, mu.mongoDefaults.fields()}} {
+		unset := bson.M{}
+		for field, id := range op.fields {
+			if id == nil {
+				unset[field] = ""
+			} else {
+				op.update["$set"].(bson.M)[field] = *id
+			}
+		}
+		if len(unset) > 0 {
+			op.update["$unset"] = unset
+		}
+	}
+	ids, err := u.update("customers", bson.M{"_id": owner, "version": versionFilter(version)}, change, revert)
+	if err != nil {
+		return mongoDefaults{}, err
+	}
+	if len(ids) == 0 {
+		return mongoDefaults{}, db.ErrVersionConflict
+	}
+	return chosen, u.record("customers", db.ChangeUpdated, at, owner)
+}
+
+// held returns the live addresses and cards with the given ids, in the order
+// of the ids
+func (u *unitOfWork) held(addressIDs, cardIDs []primitive.ObjectID) ([]heldAddress, []primitive.ObjectID, error) {
+	find := func(collectionName string, ids []primitive.ObjectID) ([]heldAddress, error) {
+		cur, err := u.collection(collectionName).Find(u.ctx, bson.M{"_id": bson.M{"$in": ids}, "deletedAt": nil},
+			options.Find().SetProjection(bson.M{"_id": 1, "type": 1}))
+		if err != nil {
+			return nil, err
+		}
+		var docs []heldAddress
+		if err := cur.All(u.ctx, &docs); err != nil {
+			return nil, err
+		}
+		found := make(map[primitive.ObjectID]heldAddress, len(docs))
+		for _, d := range docs {
+			found[d.ID] = d
+		}
+		held := make([]heldAddress, 0, len(docs))
+		for _, id := range ids {
+			if d, ok := found[id]; ok {
+				held = append(held, d)
+			}
+		}
+		return held, nil
+	}
+	addresses, err := find("addresses", addressIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	docs, err := find("cards", cardIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	cards := make([]primitive.ObjectID, 0, len(docs))
+	for _, d := range docs {
+		cards = append(cards, d.ID)
+	}
+	return addresses, cards, nil
+}
@@ -0,0 +1,234 @@
+package mongodb
+
+import (
+	"context"
+	"time"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/dsar"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var _ dsar.Store = &Mongo{}
+
+// archiveChunkSize is the most bytes of an archive one access_archives
+// document holds, well under the size limit of a document
+const archiveChunkSize = 1 << 20
+
+// mongoAccessRequest is a wrapper for access requests, holding the time the
+// request is held by a worker until. Archives are kept in access_archives,
+// in chunks, as they can outgrow a document.
+type mongoAccessRequest struct {
+	dsar.Request `bson:",inline"`
+	ID           string     `bson:"_id"`
+	LeaseUntil   *time.Time `bson:"leaseUntil,omitempty"`
+}
+
+func (mr mongoAccessRequest) request() dsar.Request {
+	r := mr.Request
+	r.ID = mr.ID
+	return r
+}
+
+// archiveChunk is a piece of the archive of an access request
+type archiveChunk struct {
+	Request string `bson:"request"`
+	N       int    `bson:"n"`
+	Data    []byte `bson:"data"`
+}
+
+// requestProjection leaves out the archive of requests completed before
+// archives were chunked
+var requestProjection = bson.M{"archive": 0}
+
+// CreateAccessRequest stores a pending access request
+func (m *Mongo) CreateAccessRequest(r *dsar.Request) error {
+	id, err := dsar.NewID()
+	if err != nil {
+		return err
+	}
+	mr := mongoAccessRequest{Request: *r, ID: id}
+	mr.Status = dsar.StatusPending
+	mr.CreatedAt = now()
+	collection := m.Client.Database(mongoDatabase).Collection("access_requests")
+	if _, err := collection.InsertOne(context.Background(), mr); err != nil {
+		return err
+	}
+	*r = mr.request()
+	return nil
+}
+
+// GetAccessRequest returns an access request by id
+func (m *Mongo) GetAccessRequest(id string) (dsar.Request, error) {
+	collection := m.Client.Database(mongoDatabase).Collection("access_requests")
+	var mr mongoAccessRequest
+	err := collection.FindOne(context.Background(), bson.M{"_id": id},
+		options.FindOne().SetProjection(requestProjection)).Decode(&mr)
+	if err != nil {
+		return dsar.Request{}, notFound(err)
+	}
+	return mr.request(), nil
+}
+
+// ClaimAccessRequest returns the oldest pending request, or a running one
+// whose lease ran out, holding it until the given time
+func (m *Mongo) ClaimAccessRequest(now, until time.Time) (*dsar.Request, error) {
+	collection := m.Client.Database(mongoDatabase).Collection("access_requests")
+	var mr mongoAccessRequest
+	err := collection.FindOneAndUpdate(context.Background(),
+		bson.M{"$or": bson.A{
+			bson.M{"status": dsar.StatusPending},
+			bson.M{"status": dsar.StatusRunning, "leaseUntil": bson.M{"$lte": now}},
+		}},
+		bson.M{"$set": bson.M{"status": dsar.StatusRunning, "leaseUntil": until}},
+		options.FindOneAndUpdate().
+			SetSort(bson.D{{Key: "createdAt", Value: 1}}).
+			SetProjection(requestProjection).
+			SetReturnDocument(options.After),
+	).Decode(&mr)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	r := mr.request()
+	return &r, nil
+}
+
+// CompleteAccessRequest saves the archive of a request in chunks, replacing
+// those a worker that lost its lease may have left
+func (m *Mongo) CompleteAccessRequest(id string, archive []byte, at, expires time.Time) error {
+	chunks := m.Client.Database(mongoDatabase).Collection("access_archives")
+	if _, err := chunks.DeleteMany(context.Background(), bson.M{"request": id}); err != nil {
+		return err
+	}
+	docs := make([]interface{}, 0, len(archive)/archiveChunkSize+1)
+	for n := 0; n*archiveChunkSize < len(archive); n++ {
+		end := (n + 1) * archiveChunkSize
+		if end > len(archive) {
+			end = len(archive)
+		}
+		docs = append(docs, archiveChunk{Request: id, N: n, Data: archive[n*archiveChunkSize : end]})
+	}
+	if len(docs) > 0 {
+		if _, err := chunks.InsertMany(context.Background(), docs); err != nil {
+			return err
+		}
+	}
+	return m.finishAccessRequest(id, bson.M{
+		"status":      dsar.StatusDone,
+		"size":        len(archive),
+		"completedAt": at,
+		"expiresAt":   expires,
+	})
+}
+
+// FailAccessRequest records why a request could not be answered
+func (m *Mongo) FailAccessRequest(id, reason string, at, expires time.Time) error {
+	return m.finishAccessRequest(id, bson.M{
+		"status":      dsar.StatusFailed,
+		"error":       reason,
+		"completedAt": at,
+		"expiresAt":   expires,
+	})
+}
+
+func (m *Mongo) finishAccessRequest(id string, set bson.M) error {
+	collection := m.Client.Database(mongoDatabase).Collection("access_requests")
+	res, err := collection.UpdateOne(context.Background(), bson.M{"_id": id},
+		bson.M{"$set": set, "$unset": bson.M{"leaseUntil": ""}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+// AccessArchive returns the archive of a finished request
+func (m *Mongo) AccessArchive(id string) ([]byte, error) {
+	collection := m.Client.Database(mongoDatabase).Collection("access_requests")
+	var doc struct {
+		Status  string `bson:"status"`
+		Size    int    `bson:"size"`
+		Archive []byte `bson:"archive"`
+	}
+	err := collection.FindOne(context.Background(), bson.M{"_id": id},
+		options.FindOne().SetProjection(bson.M{"status": 1, "size": 1, "archive": 1})).Decode(&doc)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	if doc.Status != dsar.StatusDone {
+		return nil, dsar.ErrNotReady
+	}
+	if doc.Archive != nil {
+		return doc.Archive, nil
+	}
+	chunks := m.Client.Database(mongoDatabase).Collection("access_archives")
+	cur, err := chunks.Find(context.Background(), bson.M{"request": id},
+		options.Find().SetSort(bson.D{{Key: "n", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(context.Background())
+	archive := make([]byte, 0, doc.Size)
+	for cur.Next(context.Background()) {
+		var c archiveChunk
+		if err := cur.Decode(&c); err != nil {
+			return nil, err
+		}
+		archive = append(archive, c.Data...)
+	}
+	return archive, cur.Err()
+}
+
+// PurgeAccessRequests removes the requests that expired before the given
+// time, archives first
+func (m *Mongo) PurgeAccessRequests(before time.Time) (int, error) {
+	collection := m.Client.Database(mongoDatabase).Collection("access_requests")
+	expired := bson.M{"expiresAt": bson.M{"$lt": before}}
+	cur, err := collection.Find(context.Background(), expired, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, err
+	}
+	var docs []struct {
+		ID string `bson:"_id"`
+	}
+	if err := cur.All(context.Background(), &docs); err != nil {
+		return 0, err
+	}
+	if len(docs) == 0 {
+		return 0, nil
+	}
+	ids := make([]string, 0, len(docs))
+	for _, d := range docs {
+		ids = append(ids, d.ID)
+	}
+	chunks := m.Client.Database(mongoDatabase).Collection("access_archives")
+	if _, err := chunks.DeleteMany(context.Background(), bson.M{"request": bson.M{"$in": ids}}); err != nil {
+		return 0, err
+	}
+	res, err := collection.DeleteMany(context.Background(), bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return 0, err
+	}
+	return int(res.DeletedCount), nil
+}
+
+// AuditTrail returns the changes recorded for the given ids, oldest first
+func (m *Mongo) AuditTrail(ids ...string) ([]dsar.AuditEntry, error) {
+	collection := m.Client.Database(mongoDatabase).Collection("changes")
+	cur, err := collection.Find(context.Background(), bson.M{"id": bson.M{"$in": ids}},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	audit := make([]dsar.AuditEntry, 0)
+	err = cur.All(context.Background(), &audit)
+	return audit, err
+}
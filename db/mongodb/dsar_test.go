@@ -0,0 +1,39 @@
+package mongodb
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/microservices-demo/user/dsar"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAccessArchiveChunks(t *testing.T) {
+	m := liveMongo(t, "users_test")
+	r := dsar.Request{CustomerID: "57a98d98e4b00679b4a830af"}
+	if err := m.CreateAccessRequest(&r); err != nil {
+		t.Fatal(err)
+	}
+	archive := bytes.Repeat([]byte("0123456789"), archiveChunkSize/4)
+	at := time.Now()
+	if err := m.CompleteAccessRequest(r.ID, archive, at, at.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := m.AccessArchive(r.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, archive) {
+		t.Errorf("expected the archive back whole, received %v of %v bytes", len(stored), len(archive))
+	}
+
+	if _, err := m.PurgeAccessRequests(at.Add(2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	n, err := m.Client.Database(mongoDatabase).Collection("access_archives").CountDocuments(context.Background(), bson.M{"request": r.ID})
+	if err != nil || n != 0 {
+		t.Errorf("expected the chunks purged with the request, %v left, %v", n, err)
+	}
+}
@@ -0,0 +1,124 @@
+package mongodb
+
+import (
+	"context"
+	"time"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/events"
+	"github.com/microservices-demo/user/users"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var _ db.EmailVerifier = &Mongo{}
+
+// mongoVerification is a started email verification, kept on its customer
+type mongoVerification struct {
+	Hash      string    `bson:"hash"`
+	EmailKey  string    `bson:"emailKey"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// StartEmailVerification keeps the verification on the customer. It does not
+// change the customer as the API shows it, so the version is left alone.
+func (m *Mongo) StartEmailVerification(customerID, hash string, v *users.EmailVerification) error {
+	id, err := primitive.ObjectIDFromHex(customerID)
+	if err != nil {
+		return db.ErrNotFound
+	}
+	return m.atomically(func(u *unitOfWork) error {
+		if err := u.writable(customerID); err != nil {
+			return err
+		}
+		var mu MongoUser
+		err := u.collection("customers").FindOne(u.ctx, bson.M{"_id": id, "deletedAt": nil}).Decode(&mu)
+		if err != nil {
+			return notFound(err)
+		}
+		if mu.EmailKey == "" {
+			return db.ErrInvalidVerification
+		}
+		started := mongoVerification{Hash: hash, EmailKey: mu.EmailKey, ExpiresAt: v.ExpiresAt}
+		ids, err := u.update("customers", bson.M{"_id": id, "deletedAt": nil},
+			bson.M{"$set": bson.M{"emailVerification": started}},
+			bson.M{"$unset": bson.M{"emailVerification": ""}})
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return db.ErrNotFound
+		}
+		v.Email = mu.Email
+		return nil
+	})
+}
+
+// VerifyEmail marks the email of the customer holding the verification as
+// verified, unless the email changed since the verification was started
+func (m *Mongo) VerifyEmail(hash string, at time.Time) (string, error) {
+	var customerID string
+	err := m.atomically(func(u *unitOfWork) error {
+		doc, err := u.collection("customers").FindOne(u.ctx, bson.M{
+			"emailVerification.hash":      hash,
+			"emailVerification.expiresAt": bson.M{"$gt": at},
+			"deletedAt":                   nil,
+		}).DecodeBytes()
+		if err != nil {
+			if notFound(err) == db.ErrNotFound {
+				return db.ErrInvalidVerification
+			}
+			return err
+		}
+		var mu MongoUser
+		var started struct {
+			Verification mongoVerification `bson:"emailVerification"`
+		}
+		if err := bson.Unmarshal(doc, &mu); err != nil {
+			return err
+		}
+		if err := bson.Unmarshal(doc, &started); err != nil {
+			return err
+		}
+		if started.Verification.EmailKey != mu.EmailKey {
+			return db.ErrInvalidVerification
+		}
+		customerID = mu.ID.Hex()
+		if err := u.writable(customerID); err != nil {
+			return err
+		}
+		version := storedVersion(mu.Version)
+		ids, err := u.update("customers", bson.M{"_id": mu.ID, "version": versionFilter(version)},
+			bson.M{"$set": bson.M{"emailVerified": true, "version": version + 1, "updatedAt": at}, "$unset": bson.M{"emailVerification": ""}},
+			bson.M{"$set": bson.M{"emailVerified": mu.EmailVerified, "version": version, "emailVerification": started.Verification}})
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return db.ErrVersionConflict
+		}
+		if err := u.record("customers", db.ChangeUpdated, at, mu.ID); err != nil {
+			return err
+		}
+		customer := events.NewCustomer(mu.User)
+		customer.CustomerID = customerID
+		return u.publish(at, events.CustomerUpdated{Customer: customer})
+	})
+	return customerID, err
+}
+
+// GetUserByEmail returns the live customer whose verified email has the
+// canonical form of email
+func (m *Mongo) GetUserByEmail(email string) (users.User, error) {
+	if users.Canonical(email) == "" {
+		return users.User{}, db.ErrNotFound
+	}
+	collection := m.Client.Database(mongoDatabase).Collection("customers")
+	var mu MongoUser
+	err := collection.FindOne(context.Background(), bson.M{"emailKey": users.Canonical(email), "emailVerified": true, "deletedAt": nil}).Decode(&mu)
+	if err == nil {
+		mu.AddUserIDs()
+	}
+	return mu.User, notFound(err)
+}
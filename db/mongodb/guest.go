@@ -0,0 +1,279 @@
+package mongodb
+
+import (
+	"context"
+	"time"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/events"
+	"github.com/microservices-demo/user/guest"
+	"github.com/microservices-demo/user/users"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var _ guest.Store = &Mongo{}
+
+// mongoGuest is a guest session, stored by the hash of its token
+type mongoGuest struct {
+	Hash      string    `bson:"_id"`
+	CreatedAt time.Time `bson:"createdAt"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// mongoGuestAddress and mongoGuestCard are the addresses and cards of a
+// guest session. They expire along with it, even when the session is gone.
+type mongoGuestAddress struct {
+	MongoAddress   `bson:",inline"`
+	Guest          string    `bson:"guest"`
+	GuestExpiresAt time.Time `bson:"guestExpiresAt"`
+}
+
+type mongoGuestCard struct {
+	MongoCard      `bson:",inline"`
+	Guest          string    `bson:"guest"`
+	GuestExpiresAt time.Time `bson:"guestExpiresAt"`
+}
+
+// CreateGuest stores a guest session by the hash of its token
+func (m *Mongo) CreateGuest(s guest.Session) error {
+	mg := mongoGuest{Hash: guest.Hash(s.Token), CreatedAt: s.CreatedAt, ExpiresAt: s.ExpiresAt}
+	_, err := m.Client.Database(mongoDatabase).Collection("guests").InsertOne(context.Background(), mg)
+	return err
+}
+
+// liveGuest returns the session of a token unless it expired
+func (m *Mongo) liveGuest(token string) (mongoGuest, error) {
+	var mg mongoGuest
+	err := m.Client.Database(mongoDatabase).Collection("guests").FindOne(context.Background(),
+		bson.M{"_id": guest.Hash(token), "expiresAt": bson.M{"$gt": now()}}).Decode(&mg)
+	if err == mongo.ErrNoDocuments {
+		return mg, guest.ErrInvalidToken
+	}
+	return mg, err
+}
+
+// GetGuest returns a live guest session with its addresses and cards
+func (m *Mongo) GetGuest(token string) (guest.Session, error) {
+	mg, err := m.liveGuest(token)
+	if err != nil {
+		return guest.Session{}, err
+	}
+	s := guest.Session{CreatedAt: mg.CreatedAt, ExpiresAt: mg.ExpiresAt, Addresses: make([]users.Address, 0), Cards: make([]users.Card, 0)}
+	filter := bson.M{"guest": mg.Hash, "deletedAt": nil}
+	database := m.Client.Database(mongoDatabase)
+	cur, err := database.Collection("addresses").Find(context.Background(), filter)
+	if err != nil {
+		return s, err
+	}
+	var addresses []MongoAddress
+	if err := cur.All(context.Background(), &addresses); err != nil {
+		return s, err
+	}
+	for _, ma := range addresses {
+		ma.AddID()
+		s.Addresses = append(s.Addresses, ma.Address)
+	}
+	cur, err = database.Collection("cards").Find(context.Background(), filter)
+	if err != nil {
+		return s, err
+	}
+	var cards []MongoCard
+	if err := cur.All(context.Background(), &cards); err != nil {
+		return s, err
+	}
+	for _, mc := range cards {
+		mc.AddID()
+		s.Cards = append(s.Cards, mc.Card)
+	}
+	return s, nil
+}
+
+// CreateGuestAddress adds an address to a live guest session
+func (m *Mongo) CreateGuestAddress(token string, address *users.Address) error {
+	mg, err := m.liveGuest(token)
+	if err != nil {
+		return err
+	}
+	ma := MongoAddress{Address: *address, ID: primitive.NewObjectID(), Version: 1}
+	ma.CreatedAt = now()
+	ma.UpdatedAt = ma.CreatedAt
+	ma.AddID()
+	doc := mongoGuestAddress{MongoAddress: ma, Guest: mg.Hash, GuestExpiresAt: mg.ExpiresAt}
+	event := events.AddressAdded{Address: events.NewAddress(ma.Address, "")}
+	if err := m.createAttribute("addresses", ma.ID, doc, "", event); err != nil {
+		return err
+	}
+	*address = ma.Address
+	return nil
+}
+
+// CreateGuestCard adds a card to a live guest session
+func (m *Mongo) CreateGuestCard(token string, card *users.Card) error {
+	mg, err := m.liveGuest(token)
+	if err != nil {
+		return err
+	}
+	mc := MongoCard{Card: *card, ID: primitive.NewObjectID(), Version: 1}
+	mc.CreatedAt = now()
+	mc.UpdatedAt = mc.CreatedAt
+	mc.AddID()
+	doc := mongoGuestCard{MongoCard: mc, Guest: mg.Hash, GuestExpiresAt: mg.ExpiresAt}
+	event := events.CardAdded{Card: events.NewCard(mc.Card, "")}
+	if err := m.createAttribute("cards", mc.ID, doc, "", event); err != nil {
+		return err
+	}
+	*card = mc.Card
+	return nil
+}
+
+// ClaimGuest moves the addresses and cards of a live guest session to a
+// customer, publishing them as added to it, and removes the session
+func (m *Mongo) ClaimGuest(token, customerID string) (int, error) {
+	owner, err := primitive.ObjectIDFromHex(customerID)
+	if err != nil {
+		return 0, db.ErrNotFound
+	}
+	hash := guest.Hash(token)
+	claimed := 0
+	err = m.atomically(func(u *unitOfWork) error {
+		claimed = 0
+		at := now()
+		var mg mongoGuest
+		err := u.collection("guests").FindOne(u.ctx, bson.M{"_id": hash, "expiresAt": bson.M{"$gt": at}}).Decode(&mg)
+		if err == mongo.ErrNoDocuments {
+			return guest.ErrInvalidToken
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := u.remove("guests", bson.M{"_id": hash}); err != nil {
+			return err
+		}
+		published := make([]events.Payload, 0)
+		for _, attr := range []string{"addresses", "cards"} {
+			ids, err := u.updateAndRecord(attr, bson.M{"guest": hash, "deletedAt": nil},
+				bson.M{"$unset": bson.M{"guest": "", "guestExpiresAt": ""}, "$set": bson.M{"updatedAt": at}},
+				bson.M{"$set": bson.M{"guest": hash, "guestExpiresAt": mg.ExpiresAt}},
+				db.ChangeUpdated, at)
+			if err != nil {
+				return err
+			}
+			for _, id := range ids {
+				found, err := u.addReference(attr, id, owner)
+				if err != nil {
+					return err
+				}
+				if found == 0 {
+					return db.ErrNotFound
+				}
+			}
+			payloads, err := u.added(attr, ids, customerID)
+			if err != nil {
+				return err
+			}
+			published = append(published, payloads...)
+			claimed += len(ids)
+		}
+		if claimed == 0 {
+			return nil
+		}
+		if err := u.record("customers", db.ChangeUpdated, at, owner); err != nil {
+			return err
+		}
+		if err := u.settleDefaults(at, owner); err != nil {
+			return err
+		}
+		return u.publish(at, published...)
+	})
+	return claimed, err
+}
+
+// added returns the events announcing the addresses or cards with the given
+// ids as added to a customer
+func (u *unitOfWork) added(attr string, ids []primitive.ObjectID, customerID string) ([]events.Payload, error) {
+	payloads := make([]events.Payload, 0, len(ids))
+	if len(ids) == 0 {
+		return payloads, nil
+	}
+	cur, err := u.collection(attr).Find(u.ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	if attr == "addresses" {
+		var docs []MongoAddress
+		if err := cur.All(u.ctx, &docs); err != nil {
+			return nil, err
+		}
+		for _, ma := range docs {
+			ma.AddID()
+			payloads = append(payloads, events.AddressAdded{Address: events.NewAddress(ma.Address, customerID)})
+		}
+		return payloads, nil
+	}
+	var docs []MongoCard
+	if err := cur.All(u.ctx, &docs); err != nil {
+		return nil, err
+	}
+	for _, mc := range docs {
+		mc.AddID()
+		payloads = append(payloads, events.CardAdded{Card: events.NewCard(mc.Card, customerID)})
+	}
+	return payloads, nil
+}
+
+// ExpireGuests removes the guest sessions, addresses and cards that expired
+// before the given time. The addresses and cards are retired, the numbers of
+// cards redacted, and recorded as purged, as orders placed as a guest link to
+// them.
+func (m *Mongo) ExpireGuests(before time.Time) (int, error) {
+	expired := 0
+	err := m.atomically(func(u *unitOfWork) error {
+		for _, attr := range []string{"addresses", "cards"} {
+			ids, err := u.ids(attr, bson.M{"guestExpiresAt": bson.M{"$lt": before}})
+			if err != nil {
+				return err
+			}
+			if _, err := u.retire(attr, bson.M{"_id": bson.M{"$in": ids}}, "", now()); err != nil {
+				return err
+			}
+			if attr == "cards" {
+				if err := u.redactCards(ids); err != nil {
+					return err
+				}
+			}
+			if _, err := u.remove(attr, bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+				return err
+			}
+			if err := u.record(attr, db.ChangePurged, now(), ids...); err != nil {
+				return err
+			}
+		}
+		var err error
+		expired, err = u.remove("guests", bson.M{"expiresAt": bson.M{"$lt": before}})
+		return err
+	})
+	return expired, err
+}
+
+// ids returns the ids of the documents matching filter
+func (u *unitOfWork) ids(collectionName string, filter bson.M) ([]primitive.ObjectID, error) {
+	cur, err := u.collection(collectionName).Find(u.ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var docs []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cur.All(u.ctx, &docs); err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, 0, len(docs))
+	for _, d := range docs {
+		ids = append(ids, d.ID)
+	}
+	return ids, nil
+}
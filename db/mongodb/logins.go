@@ -0,0 +1,117 @@
+package mongodb
+
+import (
+	"context"
+	"time"
+
+	"github.com/microservices-demo/user/events"
+	"github.com/microservices-demo/user/logins"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var _ logins.Store = &Mongo{}
+
+// mongoLogin is a login in the logins collection
+type mongoLogin struct {
+	logins.Login `bson:",inline"`
+	ID           primitive.ObjectID `bson:"_id"`
+}
+
+// RecordLogin flags a successful login of a customer against the ones stored
+// before it and stores it, publishing it when flagged
+func (m *Mongo) RecordLogin(l *logins.Login) error {
+	ml := mongoLogin{Login: *l, ID: primitive.NewObjectID()}
+	return m.atomically(func(u *unitOfWork) error {
+		if ml.Success && ml.CustomerID != "" {
+			seen, err := u.seen(ml.Login)
+			if err != nil {
+				return err
+			}
+			ml.Flag(seen)
+		}
+		if err := u.insert("logins", ml); err != nil {
+			return err
+		}
+		*l = ml.Login
+		l.ID = ml.ID.Hex()
+		if !l.Flagged() {
+			return nil
+		}
+		id, err := primitive.ObjectIDFromHex(l.CustomerID)
+		if err != nil {
+			return err
+		}
+		var mu MongoUser
+		if err := u.collection("customers").FindOne(u.ctx, bson.M{"_id": id}).Decode(&mu); err != nil {
+			return notFound(err)
+		}
+		customer := events.NewCustomer(mu.User)
+		customer.CustomerID = l.CustomerID
+		return u.publish(l.At, events.CustomerLoginFlagged{
+			Customer:   customer,
+			At:         l.At,
+			IP:         l.IP,
+			UserAgent:  l.UserAgent,
+			Country:    l.Country,
+			NewDevice:  l.NewDevice,
+			NewCountry: l.NewCountry,
+		})
+	})
+}
+
+// seen looks up the earlier successful logins of the customer of l
+func (u *unitOfWork) seen(l logins.Login) (logins.Seen, error) {
+	var s logins.Seen
+	for _, c := range []struct {
+		seen   *bool
+		filter bson.M
+	}{
+		{&s.Logins, bson.M{"customer": l.CustomerID, "success": true}},
+		{&s.Device, bson.M{"customer": l.CustomerID, "success": true, "device": l.Device}},
+		{&s.Located, bson.M{"customer": l.CustomerID, "success": true, "country": bson.M{"$gt": ""}}},
+		{&s.Country, bson.M{"customer": l.CustomerID, "success": true, "country": l.Country}},
+	} {
+		n, err := u.collection("logins").CountDocuments(u.ctx, c.filter, options.Count().SetLimit(1))
+		if err != nil {
+			return s, err
+		}
+		*c.seen = n > 0
+	}
+	return s, nil
+}
+
+// Logins returns the logins of a customer, newest first
+func (m *Mongo) Logins(customerID string, limit int) ([]logins.Login, error) {
+	collection := m.Client.Database(mongoDatabase).Collection("logins")
+	findOptions := options.Find().SetSort(bson.D{{Key: "at", Value: -1}, {Key: "_id", Value: -1}})
+	if limit > 0 {
+		findOptions.SetLimit(int64(limit))
+	}
+	cur, err := collection.Find(context.Background(), bson.M{"customer": customerID}, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	var mls []mongoLogin
+	if err := cur.All(context.Background(), &mls); err != nil {
+		return nil, err
+	}
+	ls := make([]logins.Login, 0, len(mls))
+	for _, ml := range mls {
+		ml.Login.ID = ml.ID.Hex()
+		ls = append(ls, ml.Login)
+	}
+	return ls, nil
+}
+
+// ExpireLogins removes the logins made before the given time
+func (m *Mongo) ExpireLogins(before time.Time) (int, error) {
+	res, err := m.Client.Database(mongoDatabase).Collection("logins").DeleteMany(context.Background(),
+		bson.M{"at": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+	return int(res.DeletedCount), nil
+}
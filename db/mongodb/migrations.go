@@ -0,0 +1,496 @@
+package mongodb
+
+import (
+	"context"
+	"time"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/db/migrate"
+	"github.com/microservices-demo/user/users"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var _ db.Migrator = &Mongo{}
+
+// Migrations returns the schema migrations of the Mongo database in order.
+// New migrations go at the end with the next version.
+func (m *Mongo) Migrations() []migrate.Migration {
+	return []migrate.Migration{
+		{
+			Version:     1,
+			Description: "username and email lookup",
+			// Not unique, as databases from before the migrations may
+			// hold duplicates, which migration 4 separates before
+			// uniqueness is enforced on the canonical keys
+			Up: m.createIndexes("customers",
+				mongo.IndexModel{
+					Keys:    bson.D{{Key: "username", Value: 1}},
+					Options: options.Index().SetName("username"),
+				},
+				mongo.IndexModel{
+					Keys:    bson.D{{Key: "email", Value: 1}},
+					Options: options.Index().SetName("email"),
+				},
+			),
+		},
+		{
+			Version:     2,
+			Description: "customer lookup by address and card",
+			Up: m.createIndexes("customers",
+				mongo.IndexModel{
+					Keys:    bson.D{{Key: "addresses", Value: 1}},
+					Options: options.Index().SetName("addresses"),
+				},
+				mongo.IndexModel{
+					Keys:    bson.D{{Key: "cards", Value: 1}},
+					Options: options.Index().SetName("cards"),
+				},
+			),
+		},
+		{
+			Version:     3,
+			Description: "deletion time for purging",
+			Up: func() error {
+				for _, collectionName := range []string{"customers", "addresses", "cards"} {
+					err := m.createIndexes(collectionName, mongo.IndexModel{
+						Keys:    bson.D{{Key: "deletedAt", Value: 1}},
+						Options: options.Index().SetName("deletedAt").SetSparse(true),
+					})()
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Version:     4,
+			Description: "unique canonical usernames and emails",
+			Up: func() error {
+				collection := m.Client.Database(mongoDatabase).Collection("customers")
+				// $toLower only folds ASCII, which covers the names
+				// registered before the keys were kept
+				_, err := collection.UpdateMany(context.Background(),
+					bson.M{"usernameKey": bson.M{"$exists": false}},
+					mongo.Pipeline{{{Key: "$set", Value: bson.M{
+						"usernameKey": bson.M{"$toLower": bson.M{"$trim": bson.M{"input": "$username"}}},
+						"emailKey":    bson.M{"$toLower": bson.M{"$trim": bson.M{"input": bson.M{"$ifNull": bson.A{"$email", ""}}}}},
+					}}}})
+				if err != nil {
+					return err
+				}
+				for _, field := range []string{"usernameKey", "emailKey"} {
+					if err := separateDuplicates(collection, field); err != nil {
+						return err
+					}
+				}
+				err = m.createIndexes("customers",
+					mongo.IndexModel{
+						Keys:    bson.D{{Key: "usernameKey", Value: 1}},
+						Options: options.Index().SetName("usernameKey").SetUnique(true),
+					},
+					mongo.IndexModel{
+						Keys: bson.D{{Key: "emailKey", Value: 1}},
+						Options: options.Index().SetName("emailKey").SetUnique(true).
+							SetPartialFilterExpression(bson.M{"emailKey": bson.M{"$gt": ""}}),
+					},
+				)()
+				if err != nil {
+					return err
+				}
+				// The canonical keys replace the case sensitive indexes
+				return m.dropIndexes("customers", "username", "email")
+			},
+		},
+		{
+			Version:     5,
+			Description: "creation and update times",
+			Up: func() error {
+				// Documents written before the times were kept were
+				// created when their ObjectID was
+				for _, collectionName := range []string{"customers", "addresses", "cards"} {
+					collection := m.Client.Database(mongoDatabase).Collection(collectionName)
+					_, err := collection.UpdateMany(context.Background(),
+						bson.M{"createdAt": bson.M{"$exists": false}},
+						mongo.Pipeline{{{Key: "$set", Value: bson.M{
+							"createdAt": bson.M{"$toDate": "$_id"},
+							"updatedAt": bson.M{"$ifNull": bson.A{"$updatedAt", bson.M{"$toDate": "$_id"}}},
+						}}}})
+					if err != nil {
+						return err
+					}
+				}
+				return m.createIndexes("customers", mongo.IndexModel{
+					Keys:    bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}},
+					Options: options.Index().SetName("createdAt"),
+				})()
+			},
+		},
+		{
+			Version:     6,
+			Description: "webhook deliveries",
+			Up: m.createIndexes("webhook_deliveries",
+				mongo.IndexModel{
+					Keys:    bson.D{{Key: "deadAt", Value: 1}, {Key: "nextAttempt", Value: 1}},
+					Options: options.Index().SetName("due"),
+				},
+				mongo.IndexModel{
+					Keys:    bson.D{{Key: "subscriptionId", Value: 1}},
+					Options: options.Index().SetName("subscriptionId"),
+				},
+			),
+		},
+		{
+			Version:     7,
+			Description: "subject access requests and their audit trail",
+			Up: func() error {
+				err := m.createIndexes("access_requests",
+					mongo.IndexModel{
+						Keys:    bson.D{{Key: "status", Value: 1}, {Key: "createdAt", Value: 1}},
+						Options: options.Index().SetName("status"),
+					},
+					mongo.IndexModel{
+						Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+						Options: options.Index().SetName("expiresAt").SetSparse(true),
+					},
+				)()
+				if err != nil {
+					return err
+				}
+				return m.createIndexes("changes", mongo.IndexModel{
+					Keys:    bson.D{{Key: "id", Value: 1}},
+					Options: options.Index().SetName("id"),
+				})()
+			},
+		},
+		{
+			Version:     8,
+			Description: "guest sessions",
+			Up: func() error {
+				err := m.createIndexes("guests", mongo.IndexModel{
+					Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+					Options: options.Index().SetName("expiresAt"),
+				})()
+				if err != nil {
+					return err
+				}
+				for _, collectionName := range []string{"addresses", "cards"} {
+					err := m.createIndexes(collectionName,
+						mongo.IndexModel{
+							Keys:    bson.D{{Key: "guest", Value: 1}},
+							Options: options.Index().SetName("guest").SetSparse(true),
+						},
+						mongo.IndexModel{
+							Keys:    bson.D{{Key: "guestExpiresAt", Value: 1}},
+							Options: options.Index().SetName("guestExpiresAt").SetSparse(true),
+						},
+					)()
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Version:     9,
+			Description: "retired versions of addresses and cards",
+			Up: func() error {
+				for _, collectionName := range versionCollections {
+					err := m.createIndexes(collectionName, mongo.IndexModel{
+						Keys:    bson.D{{Key: "of", Value: 1}, {Key: "version", Value: 1}},
+						Options: options.Index().SetName("of_version"),
+					})()
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Version:     10,
+			Description: "attribute schema versions",
+			Up: m.createIndexes("customers", mongo.IndexModel{
+				Keys:    bson.D{{Key: "attributesVersion", Value: 1}},
+				Options: options.Index().SetName("attributesVersion").SetSparse(true),
+			}),
+		},
+		{
+			Version:     11,
+			Description: "account statuses",
+			Up: func() error {
+				// Customers registered before statuses were kept are
+				// active
+				collection := m.Client.Database(mongoDatabase).Collection("customers")
+				_, err := collection.UpdateMany(context.Background(),
+					bson.M{"status": bson.M{"$exists": false}},
+					bson.M{"$set": bson.M{"status": users.StatusActive}})
+				if err != nil {
+					return err
+				}
+				return m.createIndexes("customers", mongo.IndexModel{
+					Keys:    bson.D{{Key: "status", Value: 1}},
+					Options: options.Index().SetName("status"),
+				})()
+			},
+		},
+		{
+			Version:     12,
+			Description: "unicode normalized usernames and emails, email verification",
+			Up: func() error {
+				if err := m.recanonicalize(); err != nil {
+					return err
+				}
+				return m.createIndexes("customers", mongo.IndexModel{
+					Keys:    bson.D{{Key: "emailVerification.hash", Value: 1}},
+					Options: options.Index().SetName("emailVerification").SetSparse(true),
+				})()
+			},
+		},
+		{
+			Version:     13,
+			Description: "usernames reserved after a change",
+			Up: func() error {
+				collection := m.Client.Database(mongoDatabase).Collection("customers")
+				_, err := collection.UpdateMany(context.Background(),
+					bson.M{"usernameKeys": bson.M{"$exists": false}},
+					mongo.Pipeline{{{Key: "$set", Value: bson.M{"usernameKeys": bson.A{"$usernameKey"}}}}})
+				if err != nil {
+					return err
+				}
+				return m.createIndexes("customers", mongo.IndexModel{
+					Keys:    bson.D{{Key: "usernameKeys", Value: 1}},
+					Options: options.Index().SetName("usernameKeys").SetUnique(true),
+				})()
+			},
+		},
+		{
+			Version:     14,
+			Description: "login history",
+			Up: m.createIndexes("logins",
+				mongo.IndexModel{
+					Keys:    bson.D{{Key: "customer", Value: 1}, {Key: "at", Value: -1}},
+					Options: options.Index().SetName("customer_at"),
+				},
+				mongo.IndexModel{
+					Keys:    bson.D{{Key: "at", Value: 1}},
+					Options: options.Index().SetName("at"),
+				},
+			),
+		},
+		{
+			Version:     15,
+			Description: "retired versions by customer, redacted once purged",
+			Up: func() error {
+				for _, collectionName := range versionCollections {
+					err := m.createIndexes(collectionName, mongo.IndexModel{
+						Keys:    bson.D{{Key: "customer", Value: 1}},
+						Options: options.Index().SetName("customer").SetSparse(true),
+					})()
+					if err != nil {
+						return err
+					}
+				}
+				return m.redactPurgedCards()
+			},
+		},
+		{
+			Version:     16,
+			Description: "access archives in chunks",
+			Up: m.createIndexes("access_archives", mongo.IndexModel{
+				Keys:    bson.D{{Key: "request", Value: 1}, {Key: "n", Value: 1}},
+				Options: options.Index().SetName("request").SetUnique(true),
+			}),
+		},
+	}
+}
+
+// redactPurgedCards redacts the retired versions of the cards purged before
+// purging redacted them
+func (m *Mongo) redactPurgedCards() error {
+	collection := m.Client.Database(mongoDatabase).Collection(versionCollections["cards"])
+	cur, err := collection.Aggregate(context.Background(), mongo.Pipeline{
+		{{Key: "$lookup", Value: bson.M{"from": "cards", "localField": "of", "foreignField": "_id", "as": "card"}}},
+		{{Key: "$match", Value: bson.M{"card": bson.M{"$size": 0}}}},
+	})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(context.Background())
+	for cur.Next(context.Background()) {
+		var v mongoVersion
+		if err := cur.Decode(&v); err != nil {
+			return err
+		}
+		var mc MongoCard
+		if err := bson.Unmarshal(v.Doc, &mc); err != nil {
+			return err
+		}
+		change, _ := redactCard(mc.Card)
+		if _, err := collection.UpdateOne(context.Background(), bson.M{"_id": v.ID}, change); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+// recanonicalize recomputes the canonical usernames and emails, which Mongo
+// can not normalize itself. A customer whose new key is already held by
+// another keeps its old one, so that both can still log in as before.
+func (m *Mongo) recanonicalize() error {
+	collection := m.Client.Database(mongoDatabase).Collection("customers")
+	cur, err := collection.Find(context.Background(), bson.M{},
+		options.Find().SetProjection(bson.M{"username": 1, "email": 1, "usernameKey": 1, "emailKey": 1}))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(context.Background())
+	for cur.Next(context.Background()) {
+		var doc struct {
+			ID          primitive.ObjectID `bson:"_id"`
+			Username    string             `bson:"username"`
+			Email       string             `bson:"email"`
+			UsernameKey string             `bson:"usernameKey"`
+			EmailKey    string             `bson:"emailKey"`
+		}
+		if err := cur.Decode(&doc); err != nil {
+			return err
+		}
+		for _, k := range []struct{ field, current, key string }{
+			{"usernameKey", doc.UsernameKey, users.Canonical(doc.Username)},
+			{"emailKey", doc.EmailKey, users.Canonical(doc.Email)},
+		} {
+			if k.key == k.current {
+				continue
+			}
+			_, err := collection.UpdateOne(context.Background(), bson.M{"_id": doc.ID}, bson.M{"$set": bson.M{k.field: k.key}})
+			if err != nil && !mongo.IsDuplicateKeyError(err) {
+				return err
+			}
+		}
+	}
+	return cur.Err()
+}
+
+// separateDuplicates appends the id of a customer to its key when an older
+// customer has the same one, so that the unique index on the key can be built
+// over customers registered before keys were kept. Both customers keep their
+// username and email, but only the older one holds them; the other gets a
+// conflict when it updates its profile until it changes them.
+func separateDuplicates(collection *mongo.Collection, field string) error {
+	cur, err := collection.Aggregate(context.Background(), mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{field: bson.M{"$gt": ""}}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+		{{Key: "$group", Value: bson.M{"_id": "$" + field, "ids": bson.M{"$push": "$_id"}}}},
+		{{Key: "$match", Value: bson.M{"ids.1": bson.M{"$exists": true}}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(context.Background())
+	for cur.Next(context.Background()) {
+		var duplicates struct {
+			Key string               `bson:"_id"`
+			IDs []primitive.ObjectID `bson:"ids"`
+		}
+		if err := cur.Decode(&duplicates); err != nil {
+			return err
+		}
+		for _, id := range duplicates.IDs[1:] {
+			_, err := collection.UpdateOne(context.Background(), bson.M{"_id": id},
+				bson.M{"$set": bson.M{field: duplicates.Key + "#" + id.Hex()}})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return cur.Err()
+}
+
+// dropIndexes drops indexes by name, ignoring
+// the ones that are already gone
+func (m *Mongo) dropIndexes(collectionName string, names ...string) error {
+	collection := m.Client.Database(mongoDatabase).Collection(collectionName)
+	for _, name := range names {
+		_, err := collection.Indexes().DropOne(context.Background(), name)
+		if e, ok := err.(mongo.CommandError); ok && e.Code == indexNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createIndexes returns a migration step creating indexes on a collection.
+// Creating an index that already exists with the same options is a no-op.
+func (m *Mongo) createIndexes(collectionName string, indexes ...mongo.IndexModel) func() error {
+	return func() error {
+		collection := m.Client.Database(mongoDatabase).Collection(collectionName)
+		_, err := collection.Indexes().CreateMany(context.Background(), indexes)
+		return err
+	}
+}
+
+// MigrationStore records applied migrations in the schema_migrations
+// collection and keeps the migration lock in schema_lock
+func (m *Mongo) MigrationStore() migrate.Store {
+	return &migrationStore{database: m.Client.Database(mongoDatabase)}
+}
+
+type migrationStore struct {
+	database *mongo.Database
+}
+
+const migrationLockID = "migrate"
+
+// indexNotFound is the server error code for dropping a missing index
+const indexNotFound = 27
+
+func (s *migrationStore) Applied() ([]migrate.Record, error) {
+	findOptions := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	cur, err := s.database.Collection("schema_migrations").Find(context.Background(), bson.M{}, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]migrate.Record, 0)
+	err = cur.All(context.Background(), &records)
+	return records, err
+}
+
+func (s *migrationStore) Record(r migrate.Record) error {
+	_, err := s.database.Collection("schema_migrations").ReplaceOne(context.Background(),
+		bson.M{"_id": r.Version}, r, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *migrationStore) Lock(owner string, ttl time.Duration) (bool, error) {
+	collection := s.database.Collection("schema_lock")
+	now := time.Now().UTC()
+	_, err := collection.InsertOne(context.Background(), bson.M{"_id": migrationLockID, "owner": owner, "lockedAt": now})
+	if err == nil {
+		return true, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return false, err
+	}
+	// Take over a lock abandoned by a process that died while migrating
+	res, err := collection.UpdateOne(context.Background(),
+		bson.M{"_id": migrationLockID, "lockedAt": bson.M{"$lt": now.Add(-ttl)}},
+		bson.M{"$set": bson.M{"owner": owner, "lockedAt": now}})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+func (s *migrationStore) Unlock(owner string) error {
+	_, err := s.database.Collection("schema_lock").DeleteOne(context.Background(), bson.M{"_id": migrationLockID, "owner": owner})
+	return err
+}
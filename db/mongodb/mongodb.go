@@ -5,8 +5,12 @@ import (
 
 	"context"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/go-kit/kit/log"
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/events"
 	"github.com/microservices-demo/user/users"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -18,8 +22,7 @@ import (
 
 var (
 	mongoConnection string
-	mongoDatabase         = "users"
-	totalRows       int64 = 100
+	mongoDatabase   = "users"
 )
 
 func init() {
@@ -29,6 +32,12 @@ func init() {
 // Mongo meets the Database interface requirements
 type Mongo struct {
 	Client *mongo.Client
+	// transactions is set when the deployment supports multi-document
+	// transactions
+	transactions bool
+	// Logger reports the compensating actions that fail where there are no
+	// transactions
+	Logger log.Logger
 }
 
 // Init MongoDB
@@ -42,6 +51,7 @@ func (m *Mongo) Init() error {
 		return err
 	}
 
+	m.transactions = m.supportsTransactions(ctx)
 	return nil
 }
 
@@ -51,6 +61,17 @@ type MongoUser struct {
 	ID         primitive.ObjectID   `bson:"_id"`
 	AddressIDs []primitive.ObjectID `bson:"addresses"`
 	CardIDs    []primitive.ObjectID `bson:"cards"`
+	Version    int64                `bson:"version"`
+	DeletedAt  *time.Time           `bson:"deletedAt,omitempty"`
+	DefaultIDs mongoDefaults        `bson:",inline"`
+	// UsernameKey and EmailKey are the canonical username and email, kept
+	// unique by the indexes on them
+	UsernameKey string `bson:"usernameKey"`
+	EmailKey    string `bson:"emailKey"`
+	// UsernameKeys are the canonical names held by the customer, its
+	// username and the ones it changed away from that are still reserved,
+	// kept unique across customers by the index on them
+	UsernameKeys []string `bson:"usernameKeys"`
 }
 
 // New Returns a new MongoUser
@@ -80,135 +101,295 @@ func (mu *MongoUser) AddUserIDs() {
 		mu.User.Cards = append(mu.User.Cards, users.Card{ID: id.Hex()})
 	}
 	mu.User.UserID = mu.ID.Hex()
+	mu.User.Status = users.CurrentStatus(mu.User.Status)
+	mu.User.Defaults = mu.DefaultIDs.defaults()
+	mu.User.Version = storedVersion(mu.Version)
 }
 
 // MongoAddress is a wrapper for Address
 type MongoAddress struct {
 	users.Address `bson:",inline"`
 	ID            primitive.ObjectID `bson:"_id"`
+	Version       int64              `bson:"version"`
+	DeletedAt     *time.Time         `bson:"deletedAt,omitempty"`
 }
 
 // AddID ObjectID as string
 func (ma *MongoAddress) AddID() {
 	ma.Address.ID = ma.ID.Hex()
+	ma.Address.Version = storedVersion(ma.Version)
 }
 
 // MongoCard is a wrapper for Card
 type MongoCard struct {
 	users.Card `bson:",inline"`
 	ID         primitive.ObjectID `bson:"_id"`
+	Version    int64              `bson:"version"`
+	DeletedAt  *time.Time         `bson:"deletedAt,omitempty"`
 }
 
 // AddID ObjectID as string
 func (mc *MongoCard) AddID() {
 	mc.Card.ID = mc.ID.Hex()
+	mc.Card.Version = storedVersion(mc.Version)
 }
 
-// CreateUser Insert user to MongoDB, including connected addresses and cards, update passed in user with Ids
+// storedVersion returns the version of a document, documents written before
+// versioning was introduced being at version 1
+func storedVersion(v int64) int64 {
+	if v == 0 {
+		return 1
+	}
+	return v
+}
+
+// versionFilter matches documents at version v
+func versionFilter(v int64) interface{} {
+	if storedVersion(v) == 1 {
+		return bson.M{"$in": bson.A{1, nil}}
+	}
+	return v
+}
+
+// CreateUser Insert user to MongoDB, including connected addresses and cards, update passed in user with Ids.
+// Either all documents are written or none are.
 func (m *Mongo) CreateUser(user *users.User) error {
-	id := primitive.NewObjectID()
 	mu := New()
 	mu.User = *user
-	mu.ID = id
-
-	var err error
-	mu.CardIDs, err = m.createCards(user.Cards)
-	if err != nil {
-		return err
+	mu.ID = primitive.NewObjectID()
+	mu.Version = 1
+	mu.CreatedAt = now()
+	mu.UpdatedAt = mu.CreatedAt
+	mu.UsernameKey = users.Canonical(user.Username)
+	mu.EmailKey = users.Canonical(user.Email)
+	mu.UsernameKeys = users.ReservedNames(user.Username, user.UsernameChanges, mu.CreatedAt)
+	mu.Status = users.CurrentStatus(user.Status)
+
+	customer := events.NewCustomer(mu.User)
+	customer.CustomerID = mu.ID.Hex()
+	published := []events.Payload{events.CustomerRegistered{Customer: customer}}
+
+	cards := make([]interface{}, 0, len(user.Cards))
+	mu.CardIDs = make([]primitive.ObjectID, 0, len(user.Cards))
+	for _, card := range user.Cards {
+		mc := MongoCard{Card: card, ID: primitive.NewObjectID(), Version: 1}
+		mc.CreatedAt, mc.UpdatedAt = mu.CreatedAt, mu.CreatedAt
+		cards = append(cards, mc)
+		mu.CardIDs = append(mu.CardIDs, mc.ID)
+		mc.AddID()
+		published = append(published, events.CardAdded{Card: events.NewCard(mc.Card, customer.CustomerID)})
 	}
-
-	mu.AddressIDs, err = m.createAddresses(user.Addresses)
-	if err != nil {
-		return err
+	addresses := make([]interface{}, 0, len(user.Addresses))
+	held := make([]heldAddress, 0, len(user.Addresses))
+	mu.AddressIDs = make([]primitive.ObjectID, 0, len(user.Addresses))
+	for _, address := range user.Addresses {
+		ma := MongoAddress{Address: address, ID: primitive.NewObjectID(), Version: 1}
+		ma.CreatedAt, ma.UpdatedAt = mu.CreatedAt, mu.CreatedAt
+		addresses = append(addresses, ma)
+		mu.AddressIDs = append(mu.AddressIDs, ma.ID)
+		held = append(held, heldAddress{ID: ma.ID, Type: ma.Type})
+		ma.AddID()
+		published = append(published, events.AddressAdded{Address: events.NewAddress(ma.Address, customer.CustomerID)})
 	}
+	mu.DefaultIDs = chooseDefaults(mongoDefaults{}, held, mu.CardIDs)
 
-	collection := m.Client.Database(mongoDatabase).Collection("customers")
-	_, err = collection.InsertOne(context.Background(), mu)
+	err := m.atomically(func(u *unitOfWork) error {
+		if err := u.insert("cards", cards...); err != nil {
+			return err
+		}
+		if err := u.insert("addresses", addresses...); err != nil {
+			return err
+		}
+		if err := u.insert("customers", mu); err != nil {
+			return err
+		}
+		if err := u.record("cards", db.ChangeCreated, mu.CreatedAt, mu.CardIDs...); err != nil {
+			return err
+		}
+		if err := u.record("addresses", db.ChangeCreated, mu.CreatedAt, mu.AddressIDs...); err != nil {
+			return err
+		}
+		if err := u.record("customers", db.ChangeCreated, mu.CreatedAt, mu.ID); err != nil {
+			return err
+		}
+		return u.publish(mu.CreatedAt, published...)
+	})
 	if err != nil {
-		return err
+		return duplicate(err)
+	}
+	for i := range user.Cards {
+		user.Cards[i].ID = mu.CardIDs[i].Hex()
+		user.Cards[i].Version = 1
+		user.Cards[i].CreatedAt, user.Cards[i].UpdatedAt = mu.CreatedAt, mu.CreatedAt
+	}
+	for i := range user.Addresses {
+		user.Addresses[i].ID = mu.AddressIDs[i].Hex()
+		user.Addresses[i].Version = 1
+		user.Addresses[i].CreatedAt, user.Addresses[i].UpdatedAt = mu.CreatedAt, mu.CreatedAt
 	}
 	mu.User.UserID = mu.ID.Hex()
+	mu.User.Defaults = mu.DefaultIDs.defaults()
+	mu.User.Version = 1
 	*user = mu.User
 	return nil
 }
 
-func (m *Mongo) createCards(cards []users.Card) ([]primitive.ObjectID, error) {
-	ids := make([]primitive.ObjectID, 0)
-	for i, card := range cards {
-		id := primitive.NewObjectID()
-		mc := MongoCard{Card: card, ID: id}
-		collection := m.Client.Database(mongoDatabase).Collection("cards")
-		_, err := collection.InsertOne(context.Background(), mc)
+// UpdateUser replaces the fields of a stored user, leaving its addresses and
+// cards alone. The user's Version must be the version the change is based on.
+func (m *Mongo) UpdateUser(user *users.User) error {
+	id, err := primitive.ObjectIDFromHex(user.UserID)
+	if err != nil {
+		return db.ErrNotFound
+	}
+	version := storedVersion(user.Version)
+	at := now()
+	err = m.atomically(func(u *unitOfWork) error {
+		if err := u.writable(user.UserID); err != nil {
+			return err
+		}
+		var stored MongoUser
+		err := u.collection("customers").FindOne(u.ctx, bson.M{"_id": id},
+			options.FindOne().SetProjection(bson.M{"usernameKey": 1, "emailKey": 1})).Decode(&stored)
 		if err != nil {
-			m.cleanCardsAttr(ids)
-			return ids, err
+			return notFound(err)
 		}
-		ids = append(ids, id)
-		cards[i].ID = id.Hex()
-	}
-	return ids, nil
-}
-
-func (m *Mongo) createAddresses(addresses []users.Address) ([]primitive.ObjectID, error) {
-	ids := make([]primitive.ObjectID, 0)
-	for i, address := range addresses {
-		id := primitive.NewObjectID()
-		ma := MongoAddress{Address: address, ID: id}
-		collection := m.Client.Database(mongoDatabase).Collection("addresses")
-		_, err := collection.InsertOne(context.Background(), ma)
+		set := bson.M{
+			"firstName":     user.FirstName,
+			"lastName":      user.LastName,
+			"email":         user.Email,
+			"username":      user.Username,
+			"usernameKey":   separatedKey(stored.UsernameKey, users.Canonical(user.Username)),
+			"emailKey":      separatedKey(stored.EmailKey, users.Canonical(user.Email)),
+			"emailVerified": user.EmailVerified,
+			"password":      user.Password,
+			"salt":          user.Salt,
+			"version":       version + 1,
+			"updatedAt":     at,
+		}
+		update := bson.M{"$set": set}
+		if len(user.Attributes) > 0 {
+			set["attributes"] = user.Attributes
+			set["attributesVersion"] = user.AttributesVersion
+		} else {
+			update["$unset"] = bson.M{"attributes": "", "attributesVersion": ""}
+		}
+		res, err := u.collection("customers").UpdateOne(u.ctx, bson.M{"_id": id, "version": versionFilter(version), "deletedAt": nil}, update)
 		if err != nil {
-			m.cleanAddressesAttr(ids)
-			return ids, err
+			return duplicate(err)
 		}
-		ids = append(ids, id)
-		addresses[i].ID = id.Hex()
+		if res.MatchedCount == 0 {
+			return m.conflict("customers", id)
+		}
+		if err := u.record("customers", db.ChangeUpdated, at, id); err != nil {
+			return err
+		}
+		return u.publish(at, events.CustomerUpdated{Customer: events.NewCustomer(*user)})
+	})
+	if err != nil {
+		return err
 	}
-	return ids, nil
-}
-
-func (m *Mongo) cleanAddressesAttr(addressesIds []primitive.ObjectID) error {
-	collection := m.Client.Database(mongoDatabase).Collection("addresses")
-	_, err := collection.DeleteMany(context.Background(), bson.M{"_id": bson.M{"$in": addressesIds}})
-	return err
-}
-
-func (m *Mongo) cleanCardsAttr(cardIds []primitive.ObjectID) error {
-	collection := m.Client.Database(mongoDatabase).Collection("cards")
-	_, err := collection.DeleteMany(context.Background(), bson.M{"_id": bson.M{"$in": cardIds}})
-	return err
+	user.Version = version + 1
+	user.UpdatedAt = at
+	return nil
 }
 
-func (m *Mongo) appendAttributeId(attr string, attrId primitive.ObjectID, userId string) error {
-	id, err := primitive.ObjectIDFromHex(userId)
-	if err != nil {
-		return err
+// separatedKey returns the stored key when the migration to canonical keys
+// separated it from a duplicate of key, so that the customer keeps it until
+// it takes another name or email
+func separatedKey(stored, key string) string {
+	if key != "" && strings.HasPrefix(stored, key+"#") {
+		return stored
 	}
+	return key
+}
 
-	collection := m.Client.Database(mongoDatabase).Collection("customers")
-	_, err = collection.UpdateOne(context.Background(), bson.M{"_id": bson.M{"$eq": id}}, bson.M{"$addToSet": bson.M{attr: attrId}})
-	return err
+// now returns the current time as Mongo stores it, to the millisecond
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
 }
 
-func (m *Mongo) removeAttributeId(attr string, attrId primitive.ObjectID, userId string) error {
-	id, err := primitive.ObjectIDFromHex(userId)
-	if err != nil {
-		return err
+// createAttribute inserts doc into collectionName and, unless userId is
+// empty, adds it to the customer's attr list in the same unit of work,
+// publishing the given event
+func (m *Mongo) createAttribute(collectionName string, id primitive.ObjectID, doc interface{}, userId string, event events.Payload) error {
+	var owner primitive.ObjectID
+	if userId != "" {
+		var err error
+		owner, err = primitive.ObjectIDFromHex(userId)
+		if err != nil {
+			return db.ErrNotFound
+		}
 	}
-
-	collection := m.Client.Database(mongoDatabase).Collection("customers")
-	_, err = collection.UpdateOne(context.Background(), bson.M{"_id": bson.M{"$eq": id}}, bson.M{"$pull": bson.M{attr: attrId}})
-	return err
+	return m.atomically(func(u *unitOfWork) error {
+		if err := u.writable(userId); err != nil {
+			return err
+		}
+		if err := u.insert(collectionName, doc); err != nil {
+			return err
+		}
+		at := now()
+		if err := u.record(collectionName, db.ChangeCreated, at, id); err != nil {
+			return err
+		}
+		if err := u.publish(at, event); err != nil {
+			return err
+		}
+		// Attribute of an anonymous user
+		if userId == "" {
+			return nil
+		}
+		n, err := u.addReference(collectionName, id, owner)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return db.ErrNotFound
+		}
+		return u.settleDefaults(at, owner)
+	})
 }
 
 // GetUserByName Get user by their name
 func (m *Mongo) GetUserByName(username string) (users.User, error) {
 	collection := m.Client.Database(mongoDatabase).Collection("customers")
 	var mu MongoUser
-	err := collection.FindOne(context.Background(), bson.M{"username": bson.M{"$eq": username}}).Decode(&mu)
+	err := collection.FindOne(context.Background(), bson.M{"usernameKey": users.Canonical(username), "deletedAt": nil}).Decode(&mu)
 	if err == nil {
 		mu.AddUserIDs()
 	}
-	return mu.User, err
+	return mu.User, notFound(err)
+}
+
+// Taken reports whether the username and email are held by a customer,
+// including deleted customers that may still be restored and usernames
+// reserved after a change. Empty values are never taken.
+func (m *Mongo) Taken(username, email string) (bool, bool, error) {
+	collection := m.Client.Database(mongoDatabase).Collection("customers")
+	taken := func(field, value string) (bool, error) {
+		if users.Canonical(value) == "" {
+			return false, nil
+		}
+		n, err := collection.CountDocuments(context.Background(), bson.M{field: users.Canonical(value)}, options.Count().SetLimit(1))
+		return n > 0, err
+	}
+	usernameTaken, err := taken("usernameKeys", username)
+	if err != nil {
+		return false, false, err
+	}
+	emailTaken, err := taken("emailKey", email)
+	return usernameTaken, emailTaken, err
+}
+
+// duplicate translates a unique index violation on the customers collection
+// into a db.DuplicateError naming the field
+func duplicate(err error) error {
+	if !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+	if strings.Contains(err.Error(), "emailKey") {
+		return db.DuplicateError{Field: "email"}
+	}
+	return db.DuplicateError{Field: "username"}
 }
 
 // GetUser Get user by their object id
@@ -220,103 +401,254 @@ func (m *Mongo) GetUser(id string) (users.User, error) {
 
 	collection := m.Client.Database(mongoDatabase).Collection("customers")
 	var mu MongoUser
-	err = collection.FindOne(context.Background(), bson.M{"_id": bson.M{"$eq": userId}}).Decode(&mu)
+	err = collection.FindOne(context.Background(), bson.M{"_id": bson.M{"$eq": userId}, "deletedAt": nil}).Decode(&mu)
 	if err == nil {
 		mu.AddUserIDs()
 	}
-	return mu.User, err
+	return mu.User, notFound(err)
 }
 
-// GetUsers Get all users
-func (m *Mongo) GetUsers() ([]users.User, error) {
-	// TODO: add paginations
-	collection := m.Client.Database(mongoDatabase).Collection("customers")
-	findOptions := options.Find()
-	findOptions.SetLimit(totalRows)
-	cur, err := collection.Find(context.Background(), bson.D{{}}, findOptions)
+// GetUsers Get a page of users matching the filter of the options. The
+// attributes to embed are looked up in the same aggregation as the page.
+func (m *Mongo) GetUsers(o db.ListOptions) ([]users.User, db.PageInfo, error) {
+	filter, err := m.compileFilter(o.Filter)
 	if err != nil {
-		return []users.User{}, err
+		return []users.User{}, db.PageInfo{Total: -1}, err
+	}
+	docs, page, err := m.findPage("customers", filter, sortKeys(o.Sort), o, embedStages(o)...)
+	if err != nil {
+		return []users.User{}, page, err
 	}
-	defer cur.Close(context.Background())
 
-	us := make([]users.User, 0)
-	for cur.Next(context.Background()) {
-		var mu MongoUser
-		err := cur.Decode(&mu)
+	us := make([]users.User, 0, len(docs))
+	for _, doc := range docs {
+		var me mongoEmbedded
+		err := bson.Unmarshal(doc, &me)
 		if err != nil {
-			return []users.User{}, err
+			return []users.User{}, page, err
 		}
-		mu.AddUserIDs()
-		us = append(us, mu.User)
+		me.AddUserIDs()
+		me.embed(&me.User, o.Embeds(db.EmbedAddresses), o.Embeds(db.EmbedCards))
+		us = append(us, me.User)
 	}
 
-	return us, nil
+	return us, page, nil
 }
 
-// GetUserAttributes given a user, load all cards and addresses connected to that user
-func (m *Mongo) GetUserAttributes(user *users.User) error {
-	findOptions := options.Find()
-	findOptions.SetLimit(totalRows)
+// findPage returns one page of raw documents of a collection matching filter
+// in the order given by keys, together with the cursors of the neighbouring
+// pages. When stages are given the page is read by an aggregation ending with
+// them.
+func (m *Mongo) findPage(collectionName string, filter bson.M, keys []sortKey, o db.ListOptions, stages ...bson.M) ([]bson.Raw, db.PageInfo, error) {
+	page := db.PageInfo{Total: -1}
+	c, err := db.DecodeCursor(o.Cursor)
+	if err != nil {
+		return nil, page, err
+	}
+	size := o.PageSize()
 
-	ids := make([]primitive.ObjectID, 0)
-	for _, address := range user.Addresses {
-		addressId, err := primitive.ObjectIDFromHex(address.ID)
+	// Deleted documents are hidden until they are restored or purged
+	find := bson.M{"$and": bson.A{filter, live}}
+	if c.ID != "" {
+		keyset, err := keysetFilter(keys, c)
 		if err != nil {
-			return err
+			return nil, page, err
 		}
-		ids = append(ids, addressId)
+		find = bson.M{"$and": bson.A{filter, live, keyset}}
+	}
+	sort := bson.D{}
+	for _, key := range keys {
+		order := 1
+		if key.desc != c.Before {
+			order = -1
+		}
+		sort = append(sort, bson.E{Key: key.path, Value: order})
 	}
 
-	collection := m.Client.Database(mongoDatabase).Collection("addresses")
-	cur, err := collection.Find(context.Background(), bson.M{"_id": bson.M{"$in": ids}}, findOptions)
+	collection := m.Client.Database(mongoDatabase).Collection(collectionName)
+	// One extra document tells us whether there is a page beyond this one
+	var cur *mongo.Cursor
+	if len(stages) == 0 {
+		findOptions := options.Find()
+		findOptions.SetSort(sort)
+		findOptions.SetLimit(int64(size + 1))
+		cur, err = collection.Find(context.Background(), find, findOptions)
+	} else {
+		pipeline := bson.A{bson.M{"$match": find}, bson.M{"$sort": sort}, bson.M{"$limit": size + 1}}
+		for _, stage := range stages {
+			pipeline = append(pipeline, stage)
+		}
+		cur, err = collection.Aggregate(context.Background(), pipeline)
+	}
 	if err != nil {
-		return err
+		return nil, page, err
 	}
 	defer cur.Close(context.Background())
 
-	addresses := make([]users.Address, 0)
+	docs := make([]bson.Raw, 0, size+1)
 	for cur.Next(context.Background()) {
-		var ma MongoAddress
-		err := cur.Decode(&ma)
-		if err != nil {
-			return err
+		docs = append(docs, append(bson.Raw{}, cur.Current...))
+	}
+	if err := cur.Err(); err != nil {
+		return nil, page, err
+	}
+
+	more := len(docs) > size
+	if more {
+		docs = docs[:size]
+	}
+	if c.Before {
+		for i, j := 0, len(docs)-1; i < j; i, j = i+1, j-1 {
+			docs[i], docs[j] = docs[j], docs[i]
 		}
-		ma.Address.ID = ma.ID.Hex()
-		addresses = append(addresses, ma.Address)
-	}	
-	user.Addresses = addresses
+	}
+	if len(docs) > 0 {
+		if (c.Before && more) || (!c.Before && c.ID != "") {
+			page.Prev = cursorFor(docs[0], keys, true).Encode()
+		}
+		if (!c.Before && more) || c.Before {
+			page.Next = cursorFor(docs[len(docs)-1], keys, false).Encode()
+		}
+	}
 
-	ids = make([]primitive.ObjectID, 0)
-	for _, card := range user.Cards {
-		cardId, err := primitive.ObjectIDFromHex(card.ID)
-		if err != nil {
-			return err
+	// Only the whole collection can be counted cheaply, from its metadata,
+	// which includes deleted documents that are not purged yet
+	if len(filter) == 0 {
+		total, err := collection.EstimatedDocumentCount(context.Background())
+		if err == nil {
+			page.Total = total
 		}
-		ids = append(ids, cardId)
 	}
+	return docs, page, nil
+}
 
-	collection = m.Client.Database(mongoDatabase).Collection("cards")
-	cur, err = collection.Find(context.Background(), bson.M{"_id": bson.M{"$in": ids}}, findOptions)
+// GetUserAttributes given a user, load the cards and addresses of that user
+// whose ids it holds. The customer and both attributes are read by one
+// aggregation.
+func (m *Mongo) GetUserAttributes(user *users.User) error {
+	userId, err := primitive.ObjectIDFromHex(user.UserID)
+	if err != nil {
+		return err
+	}
+	addressIds, err := objectIDs(len(user.Addresses), func(i int) string { return user.Addresses[i].ID })
+	if err != nil {
+		return err
+	}
+	cardIds, err := objectIDs(len(user.Cards), func(i int) string { return user.Cards[i].ID })
+	if err != nil {
+		return err
+	}
+
+	collection := m.Client.Database(mongoDatabase).Collection("customers")
+	cur, err := collection.Aggregate(context.Background(), bson.A{
+		bson.M{"$match": bson.M{"_id": userId}},
+		bson.M{"$project": bson.M{"_id": 1}},
+		bson.M{"$lookup": bson.M{
+			"from":     "addresses",
+			"pipeline": bson.A{bson.M{"$match": bson.M{"_id": bson.M{"$in": addressIds}, "deletedAt": nil}}},
+			"as":       "addressDocs",
+		}},
+		bson.M{"$lookup": bson.M{
+			"from":     "cards",
+			"pipeline": bson.A{bson.M{"$match": bson.M{"_id": bson.M{"$in": cardIds}, "deletedAt": nil}}},
+			"as":       "cardDocs",
+		}},
+	})
 	if err != nil {
 		return err
 	}
 	defer cur.Close(context.Background())
 
-	cards := make([]users.Card, 0)
-	for cur.Next(context.Background()) {
-		var mc MongoCard
-		err := cur.Decode(&mc)
-		if err != nil {
+	var me mongoEmbedded
+	if cur.Next(context.Background()) {
+		if err := cur.Decode(&me); err != nil {
 			return err
 		}
-		mc.Card.ID = mc.ID.Hex()
-		cards = append(cards, mc.Card)
 	}
-	user.Cards = cards
-
+	if err := cur.Err(); err != nil {
+		return err
+	}
+	me.embed(user, true, true)
 	return nil
 }
 
+// objectIDs parses n hex ids
+func objectIDs(n int, id func(int) string) ([]primitive.ObjectID, error) {
+	ids := make([]primitive.ObjectID, 0, n)
+	for i := 0; i < n; i++ {
+		oid, err := primitive.ObjectIDFromHex(id(i))
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, oid)
+	}
+	return ids, nil
+}
+
+// mongoEmbedded is a customer document with its live addresses and cards
+// looked up alongside it. It is never encoded as JSON.
+type mongoEmbedded struct {
+	MongoUser   `bson:",inline" json:"-"`
+	AddressDocs []MongoAddress `bson:"addressDocs"`
+	CardDocs    []MongoCard    `bson:"cardDocs"`
+}
+
+// embedStages returns the stages looking up the live addresses and cards of
+// each customer of a page
+func embedStages(o db.ListOptions) []bson.M {
+	stages := make([]bson.M, 0, 2)
+	lookup := func(from, field, as string) bson.M {
+		return bson.M{"$lookup": bson.M{
+			"from":         from,
+			"localField":   field,
+			"foreignField": "_id",
+			"pipeline":     bson.A{bson.M{"$match": live}},
+			"as":           as,
+		}}
+	}
+	if o.Embeds(db.EmbedAddresses) {
+		stages = append(stages, lookup("addresses", "addresses", "addressDocs"))
+	}
+	if o.Embeds(db.EmbedCards) {
+		stages = append(stages, lookup("cards", "cards", "cardDocs"))
+	}
+	return stages
+}
+
+// embed replaces the address and card ids held by user with the looked up
+// documents, in the order of the ids. Ids that were not found, because the
+// attribute is deleted, are dropped.
+func (me mongoEmbedded) embed(user *users.User, addresses, cards bool) {
+	if addresses {
+		found := make(map[string]users.Address, len(me.AddressDocs))
+		for _, ma := range me.AddressDocs {
+			ma.AddID()
+			found[ma.Address.ID] = ma.Address
+		}
+		loaded := make([]users.Address, 0, len(found))
+		for _, a := range user.Addresses {
+			if address, ok := found[a.ID]; ok {
+				loaded = append(loaded, address)
+			}
+		}
+		user.Addresses = loaded
+	}
+	if cards {
+		found := make(map[string]users.Card, len(me.CardDocs))
+		for _, mc := range me.CardDocs {
+			mc.AddID()
+			found[mc.Card.ID] = mc.Card
+		}
+		loaded := make([]users.Card, 0, len(found))
+		for _, c := range user.Cards {
+			if card, ok := found[c.ID]; ok {
+				loaded = append(loaded, card)
+			}
+		}
+		user.Cards = loaded
+	}
+}
+
 // GetCard Gets card by objects Id
 func (m *Mongo) GetCard(id string) (users.Card, error) {
 	cardId, err := primitive.ObjectIDFromHex(id)
@@ -326,59 +658,66 @@ func (m *Mongo) GetCard(id string) (users.Card, error) {
 
 	collection := m.Client.Database(mongoDatabase).Collection("cards")
 	var mc MongoCard
-	err = collection.FindOne(context.Background(), bson.M{"_id": bson.M{"$eq": cardId}}).Decode(&mc)
+	err = collection.FindOne(context.Background(), bson.M{"_id": bson.M{"$eq": cardId}, "deletedAt": nil}).Decode(&mc)
 	if err == nil {
 		mc.AddID()
 	}
-	return mc.Card, err
+	return mc.Card, notFound(err)
 }
 
-// GetCards Gets all cards
-func (m *Mongo) GetCards() ([]users.Card, error) {
-	// TODO: add paginations
-	collection := m.Client.Database(mongoDatabase).Collection("cards")
-	findOptions := options.Find()
-	findOptions.SetLimit(totalRows)
-	cur, err := collection.Find(context.Background(), bson.D{{}}, findOptions)
+// GetCards Gets a page of cards
+func (m *Mongo) GetCards(o db.ListOptions) ([]users.Card, db.PageInfo, error) {
+	docs, page, err := m.findPage("cards", bson.M{}, sortKeys(nil), o)
 	if err != nil {
-		return []users.Card{}, err
+		return []users.Card{}, page, err
 	}
-	defer cur.Close(context.Background())
 
-	cards := make([]users.Card, 0)
-	for cur.Next(context.Background()) {
+	cards := make([]users.Card, 0, len(docs))
+	for _, doc := range docs {
 		var mc MongoCard
-		err := cur.Decode(&mc)
+		err := bson.Unmarshal(doc, &mc)
 		if err != nil {
-			return []users.Card{}, err
+			return []users.Card{}, page, err
 		}
 		mc.AddID()
 		cards = append(cards, mc.Card)
 	}
 
-	return cards, nil
+	return cards, page, nil
 }
 
 // CreateCard adds card to MongoDB
 func (m *Mongo) CreateCard(card *users.Card, userId string) error {
-	collection := m.Client.Database(mongoDatabase).Collection("cards")
-	cardId := primitive.NewObjectID()
-	mc := MongoCard{Card: *card, ID: cardId}
-
-	_, err := collection.InsertOne(context.Background(), mc)
-	if err != nil {
+	mc := MongoCard{Card: *card, ID: primitive.NewObjectID(), Version: 1}
+	mc.CreatedAt = now()
+	mc.UpdatedAt = mc.CreatedAt
+	mc.AddID()
+	event := events.CardAdded{Card: events.NewCard(mc.Card, userId)}
+	if err := m.createAttribute("cards", mc.ID, mc, userId, event); err != nil {
 		return err
 	}
-
-	// Address for anonymous user
-	if userId != "" {
-		err = m.appendAttributeId("cards", mc.ID, userId)
-		if err != nil {
-			return err
-		}
-	}
 	mc.AddID()
 	*card = mc.Card
+	return nil
+}
+
+// UpdateCard replaces a stored card. The card's Version must be the version
+// the change is based on.
+func (m *Mongo) UpdateCard(card *users.Card) error {
+	id, err := primitive.ObjectIDFromHex(card.ID)
+	if err != nil {
+		return db.ErrNotFound
+	}
+	version := storedVersion(card.Version)
+	mc := MongoCard{Card: *card, ID: id, Version: version + 1}
+	mc.UpdatedAt = now()
+	err = m.replace("cards", id, version, mc, func(customerID string) events.Payload {
+		return events.CardUpdated{Card: events.NewCard(*card, customerID)}
+	})
+	if err == nil {
+		card.Version = version + 1
+		card.UpdatedAt = mc.UpdatedAt
+	}
 	return err
 }
 
@@ -391,111 +730,354 @@ func (m *Mongo) GetAddress(id string) (users.Address, error) {
 
 	collection := m.Client.Database(mongoDatabase).Collection("addresses")
 	var ma MongoAddress
-	err = collection.FindOne(context.Background(), bson.M{"_id": bson.M{"$eq": addressId}}).Decode(&ma)
+	err = collection.FindOne(context.Background(), bson.M{"_id": bson.M{"$eq": addressId}, "deletedAt": nil}).Decode(&ma)
 	if err == nil {
 		ma.AddID()
 	}
-	return ma.Address, err
+	return ma.Address, notFound(err)
 }
 
-// GetAddresses gets all addresses
-func (m *Mongo) GetAddresses() ([]users.Address, error) {
-	// TODO: add paginations
-	collection := m.Client.Database(mongoDatabase).Collection("addresses")
-	findOptions := options.Find()
-	findOptions.SetLimit(totalRows)
-	cur, err := collection.Find(context.Background(), bson.D{{}}, findOptions)
+// GetAddresses gets a page of addresses
+func (m *Mongo) GetAddresses(o db.ListOptions) ([]users.Address, db.PageInfo, error) {
+	docs, page, err := m.findPage("addresses", bson.M{}, sortKeys(nil), o)
 	if err != nil {
-		return []users.Address{}, err
+		return []users.Address{}, page, err
 	}
-	defer cur.Close(context.Background())
 
-	addresses := make([]users.Address, 0)
-	for cur.Next(context.Background()) {
+	addresses := make([]users.Address, 0, len(docs))
+	for _, doc := range docs {
 		var ma MongoAddress
-		err := cur.Decode(&ma)
+		err := bson.Unmarshal(doc, &ma)
 		if err != nil {
-			return []users.Address{}, err
+			return []users.Address{}, page, err
 		}
 		ma.AddID()
 		addresses = append(addresses, ma.Address)
 	}
 
-	return addresses, nil
+	return addresses, page, nil
 }
 
 // CreateAddress Inserts Address into MongoDB
 func (m *Mongo) CreateAddress(address *users.Address, userId string) error {
-	collection := m.Client.Database(mongoDatabase).Collection("addresses")
-	addressId := primitive.NewObjectID()
-	ma := MongoAddress{Address: *address, ID: addressId}
+	ma := MongoAddress{Address: *address, ID: primitive.NewObjectID(), Version: 1}
+	ma.CreatedAt = now()
+	ma.UpdatedAt = ma.CreatedAt
+	ma.AddID()
+	event := events.AddressAdded{Address: events.NewAddress(ma.Address, userId)}
+	if err := m.createAttribute("addresses", ma.ID, ma, userId, event); err != nil {
+		return err
+	}
+	ma.AddID()
+	*address = ma.Address
+	return nil
+}
 
-	_, err := collection.InsertOne(context.Background(), ma)
+// UpdateAddress replaces a stored address. The address's Version must be the
+// version the change is based on.
+func (m *Mongo) UpdateAddress(address *users.Address) error {
+	id, err := primitive.ObjectIDFromHex(address.ID)
 	if err != nil {
-		return err
+		return db.ErrNotFound
 	}
+	version := storedVersion(address.Version)
+	ma := MongoAddress{Address: *address, ID: id, Version: version + 1}
+	ma.UpdatedAt = now()
+	err = m.replace("addresses", id, version, ma, func(customerID string) events.Payload {
+		return events.AddressUpdated{Address: events.NewAddress(*address, customerID)}
+	})
+	if err == nil {
+		address.Version = version + 1
+		address.UpdatedAt = ma.UpdatedAt
+	}
+	return err
+}
 
-	// Address for anonymous user
-	if userId != "" {
-		err = m.appendAttributeId("addresses", ma.ID, userId)
+// replace swaps the document with the given id for doc, provided it is still
+// at version, retiring the version replaced, and records the change. The
+// event published is made for the customer holding the document.
+func (m *Mongo) replace(collectionName string, id primitive.ObjectID, version int64, doc interface{}, event func(customerID string) events.Payload) error {
+	return m.atomically(func(u *unitOfWork) error {
+		owner, err := u.owner(collectionName, id)
+		if err != nil {
+			return err
+		}
+		if err := u.writable(owner); err != nil {
+			return err
+		}
+		at := now()
+		current := bson.M{"_id": id, "version": versionFilter(version), "deletedAt": nil}
+		n, err := u.retire(collectionName, current, owner, at)
 		if err != nil {
 			return err
 		}
+		if n == 0 {
+			return m.conflict(collectionName, id)
+		}
+		res, err := u.collection(collectionName).ReplaceOne(u.ctx, current, doc)
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 0 {
+			return m.conflict(collectionName, id)
+		}
+		if err := u.record(collectionName, db.ChangeUpdated, at, id); err != nil {
+			return err
+		}
+		if err := u.settle(owner, at); err != nil {
+			return err
+		}
+		return u.publish(at, event(owner))
+	})
+}
+
+// conflict explains why a versioned write matched nothing: either the
+// document is gone or it has moved on to another version
+func (m *Mongo) conflict(collectionName string, id primitive.ObjectID) error {
+	collection := m.Client.Database(mongoDatabase).Collection(collectionName)
+	n, err := collection.CountDocuments(context.Background(), bson.M{"_id": id, "deletedAt": nil})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return db.ErrNotFound
+	}
+	return db.ErrVersionConflict
+}
+
+// notFound translates the driver's missing document error to db.ErrNotFound
+func notFound(err error) error {
+	if err == mongo.ErrNoDocuments {
+		return db.ErrNotFound
 	}
-	ma.AddID()
-	*address = ma.Address
 	return err
 }
 
-// CreateAddress Inserts Address into MongoDB
-func (m *Mongo) Delete(collectionName, id string) error {
-	if collectionName == "customers" {
-		user, err := m.GetUser(id)
+// live matches the documents that have not been deleted
+var live = bson.M{"deletedAt": nil}
+
+// Delete marks an entity in MongoDB as deleted. Deleting a customer deletes
+// its addresses and cards along with it. Deleted entities are hidden until
+// they are restored or purged. A non zero version must match the stored
+// version.
+func (m *Mongo) Delete(collectionName, id string, version int64) error {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return db.ErrNotFound
+	}
+	target := bson.M{"_id": objectId, "deletedAt": nil}
+	if version != 0 {
+		target["version"] = versionFilter(version)
+	}
+	at := now()
+	deleted := bson.M{"$set": bson.M{"deletedAt": at, "updatedAt": at}}
+	restored := bson.M{"$unset": bson.M{"deletedAt": ""}}
+
+	return m.atomically(func(u *unitOfWork) error {
+		published := make([]events.Payload, 0)
+		owner := id
+		if collectionName == "customers" {
+			var mu MongoUser
+			err := u.collection("customers").FindOne(u.ctx, target).Decode(&mu)
+			if err == mongo.ErrNoDocuments {
+				return m.conflict(collectionName, objectId)
+			}
+			if err != nil {
+				return err
+			}
+			if err := u.writable(id); err != nil {
+				return err
+			}
+			for attr, attrIds := range map[string][]primitive.ObjectID{"addresses": mu.AddressIDs, "cards": mu.CardIDs} {
+				ids, err := u.updateAndRecord(attr, bson.M{"_id": bson.M{"$in": attrIds}, "deletedAt": nil}, deleted, restored, db.ChangeDeleted, at)
+				if err != nil {
+					return err
+				}
+				for _, attrId := range ids {
+					published = append(published, events.Removed(attr, attrId.Hex(), owner, false))
+				}
+			}
+		} else if owner, err = u.owner(collectionName, objectId); err != nil {
+			return err
+		} else if err := u.writable(owner); err != nil {
+			return err
+		}
+		ids, err := u.updateAndRecord(collectionName, target, deleted, restored, db.ChangeDeleted, at)
 		if err != nil {
 			return err
 		}
-
-		ids := make([]primitive.ObjectID, 0)
-		for _, address := range user.Addresses {
-			addressId, err := primitive.ObjectIDFromHex(address.ID)
-			if err != nil {
+		if len(ids) == 0 {
+			return m.conflict(collectionName, objectId)
+		}
+		if collectionName != "customers" {
+			if err := u.settle(owner, at); err != nil {
 				return err
 			}
-			ids = append(ids, addressId)
 		}
-		collection := m.Client.Database(mongoDatabase).Collection("addresses")
-		_, err = collection.DeleteMany(context.Background(), bson.M{"_id": bson.M{"$in": ids}})
+		published = append(published, events.Removed(collectionName, id, owner, false))
+		return u.publish(at, published...)
+	})
+}
+
+// Restore undoes the deletion of an entity deleted after since. Restoring a
+// customer restores the addresses and cards deleted along with it.
+func (m *Mongo) Restore(collectionName, id string, since time.Time) error {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return db.ErrNotFound
+	}
+	at := now()
+
+	return m.atomically(func(u *unitOfWork) error {
+		var doc struct {
+			DeletedAt  time.Time            `bson:"deletedAt"`
+			AddressIDs []primitive.ObjectID `bson:"addresses"`
+			CardIDs    []primitive.ObjectID `bson:"cards"`
+		}
+		err := u.collection(collectionName).FindOne(u.ctx, bson.M{"_id": objectId, "deletedAt": bson.M{"$gte": since}}).Decode(&doc)
 		if err != nil {
+			return notFound(err)
+		}
+		restored := bson.M{"$unset": bson.M{"deletedAt": ""}, "$set": bson.M{"updatedAt": at}}
+		deleted := bson.M{"$set": bson.M{"deletedAt": doc.DeletedAt}}
+		published := make([]events.Payload, 0)
+		owner := id
+		if collectionName == "customers" {
+			for attr, attrIds := range map[string][]primitive.ObjectID{"addresses": doc.AddressIDs, "cards": doc.CardIDs} {
+				ids, err := u.updateAndRecord(attr, bson.M{"_id": bson.M{"$in": attrIds}, "deletedAt": doc.DeletedAt}, restored, deleted, db.ChangeRestored, at)
+				if err != nil {
+					return err
+				}
+				for _, attrId := range ids {
+					published = append(published, events.Removed(attr, attrId.Hex(), owner, true))
+				}
+			}
+		} else if owner, err = u.owner(collectionName, objectId); err != nil {
+			return err
+		} else if err := u.writable(owner); err != nil {
 			return err
 		}
+		if _, err := u.updateAndRecord(collectionName, bson.M{"_id": objectId, "deletedAt": doc.DeletedAt}, restored, deleted, db.ChangeRestored, at); err != nil {
+			return err
+		}
+		if err := u.settle(owner, at); err != nil {
+			return err
+		}
+		published = append(published, events.Removed(collectionName, id, owner, true))
+		return u.publish(at, published...)
+	})
+}
 
-		ids = make([]primitive.ObjectID, 0)
-		for _, card := range user.Cards {
-			cardId, err := primitive.ObjectIDFromHex(card.ID)
-			if err != nil {
+// Purge permanently removes the entities deleted before the given time,
+// returning how many customers, addresses and cards were removed
+func (m *Mongo) Purge(before time.Time) (int, error) {
+	purged := 0
+	var failed error
+	for _, collectionName := range []string{"customers", "addresses", "cards"} {
+		collection := m.Client.Database(mongoDatabase).Collection(collectionName)
+		findOptions := options.Find().SetProjection(bson.M{"_id": 1})
+		cur, err := collection.Find(context.Background(), bson.M{"deletedAt": bson.M{"$lt": before}}, findOptions)
+		if err != nil {
+			return purged, err
+		}
+		var docs []struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}
+		if err := cur.All(context.Background(), &docs); err != nil {
+			return purged, err
+		}
+		// Every entity goes in a unit of work of its own, so one failure
+		// does not hold back the rest
+		for _, doc := range docs {
+			var n int
+			err := m.atomically(func(u *unitOfWork) (err error) {
+				n, err = purge(u, collectionName, doc.ID)
 				return err
+			})
+			if err != nil {
+				if failed == nil {
+					failed = err
+				}
+				continue
 			}
-			ids = append(ids, cardId)
+			purged += n
 		}
-		collection = m.Client.Database(mongoDatabase).Collection("cards")
-		_, err = collection.DeleteMany(context.Background(), bson.M{"_id": bson.M{"$in": ids}})
+	}
+	return purged, failed
+}
+
+// purge removes a document for good. An address or card is taken out of its
+// customers and its last version retired, with the numbers of a card
+// redacted in all of its versions. A customer takes its addresses and cards
+// with it, along with all their versions, each recorded as purged.
+func purge(u *unitOfWork, collectionName string, id primitive.ObjectID) (int, error) {
+	if collectionName != "customers" {
+		owner, err := u.owner(collectionName, id)
 		if err != nil {
-			return err
+			return 0, err
 		}
-	} else {
-		collectionId, err := primitive.ObjectIDFromHex(id)
+		if err := u.removeReference(collectionName, id); err != nil {
+			return 0, err
+		}
+		if _, err := u.retire(collectionName, bson.M{"_id": id}, owner, now()); err != nil {
+			return 0, err
+		}
+		if collectionName == "cards" {
+			if err := u.redactCards([]primitive.ObjectID{id}); err != nil {
+				return 0, err
+			}
+		}
+		n, err := u.remove(collectionName, bson.M{"_id": id})
 		if err != nil {
-			return err
+			return 0, err
 		}
+		return n, u.record(collectionName, db.ChangePurged, now(), id)
+	}
 
-		collection := m.Client.Database(mongoDatabase).Collection("customers")
-		_, err = collection.UpdateMany(context.Background(), bson.M{}, bson.M{"$pull": bson.M{collectionName: collectionId}})
+	var mu MongoUser
+	err := u.collection("customers").FindOne(u.ctx, bson.M{"_id": id}).Decode(&mu)
+	if err != nil {
+		return 0, notFound(err)
+	}
+	purged := 0
+	children := map[string][]primitive.ObjectID{"addresses": mu.AddressIDs, "cards": mu.CardIDs}
+	for _, attr := range []string{"addresses", "cards"} {
+		held := children[attr]
+		ids, err := u.ids(attr, bson.M{"_id": bson.M{"$in": held}})
 		if err != nil {
-			return err
+			return 0, err
+		}
+		versions := bson.M{"$or": bson.A{bson.M{"of": bson.M{"$in": held}}, bson.M{"customer": id.Hex()}}}
+		if _, err := u.remove(versionCollections[attr], versions); err != nil {
+			return 0, err
 		}
+		n, err := u.remove(attr, bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return 0, err
+		}
+		if err := u.record(attr, db.ChangePurged, now(), ids...); err != nil {
+			return 0, err
+		}
+		purged += n
+	}
+	customers, err := u.remove("customers", bson.M{"_id": id})
+	if err != nil {
+		return 0, err
 	}
+	return purged + customers, u.record("customers", db.ChangePurged, now(), id)
+}
 
-	return nil
+// Changes returns the changes recorded after since in order
+func (m *Mongo) Changes(since int64, limit int) ([]db.Change, error) {
+	collection := m.Client.Database(mongoDatabase).Collection("changes")
+	findOptions := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(int64(limit))
+	cur, err := collection.Find(context.Background(), bson.M{"_id": bson.M{"$gt": since}}, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]db.Change, 0, limit)
+	err = cur.All(context.Background(), &changes)
+	return changes, err
 }
 
 func (m *Mongo) Ping() error {
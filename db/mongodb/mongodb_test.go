@@ -4,6 +4,7 @@ import (
 	"fmt"
 //	"os"
 	"testing"
+	"time"
 
 	"github.com/microservices-demo/user/users"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -101,6 +102,62 @@ func TestCardAddId(t *testing.T) {
 	}
 }
 
+func TestEmbed(t *testing.T) {
+	m := mongoEmbedded{MongoUser: New()}
+	a1, a2, c1 := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	m.AddressIDs = []primitive.ObjectID{a1, a2}
+	m.CardIDs = []primitive.ObjectID{c1}
+	m.AddUserIDs()
+	m.AddressDocs = []MongoAddress{{ID: a2, Address: users.Address{Street: "second"}}, {ID: a1, Address: users.Address{Street: "first"}}}
+
+	u := m.User
+	m.embed(&u, true, false)
+	if len(u.Addresses) != 2 || u.Addresses[0].Street != "first" || u.Addresses[1].ID != a2.Hex() {
+		t.Errorf("expected the addresses in the order of the customer, received %v", u.Addresses)
+	}
+	if len(u.Cards) != 1 || u.Cards[0].ID != c1.Hex() {
+		t.Errorf("expected the card ids to be kept when cards are not embedded, received %v", u.Cards)
+	}
+	m.embed(&u, false, true)
+	if len(u.Cards) != 0 {
+		t.Errorf("expected a card that was not found to be dropped, received %v", u.Cards)
+	}
+}
+
+func TestOldestFirst(t *testing.T) {
+	first := primitive.NewObjectIDFromTimestamp(time.Unix(1500000000, 0))
+	second := primitive.NewObjectIDFromTimestamp(time.Unix(1600000000, 0))
+	ids := oldestFirst([]primitive.ObjectID{second, first})
+	if ids[0] != first || ids[1] != second {
+		t.Errorf("expected the older customer first, received %v", ids)
+	}
+}
+
+func TestChooseDefaults(t *testing.T) {
+	shipping, billing, both := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	card, other := primitive.NewObjectID(), primitive.NewObjectID()
+	addresses := []heldAddress{{ID: shipping, Type: users.Shipping}, {ID: billing, Type: users.Billing}, {ID: both}}
+
+	d := chooseDefaults(mongoDefaults{}, addresses, []primitive.ObjectID{card, other})
+	if *d.ShippingAddress != shipping || *d.BillingAddress != billing || *d.Card != card {
+		t.Errorf("expected the first address and card that fit, received %+v", d.defaults())
+	}
+
+	d = chooseDefaults(mongoDefaults{ShippingAddress: &both, BillingAddress: &shipping, Card: &other}, addresses, []primitive.ObjectID{card, other})
+	if *d.ShippingAddress != both || *d.Card != other {
+		t.Errorf("expected fitting defaults to be kept, received %+v", d.defaults())
+	}
+	if *d.BillingAddress != billing {
+		t.Errorf("expected a shipping address not to be billed, received %v", d.BillingAddress.Hex())
+	}
+
+	// The default billing address was deleted
+	d = chooseDefaults(d, addresses[:1], nil)
+	if *d.ShippingAddress != shipping || d.BillingAddress != nil || d.Card != nil {
+		t.Errorf("expected defaults nothing fits to be left out, received %+v", d.defaults())
+	}
+}
+
 /*func TestCreate(t *testing.T) {
 	TestMongo.Session = TestServer.Session()
 	defer TestMongo.Session.Close()
@@ -162,3 +219,16 @@ func TestGetUserAttributes(t *testing.T) {
 		t.Error(err)
 	}
 }*/
+
+func TestSeparatedKey(t *testing.T) {
+	for _, c := range []struct{ stored, key, expected string }{
+		{"eve#57a98d98e4b00679b4a830ad", "eve", "eve#57a98d98e4b00679b4a830ad"},
+		{"eve#57a98d98e4b00679b4a830ad", "eve_berger", "eve_berger"},
+		{"eve", "eve", "eve"},
+		{"#57a98d98e4b00679b4a830ad", "", ""},
+	} {
+		if k := separatedKey(c.stored, c.key); k != c.expected {
+			t.Errorf("expected %q for %q kept as %q, received %q", c.expected, c.key, c.stored, k)
+		}
+	}
+}
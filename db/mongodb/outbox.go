@@ -0,0 +1,55 @@
+package mongodb
+
+import (
+	"context"
+
+	"github.com/microservices-demo/user/events"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var _ events.Outbox = &Mongo{}
+
+// outboxEvent is an event waiting in the outbox collection. Its ObjectID
+// orders the events and becomes the event ID.
+type outboxEvent struct {
+	events.Event `bson:",inline"`
+	ID           primitive.ObjectID `bson:"_id"`
+}
+
+// Pending returns up to limit undelivered events, oldest first
+func (m *Mongo) Pending(limit int) ([]events.Event, error) {
+	collection := m.Client.Database(mongoDatabase).Collection("outbox")
+	findOptions := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(int64(limit))
+	cur, err := collection.Find(context.Background(), bson.M{}, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	var docs []outboxEvent
+	if err := cur.All(context.Background(), &docs); err != nil {
+		return nil, err
+	}
+	pending := make([]events.Event, 0, len(docs))
+	for _, doc := range docs {
+		doc.Event.ID = doc.ID.Hex()
+		pending = append(pending, doc.Event)
+	}
+	return pending, nil
+}
+
+// Delivered removes delivered events from the outbox
+func (m *Mongo) Delivered(ids ...string) error {
+	oids := make([]primitive.ObjectID, 0, len(ids))
+	for _, id := range ids {
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			return err
+		}
+		oids = append(oids, oid)
+	}
+	collection := m.Client.Database(mongoDatabase).Collection("outbox")
+	_, err := collection.DeleteMany(context.Background(), bson.M{"_id": bson.M{"$in": oids}})
+	return err
+}
@@ -0,0 +1,242 @@
+package mongodb
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/db/query"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// sortKey is one component of the order of a listing
+type sortKey struct {
+	path string
+	typ  query.Type
+	desc bool
+}
+
+// sortKeys translates the requested sort into document paths, always ending
+// with _id so that the order is total and can be resumed from a cursor
+func sortKeys(sorts []query.Sort) []sortKey {
+	keys := make([]sortKey, 0, len(sorts)+1)
+	for _, s := range sorts {
+		keys = append(keys, sortKey{path: s.Field, typ: query.Fields[s.Field].Type, desc: s.Desc})
+	}
+	return append(keys, sortKey{path: "_id"})
+}
+
+// compileFilter translates a parsed filter into a Mongo filter document for
+// the customers collection
+func (m *Mongo) compileFilter(e query.Expr) (bson.M, error) {
+	switch e := e.(type) {
+	case nil:
+		return bson.M{}, nil
+	case query.And:
+		return m.compileList("$and", e)
+	case query.Or:
+		return m.compileList("$or", e)
+	case query.Not:
+		f, err := m.compileFilter(e.Expr)
+		if err != nil {
+			return nil, err
+		}
+		return bson.M{"$nor": bson.A{f}}, nil
+	case query.Cmp:
+		if e.Field == "country" {
+			return m.compileCountry(e)
+		}
+		if t, ok := e.Value.(time.Time); ok {
+			return bson.M{e.Field: compileTime(e.Op, t)}, nil
+		}
+		return bson.M{e.Field: compileCmp(e.Op, e.Value)}, nil
+	}
+	return nil, fmt.Errorf("unsupported filter %v", e)
+}
+
+func (m *Mongo) compileList(op string, es []query.Expr) (bson.M, error) {
+	list := make(bson.A, 0, len(es))
+	for _, e := range es {
+		f, err := m.compileFilter(e)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, f)
+	}
+	return bson.M{op: list}, nil
+}
+
+// compileCountry matches customers holding at least one address in a
+// matching country
+func (m *Mongo) compileCountry(e query.Cmp) (bson.M, error) {
+	collection := m.Client.Database(mongoDatabase).Collection("addresses")
+	findOptions := options.Find().SetProjection(bson.M{"_id": 1})
+	cur, err := collection.Find(context.Background(), bson.M{"country": compileCmp(e.Op, e.Value), "deletedAt": nil}, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(context.Background())
+
+	ids := make([]primitive.ObjectID, 0)
+	for cur.Next(context.Background()) {
+		ids = append(ids, cur.Current.Lookup("_id").ObjectID())
+	}
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+	return bson.M{"addresses": bson.M{"$in": ids}}, nil
+}
+
+// compileCmp compares a field with a value, matching text without regard to
+// case
+func compileCmp(op query.Op, v interface{}) interface{} {
+	if s, ok := v.(string); ok {
+		switch op {
+		case query.Eq:
+			return primitive.Regex{Pattern: "^" + regexp.QuoteMeta(s) + "$", Options: "i"}
+		case query.Ne:
+			return bson.M{"$not": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(s) + "$", Options: "i"}}
+		case query.Prefix:
+			return primitive.Regex{Pattern: "^" + regexp.QuoteMeta(s), Options: "i"}
+		case query.Suffix:
+			return primitive.Regex{Pattern: regexp.QuoteMeta(s) + "$", Options: "i"}
+		case query.Contains:
+			return primitive.Regex{Pattern: regexp.QuoteMeta(s), Options: "i"}
+		}
+	}
+	switch op {
+	case query.Ne:
+		return bson.M{"$ne": v}
+	case query.Lt:
+		return bson.M{"$lt": v}
+	case query.Le:
+		return bson.M{"$lte": v}
+	case query.Gt:
+		return bson.M{"$gt": v}
+	case query.Ge:
+		return bson.M{"$gte": v}
+	}
+	return v
+}
+
+// compileTime compares times to the second, so that a time given in a filter
+// stands for the whole second it falls in
+func compileTime(op query.Op, t time.Time) bson.M {
+	from := t.Truncate(time.Second)
+	to := from.Add(time.Second)
+	switch op {
+	case query.Ne:
+		return bson.M{"$not": bson.M{"$gte": from, "$lt": to}}
+	case query.Lt:
+		return bson.M{"$lt": from}
+	case query.Le:
+		return bson.M{"$lt": to}
+	case query.Gt:
+		return bson.M{"$gte": to}
+	case query.Ge:
+		return bson.M{"$gte": from}
+	}
+	return bson.M{"$gte": from, "$lt": to}
+}
+
+// keysetFilter selects the documents that follow (or precede) the cursor in
+// the order given by keys. Missing values sort before all others, as they do
+// in Mongo, but no comparison operator matches them, so they are selected
+// explicitly.
+func keysetFilter(keys []sortKey, c db.Cursor) (bson.M, error) {
+	values := make([]interface{}, len(keys))
+	k := 0
+	for i, key := range keys {
+		if key.path == "_id" {
+			id, err := primitive.ObjectIDFromHex(c.ID)
+			if err != nil {
+				return nil, db.ErrInvalidCursor
+			}
+			values[i] = id
+			continue
+		}
+		if k >= len(c.Keys) {
+			return nil, db.ErrInvalidCursor
+		}
+		v, err := fromCursorKey(key, c.Keys[k])
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+		k++
+	}
+	if k != len(c.Keys) {
+		return nil, db.ErrInvalidCursor
+	}
+
+	or := make(bson.A, 0, len(keys))
+	for i, key := range keys {
+		f := bson.M{}
+		for j := 0; j < i; j++ {
+			f[keys[j].path] = values[j]
+		}
+		op := "$gt"
+		if key.desc != c.Before {
+			op = "$lt"
+		}
+		switch {
+		case values[i] == nil && op == "$lt":
+			// Nothing sorts before a missing value
+			continue
+		case values[i] == nil:
+			f[key.path] = bson.M{"$ne": nil}
+		case op == "$lt" && key.path != "_id":
+			f["$or"] = bson.A{bson.M{key.path: bson.M{"$lt": values[i]}}, bson.M{key.path: nil}}
+		default:
+			f[key.path] = bson.M{op: values[i]}
+		}
+		or = append(or, f)
+	}
+	return bson.M{"$or": or}, nil
+}
+
+// cursorFor builds the cursor pointing at doc in the order given by keys
+func cursorFor(doc bson.Raw, keys []sortKey, before bool) db.Cursor {
+	c := db.Cursor{ID: doc.Lookup("_id").ObjectID().Hex(), Before: before}
+	for _, key := range keys {
+		if key.path == "_id" {
+			continue
+		}
+		v, err := doc.LookupErr(key.path)
+		switch {
+		case err != nil || v.Type == bsontype.Null:
+			c.Keys = append(c.Keys, nil)
+		case v.Type == bsontype.DateTime:
+			c.Keys = append(c.Keys, v.Time().Format(time.RFC3339Nano))
+		case v.Type == bsontype.String:
+			c.Keys = append(c.Keys, v.StringValue())
+		default:
+			c.Keys = append(c.Keys, v.String())
+		}
+	}
+	return c
+}
+
+func fromCursorKey(key sortKey, v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return nil, db.ErrInvalidCursor
+	}
+	if key.typ == query.Time {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, db.ErrInvalidCursor
+		}
+		return t, nil
+	}
+	return s, nil
+}
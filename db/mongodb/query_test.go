@@ -0,0 +1,110 @@
+package mongodb
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/db/query"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSortKeys(t *testing.T) {
+	keys := sortKeys([]query.Sort{{Field: "lastName", Desc: true}})
+	expected := []sortKey{{path: "lastName", desc: true}, {path: "_id"}}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected %v received %v", expected, keys)
+	}
+	keys = sortKeys([]query.Sort{{Field: "createdAt"}, {Field: "lastName"}})
+	if len(keys) != 3 || keys[0].typ != query.Time || keys[2].path != "_id" {
+		t.Errorf("expected sort on createdAt, lastName and _id, received %v", keys)
+	}
+}
+
+func TestCompileFilter(t *testing.T) {
+	e, err := query.Parse(`lastName ^= "B.r" and not firstName = Eve`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := TestMongo.compileFilter(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := bson.M{"$and": bson.A{
+		bson.M{"lastName": primitive.Regex{Pattern: `^B\.r`, Options: "i"}},
+		bson.M{"$nor": bson.A{bson.M{"firstName": primitive.Regex{Pattern: `^Eve$`, Options: "i"}}}},
+	}}
+	if !reflect.DeepEqual(f, expected) {
+		t.Errorf("expected %v received %v", expected, f)
+	}
+}
+
+func TestCompileTime(t *testing.T) {
+	day := time.Date(2016, 8, 9, 0, 0, 0, 0, time.UTC)
+	f := compileTime(query.Le, day.Add(time.Millisecond))
+	if f["$lt"] != day.Add(time.Second) {
+		t.Errorf("expected upper bound to include the whole second, received %v", f)
+	}
+	f = compileTime(query.Eq, day)
+	if f["$gte"] != day || f["$lt"] != day.Add(time.Second) {
+		t.Errorf("expected equality to match the whole second, received %v", f)
+	}
+}
+
+func TestKeysetFilter(t *testing.T) {
+	id := primitive.NewObjectID()
+	keys := []sortKey{{path: "lastName"}, {path: "_id"}}
+	f, err := keysetFilter(keys, db.Cursor{ID: id.Hex(), Keys: []interface{}{"Berger"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := bson.M{"$or": bson.A{
+		bson.M{"lastName": bson.M{"$gt": "Berger"}},
+		bson.M{"lastName": "Berger", "_id": bson.M{"$gt": id}},
+	}}
+	if !reflect.DeepEqual(f, expected) {
+		t.Errorf("expected %v received %v", expected, f)
+	}
+
+	f, _ = keysetFilter(keys, db.Cursor{ID: id.Hex(), Keys: []interface{}{"Berger"}, Before: true})
+	expected = bson.M{"$or": bson.A{
+		bson.M{"$or": bson.A{bson.M{"lastName": bson.M{"$lt": "Berger"}}, bson.M{"lastName": nil}}},
+		bson.M{"lastName": "Berger", "_id": bson.M{"$lt": id}},
+	}}
+	if !reflect.DeepEqual(f, expected) {
+		t.Errorf("expected reversed comparison including missing values for previous page, received %v", f)
+	}
+
+	f, _ = keysetFilter(keys, db.Cursor{ID: id.Hex(), Keys: []interface{}{nil}})
+	expected = bson.M{"$or": bson.A{
+		bson.M{"lastName": bson.M{"$ne": nil}},
+		bson.M{"lastName": nil, "_id": bson.M{"$gt": id}},
+	}}
+	if !reflect.DeepEqual(f, expected) {
+		t.Errorf("expected every value to follow a missing one, received %v", f)
+	}
+	f, _ = keysetFilter(keys, db.Cursor{ID: id.Hex(), Keys: []interface{}{nil}, Before: true})
+	expected = bson.M{"$or": bson.A{bson.M{"lastName": nil, "_id": bson.M{"$lt": id}}}}
+	if !reflect.DeepEqual(f, expected) {
+		t.Errorf("expected nothing but missing values to precede a missing one, received %v", f)
+	}
+
+	if _, err := keysetFilter(keys, db.Cursor{ID: id.Hex()}); err != db.ErrInvalidCursor {
+		t.Error("expected invalid cursor for missing sort keys")
+	}
+}
+
+func TestCursorFor(t *testing.T) {
+	id := primitive.NewObjectID()
+	doc, _ := bson.Marshal(bson.M{"_id": id, "lastName": "Berger"})
+	c := cursorFor(doc, []sortKey{{path: "lastName"}, {path: "_id"}}, false)
+	if c.ID != id.Hex() || !reflect.DeepEqual(c.Keys, []interface{}{"Berger"}) {
+		t.Errorf("unexpected cursor %+v", c)
+	}
+	doc, _ = bson.Marshal(bson.M{"_id": id, "lastName": nil})
+	if c = cursorFor(doc, []sortKey{{path: "lastName"}, {path: "_id"}}, false); !reflect.DeepEqual(c.Keys, []interface{}{nil}) {
+		t.Errorf("expected a null key for a null value, received %+v", c)
+	}
+}
@@ -0,0 +1,119 @@
+package mongodb
+
+import (
+	"context"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/events"
+	"github.com/microservices-demo/user/users"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var _ db.StatusStore = &Mongo{}
+
+// SetStatus moves a live customer to another status, recording the
+// transition in the change feed. The transition is expected to be valid.
+func (m *Mongo) SetStatus(customerID string, t *users.Transition) error {
+	id, err := primitive.ObjectIDFromHex(customerID)
+	if err != nil {
+		return db.ErrNotFound
+	}
+	at := now()
+	return m.atomically(func(u *unitOfWork) error {
+		var mu struct {
+			Status  string `bson:"status"`
+			Version int64  `bson:"version"`
+		}
+		err := u.collection("customers").FindOne(u.ctx, bson.M{"_id": id, "deletedAt": nil}).Decode(&mu)
+		if err != nil {
+			return notFound(err)
+		}
+		t.From = users.CurrentStatus(mu.Status)
+		t.At = at
+		if err := users.CanMove(t.From, t.To); err != nil {
+			return err
+		}
+		version := storedVersion(mu.Version)
+		change := bson.M{"$set": bson.M{"status": t.To, "version": version + 1, "updatedAt": at}}
+		revert := bson.M{"$set": bson.M{"status": mu.Status, "version": version}}
+		if mu.Status == "" {
+			revert = bson.M{"$set": bson.M{"version": version}, "$unset": bson.M{"status": ""}}
+		}
+		ids, err := u.update("customers", bson.M{"_id": id, "version": versionFilter(version)}, change, revert)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return db.ErrVersionConflict
+		}
+		seq, err := u.seq()
+		if err != nil {
+			return err
+		}
+		err = u.insert("changes", db.Change{
+			Seq:    seq,
+			Entity: "customers",
+			ID:     customerID,
+			Op:     db.ChangeStatus,
+			At:     at,
+			Status: t.To,
+			From:   t.From,
+			Reason: t.Reason,
+			Actor:  t.Actor,
+		})
+		if err != nil {
+			return err
+		}
+		return u.publish(at, events.CustomerStatusChanged{CustomerID: customerID, From: t.From, To: t.To, Reason: t.Reason, Actor: t.Actor})
+	})
+}
+
+// StatusHistory returns the transitions of a customer from the change feed,
+// oldest first
+func (m *Mongo) StatusHistory(customerID string) ([]users.Transition, error) {
+	collection := m.Client.Database(mongoDatabase).Collection("changes")
+	cur, err := collection.Find(context.Background(),
+		bson.M{"entity": "customers", "id": customerID, "op": db.ChangeStatus},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var changes []db.Change
+	if err := cur.All(context.Background(), &changes); err != nil {
+		return nil, err
+	}
+	history := make([]users.Transition, 0, len(changes))
+	for _, c := range changes {
+		history = append(history, users.Transition{From: c.From, To: c.Status, Reason: c.Reason, Actor: c.Actor, At: c.At})
+	}
+	return history, nil
+}
+
+// writable refuses writes to the customer with the given hex id, as returned
+// by owner, when its status does not allow them. Addresses and cards of
+// anonymous customers are always writable.
+func (u *unitOfWork) writable(owner string) error {
+	if owner == "" {
+		return nil
+	}
+	id, err := primitive.ObjectIDFromHex(owner)
+	if err != nil {
+		return err
+	}
+	var doc struct {
+		Status string `bson:"status"`
+	}
+	err = u.collection("customers").FindOne(u.ctx, bson.M{"_id": id},
+		options.FindOne().SetProjection(bson.M{"status": 1})).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return users.CanWrite(doc.Status)
+}
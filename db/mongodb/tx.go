@@ -0,0 +1,292 @@
+package mongodb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/events"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// unitOfWork groups the writes of one logical change. Writes must use its
+// context so they join the transaction when there is one. Without
+// transactions every write registers the action that undoes it, and those
+// run in reverse order when a later write fails.
+type unitOfWork struct {
+	ctx  context.Context
+	db   *mongo.Database
+	undo []func(context.Context) error
+}
+
+// onRollback registers the compensating action for a write that succeeded
+func (u *unitOfWork) onRollback(f func(ctx context.Context) error) {
+	u.undo = append(u.undo, f)
+}
+
+func (u *unitOfWork) collection(name string) *mongo.Collection {
+	return u.db.Collection(name)
+}
+
+// insert adds docs to a collection, removing them again on rollback
+func (u *unitOfWork) insert(collectionName string, docs ...interface{}) error {
+	if len(docs) == 0 {
+		return nil
+	}
+	res, err := u.collection(collectionName).InsertMany(u.ctx, docs)
+	if res != nil && len(res.InsertedIDs) > 0 {
+		ids := res.InsertedIDs
+		u.onRollback(func(ctx context.Context) error {
+			_, err := u.collection(collectionName).DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+			return err
+		})
+	}
+	return err
+}
+
+// remove deletes the documents matching filter, putting them back on
+// rollback. It returns the number of documents deleted.
+func (u *unitOfWork) remove(collectionName string, filter interface{}) (int, error) {
+	collection := u.collection(collectionName)
+	cur, err := collection.Find(u.ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	var docs []bson.Raw
+	if err := cur.All(u.ctx, &docs); err != nil {
+		return 0, err
+	}
+	if len(docs) == 0 {
+		return 0, nil
+	}
+	ids := make(bson.A, 0, len(docs))
+	saved := make([]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		ids = append(ids, doc.Lookup("_id"))
+		saved = append(saved, doc)
+	}
+	res, err := collection.DeleteMany(u.ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if res != nil && res.DeletedCount > 0 {
+		u.onRollback(func(ctx context.Context) error {
+			_, err := collection.InsertMany(ctx, saved, nil)
+			if mongo.IsDuplicateKeyError(err) {
+				return nil
+			}
+			return err
+		})
+	}
+	return len(docs), err
+}
+
+// addReference adds id to the attr list of the live customers with the given ids,
+// taking it out again on rollback. It returns the number of customers found.
+func (u *unitOfWork) addReference(attr string, id primitive.ObjectID, owners ...primitive.ObjectID) (int64, error) {
+	collection := u.collection("customers")
+	res, err := collection.UpdateMany(u.ctx, bson.M{"_id": bson.M{"$in": owners}, "deletedAt": nil}, bson.M{"$addToSet": bson.M{attr: id}})
+	if err != nil {
+		return 0, err
+	}
+	if res.ModifiedCount > 0 {
+		u.onRollback(func(ctx context.Context) error {
+			_, err := collection.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": owners}}, bson.M{"$pull": bson.M{attr: id}})
+			return err
+		})
+	}
+	return res.MatchedCount, nil
+}
+
+// update applies change to the documents matching filter, applying revert to
+// the same documents on rollback. It returns the ids of the documents changed.
+func (u *unitOfWork) update(collectionName string, filter bson.M, change, revert bson.M) ([]primitive.ObjectID, error) {
+	collection := u.collection(collectionName)
+	findOptions := options.Find().SetProjection(bson.M{"_id": 1})
+	cur, err := collection.Find(u.ctx, filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	var docs []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cur.All(u.ctx, &docs); err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		return nil, nil
+	}
+	ids := make([]primitive.ObjectID, 0, len(docs))
+	for _, doc := range docs {
+		ids = append(ids, doc.ID)
+	}
+	_, err = collection.UpdateMany(u.ctx, bson.M{"_id": bson.M{"$in": ids}}, change)
+	if err != nil {
+		return nil, err
+	}
+	u.onRollback(func(ctx context.Context) error {
+		_, err := collection.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": ids}}, revert)
+		return err
+	})
+	return ids, nil
+}
+
+// updateAndRecord updates the documents matching filter like update and
+// records the change of each of them
+func (u *unitOfWork) updateAndRecord(collectionName string, filter bson.M, change, revert bson.M, op string, at time.Time) ([]primitive.ObjectID, error) {
+	ids, err := u.update(collectionName, filter, change, revert)
+	if err != nil {
+		return nil, err
+	}
+	return ids, u.record(collectionName, op, at, ids...)
+}
+
+// publish writes events to the outbox, from where they are delivered once
+// the unit of work is committed
+func (u *unitOfWork) publish(at time.Time, payloads ...events.Payload) error {
+	docs := make([]interface{}, 0, len(payloads))
+	for _, p := range payloads {
+		e, err := events.New(p, at)
+		if err != nil {
+			return err
+		}
+		docs = append(docs, outboxEvent{ID: primitive.NewObjectID(), Event: e})
+	}
+	return u.insert("outbox", docs...)
+}
+
+// owner returns the id of the customer holding the address or card, or the
+// empty string for the attributes of anonymous customers
+func (u *unitOfWork) owner(attr string, id primitive.ObjectID) (string, error) {
+	var doc struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	findOptions := options.FindOne().SetProjection(bson.M{"_id": 1})
+	err := u.collection("customers").FindOne(u.ctx, bson.M{attr: id}, findOptions).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return doc.ID.Hex(), nil
+}
+
+// record appends changes of the documents with the given ids to the change
+// feed. Sequence numbers come from the changes counter; one taken by a write
+// that is rolled back without a transaction leaves a gap in the feed.
+func (u *unitOfWork) record(collectionName, op string, at time.Time, ids ...primitive.ObjectID) error {
+	changes := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		seq, err := u.seq()
+		if err != nil {
+			return err
+		}
+		changes = append(changes, db.Change{Seq: seq, Entity: collectionName, ID: id.Hex(), Op: op, At: at})
+	}
+	return u.insert("changes", changes...)
+}
+
+// seq takes the next sequence number of the change feed
+func (u *unitOfWork) seq() (int64, error) {
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := u.collection("counters").FindOneAndUpdate(u.ctx,
+		bson.M{"_id": "changes"},
+		bson.M{"$inc": bson.M{"seq": 1}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&counter)
+	return counter.Seq, err
+}
+
+// removeReference takes id out of the attr list of every customer holding
+// it, adding it back on rollback
+func (u *unitOfWork) removeReference(attr string, id primitive.ObjectID) error {
+	collection := u.collection("customers")
+	cur, err := collection.Find(u.ctx, bson.M{attr: id})
+	if err != nil {
+		return err
+	}
+	var owners []MongoUser
+	if err := cur.All(u.ctx, &owners); err != nil {
+		return err
+	}
+	if len(owners) == 0 {
+		return nil
+	}
+	ids := make([]primitive.ObjectID, 0, len(owners))
+	for _, o := range owners {
+		ids = append(ids, o.ID)
+	}
+	_, err = collection.UpdateMany(u.ctx, bson.M{"_id": bson.M{"$in": ids}}, bson.M{"$pull": bson.M{attr: id}})
+	if err != nil {
+		return err
+	}
+	u.onRollback(func(ctx context.Context) error {
+		_, err := collection.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": ids}}, bson.M{"$addToSet": bson.M{attr: id}})
+		return err
+	})
+	return nil
+}
+
+// atomically runs fn as one unit of work, in a transaction when the
+// deployment supports them and with compensating actions otherwise
+func (m *Mongo) atomically(fn func(u *unitOfWork) error) error {
+	database := m.Client.Database(mongoDatabase)
+	if m.transactions {
+		session, err := m.Client.StartSession()
+		if err != nil {
+			return err
+		}
+		defer session.EndSession(context.Background())
+		_, err = session.WithTransaction(context.Background(), func(sc mongo.SessionContext) (interface{}, error) {
+			return nil, fn(&unitOfWork{ctx: sc, db: database})
+		})
+		return err
+	}
+
+	u := &unitOfWork{ctx: context.Background(), db: database}
+	if err := fn(u); err != nil {
+		if failed := u.rollback(); failed != nil && m.Logger != nil {
+			m.Logger.Log("err", err, "rollback", failed)
+		}
+		// The cause is returned as it is so that callers still tell it
+		// apart
+		return err
+	}
+	return nil
+}
+
+// rollback runs the compensating actions in reverse order, returning the
+// errors of the ones that fail
+func (u *unitOfWork) rollback() error {
+	failed := make([]string, 0)
+	for i := len(u.undo) - 1; i >= 0; i-- {
+		if err := u.undo[i](context.Background()); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	u.undo = nil
+	if len(failed) > 0 {
+		return fmt.Errorf("rollback failed: %v", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// supportsTransactions reports whether the server is a replica set member or
+// a mongos router, the deployments on which multi-document transactions work
+func (m *Mongo) supportsTransactions(ctx context.Context) bool {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	err := m.Client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	if err != nil {
+		return false
+	}
+	return hello.SetName != "" || hello.Msg == "isdbgrid"
+}
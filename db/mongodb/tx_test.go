@@ -0,0 +1,33 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRollback(t *testing.T) {
+	var order []int
+	u := &unitOfWork{}
+	for i := 0; i < 3; i++ {
+		i := i
+		u.onRollback(func(context.Context) error {
+			order = append(order, i)
+			return nil
+		})
+	}
+	if err := u.rollback(); err != nil {
+		t.Errorf("expected no error, received %v", err)
+	}
+	if len(order) != 3 || order[0] != 2 || order[2] != 0 {
+		t.Errorf("expected compensating actions in reverse order, received %v", order)
+	}
+
+	u.onRollback(func(context.Context) error { return errors.New("reinsert failed") })
+	u.onRollback(func(context.Context) error { return errors.New("restore failed") })
+	err := u.rollback()
+	if err == nil || !strings.Contains(err.Error(), "reinsert failed") || !strings.Contains(err.Error(), "restore failed") {
+		t.Errorf("expected both failures to be reported, received %v", err)
+	}
+}
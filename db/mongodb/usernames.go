@@ -0,0 +1,156 @@
+package mongodb
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/events"
+	"github.com/microservices-demo/user/users"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var _ db.UsernameChanger = &Mongo{}
+
+// ChangeUsername renames the customer and adds the change to its history.
+// The customer keeps holding its old name in usernameKeys, so the unique
+// index on them refuses a name held or reserved by another customer.
+func (m *Mongo) ChangeUsername(customerID string, c *users.UsernameChange) error {
+	id, err := primitive.ObjectIDFromHex(customerID)
+	if err != nil {
+		return db.ErrNotFound
+	}
+	at := now()
+	err = m.atomically(func(u *unitOfWork) error {
+		if err := u.writable(customerID); err != nil {
+			return err
+		}
+		var mu MongoUser
+		err := u.collection("customers").FindOne(u.ctx, bson.M{"_id": id, "deletedAt": nil}).Decode(&mu)
+		if err != nil {
+			return notFound(err)
+		}
+		c.From = mu.Username
+		c.Hold(at)
+		changes := append(mu.UsernameChanges, *c)
+		version := storedVersion(mu.Version)
+		change := bson.M{"$set": bson.M{
+			"username":        c.To,
+			"usernameKey":     users.Canonical(c.To),
+			"usernameKeys":    users.ReservedNames(c.To, changes, at),
+			"usernameChanges": changes,
+			"version":         version + 1,
+			"updatedAt":       at,
+		}}
+		revert := bson.M{"$set": bson.M{
+			"username":        mu.Username,
+			"usernameKey":     mu.UsernameKey,
+			"usernameKeys":    mu.UsernameKeys,
+			"usernameChanges": mu.UsernameChanges,
+			"version":         version,
+			"updatedAt":       mu.UpdatedAt,
+		}}
+		ids, err := u.update("customers", bson.M{"_id": id, "version": versionFilter(version)}, change, revert)
+		if err != nil {
+			return duplicate(err)
+		}
+		if len(ids) == 0 {
+			return db.ErrVersionConflict
+		}
+		if err := u.record("customers", db.ChangeUpdated, at, id); err != nil {
+			return err
+		}
+		return u.publish(at, events.CustomerUsernameChanged{CustomerID: customerID, From: c.From, To: c.To})
+	})
+	return err
+}
+
+// GetUserByPreviousName finds the customer still holding the name among its
+// usernameKeys, and checks its history on whether the name logs it in
+func (m *Mongo) GetUserByPreviousName(name string, at time.Time) (users.User, error) {
+	key := users.Canonical(name)
+	if key == "" {
+		return users.User{}, db.ErrNotFound
+	}
+	collection := m.Client.Database(mongoDatabase).Collection("customers")
+	var mu MongoUser
+	err := collection.FindOne(context.Background(), bson.M{"usernameKeys": key, "usernameKey": bson.M{"$ne": key}, "deletedAt": nil}).Decode(&mu)
+	if err != nil {
+		return users.User{}, notFound(err)
+	}
+	if !users.LogsIn(name, mu.UsernameChanges, at) {
+		return users.User{}, db.ErrNotFound
+	}
+	mu.AddUserIDs()
+	return mu.User, nil
+}
+
+// GetUsersBySeparatedName finds the customers whose usernameKey the
+// migration to canonical keys suffixed with their ID
+func (m *Mongo) GetUsersBySeparatedName(name string) ([]users.User, error) {
+	key := users.Canonical(name)
+	if key == "" {
+		return nil, nil
+	}
+	collection := m.Client.Database(mongoDatabase).Collection("customers")
+	cur, err := collection.Find(context.Background(), bson.M{"usernameKey": bson.M{"$regex": "^" + regexp.QuoteMeta(key+"#")}, "deletedAt": nil})
+	if err != nil {
+		return nil, err
+	}
+	var mus []MongoUser
+	if err := cur.All(context.Background(), &mus); err != nil {
+		return nil, err
+	}
+	us := make([]users.User, 0, len(mus))
+	for _, mu := range mus {
+		mu.AddUserIDs()
+		us = append(us, mu.User)
+	}
+	return us, nil
+}
+
+// ReleaseUsernames drops the names whose reservation ended from the
+// usernameKeys of the customers holding more than their username. Releasing
+// does not change the customers as the API shows them, so their version is
+// left alone.
+func (m *Mongo) ReleaseUsernames(before time.Time) (int, error) {
+	collection := m.Client.Database(mongoDatabase).Collection("customers")
+	cur, err := collection.Find(context.Background(), bson.M{"usernameKeys.1": bson.M{"$exists": true}},
+		options.Find().SetProjection(bson.M{"username": 1, "usernameKeys": 1, "usernameChanges": 1}))
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(context.Background())
+	released := 0
+	for cur.Next(context.Background()) {
+		var doc struct {
+			ID              primitive.ObjectID     `bson:"_id"`
+			Username        string                 `bson:"username"`
+			UsernameKeys    []string               `bson:"usernameKeys"`
+			UsernameChanges []users.UsernameChange `bson:"usernameChanges"`
+		}
+		if err := cur.Decode(&doc); err != nil {
+			return released, err
+		}
+		keys := users.ReservedNames(doc.Username, doc.UsernameChanges, before)
+		if len(keys) == len(doc.UsernameKeys) {
+			continue
+		}
+		// Matching the keys read leaves a customer renamed meanwhile to
+		// the next run
+		res, err := collection.UpdateOne(context.Background(),
+			bson.M{"_id": doc.ID, "usernameKeys": doc.UsernameKeys},
+			bson.M{"$set": bson.M{"usernameKeys": keys}})
+		if err != nil {
+			return released, err
+		}
+		if res.ModifiedCount > 0 {
+			released += len(doc.UsernameKeys) - len(keys)
+		}
+	}
+	return released, cur.Err()
+}
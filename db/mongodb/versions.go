@@ -0,0 +1,142 @@
+package mongodb
+
+import (
+	"context"
+	"time"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/users"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var _ db.Versions = &Mongo{}
+
+// versionCollections hold the retired versions of addresses and cards
+var versionCollections = map[string]string{
+	"addresses": "address_versions",
+	"cards":     "card_versions",
+}
+
+// mongoVersion is an address or card as it was before it was replaced or
+// purged, kept whole but for the number and security code of a purged card.
+// Customer is the customer that held it, if any.
+type mongoVersion struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	Of        primitive.ObjectID `bson:"of"`
+	Customer  string             `bson:"customer,omitempty"`
+	Version   int64              `bson:"version"`
+	RetiredAt time.Time          `bson:"retiredAt"`
+	Doc       bson.Raw           `bson:"doc"`
+}
+
+// GetAddressVersion returns the given version of an address, deleted,
+// replaced or purged since
+func (m *Mongo) GetAddressVersion(id string, version int64) (users.Address, error) {
+	var ma MongoAddress
+	if err := m.version("addresses", id, version, &ma); err != nil {
+		return users.Address{}, err
+	}
+	ma.AddID()
+	return ma.Address, nil
+}
+
+// GetCardVersion returns the given version of a card, deleted, replaced or
+// purged since
+func (m *Mongo) GetCardVersion(id string, version int64) (users.Card, error) {
+	var mc MongoCard
+	if err := m.version("cards", id, version, &mc); err != nil {
+		return users.Card{}, err
+	}
+	mc.AddID()
+	return mc.Card, nil
+}
+
+// version decodes the given version of an attr document into doc, looking at
+// the stored document first and at the retired versions after
+func (m *Mongo) version(attr, id string, version int64, doc interface{}) error {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil || version <= 0 {
+		return db.ErrNotFound
+	}
+	database := m.Client.Database(mongoDatabase)
+	err = database.Collection(attr).FindOne(context.Background(), bson.M{"_id": objectId, "version": versionFilter(version)}).Decode(doc)
+	if err != mongo.ErrNoDocuments {
+		return err
+	}
+	var mv mongoVersion
+	err = database.Collection(versionCollections[attr]).FindOne(context.Background(), bson.M{"of": objectId, "version": version}).Decode(&mv)
+	if err != nil {
+		return notFound(err)
+	}
+	return bson.Unmarshal(mv.Doc, doc)
+}
+
+// retire keeps the attr documents matching filter, held by customer, as
+// retired versions before they are replaced or removed. It returns the number
+// of versions kept.
+func (u *unitOfWork) retire(attr string, filter bson.M, customer string, at time.Time) (int, error) {
+	cur, err := u.collection(attr).Find(u.ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	var docs []bson.Raw
+	if err := cur.All(u.ctx, &docs); err != nil {
+		return 0, err
+	}
+	versions := make([]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		var key struct {
+			ID      primitive.ObjectID `bson:"_id"`
+			Version int64              `bson:"version"`
+		}
+		if err := bson.Unmarshal(doc, &key); err != nil {
+			return 0, err
+		}
+		versions = append(versions, mongoVersion{
+			ID:        primitive.NewObjectID(),
+			Of:        key.ID,
+			Customer:  customer,
+			Version:   storedVersion(key.Version),
+			RetiredAt: at,
+			Doc:       doc,
+		})
+	}
+	return len(versions), u.insert(versionCollections[attr], versions...)
+}
+
+// redactCards masks the numbers and drops the security codes of every retired
+// version of the given cards, so that purged cards can not be read back
+// while the orders linking to their versions still show which card was used
+func (u *unitOfWork) redactCards(ids []primitive.ObjectID) error {
+	cur, err := u.collection(versionCollections["cards"]).Find(u.ctx, bson.M{"of": bson.M{"$in": ids}})
+	if err != nil {
+		return err
+	}
+	var versions []mongoVersion
+	if err := cur.All(u.ctx, &versions); err != nil {
+		return err
+	}
+	for _, v := range versions {
+		var mc MongoCard
+		if err := bson.Unmarshal(v.Doc, &mc); err != nil {
+			return err
+		}
+		change, revert := redactCard(mc.Card)
+		if _, err := u.update(versionCollections["cards"], bson.M{"_id": v.ID}, change, revert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redactCard returns the update redacting a retired version of card, and the
+// one undoing it
+func redactCard(card users.Card) (change, revert bson.M) {
+	masked := card
+	masked.MaskCC()
+	return bson.M{"$set": bson.M{"doc.longNum": masked.LongNum}, "$unset": bson.M{"doc.ccv": ""}},
+		bson.M{"$set": bson.M{"doc.longNum": card.LongNum, "doc.ccv": card.CCV}}
+}
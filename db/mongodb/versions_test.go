@@ -0,0 +1,72 @@
+package mongodb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/users"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestRedactCard(t *testing.T) {
+	change, revert := redactCard(users.Card{LongNum: "4111111111111111", CCV: "123"})
+	if change["$set"].(bson.M)["doc.longNum"] != "************1111" || change["$unset"].(bson.M)["doc.ccv"] != "" {
+		t.Errorf("expected the number masked and the security code dropped, received %v", change)
+	}
+	if revert["$set"].(bson.M)["doc.longNum"] != "4111111111111111" || revert["$set"].(bson.M)["doc.ccv"] != "123" {
+		t.Errorf("expected the card restored on rollback, received %v", revert)
+	}
+}
+
+func TestPurgedCardVersions(t *testing.T) {
+	m := liveMongo(t, "users_test")
+	u := users.New()
+	u.Username = "eve"
+	u.Cards = []users.Card{{LongNum: "4111111111111111", Expires: "12/30", CCV: "123"}}
+	u.Addresses = []users.Address{{Street: "Main Street", Number: "1"}}
+	if err := m.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	card := u.Cards[0]
+	card.LongNum, card.Version = "5500000000000004", 1
+	if err := m.UpdateCard(&card); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Delete("cards", card.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Purge(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	for version, expected := range map[int64]string{1: "************1111", 2: "************0004"} {
+		c, err := m.GetCardVersion(card.ID, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.LongNum != expected || c.CCV != "" {
+			t.Errorf("expected version %v of the purged card to be redacted, received %+v", version, c)
+		}
+	}
+
+	if err := m.Delete("customers", u.UserID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Purge(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.GetCardVersion(card.ID, 1); err != db.ErrNotFound {
+		t.Errorf("expected the versions to go with the customer, received %v", err)
+	}
+	changes, err := m.Changes(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	purged := false
+	for _, c := range changes {
+		purged = purged || (c.Entity == "addresses" && c.ID == u.Addresses[0].ID && c.Op == db.ChangePurged)
+	}
+	if !purged {
+		t.Errorf("expected the address purged with the customer to be in the change feed")
+	}
+}
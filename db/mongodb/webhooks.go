@@ -0,0 +1,190 @@
+package mongodb
+
+import (
+	"context"
+	"time"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/webhooks"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var _ webhooks.Store = &Mongo{}
+
+// mongoSubscription is a wrapper for webhook subscriptions
+type mongoSubscription struct {
+	webhooks.Subscription `bson:",inline"`
+	ID                    primitive.ObjectID `bson:"_id"`
+}
+
+// mongoDelivery is a wrapper for webhook deliveries. Its ID is made of the
+// event and subscription IDs, so an event is queued once per subscription.
+type mongoDelivery struct {
+	webhooks.Delivery `bson:",inline"`
+	ID                string `bson:"_id"`
+	EventID           string `bson:"eventId"`
+}
+
+func (md mongoDelivery) delivery() webhooks.Delivery {
+	d := md.Delivery
+	d.ID = md.ID
+	d.Event.ID = md.EventID
+	return d
+}
+
+// CreateSubscription stores a webhook subscription
+func (m *Mongo) CreateSubscription(s *webhooks.Subscription) error {
+	ms := mongoSubscription{Subscription: *s, ID: primitive.NewObjectID()}
+	ms.CreatedAt = now()
+	collection := m.Client.Database(mongoDatabase).Collection("webhooks")
+	if _, err := collection.InsertOne(context.Background(), ms); err != nil {
+		return err
+	}
+	s.ID = ms.ID.Hex()
+	s.CreatedAt = ms.CreatedAt
+	return nil
+}
+
+// GetSubscription returns a webhook subscription by id
+func (m *Mongo) GetSubscription(id string) (webhooks.Subscription, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return webhooks.Subscription{}, db.ErrNotFound
+	}
+	collection := m.Client.Database(mongoDatabase).Collection("webhooks")
+	var ms mongoSubscription
+	if err := collection.FindOne(context.Background(), bson.M{"_id": oid}).Decode(&ms); err != nil {
+		return webhooks.Subscription{}, notFound(err)
+	}
+	ms.Subscription.ID = ms.ID.Hex()
+	return ms.Subscription, nil
+}
+
+// GetSubscriptions returns all webhook subscriptions, oldest first
+func (m *Mongo) GetSubscriptions() ([]webhooks.Subscription, error) {
+	collection := m.Client.Database(mongoDatabase).Collection("webhooks")
+	cur, err := collection.Find(context.Background(), bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var docs []mongoSubscription
+	if err := cur.All(context.Background(), &docs); err != nil {
+		return nil, err
+	}
+	subs := make([]webhooks.Subscription, 0, len(docs))
+	for _, ms := range docs {
+		ms.Subscription.ID = ms.ID.Hex()
+		subs = append(subs, ms.Subscription)
+	}
+	return subs, nil
+}
+
+// DeleteSubscription removes a webhook subscription and its deliveries
+func (m *Mongo) DeleteSubscription(id string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return db.ErrNotFound
+	}
+	res, err := m.Client.Database(mongoDatabase).Collection("webhooks").DeleteOne(context.Background(), bson.M{"_id": oid})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return db.ErrNotFound
+	}
+	_, err = m.Client.Database(mongoDatabase).Collection("webhook_deliveries").DeleteMany(context.Background(), bson.M{"subscriptionId": id})
+	return err
+}
+
+// EnqueueDeliveries adds deliveries, skipping the ones already queued
+func (m *Mongo) EnqueueDeliveries(ds ...webhooks.Delivery) error {
+	collection := m.Client.Database(mongoDatabase).Collection("webhook_deliveries")
+	for _, d := range ds {
+		_, err := collection.InsertOne(context.Background(), mongoDelivery{Delivery: d, ID: d.ID, EventID: d.Event.ID})
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ClaimDelivery returns the live delivery due the longest, holding it back
+// until the given time, or nil when none is due
+func (m *Mongo) ClaimDelivery(now, until time.Time) (*webhooks.Delivery, error) {
+	collection := m.Client.Database(mongoDatabase).Collection("webhook_deliveries")
+	var md mongoDelivery
+	err := collection.FindOneAndUpdate(context.Background(),
+		bson.M{"deadAt": nil, "nextAttempt": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"nextAttempt": until}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "nextAttempt", Value: 1}}),
+	).Decode(&md)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The claim is not part of the delivery as attempted
+	md.NextAttempt = now
+	d := md.delivery()
+	return &d, nil
+}
+
+// RescheduleDelivery saves the outcome of a failed attempt
+func (m *Mongo) RescheduleDelivery(d webhooks.Delivery) error {
+	collection := m.Client.Database(mongoDatabase).Collection("webhook_deliveries")
+	_, err := collection.UpdateOne(context.Background(), bson.M{"_id": d.ID}, bson.M{"$set": bson.M{
+		"attempts":    d.Attempts,
+		"nextAttempt": d.NextAttempt,
+		"lastStatus":  d.LastStatus,
+		"lastError":   d.LastError,
+		"deadAt":      d.DeadAt,
+	}})
+	return err
+}
+
+// CompleteDelivery removes a delivery
+func (m *Mongo) CompleteDelivery(id string) error {
+	collection := m.Client.Database(mongoDatabase).Collection("webhook_deliveries")
+	_, err := collection.DeleteOne(context.Background(), bson.M{"_id": id})
+	return err
+}
+
+// DeadLetters returns the dead deliveries of a subscription, latest first
+func (m *Mongo) DeadLetters(subscriptionID string) ([]webhooks.Delivery, error) {
+	collection := m.Client.Database(mongoDatabase).Collection("webhook_deliveries")
+	cur, err := collection.Find(context.Background(),
+		bson.M{"subscriptionId": subscriptionID, "deadAt": bson.M{"$ne": nil}},
+		options.Find().SetSort(bson.D{{Key: "deadAt", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	var docs []mongoDelivery
+	if err := cur.All(context.Background(), &docs); err != nil {
+		return nil, err
+	}
+	dead := make([]webhooks.Delivery, 0, len(docs))
+	for _, md := range docs {
+		dead = append(dead, md.delivery())
+	}
+	return dead, nil
+}
+
+// ReplayDelivery makes a dead delivery due again, with a fresh set of attempts
+func (m *Mongo) ReplayDelivery(subscriptionID, id string, at time.Time) error {
+	collection := m.Client.Database(mongoDatabase).Collection("webhook_deliveries")
+	res, err := collection.UpdateOne(context.Background(),
+		bson.M{"_id": id, "subscriptionId": subscriptionID, "deadAt": bson.M{"$ne": nil}},
+		bson.M{"$set": bson.M{"attempts": 0, "nextAttempt": at}, "$unset": bson.M{"deadAt": ""}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// operators is ordered so that longer operators are tried first
+var operators = []Op{Ne, Le, Ge, Prefix, Suffix, Eq, Lt, Gt, Contains}
+
+// Parse parses a filter expression, checking every field against the
+// allow-list. The empty string parses to a nil Expr which matches everything.
+func Parse(s string) (Expr, error) {
+	p := &parser{src: s}
+	p.skipSpace()
+	if p.eof() {
+		return nil, nil
+	}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if !p.eof() {
+		return nil, p.errorf("unexpected %q", p.src[p.pos:])
+	}
+	return e, nil
+}
+
+type parser struct {
+	src string
+	pos int
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return &SyntaxError{Pos: p.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *parser) skipSpace() {
+	for !p.eof() && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+// keyword consumes the keyword kw if it is next in the input
+func (p *parser) keyword(kw string) bool {
+	p.skipSpace()
+	end := p.pos + len(kw)
+	if end > len(p.src) || !strings.EqualFold(p.src[p.pos:end], kw) {
+		return false
+	}
+	if end < len(p.src) && isIdent(p.src[end]) {
+		return false
+	}
+	p.pos = end
+	return true
+}
+
+func (p *parser) parseOr() (Expr, error) {
+	e, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	or := Or{e}
+	for p.keyword("or") {
+		e, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		or = append(or, e)
+	}
+	if len(or) == 1 {
+		return or[0], nil
+	}
+	return or, nil
+}
+
+func (p *parser) parseAnd() (Expr, error) {
+	e, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	and := And{e}
+	for p.keyword("and") {
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		and = append(and, e)
+	}
+	if len(and) == 1 {
+		return and[0], nil
+	}
+	return and, nil
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	if p.keyword("not") {
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return Not{Expr: e}, nil
+	}
+	p.skipSpace()
+	if !p.eof() && p.src[p.pos] == '(' {
+		p.pos++
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.eof() || p.src[p.pos] != ')' {
+			return nil, p.errorf("missing )")
+		}
+		p.pos++
+		return e, nil
+	}
+	return p.parseCmp()
+}
+
+func (p *parser) parseCmp() (Expr, error) {
+	p.skipSpace()
+	start := p.pos
+	for !p.eof() && isIdent(p.src[p.pos]) {
+		p.pos++
+	}
+	name := p.src[start:p.pos]
+	if name == "" {
+		return nil, p.errorf("expected a field name")
+	}
+	f, ok := Fields[name]
+	if !ok {
+		p.pos = start
+		return nil, p.errorf("unknown field %q", name)
+	}
+
+	if p.keyword("in") {
+		raw, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		bounds := strings.SplitN(raw, "..", 2)
+		if len(bounds) != 2 {
+			return nil, p.errorf("expected a range like from..to")
+		}
+		and := And{}
+		for i, op := range []Op{Ge, Le} {
+			if bounds[i] == "" {
+				continue
+			}
+			v, err := parseValue(f, bounds[i])
+			if err != nil {
+				return nil, p.errorf("%v", err)
+			}
+			and = append(and, wholeDay(Cmp{Field: name, Op: op, Value: v}, bounds[i]))
+		}
+		if len(and) == 0 {
+			return nil, p.errorf("empty range")
+		}
+		return and, nil
+	}
+
+	p.skipSpace()
+	var op Op
+	for _, o := range operators {
+		if strings.HasPrefix(p.src[p.pos:], string(o)) {
+			op = o
+			break
+		}
+	}
+	if op == "" {
+		return nil, p.errorf("expected an operator after %q", name)
+	}
+	p.pos += len(op)
+	if f.Type != String && (op == Prefix || op == Suffix || op == Contains) {
+		return nil, p.errorf("operator %v needs a text field", op)
+	}
+	raw, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	v, err := parseValue(f, raw)
+	if err != nil {
+		return nil, p.errorf("%v", err)
+	}
+	return wholeDay(Cmp{Field: name, Op: op, Value: v}, raw), nil
+}
+
+// parseValue reads a double quoted string or a bare word ending at white
+// space or a parenthesis
+func (p *parser) parseValue() (string, error) {
+	p.skipSpace()
+	if p.eof() {
+		return "", p.errorf("expected a value")
+	}
+	if p.src[p.pos] == '"' {
+		var b strings.Builder
+		for p.pos++; !p.eof(); p.pos++ {
+			c := p.src[p.pos]
+			switch {
+			case c == '\\' && p.pos+1 < len(p.src):
+				p.pos++
+				b.WriteByte(p.src[p.pos])
+			case c == '"':
+				p.pos++
+				return b.String(), nil
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return "", p.errorf("unterminated string")
+	}
+	start := p.pos
+	for !p.eof() && !unicode.IsSpace(rune(p.src[p.pos])) && p.src[p.pos] != '(' && p.src[p.pos] != ')' {
+		p.pos++
+	}
+	if start == p.pos {
+		return "", p.errorf("expected a value")
+	}
+	return p.src[start:p.pos], nil
+}
+
+func isIdent(c byte) bool {
+	return c == '_' || c == '.' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
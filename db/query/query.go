@@ -0,0 +1,201 @@
+// Package query implements the filter language accepted by customer searches.
+//
+// An expression compares allow-listed fields with values and combines the
+// comparisons with and, or, not and parentheses:
+//
+//	lastName ^= Ber and (email $= @example.com or country = Netherlands)
+//	createdAt in 2016-01-01..2016-12-31 and not username = admin
+//
+// Text is compared without regard to case. A date without a time stands for
+// the whole day it names, so the range above includes December 31st.
+//
+// Parsing produces a backend-neutral tree which every database implementation
+// compiles to its own native query.
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Op is a comparison operator
+type Op string
+
+const (
+	Eq       Op = "="
+	Ne       Op = "!="
+	Lt       Op = "<"
+	Le       Op = "<="
+	Gt       Op = ">"
+	Ge       Op = ">="
+	Prefix   Op = "^="
+	Suffix   Op = "$="
+	Contains Op = "~"
+)
+
+// Type is the type of the values a field holds
+type Type int
+
+const (
+	String Type = iota
+	Time
+	Number
+	Bool
+)
+
+// Field describes a field that may be searched on
+type Field struct {
+	Name     string
+	Type     Type
+	Sortable bool
+}
+
+// Fields is the allow-list of customer fields that can be searched
+var Fields = map[string]Field{
+	"firstName": {Name: "firstName", Type: String, Sortable: true},
+	"lastName":  {Name: "lastName", Type: String, Sortable: true},
+	"username":  {Name: "username", Type: String, Sortable: true},
+	"email":     {Name: "email", Type: String, Sortable: true},
+	"country":   {Name: "country", Type: String},
+	"status":    {Name: "status", Type: String},
+	"createdAt": {Name: "createdAt", Type: Time, Sortable: true},
+}
+
+// Expr is a node of a parsed filter
+type Expr interface {
+	String() string
+}
+
+// Cmp compares a field with a value. Value is a string for String fields, a
+// time.Time for Time fields, a float64 for Number fields and a bool for Bool
+// fields.
+type Cmp struct {
+	Field string
+	Op    Op
+	Value interface{}
+}
+
+// And matches when all of its expressions match
+type And []Expr
+
+// Or matches when any of its expressions match
+type Or []Expr
+
+// Not matches when its expression does not
+type Not struct {
+	Expr Expr
+}
+
+func (c Cmp) String() string {
+	if t, ok := c.Value.(time.Time); ok {
+		return fmt.Sprintf("%v %v %v", c.Field, c.Op, t.Format(time.RFC3339))
+	}
+	if s, ok := c.Value.(string); ok {
+		return fmt.Sprintf("%v %v %q", c.Field, c.Op, s)
+	}
+	return fmt.Sprintf("%v %v %v", c.Field, c.Op, c.Value)
+}
+
+func (a And) String() string { return join(a, " and ") }
+
+func (o Or) String() string { return join(o, " or ") }
+
+func (n Not) String() string { return "not " + n.Expr.String() }
+
+func join(es []Expr, sep string) string {
+	parts := make([]string, len(es))
+	for i, e := range es {
+		parts[i] = e.String()
+	}
+	return "(" + strings.Join(parts, sep) + ")"
+}
+
+// Sort orders results by a field
+type Sort struct {
+	Field string
+	Desc  bool
+}
+
+// ParseSort parses a comma separated list of sortable fields, each optionally
+// prefixed with - for descending order
+func ParseSort(s string) ([]Sort, error) {
+	if s == "" {
+		return nil, nil
+	}
+	sorts := make([]Sort, 0)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		sort := Sort{Field: part}
+		if strings.HasPrefix(part, "-") {
+			sort = Sort{Field: part[1:], Desc: true}
+		}
+		f, ok := Fields[sort.Field]
+		if !ok || !f.Sortable {
+			return nil, &SyntaxError{Msg: fmt.Sprintf("can not sort by %q", sort.Field)}
+		}
+		sorts = append(sorts, sort)
+	}
+	return sorts, nil
+}
+
+// SyntaxError reports an invalid filter or sort expression
+type SyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("Invalid query at %v: %v", e.Pos, e.Msg)
+}
+
+// dateLayout is the layout of a date without a time
+const dateLayout = "2006-01-02"
+
+// wholeDay rewrites a comparison with a date so that it covers the whole day,
+// leaving comparisons with a time as they are
+func wholeDay(c Cmp, raw string) Expr {
+	from, ok := c.Value.(time.Time)
+	if !ok || len(raw) != len(dateLayout) {
+		return c
+	}
+	to := from.AddDate(0, 0, 1)
+	switch c.Op {
+	case Eq:
+		return And{Cmp{Field: c.Field, Op: Ge, Value: from}, Cmp{Field: c.Field, Op: Lt, Value: to}}
+	case Ne:
+		return Or{Cmp{Field: c.Field, Op: Lt, Value: from}, Cmp{Field: c.Field, Op: Ge, Value: to}}
+	case Le:
+		return Cmp{Field: c.Field, Op: Lt, Value: to}
+	case Gt:
+		return Cmp{Field: c.Field, Op: Ge, Value: to}
+	}
+	return c
+}
+
+// parseValue converts a literal to the type of the field
+func parseValue(f Field, s string) (interface{}, error) {
+	switch f.Type {
+	case String:
+		return s, nil
+	case Number:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", s)
+		}
+		return n, nil
+	case Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not true or false", s)
+		}
+		return b, nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", dateLayout} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("%q is not a date", s)
+}
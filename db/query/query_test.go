@@ -0,0 +1,130 @@
+package query
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseComparison(t *testing.T) {
+	e, err := Parse(`lastName ^= Ber`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(e, Cmp{Field: "lastName", Op: Prefix, Value: "Ber"}) {
+		t.Errorf("unexpected expression %v", e)
+	}
+	e, err = Parse(`email$="@example.com"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(e, Cmp{Field: "email", Op: Suffix, Value: "@example.com"}) {
+		t.Errorf("unexpected expression %v", e)
+	}
+}
+
+func TestParsePrecedence(t *testing.T) {
+	e, err := Parse(`firstName = Eve or lastName = Berger and not (country = Netherlands or country ~ land)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Or{
+		Cmp{Field: "firstName", Op: Eq, Value: "Eve"},
+		And{
+			Cmp{Field: "lastName", Op: Eq, Value: "Berger"},
+			Not{Expr: Or{
+				Cmp{Field: "country", Op: Eq, Value: "Netherlands"},
+				Cmp{Field: "country", Op: Contains, Value: "land"},
+			}},
+		},
+	}
+	if !reflect.DeepEqual(e, expected) {
+		t.Errorf("expected %v received %v", expected, e)
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	e, err := Parse(`createdAt in 2016-01-01..2016-12-31`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := And{
+		Cmp{Field: "createdAt", Op: Ge, Value: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)},
+		Cmp{Field: "createdAt", Op: Lt, Value: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	if !reflect.DeepEqual(e, expected) {
+		t.Errorf("expected %v received %v", expected, e)
+	}
+
+	day, next := time.Date(2016, 8, 9, 0, 0, 0, 0, time.UTC), time.Date(2016, 8, 10, 0, 0, 0, 0, time.UTC)
+	for src, expected := range map[string]Expr{
+		`createdAt in ..2016-08-09`:        And{Cmp{Field: "createdAt", Op: Lt, Value: next}},
+		`createdAt > 2016-08-09`:           Cmp{Field: "createdAt", Op: Ge, Value: next},
+		`createdAt = 2016-08-09`:           And{Cmp{Field: "createdAt", Op: Ge, Value: day}, Cmp{Field: "createdAt", Op: Lt, Value: next}},
+		`createdAt <= 2016-08-09T00:00:00`: Cmp{Field: "createdAt", Op: Le, Value: day},
+		`createdAt < 2016-08-09`:           Cmp{Field: "createdAt", Op: Lt, Value: day},
+	} {
+		if e, err := Parse(src); err != nil || !reflect.DeepEqual(e, expected) {
+			t.Errorf("%v: expected %v received %v %v", src, expected, e, err)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, q := range []string{
+		`password = secret`,
+		`firstName`,
+		`firstName = `,
+		`(firstName = Eve`,
+		`createdAt ^= 2016`,
+		`createdAt > yesterday`,
+		`firstName = "Eve`,
+		`firstName = Eve lastName = Berger`,
+	} {
+		if _, err := Parse(q); err == nil {
+			t.Errorf("expected error parsing %q", q)
+		} else if _, ok := err.(*SyntaxError); !ok {
+			t.Errorf("expected syntax error parsing %q received %v", q, err)
+		}
+	}
+	if e, err := Parse("  "); e != nil || err != nil {
+		t.Error("expected empty filter")
+	}
+}
+
+func TestParseSort(t *testing.T) {
+	s, err := ParseSort("lastName,-createdAt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s, []Sort{{Field: "lastName"}, {Field: "createdAt", Desc: true}}) {
+		t.Errorf("unexpected sort %v", s)
+	}
+	if _, err := ParseSort("country"); err == nil {
+		t.Error("expected error sorting by unsortable field")
+	}
+}
+
+func TestParseNumberAndBool(t *testing.T) {
+	Fields["attributes.points"] = Field{Name: "attributes.points", Type: Number}
+	Fields["attributes.newsletter"] = Field{Name: "attributes.newsletter", Type: Bool}
+	defer delete(Fields, "attributes.points")
+	defer delete(Fields, "attributes.newsletter")
+
+	e, err := Parse(`attributes.points >= 100 and attributes.newsletter = true`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := And{
+		Cmp{Field: "attributes.points", Op: Ge, Value: 100.0},
+		Cmp{Field: "attributes.newsletter", Op: Eq, Value: true},
+	}
+	if !reflect.DeepEqual(e, expected) {
+		t.Errorf("unexpected expression %v", e)
+	}
+	for _, src := range []string{`attributes.points = many`, `attributes.points ^= 1`, `attributes.newsletter = maybe`} {
+		if _, err := Parse(src); err == nil {
+			t.Errorf("expected %q to be refused", src)
+		}
+	}
+}
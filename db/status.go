@@ -0,0 +1,43 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/microservices-demo/user/users"
+)
+
+// ErrStatusUnsupported is returned when the selected database can not keep account statuses
+var ErrStatusUnsupported = errors.New("Database does not support account statuses")
+
+// StatusStore is implemented by databases that keep the status of customers
+// and the transitions that led to it. Such a database also refuses writes to
+// customers whose status does not allow them, and to their addresses and
+// cards, with a users.StatusError.
+type StatusStore interface {
+	// SetStatus moves a live customer to status t.To, filling in t.From
+	// and t.At. The transition is recorded in the change feed and
+	// published.
+	SetStatus(customerID string, t *users.Transition) error
+	// StatusHistory returns the transitions of a customer, oldest first
+	StatusHistory(customerID string) ([]users.Transition, error)
+}
+
+// Statuses returns the account status store of DefaultDb
+func Statuses() (StatusStore, error) {
+	s, ok := Unwrap(DefaultDb).(StatusStore)
+	if !ok {
+		return nil, ErrStatusUnsupported
+	}
+	return s, nil
+}
+
+// SetStatus moves a customer of DefaultDb to another status
+func SetStatus(customerID string, t *users.Transition) error {
+	s, err := Statuses()
+	if err != nil {
+		return err
+	}
+	err = s.SetStatus(customerID, t)
+	Invalidate("customers", customerID)
+	return err
+}
@@ -0,0 +1,53 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/microservices-demo/user/users"
+)
+
+// ErrUsernamesUnsupported is returned when the selected database can not change usernames
+var ErrUsernamesUnsupported = errors.New("Database does not support changing usernames")
+
+// UsernameChanger is implemented by databases that can change the username
+// of customers. The names a customer changed away from are kept in its
+// users.UsernameChanges and stay held by it, so that no one else registers
+// them, until they are released once their reservation ended.
+type UsernameChanger interface {
+	// ChangeUsername renames a live customer to c.To, filling in c.From
+	// and the times of the change. A c.To held by another customer is a
+	// DuplicateError. The change is recorded in the change feed and
+	// published.
+	ChangeUsername(customerID string, c *users.UsernameChange) error
+	// GetUserByPreviousName returns the live customer that changed away
+	// from name and can still log in with it at the given time
+	GetUserByPreviousName(name string, at time.Time) (users.User, error)
+	// GetUsersBySeparatedName returns the live customers that registered
+	// name before usernames were unique and were separated from the
+	// customer holding it, who can still log in with it
+	GetUsersBySeparatedName(name string) ([]users.User, error)
+	// ReleaseUsernames frees the previous names whose reservation ended
+	// before the given time, returning how many
+	ReleaseUsernames(before time.Time) (int, error)
+}
+
+// Usernames returns the username changer of DefaultDb
+func Usernames() (UsernameChanger, error) {
+	s, ok := Unwrap(DefaultDb).(UsernameChanger)
+	if !ok {
+		return nil, ErrUsernamesUnsupported
+	}
+	return s, nil
+}
+
+// ChangeUsername renames a customer of DefaultDb
+func ChangeUsername(customerID string, c *users.UsernameChange) error {
+	s, err := Usernames()
+	if err != nil {
+		return err
+	}
+	err = s.ChangeUsername(customerID, c)
+	Invalidate("customers", customerID)
+	return err
+}
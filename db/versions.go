@@ -0,0 +1,45 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/microservices-demo/user/users"
+)
+
+// ErrVersionsUnsupported is returned when the selected database does not keep former versions
+var ErrVersionsUnsupported = errors.New("Database does not keep versions of addresses and cards")
+
+// Versions is implemented by databases that keep every version of an address
+// or card. Editing one makes a new version and deleting or purging one retires
+// it, but any version once returned can still be read, so that orders linking
+// to it keep their shipping and payment details.
+type Versions interface {
+	GetAddressVersion(id string, version int64) (users.Address, error)
+	GetCardVersion(id string, version int64) (users.Card, error)
+}
+
+// GetAddressVersion returns the given version of an address, current or not
+func GetAddressVersion(id string, version int64) (users.Address, error) {
+	v, ok := Unwrap(DefaultDb).(Versions)
+	if !ok {
+		return users.Address{}, ErrVersionsUnsupported
+	}
+	a, err := v.GetAddressVersion(id, version)
+	if err == nil {
+		a.AddLinks()
+	}
+	return a, err
+}
+
+// GetCardVersion returns the given version of a card, current or not
+func GetCardVersion(id string, version int64) (users.Card, error) {
+	v, ok := Unwrap(DefaultDb).(Versions)
+	if !ok {
+		return users.Card{}, ErrVersionsUnsupported
+	}
+	c, err := v.GetCardVersion(id, version)
+	if err == nil {
+		c.AddLinks()
+	}
+	return c, err
+}
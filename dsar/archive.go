@@ -0,0 +1,255 @@
+package dsar
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/microservices-demo/user/logins"
+	"github.com/microservices-demo/user/users"
+)
+
+// Archive file names
+const (
+	DataFile    = "data.json"
+	SummaryFile = "summary.txt"
+)
+
+// Subject is everything held about a customer. Passwords and their salts
+// are left out, card numbers are masked and CCVs are not included.
+type Subject struct {
+	GeneratedAt time.Time    `json:"generatedAt"`
+	Profile     Profile      `json:"profile"`
+	Addresses   []Address    `json:"addresses"`
+	Cards       []Card       `json:"cards"`
+	Logins      []Login      `json:"loginHistory"`
+	Consents    []Consent    `json:"consents"`
+	Audit       []AuditEntry `json:"audit"`
+}
+
+// Profile is the personal data of a customer
+type Profile struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	FirstName string    `json:"firstName"`
+	LastName  string    `json:"lastName"`
+	Email     string    `json:"email"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// Attributes are the profile attributes of the customer
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	// UsernameChanges are the previous usernames of the customer
+	UsernameChanges []users.UsernameChange `json:"usernameChanges,omitempty"`
+}
+
+// Address is an address of a customer
+type Address struct {
+	ID        string    `json:"id"`
+	Street    string    `json:"street"`
+	Number    string    `json:"number"`
+	City      string    `json:"city"`
+	PostCode  string    `json:"postcode"`
+	Country   string    `json:"country"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Card is a card of a customer, with its number masked
+type Card struct {
+	ID        string    `json:"id"`
+	LongNum   string    `json:"longNum"`
+	Expires   string    `json:"expires"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Login is an attempt to log in as the customer, newest first
+type Login struct {
+	At        time.Time `json:"at"`
+	Success   bool      `json:"success"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	Country   string    `json:"country,omitempty"`
+}
+
+// Consent is a purpose the customer agreed to. The service does not record
+// consents, so archives list none.
+type Consent struct {
+	Purpose string    `json:"purpose"`
+	At      time.Time `json:"at"`
+}
+
+// NewSubject returns the data held about a customer, loaded with its
+// addresses and cards, and the audit trail of its writes
+func NewSubject(u users.User, audit []AuditEntry, at time.Time) Subject {
+	s := Subject{
+		GeneratedAt: at,
+		Profile: Profile{
+			ID:              u.UserID,
+			Username:        u.Username,
+			FirstName:       u.FirstName,
+			LastName:        u.LastName,
+			Email:           u.Email,
+			Status:          users.CurrentStatus(u.Status),
+			CreatedAt:       u.CreatedAt,
+			UpdatedAt:       u.UpdatedAt,
+			Attributes:      u.Attributes,
+			UsernameChanges: u.UsernameChanges,
+		},
+		Addresses: make([]Address, 0, len(u.Addresses)),
+		Cards:     make([]Card, 0, len(u.Cards)),
+		Logins:    make([]Login, 0),
+		Consents:  make([]Consent, 0),
+		Audit:     audit,
+	}
+	if s.Audit == nil {
+		s.Audit = make([]AuditEntry, 0)
+	}
+	for _, a := range u.Addresses {
+		s.Addresses = append(s.Addresses, Address{
+			ID:        a.ID,
+			Street:    a.Street,
+			Number:    a.Number,
+			City:      a.City,
+			PostCode:  a.PostCode,
+			Country:   a.Country,
+			CreatedAt: a.CreatedAt,
+			UpdatedAt: a.UpdatedAt,
+		})
+	}
+	for _, c := range u.Cards {
+		c.MaskCC()
+		s.Cards = append(s.Cards, Card{
+			ID:        c.ID,
+			LongNum:   c.LongNum,
+			Expires:   c.Expires,
+			CreatedAt: c.CreatedAt,
+			UpdatedAt: c.UpdatedAt,
+		})
+	}
+	return s
+}
+
+// AddLogins adds the login history of the customer, newest first
+func (s *Subject) AddLogins(ls []logins.Login) {
+	for _, l := range ls {
+		s.Logins = append(s.Logins, Login{At: l.At, Success: l.Success, IP: l.IP, UserAgent: l.UserAgent, Country: l.Country})
+	}
+}
+
+// Archive returns the zip archive of a subject: its data as JSON and a
+// summary to be read by the customer
+func (s Subject) Archive() ([]byte, error) {
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	for _, f := range []struct {
+		name  string
+		write func(io.Writer) error
+	}{
+		{DataFile, s.writeJSON},
+		{SummaryFile, s.writeSummary},
+	} {
+		w, err := z.CreateHeader(&zip.FileHeader{Name: f.name, Method: zip.Deflate, Modified: s.GeneratedAt})
+		if err != nil {
+			return nil, err
+		}
+		if err := f.write(w); err != nil {
+			return nil, err
+		}
+	}
+	if err := z.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s Subject) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+func (s Subject) writeSummary(w io.Writer) error {
+	const day = "2 January 2006"
+	const moment = "2 January 2006 15:04 MST"
+	p := s.Profile
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Data held about %s %s\n", p.FirstName, p.LastName)
+	fmt.Fprintf(tw, "Generated on %s\n\n", s.GeneratedAt.UTC().Format(moment))
+
+	fmt.Fprintf(tw, "Profile\n")
+	fmt.Fprintf(tw, "  Customer ID\t%s\n", p.ID)
+	fmt.Fprintf(tw, "  Username\t%s\n", p.Username)
+	for _, c := range p.UsernameChanges {
+		fmt.Fprintf(tw, "  Previously\t%s, until %s\n", c.From, c.At.UTC().Format(day))
+	}
+	fmt.Fprintf(tw, "  Name\t%s %s\n", p.FirstName, p.LastName)
+	fmt.Fprintf(tw, "  Email\t%s\n", orNone(p.Email))
+	fmt.Fprintf(tw, "  Account status\t%s\n", p.Status)
+	fmt.Fprintf(tw, "  Registered on\t%s\n", p.CreatedAt.UTC().Format(day))
+	fmt.Fprintf(tw, "  Last changed on\t%s\n", p.UpdatedAt.UTC().Format(day))
+	names := make([]string, 0, len(p.Attributes))
+	for name := range p.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(tw, "  %s\t%v\n", name, p.Attributes[name])
+	}
+	fmt.Fprintf(tw, "  Password\tstored as a salted hash only, not included\n\n")
+
+	fmt.Fprintf(tw, "Addresses (%d)\n", len(s.Addresses))
+	for _, a := range s.Addresses {
+		fmt.Fprintf(tw, "  %s %s, %s %s, %s\n", a.Number, a.Street, a.PostCode, a.City, a.Country)
+	}
+	fmt.Fprintf(tw, "\nCards (%d, numbers masked)\n", len(s.Cards))
+	for _, c := range s.Cards {
+		fmt.Fprintf(tw, "  %s\texpires %s\n", c.LongNum, c.Expires)
+	}
+	fmt.Fprintf(tw, "\nLogin history (%d)\n", len(s.Logins))
+	if len(s.Logins) == 0 {
+		fmt.Fprintf(tw, "  No logins are recorded\n")
+	}
+	for _, l := range s.Logins {
+		outcome := "failed"
+		if l.Success {
+			outcome = "succeeded"
+		}
+		from := l.IP
+		if l.Country != "" {
+			from += " (" + l.Country + ")"
+		}
+		fmt.Fprintf(tw, "  %s\t%s\tfrom %s\t%s\n", l.At.UTC().Format(moment), outcome, from, l.UserAgent)
+	}
+	fmt.Fprintf(tw, "\nConsents (%d)\n", len(s.Consents))
+	if len(s.Consents) == 0 {
+		fmt.Fprintf(tw, "  No consents are recorded\n")
+	}
+	for _, c := range s.Consents {
+		fmt.Fprintf(tw, "  %s\tgiven on %s\n", c.Purpose, c.At.UTC().Format(day))
+	}
+	fmt.Fprintf(tw, "\nChanges to your data (%d)\n", len(s.Audit))
+	for _, e := range s.Audit {
+		if e.Status != "" {
+			fmt.Fprintf(tw, "  %s\t%s %s %s\t%s, %s\n", e.At.UTC().Format(moment), e.Entity, e.Op, e.Status, e.ID, e.Reason)
+			continue
+		}
+		fmt.Fprintf(tw, "  %s\t%s %s\t%s\n", e.At.UTC().Format(moment), e.Entity, e.Op, e.ID)
+	}
+	fmt.Fprintf(tw, "\nThe complete data is in %s.\n", DataFile)
+	return tw.Flush()
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
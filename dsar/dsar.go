@@ -0,0 +1,102 @@
+// Package dsar answers data subject access requests: a customer asking for
+// all the data held about them. A request is a job kept in a Store; a Worker
+// picks it up, gathers the customer with their addresses, masked cards and
+// the history of their writes, and leaves a zip archive with the data as JSON
+// and a readable summary, until it expires.
+package dsar
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"time"
+
+	"github.com/microservices-demo/user/users"
+)
+
+// Request statuses
+const (
+	StatusPending = "pending"
+	StatusRunning = "running"
+	StatusDone    = "done"
+	StatusFailed  = "failed"
+)
+
+var (
+	ErrNotReady = errors.New("Access request archive is not ready")
+
+	// Retention is how long a finished archive is kept for download
+	Retention = 7 * 24 * time.Hour
+)
+
+func init() {
+	flag.DurationVar(&Retention, "access-retention", Retention, "How long subject access archives are kept for download")
+}
+
+// Request is a data subject access request. Its ID is random, so that only
+// whoever asked for the archive can find it.
+type Request struct {
+	ID          string      `json:"id" bson:"-"`
+	CustomerID  string      `json:"customerId" bson:"customerId"`
+	Status      string      `json:"status" bson:"status"`
+	CreatedAt   time.Time   `json:"createdAt" bson:"createdAt"`
+	CompletedAt *time.Time  `json:"completedAt,omitempty" bson:"completedAt,omitempty"`
+	ExpiresAt   *time.Time  `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+	Size        int         `json:"size,omitempty" bson:"size,omitempty"`
+	Error       string      `json:"error,omitempty" bson:"error,omitempty"`
+	Links       users.Links `json:"_links,omitempty" bson:"-"`
+}
+
+// AddLinks links a request to itself and, once done, to its archive
+func (r *Request) AddLinks() {
+	r.Links = nil
+	r.Links.AddPathLink("self", "access-requests/"+r.ID)
+	r.Links.AddPathLink("customer", "customers/"+r.CustomerID)
+	if r.Status == StatusDone {
+		r.Links.AddPathLink("archive", "access-requests/"+r.ID+"/archive")
+	}
+}
+
+// NewID returns a random request ID
+func NewID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Store keeps access requests and their archives
+type Store interface {
+	CreateAccessRequest(*Request) error
+	GetAccessRequest(id string) (Request, error)
+	// ClaimAccessRequest returns a pending request, or one whose worker
+	// gave up before until, holding it back from other workers until the
+	// given time, or nil when there is none
+	ClaimAccessRequest(now, until time.Time) (*Request, error)
+	// CompleteAccessRequest saves the archive of a request
+	CompleteAccessRequest(id string, archive []byte, at, expires time.Time) error
+	// FailAccessRequest records why a request could not be answered
+	FailAccessRequest(id, reason string, at, expires time.Time) error
+	// AccessArchive returns the archive of a finished request
+	AccessArchive(id string) ([]byte, error)
+	// PurgeAccessRequests removes the requests that expired before the
+	// given time, returning how many
+	PurgeAccessRequests(before time.Time) (int, error)
+	// AuditTrail returns the recorded writes to the given customers,
+	// addresses and cards, oldest first
+	AuditTrail(ids ...string) ([]AuditEntry, error)
+}
+
+// AuditEntry records one write to the data of a customer
+type AuditEntry struct {
+	At     time.Time `json:"at" bson:"at"`
+	Entity string    `json:"entity" bson:"entity"`
+	ID     string    `json:"id" bson:"id"`
+	Op     string    `json:"op" bson:"op"`
+	// Status changes tell the status moved to, why and by whom
+	Status string `json:"status,omitempty" bson:"status,omitempty"`
+	Reason string `json:"reason,omitempty" bson:"reason,omitempty"`
+	Actor  string `json:"actor,omitempty" bson:"actor,omitempty"`
+}
@@ -0,0 +1,218 @@
+package dsar
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/microservices-demo/user/logins"
+	"github.com/microservices-demo/user/users"
+)
+
+var (
+	generated = time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	customer  = users.User{
+		UserID:    "57a98d98e4b00679b4a830af",
+		FirstName: "Eve",
+		LastName:  "Berger",
+		Username:  "Eve_Berger",
+		Email:     "eve@example.com",
+		Password:  "hash",
+		Salt:      "salt",
+		Addresses: []users.Address{{ID: "57a98d98e4b00679b4a830ad", Street: "Whitelees Road", Number: "246", City: "Glasgow", PostCode: "G67 3DL", Country: "United Kingdom"}},
+		Cards:     []users.Card{{ID: "57a98d98e4b00679b4a830ae", LongNum: "5953580604169678", Expires: "08/19", CCV: "678"}},
+	}
+)
+
+func TestArchive(t *testing.T) {
+	audit := []AuditEntry{{At: generated.Add(-time.Hour), Entity: "customer", ID: customer.UserID, Op: "created"}}
+	archive, err := NewSubject(customer, audit, generated).Archive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := unzip(t, archive)
+
+	var s Subject
+	if err := json.Unmarshal(files[DataFile], &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Profile.Email != "eve@example.com" || len(s.Addresses) != 1 || len(s.Audit) != 1 {
+		t.Errorf("expected the profile, address and audit trail, received %+v", s)
+	}
+	if s.Logins == nil || s.Consents == nil {
+		t.Error("expected empty login history and consents to be listed")
+	}
+	if len(s.Cards) != 1 || s.Cards[0].LongNum != "************9678" {
+		t.Errorf("expected a masked card, received %+v", s.Cards)
+	}
+	for _, secret := range []string{"5953580604169678", `"678"`, "hash", "salt"} {
+		if bytes.Contains(files[DataFile], []byte(secret)) {
+			t.Errorf("expected %v to be left out of the archive", secret)
+		}
+	}
+	summary := string(files[SummaryFile])
+	for _, expected := range []string{"Eve Berger", "eve@example.com", "246 Whitelees Road, G67 3DL Glasgow", "************9678", "No logins are recorded", "customer created"} {
+		if !strings.Contains(summary, expected) {
+			t.Errorf("expected summary to contain %q, received\n%v", expected, summary)
+		}
+	}
+}
+
+func TestWorker(t *testing.T) {
+	store := newMemoryStore()
+	for _, id := range []string{customer.UserID, "missing"} {
+		if err := store.CreateAccessRequest(&Request{CustomerID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := NewWorker(store, func(id string) (users.User, error) {
+		if id != customer.UserID {
+			return users.User{}, errors.New("Not found")
+		}
+		return customer, nil
+	}, log.NewNopLogger())
+	w.now = func() time.Time { return generated }
+	w.Logins = func(id string) ([]logins.Login, error) {
+		return []logins.Login{{At: generated.Add(-time.Minute), Success: true, IP: "192.0.2.1", UserAgent: "curl/8.0", Country: "NL"}}, nil
+	}
+
+	n, err := w.Flush()
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 requests answered, received %v, %v", n, err)
+	}
+	done, failed := store.requests["1"], store.requests["2"]
+	if done.Status != StatusDone || done.Size == 0 || !done.ExpiresAt.Equal(generated.Add(Retention)) {
+		t.Errorf("expected a finished request, received %+v", done)
+	}
+	if failed.Status != StatusFailed || failed.Error == "" {
+		t.Errorf("expected a failed request, received %+v", failed)
+	}
+	if _, err := store.AccessArchive("2"); err != ErrNotReady {
+		t.Errorf("expected no archive for a failed request, received %v", err)
+	}
+	archive, err := store.AccessArchive("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := unzip(t, archive)
+	if !strings.Contains(string(files[DataFile]), `"op": "created"`) {
+		t.Error("expected the audit trail in the archive")
+	}
+	if !strings.Contains(string(files[SummaryFile]), "succeeded  from 192.0.2.1 (NL)  curl/8.0") {
+		t.Errorf("expected the login history in the summary, received %s", files[SummaryFile])
+	}
+
+	if n, _ := store.PurgeAccessRequests(generated.Add(Retention + time.Second)); n != 2 {
+		t.Errorf("expected 2 expired requests purged, received %v", n)
+	}
+}
+
+func TestLinks(t *testing.T) {
+	r := Request{ID: "abc", CustomerID: "1", Status: StatusPending}
+	r.AddLinks()
+	if _, ok := r.Links["archive"]; ok {
+		t.Error("expected no archive link before the archive is built")
+	}
+	r.Status = StatusDone
+	r.AddLinks()
+	if !strings.HasSuffix(r.Links["archive"].Link, "/access-requests/abc/archive") {
+		t.Errorf("expected an archive link, received %v", r.Links)
+	}
+}
+
+func unzip(t *testing.T, archive []byte) map[string][]byte {
+	z, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	for _, f := range z.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name], _ = ioutil.ReadAll(r)
+		r.Close()
+	}
+	return files
+}
+
+type memoryStore struct {
+	requests map[string]*Request
+	archives map[string][]byte
+	order    []string
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{requests: map[string]*Request{}, archives: map[string][]byte{}}
+}
+
+func (s *memoryStore) CreateAccessRequest(r *Request) error {
+	r.ID = string(rune('1' + len(s.order)))
+	r.Status = StatusPending
+	stored := *r
+	s.requests[r.ID] = &stored
+	s.order = append(s.order, r.ID)
+	return nil
+}
+
+func (s *memoryStore) GetAccessRequest(id string) (Request, error) {
+	r, ok := s.requests[id]
+	if !ok {
+		return Request{}, errors.New("Not found")
+	}
+	return *r, nil
+}
+
+func (s *memoryStore) ClaimAccessRequest(now, until time.Time) (*Request, error) {
+	for _, id := range s.order {
+		if r, ok := s.requests[id]; ok && r.Status == StatusPending {
+			r.Status = StatusRunning
+			claimed := *r
+			return &claimed, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryStore) CompleteAccessRequest(id string, archive []byte, at, expires time.Time) error {
+	r := s.requests[id]
+	r.Status, r.Size, r.CompletedAt, r.ExpiresAt = StatusDone, len(archive), &at, &expires
+	s.archives[id] = archive
+	return nil
+}
+
+func (s *memoryStore) FailAccessRequest(id, reason string, at, expires time.Time) error {
+	r := s.requests[id]
+	r.Status, r.Error, r.CompletedAt, r.ExpiresAt = StatusFailed, reason, &at, &expires
+	return nil
+}
+
+func (s *memoryStore) AccessArchive(id string) ([]byte, error) {
+	if r, ok := s.requests[id]; !ok || r.Status != StatusDone {
+		return nil, ErrNotReady
+	}
+	return s.archives[id], nil
+}
+
+func (s *memoryStore) PurgeAccessRequests(before time.Time) (int, error) {
+	n := 0
+	for id, r := range s.requests {
+		if r.ExpiresAt != nil && r.ExpiresAt.Before(before) {
+			delete(s.requests, id)
+			delete(s.archives, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryStore) AuditTrail(ids ...string) ([]AuditEntry, error) {
+	return []AuditEntry{{At: generated.Add(-time.Hour), Entity: "customer", ID: customer.UserID, Op: "created"}}, nil
+}
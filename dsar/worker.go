@@ -0,0 +1,117 @@
+package dsar
+
+import (
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/microservices-demo/user/logins"
+	"github.com/microservices-demo/user/users"
+)
+
+// Worker answers pending access requests one at a time and purges the
+// requests that expired
+type Worker struct {
+	Store Store
+	// Customer returns a customer loaded with its addresses and cards
+	Customer func(id string) (users.User, error)
+	Logger   log.Logger
+	// Interval is the pause between rounds when nothing is pending
+	Interval time.Duration
+	// Lease is how long a claimed request is held back from other workers
+	Lease time.Duration
+	// Logins returns the login history of a customer, if one is kept
+	Logins func(customerID string) ([]logins.Login, error)
+
+	now func() time.Time
+}
+
+// NewWorker returns a worker with default settings
+func NewWorker(s Store, customer func(id string) (users.User, error), logger log.Logger) *Worker {
+	return &Worker{
+		Store:    s,
+		Customer: customer,
+		Logger:   logger,
+		Interval: time.Second,
+		Lease:    5 * time.Minute,
+		now:      time.Now,
+	}
+}
+
+// Flush answers the pending requests, returning the number answered
+func (w *Worker) Flush() (int, error) {
+	answered := 0
+	for {
+		now := w.now()
+		r, err := w.Store.ClaimAccessRequest(now, now.Add(w.Lease))
+		if err != nil || r == nil {
+			return answered, err
+		}
+		answered++
+		if err := w.answer(*r); err != nil {
+			return answered, err
+		}
+	}
+}
+
+// Run answers pending requests and purges expired ones every Interval until
+// stop is closed
+func (w *Worker) Run(stop <-chan struct{}) {
+	t := time.NewTicker(w.Interval)
+	defer t.Stop()
+	for {
+		if _, err := w.Flush(); err != nil {
+			w.Logger.Log("worker", "dsar", "err", err)
+		}
+		if n, err := w.Store.PurgeAccessRequests(w.now()); err != nil {
+			w.Logger.Log("worker", "dsar", "err", err)
+		} else if n > 0 {
+			w.Logger.Log("worker", "dsar", "purged", n)
+		}
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// answer builds the archive of a request, recording a failure when the data
+// can not be gathered and returning an error only when the outcome can not be
+// saved
+func (w *Worker) answer(r Request) error {
+	archive, err := w.archive(r.CustomerID)
+	now := w.now()
+	if err != nil {
+		w.Logger.Log("request", r.ID, "customer", r.CustomerID, "err", err)
+		return w.Store.FailAccessRequest(r.ID, err.Error(), now, now.Add(Retention))
+	}
+	w.Logger.Log("request", r.ID, "customer", r.CustomerID, "size", len(archive))
+	return w.Store.CompleteAccessRequest(r.ID, archive, now, now.Add(Retention))
+}
+
+func (w *Worker) archive(customerID string) ([]byte, error) {
+	u, err := w.Customer(customerID)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{u.UserID}
+	for _, a := range u.Addresses {
+		ids = append(ids, a.ID)
+	}
+	for _, c := range u.Cards {
+		ids = append(ids, c.ID)
+	}
+	audit, err := w.Store.AuditTrail(ids...)
+	if err != nil {
+		return nil, err
+	}
+	s := NewSubject(u, audit, w.now())
+	if w.Logins != nil {
+		ls, err := w.Logins(u.UserID)
+		if err != nil {
+			return nil, err
+		}
+		s.AddLogins(ls)
+	}
+	return s.Archive()
+}
@@ -0,0 +1,207 @@
+// Package events holds the domain events of the user service and the
+// publishers that deliver them to other services. Events are written to an
+// outbox together with the change they describe and delivered from there by a
+// Relay, so an event is published if and only if its change was committed.
+package events
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/microservices-demo/user/users"
+)
+
+// Event is a domain event as it is stored and published. Data holds the JSON
+// encoding of the typed payload named by Type.
+type Event struct {
+	ID         string          `json:"id" bson:"-"`
+	Type       string          `json:"type" bson:"type"`
+	OccurredAt time.Time       `json:"occurredAt" bson:"occurredAt"`
+	Data       json.RawMessage `json:"data" bson:"data"`
+}
+
+// Payload is the typed content of an event
+type Payload interface {
+	EventType() string
+}
+
+// New wraps a payload in an event that occurred at the given time
+func New(p Payload, at time.Time) (Event, error) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return Event{}, err
+	}
+	return Event{Type: p.EventType(), OccurredAt: at, Data: data}, nil
+}
+
+// Customer is the part of a customer carried by events; credentials are
+// never published
+type Customer struct {
+	CustomerID string `json:"customerId"`
+	Username   string `json:"username"`
+	Email      string `json:"email"`
+	FirstName  string `json:"firstName"`
+	LastName   string `json:"lastName"`
+}
+
+// NewCustomer returns the event view of a customer
+func NewCustomer(u users.User) Customer {
+	return Customer{
+		CustomerID: u.UserID,
+		Username:   u.Username,
+		Email:      u.Email,
+		FirstName:  u.FirstName,
+		LastName:   u.LastName,
+	}
+}
+
+// Address is an address as carried by events. CustomerID is empty for the
+// addresses of anonymous customers.
+type Address struct {
+	AddressID  string `json:"addressId"`
+	CustomerID string `json:"customerId,omitempty"`
+	Street     string `json:"street"`
+	Number     string `json:"number"`
+	Country    string `json:"country"`
+	City       string `json:"city"`
+	PostCode   string `json:"postcode"`
+	Type       string `json:"type,omitempty"`
+}
+
+// NewAddress returns the event view of an address
+func NewAddress(a users.Address, customerID string) Address {
+	return Address{
+		AddressID:  a.ID,
+		CustomerID: customerID,
+		Street:     a.Street,
+		Number:     a.Number,
+		Country:    a.Country,
+		City:       a.City,
+		PostCode:   a.PostCode,
+		Type:       a.Type,
+	}
+}
+
+// Card is a card as carried by events, with its number masked
+type Card struct {
+	CardID         string `json:"cardId"`
+	CustomerID     string `json:"customerId,omitempty"`
+	LongNum        string `json:"longNum"`
+	Expires        string `json:"expires"`
+	BillingAddress string `json:"billingAddressId,omitempty"`
+}
+
+// NewCard returns the event view of a card
+func NewCard(c users.Card, customerID string) Card {
+	if len(c.LongNum) >= 4 {
+		c.MaskCC()
+	}
+	return Card{CardID: c.ID, CustomerID: customerID, LongNum: c.LongNum, Expires: c.Expires, BillingAddress: c.BillingAddress}
+}
+
+// Removal identifies a deleted or restored entity
+type Removal struct {
+	ID         string `json:"id"`
+	CustomerID string `json:"customerId,omitempty"`
+}
+
+// CustomerRegistered is published when a customer is created
+type CustomerRegistered struct{ Customer }
+
+// CustomerUpdated is published when the profile of a customer changes
+type CustomerUpdated struct{ Customer }
+
+// CustomerStatusChanged is published when a customer moves to another
+// account status
+type CustomerStatusChanged struct {
+	CustomerID string `json:"customerId"`
+	From       string `json:"from"`
+	To         string `json:"to"`
+	Reason     string `json:"reason"`
+	Actor      string `json:"actor"`
+}
+
+// CustomerUsernameChanged is published when a customer changes its
+// username. From stays reserved for the customer for a while.
+type CustomerUsernameChanged struct {
+	CustomerID string `json:"customerId"`
+	From       string `json:"from"`
+	To         string `json:"to"`
+}
+
+// CustomerLoginFlagged is published when a customer logs in from a device or
+// country it did not log in from before
+type CustomerLoginFlagged struct {
+	Customer
+	At         time.Time `json:"at"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"userAgent"`
+	Country    string    `json:"country,omitempty"`
+	NewDevice  bool      `json:"newDevice"`
+	NewCountry bool      `json:"newCountry"`
+}
+
+// CustomerDeleted is published when a customer is deleted
+type CustomerDeleted struct{ Removal }
+
+// CustomerRestored is published when a deleted customer is restored
+type CustomerRestored struct{ Removal }
+
+// AddressAdded is published when an address is created
+type AddressAdded struct{ Address }
+
+// AddressUpdated is published when an address changes
+type AddressUpdated struct{ Address }
+
+// AddressDeleted is published when an address is deleted
+type AddressDeleted struct{ Removal }
+
+// AddressRestored is published when a deleted address is restored
+type AddressRestored struct{ Removal }
+
+// CardAdded is published when a card is created
+type CardAdded struct{ Card }
+
+// CardUpdated is published when a card changes
+type CardUpdated struct{ Card }
+
+// CardDeleted is published when a card is deleted
+type CardDeleted struct{ Removal }
+
+// CardRestored is published when a deleted card is restored
+type CardRestored struct{ Removal }
+
+func (CustomerRegistered) EventType() string      { return "CustomerRegistered" }
+func (CustomerUpdated) EventType() string         { return "CustomerUpdated" }
+func (CustomerStatusChanged) EventType() string   { return "CustomerStatusChanged" }
+func (CustomerUsernameChanged) EventType() string { return "CustomerUsernameChanged" }
+func (CustomerLoginFlagged) EventType() string    { return "CustomerLoginFlagged" }
+func (CustomerDeleted) EventType() string         { return "CustomerDeleted" }
+func (CustomerRestored) EventType() string        { return "CustomerRestored" }
+func (AddressAdded) EventType() string            { return "AddressAdded" }
+func (AddressUpdated) EventType() string          { return "AddressUpdated" }
+func (AddressDeleted) EventType() string          { return "AddressDeleted" }
+func (AddressRestored) EventType() string         { return "AddressRestored" }
+func (CardAdded) EventType() string               { return "CardAdded" }
+func (CardUpdated) EventType() string             { return "CardUpdated" }
+func (CardDeleted) EventType() string             { return "CardDeleted" }
+func (CardRestored) EventType() string            { return "CardRestored" }
+
+// Removed returns the deletion or restore event for an entity of the given
+// collection
+func Removed(collectionName, id, customerID string, restored bool) Payload {
+	r := Removal{ID: id, CustomerID: customerID}
+	switch {
+	case collectionName == "customers" && restored:
+		return CustomerRestored{r}
+	case collectionName == "customers":
+		return CustomerDeleted{r}
+	case collectionName == "addresses" && restored:
+		return AddressRestored{r}
+	case collectionName == "addresses":
+		return AddressDeleted{r}
+	case restored:
+		return CardRestored{r}
+	}
+	return CardDeleted{r}
+}
@@ -0,0 +1,190 @@
+package events
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/microservices-demo/user/users"
+)
+
+func TestNew(t *testing.T) {
+	e, err := New(CardAdded{NewCard(users.Card{ID: "c1", LongNum: "4111111111111111", Expires: "08/19"}, "u1")}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != "CardAdded" {
+		t.Errorf("expected CardAdded received %v", e.Type)
+	}
+	var c Card
+	json.Unmarshal(e.Data, &c)
+	if c.CardID != "c1" || c.CustomerID != "u1" || c.LongNum != "************1111" {
+		t.Errorf("unexpected card payload %s", e.Data)
+	}
+}
+
+func TestBus(t *testing.T) {
+	b := NewBus()
+	var all, registered int
+	b.Subscribe("", func(Event) error { all++; return nil })
+	b.Subscribe("CustomerRegistered", func(Event) error { registered++; return errors.New("failed") })
+	if err := b.Publish(Event{Type: "CustomerRegistered"}); err == nil {
+		t.Error("expected the handler error to be returned")
+	}
+	b.Publish(Event{Type: "CardAdded"})
+	if all != 2 || registered != 1 {
+		t.Errorf("unexpected deliveries all=%v registered=%v", all, registered)
+	}
+}
+
+func TestLog(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLog(&buf)
+	l.Publish(Event{ID: "1", Type: "CardAdded"})
+	l.Publish(Event{ID: "2", Type: "CardDeleted"})
+	if strings.Count(buf.String(), "\n") != 2 || !strings.Contains(buf.String(), `"type":"CardDeleted"`) {
+		t.Errorf("unexpected log %s", buf.String())
+	}
+}
+
+type memoryOutbox struct {
+	events []Event
+}
+
+func (o *memoryOutbox) Pending(limit int) ([]Event, error) {
+	if len(o.events) < limit {
+		limit = len(o.events)
+	}
+	return append([]Event{}, o.events[:limit]...), nil
+}
+
+func (o *memoryOutbox) Delivered(ids ...string) error {
+	for _, id := range ids {
+		for i, e := range o.events {
+			if e.ID == id {
+				o.events = append(o.events[:i], o.events[i+1:]...)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+type failingPublisher struct {
+	published []string
+	failOn    string
+}
+
+func (p *failingPublisher) Publish(e Event) error {
+	if e.ID == p.failOn {
+		return errors.New("unavailable")
+	}
+	p.published = append(p.published, e.ID)
+	return nil
+}
+
+func TestRelay(t *testing.T) {
+	o := &memoryOutbox{}
+	for i := 1; i <= 5; i++ {
+		o.events = append(o.events, Event{ID: strconv.Itoa(i)})
+	}
+	p := &failingPublisher{failOn: "4"}
+	r := NewRelay(o, p, log.NewNopLogger())
+	r.Batch = 2
+
+	n, err := r.Flush()
+	if err == nil || n != 3 || len(o.events) != 2 {
+		t.Errorf("expected to stop at the failing event, delivered %v %v", n, err)
+	}
+	p.failOn = ""
+	n, err = r.Flush()
+	if err != nil || n != 2 || len(o.events) != 0 {
+		t.Errorf("expected the rest to be delivered, delivered %v %v", n, err)
+	}
+	if strings.Join(p.published, ",") != "1,2,3,4,5" {
+		t.Errorf("expected delivery in order, received %v", p.published)
+	}
+}
+
+// natsStub is a minimal NATS server acknowledging every publish
+func natsStub(t *testing.T, received chan<- string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		fmt.Fprintf(conn, "INFO {\"server_id\":\"stub\"}\r\n")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(line)
+			switch fields[0] {
+			case "CONNECT":
+				fmt.Fprintf(conn, "+OK\r\n")
+			case "PING":
+				fmt.Fprintf(conn, "PONG\r\n")
+			case "PUB":
+				size, _ := strconv.Atoi(fields[2])
+				payload := make([]byte, size+2)
+				if _, err := io.ReadFull(r, payload); err != nil {
+					return
+				}
+				// Make the client answer a ping before the acknowledgement
+				fmt.Fprintf(conn, "PING\r\n")
+				if line, _ := r.ReadString('\n'); strings.TrimSpace(line) != "PONG" {
+					fmt.Fprintf(conn, "-ERR 'expected pong'\r\n")
+					continue
+				}
+				received <- fields[1] + " " + string(payload[:size])
+				fmt.Fprintf(conn, "+OK\r\n")
+			}
+		}
+	}()
+	return l
+}
+
+func TestNATS(t *testing.T) {
+	received := make(chan string, 1)
+	l := natsStub(t, received)
+	defer l.Close()
+
+	n, err := NewNATS("nats://" + l.Addr().String() + "/shop.user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	if err := n.Publish(Event{ID: "1", Type: "CustomerRegistered", Data: json.RawMessage(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-received
+	if !strings.HasPrefix(msg, "shop.user.CustomerRegistered ") || !strings.Contains(msg, `"id":"1"`) {
+		t.Errorf("unexpected message %q", msg)
+	}
+}
+
+func TestNewNATS(t *testing.T) {
+	if _, err := NewNATS("http://localhost:4222"); err == nil {
+		t.Error("expected non NATS URL to be rejected")
+	}
+	n, _ := NewNATS("nats://localhost:4222")
+	if n.Prefix != "user" {
+		t.Errorf("expected default prefix, received %v", n.Prefix)
+	}
+}
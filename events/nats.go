@@ -0,0 +1,155 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NATS publishes events to a NATS server, on the subject made of the prefix
+// and the event type, for example user.CustomerRegistered. It speaks the
+// plain text client protocol in verbose mode, so every publish is
+// acknowledged by the server before Publish returns.
+type NATS struct {
+	Addr    string
+	Prefix  string
+	Name    string
+	Timeout time.Duration
+
+	mtx  sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// NewNATS returns a publisher for a nats://host:port URL. The path of the URL,
+// if any, is the subject prefix.
+func NewNATS(rawurl string) (*NATS, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "nats" || u.Host == "" {
+		return nil, fmt.Errorf("invalid NATS URL %q", rawurl)
+	}
+	prefix := strings.Trim(u.Path, "/")
+	if prefix == "" {
+		prefix = "user"
+	}
+	return &NATS{Addr: u.Host, Prefix: prefix, Name: "user", Timeout: 5 * time.Second}, nil
+}
+
+// Publish implements Publisher. A connection that fails is dropped and dialed
+// again on the next publish.
+func (n *NATS) Publish(e Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	if n.conn == nil {
+		if err := n.connect(); err != nil {
+			return err
+		}
+	}
+	err = n.publish(n.Prefix+"."+e.Type, b)
+	if err != nil {
+		n.close()
+	}
+	return err
+}
+
+// Close closes the connection to the server
+func (n *NATS) Close() error {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	return n.close()
+}
+
+func (n *NATS) close() error {
+	if n.conn == nil {
+		return nil
+	}
+	err := n.conn.Close()
+	n.conn = nil
+	return err
+}
+
+func (n *NATS) connect() error {
+	conn, err := net.DialTimeout("tcp", n.Addr, n.Timeout)
+	if err != nil {
+		return err
+	}
+	n.conn = conn
+	n.r = bufio.NewReader(conn)
+	n.conn.SetDeadline(time.Now().Add(n.Timeout))
+
+	line, err := n.r.ReadString('\n')
+	if err != nil {
+		n.close()
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		n.close()
+		return fmt.Errorf("unexpected NATS greeting %q", strings.TrimSpace(line))
+	}
+	connect, _ := json.Marshal(map[string]interface{}{
+		"verbose":  true,
+		"pedantic": false,
+		"name":     n.Name,
+		"lang":     "go",
+	})
+	if _, err := fmt.Fprintf(n.conn, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+		n.close()
+		return err
+	}
+	// Verbose mode acknowledges the CONNECT before answering the PING
+	if err := n.expect("+OK"); err != nil {
+		n.close()
+		return err
+	}
+	if err := n.expect("PONG"); err != nil {
+		n.close()
+		return err
+	}
+	return nil
+}
+
+func (n *NATS) publish(subject string, payload []byte) error {
+	n.conn.SetDeadline(time.Now().Add(n.Timeout))
+	if _, err := fmt.Fprintf(n.conn, "PUB %s %d\r\n%s\r\n", subject, len(payload), payload); err != nil {
+		return err
+	}
+	return n.expect("+OK")
+}
+
+// expect reads the next reply of the server, answering its pings meanwhile
+func (n *NATS) expect(reply string) error {
+	for {
+		line, err := n.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == reply:
+			return nil
+		case line == "PING":
+			if _, err := n.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "INFO "):
+			// Cluster updates may arrive at any time
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New("NATS: " + strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		default:
+			return fmt.Errorf("unexpected NATS reply %q", line)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package events
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// Publisher delivers events to their consumers. A Publisher may deliver an
+// event more than once, consumers use the event ID to tell.
+type Publisher interface {
+	Publish(Event) error
+}
+
+// Handler receives the events published on a Bus
+type Handler func(Event) error
+
+// Bus delivers events to handlers subscribed in the same process
+type Bus struct {
+	mtx      sync.RWMutex
+	handlers map[string][]Handler
+}
+
+// NewBus returns a bus without subscribers
+func NewBus() *Bus {
+	return &Bus{handlers: make(map[string][]Handler)}
+}
+
+// Subscribe calls h for every event of the given type, or for every event
+// when the type is empty
+func (b *Bus) Subscribe(eventType string, h Handler) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.handlers[eventType] = append(b.handlers[eventType], h)
+}
+
+// Publish hands the event to each subscribed handler in turn, returning the
+// first error. Every handler is called, even after one failed.
+func (b *Bus) Publish(e Event) error {
+	b.mtx.RLock()
+	handlers := append(append([]Handler{}, b.handlers[""]...), b.handlers[e.Type]...)
+	b.mtx.RUnlock()
+
+	var failed error
+	for _, h := range handlers {
+		if err := h(e); err != nil && failed == nil {
+			failed = err
+		}
+	}
+	return failed
+}
+
+// Log writes events as JSON lines, to a file or standard output
+type Log struct {
+	mtx sync.Mutex
+	w   io.Writer
+}
+
+// NewLog returns a publisher writing to w
+func NewLog(w io.Writer) *Log {
+	return &Log{w: w}
+}
+
+// Publish implements Publisher.
+func (l *Log) Publish(e Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	_, err = l.w.Write(append(b, '\n'))
+	return err
+}
+
+// Fanout publishes every event to all of its publishers
+type Fanout []Publisher
+
+// Publish implements Publisher. It stops at the first publisher that fails,
+// the event is delivered again to all of them on the next attempt.
+func (f Fanout) Publish(e Event) error {
+	for _, p := range f {
+		if err := p.Publish(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
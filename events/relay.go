@@ -0,0 +1,74 @@
+package events
+
+import (
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// Outbox holds the events written along with the changes they describe until
+// they are delivered
+type Outbox interface {
+	// Pending returns up to limit undelivered events, oldest first
+	Pending(limit int) ([]Event, error)
+	// Delivered removes delivered events from the outbox
+	Delivered(ids ...string) error
+}
+
+// Relay moves events from an outbox to a publisher. Events are published in
+// order; when one fails the relay stops and tries again from that event on
+// the next round, so an event is delivered at least once.
+type Relay struct {
+	Outbox    Outbox
+	Publisher Publisher
+	Logger    log.Logger
+	// Interval is the pause between rounds when the outbox is drained
+	Interval time.Duration
+	// Batch is the number of events read from the outbox at once
+	Batch int
+}
+
+// NewRelay returns a relay with default settings
+func NewRelay(o Outbox, p Publisher, logger log.Logger) *Relay {
+	return &Relay{Outbox: o, Publisher: p, Logger: logger, Interval: time.Second, Batch: 100}
+}
+
+// Flush delivers pending events until the outbox is empty or an event can not
+// be published, returning the number delivered
+func (r *Relay) Flush() (int, error) {
+	delivered := 0
+	for {
+		pending, err := r.Outbox.Pending(r.Batch)
+		if err != nil || len(pending) == 0 {
+			return delivered, err
+		}
+		for _, e := range pending {
+			if err := r.Publisher.Publish(e); err != nil {
+				return delivered, err
+			}
+			if err := r.Outbox.Delivered(e.ID); err != nil {
+				return delivered, err
+			}
+			delivered++
+		}
+		if len(pending) < r.Batch {
+			return delivered, nil
+		}
+	}
+}
+
+// Run flushes the outbox every Interval until stop is closed
+func (r *Relay) Run(stop <-chan struct{}) {
+	t := time.NewTicker(r.Interval)
+	defer t.Stop()
+	for {
+		if _, err := r.Flush(); err != nil {
+			r.Logger.Log("relay", "events", "err", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -11,6 +11,7 @@ require (
 	github.com/weaveworks/common v0.0.0-20170321114712-f94043b3da14
 	go.mongodb.org/mongo-driver v1.10.2
 	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2
+	golang.org/x/text v0.3.7
 	gopkg.in/mgo.v2 v2.0.0-20160818020120-3f83fa500528
 )
 
@@ -51,7 +52,6 @@ require (
 	golang.org/x/crypto v0.0.0-20220622213112-05595931fe9d // indirect
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
 	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
-	golang.org/x/text v0.3.7 // indirect
 	google.golang.org/grpc v1.0.6-0.20170111191052-50955793b018 // indirect
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 	gopkg.in/tomb.v2 v2.0.0-20140626144623-14b3d72120e8 // indirect
@@ -0,0 +1,74 @@
+// Package guest keeps the addresses and cards entered during a guest
+// checkout. A guest session is identified by a random token held by the
+// client; only its hash is stored. The addresses and cards of a session can be
+// read back with the token until the session expires, and move to the
+// customer who registers or logs in with it.
+package guest
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"time"
+
+	"github.com/microservices-demo/user/users"
+)
+
+// TokenHeader carries the token of a guest session
+const TokenHeader = "X-Guest-Token"
+
+var (
+	ErrInvalidToken = errors.New("Guest session not found or expired")
+
+	// TTL is how long a guest session and its addresses and cards are kept
+	TTL = 24 * time.Hour
+)
+
+func init() {
+	flag.DurationVar(&TTL, "guest-ttl", TTL, "How long guest sessions and their addresses and cards are kept")
+}
+
+// Session is a guest checkout. The token is only known when the session is
+// created.
+type Session struct {
+	Token     string          `json:"token,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+	ExpiresAt time.Time       `json:"expiresAt"`
+	Addresses []users.Address `json:"addresses"`
+	Cards     []users.Card    `json:"cards"`
+}
+
+// NewToken returns a random session token
+func NewToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Hash returns the stored form of a token
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Store keeps guest sessions with their addresses and cards
+type Store interface {
+	// CreateGuest stores a session with the hash of its token
+	CreateGuest(Session) error
+	// GetGuest returns a live session with its addresses and cards
+	GetGuest(token string) (Session, error)
+	CreateGuestAddress(token string, a *users.Address) error
+	CreateGuestCard(token string, c *users.Card) error
+	// ClaimGuest moves the addresses and cards of a live session to a
+	// customer and ends the session, all in one unit of work. It returns
+	// the number of addresses and cards moved.
+	ClaimGuest(token, customerID string) (int, error)
+	// ExpireGuests removes the sessions that expired before the given
+	// time with their addresses and cards, returning how many sessions
+	ExpireGuests(before time.Time) (int, error)
+}
@@ -0,0 +1,32 @@
+package guest
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestNewToken(t *testing.T) {
+	a, err := NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := NewToken()
+	if a == b {
+		t.Error("expected tokens to differ")
+	}
+	if raw, err := base64.RawURLEncoding.DecodeString(a); err != nil || len(raw) != 32 {
+		t.Errorf("expected 32 random bytes, received %v, %v", len(raw), err)
+	}
+}
+
+func TestHash(t *testing.T) {
+	if Hash("token") != Hash("token") {
+		t.Error("expected the hash of a token to be stable")
+	}
+	if Hash("token") == Hash("other") || Hash("token") == "token" {
+		t.Error("expected tokens to be hashed")
+	}
+	if len(Hash("token")) != 64 {
+		t.Errorf("expected a sha256 hex digest, received %v", Hash("token"))
+	}
+}
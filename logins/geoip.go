@@ -0,0 +1,120 @@
+package logins
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+var geoipFile string
+
+func init() {
+	flag.StringVar(&geoipFile, "geoip-database", os.Getenv("GEOIP_DATABASE"), "CSV file of IP ranges and the countries they are in, to locate logins")
+}
+
+// Countries locates the clients logging in. Without a database no client is
+// located.
+var Countries *GeoIP
+
+// GeoIP is a database of IP ranges and the countries they are in
+type GeoIP struct {
+	ranges []ipRange
+}
+
+type ipRange struct {
+	first, last netip.Addr
+	country     string
+}
+
+// ParseGeoIP reads a GeoIP database in CSV with the first address, last
+// address and country code of a range in the first three columns, as the
+// freely available IP to country lists are. Further columns and a header line
+// are ignored. Ranges must not overlap.
+func ParseGeoIP(r io.Reader) (*GeoIP, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	g := &GeoIP{}
+	for line := 1; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 3 {
+			return nil, fmt.Errorf("line %d: expected first address, last address and country", line)
+		}
+		first, ferr := netip.ParseAddr(strings.TrimSpace(record[0]))
+		last, lerr := netip.ParseAddr(strings.TrimSpace(record[1]))
+		if line == 1 && ferr != nil {
+			// A header
+			continue
+		}
+		first, last = first.Unmap(), last.Unmap()
+		if ferr != nil || lerr != nil || first.Is4() != last.Is4() || last.Less(first) {
+			return nil, fmt.Errorf("line %d: invalid range %v - %v", line, record[0], record[1])
+		}
+		g.ranges = append(g.ranges, ipRange{first: first, last: last, country: country(record[2])})
+	}
+	sort.Slice(g.ranges, func(i, j int) bool { return g.ranges[i].first.Less(g.ranges[j].first) })
+	for i := 1; i < len(g.ranges); i++ {
+		if !g.ranges[i-1].last.Less(g.ranges[i].first) {
+			return nil, fmt.Errorf("range %v - %v overlaps the one before", g.ranges[i].first, g.ranges[i].last)
+		}
+	}
+	return g, nil
+}
+
+// country returns the country code of a range, empty for the codes lists use
+// for unknown or reserved ranges
+func country(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	switch code {
+	case "-", "ZZ", "XX":
+		return ""
+	}
+	return code
+}
+
+// Country returns the country code of the range holding ip, or the empty
+// string when no range does or ip is not an address
+func (g *GeoIP) Country(ip string) string {
+	if g == nil {
+		return ""
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap().WithZone("")
+	i := sort.Search(len(g.ranges), func(i int) bool { return !g.ranges[i].last.Less(addr) })
+	if i == len(g.ranges) || addr.Less(g.ranges[i].first) {
+		return ""
+	}
+	return g.ranges[i].country
+}
+
+// Load reads the GeoIP database given with -geoip-database into Countries
+func Load() error {
+	if geoipFile == "" {
+		return nil
+	}
+	f, err := os.Open(geoipFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	g, err := ParseGeoIP(f)
+	if err != nil {
+		return fmt.Errorf("%v: %v", geoipFile, err)
+	}
+	Countries = g
+	return nil
+}
@@ -0,0 +1,58 @@
+package logins
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func mustRange(t *testing.T, first, last, country string) ipRange {
+	t.Helper()
+	return ipRange{first: netip.MustParseAddr(first), last: netip.MustParseAddr(last), country: country}
+}
+
+const database = `ip_start,ip_end,country
+"192.0.2.0","192.0.2.255","NL"
+198.51.100.0,198.51.100.127,de,Germany
+198.51.100.128,198.51.100.255,ZZ
+2001:db8::,2001:db8::ffff,US
+`
+
+func TestGeoIP(t *testing.T) {
+	g, err := ParseGeoIP(strings.NewReader(database))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, expected := range map[string]string{
+		"192.0.2.0":        "NL",
+		"192.0.2.255":      "NL",
+		"::ffff:192.0.2.9": "NL",
+		"198.51.100.1":     "DE",
+		"198.51.100.200":   "",
+		"192.0.3.0":        "",
+		"10.0.0.1":         "",
+		"2001:db8::1":      "US",
+		"2001:db8::1:0":    "",
+		"localhost":        "",
+	} {
+		if country := g.Country(ip); country != expected {
+			t.Errorf("%v: expected %q, received %q", ip, expected, country)
+		}
+	}
+	var none *GeoIP
+	if none.Country("192.0.2.1") != "" {
+		t.Error("expected no country without a database")
+	}
+
+	for _, src := range []string{
+		"192.0.2.0,192.0.2.255\n",
+		"192.0.2.0,192.0.2.255,NL\nnot,an,address\n",
+		"192.0.2.255,192.0.2.0,NL\n",
+		"192.0.2.0,2001:db8::,NL\n",
+		"192.0.2.0,192.0.2.255,NL\n192.0.2.128,192.0.3.0,DE\n",
+	} {
+		if _, err := ParseGeoIP(strings.NewReader(src)); err == nil {
+			t.Errorf("expected %q to be refused", src)
+		}
+	}
+}
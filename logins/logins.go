@@ -0,0 +1,136 @@
+// Package logins keeps the history of attempts to log in. A successful login
+// from a device or country the customer did not log in from before is
+// flagged, and the customer notified of it through a Notifier. Devices are
+// told apart by a random id kept in a cookie; only its hash is stored.
+package logins
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"time"
+)
+
+// DeviceCookie holds the id of the device a client logs in from
+const DeviceCookie = "device_id"
+
+// maxField bounds the username and user agent kept, which the client chooses
+const maxField = 256
+
+// Retention is how long logins are kept
+var Retention = 180 * 24 * time.Hour
+
+func init() {
+	flag.DurationVar(&Retention, "login-retention", Retention, "How long the login history is kept")
+}
+
+// Client is where an attempt to log in comes from
+type Client struct {
+	IP        string
+	UserAgent string
+	// Device is the id from the device cookie
+	Device string
+}
+
+// Login is an attempt to log in. CustomerID is empty when no customer has
+// the username tried.
+type Login struct {
+	ID         string    `json:"id" bson:"-"`
+	CustomerID string    `json:"customerId,omitempty" bson:"customer,omitempty"`
+	Username   string    `json:"username" bson:"username"`
+	At         time.Time `json:"at" bson:"at"`
+	Success    bool      `json:"success" bson:"success"`
+	IP         string    `json:"ip" bson:"ip"`
+	UserAgent  string    `json:"userAgent" bson:"userAgent"`
+	// Device is the hash of the device id
+	Device  string `json:"device" bson:"device"`
+	Country string `json:"country,omitempty" bson:"country,omitempty"`
+	// NewDevice and NewCountry flag a successful login from where the
+	// customer did not log in from before
+	NewDevice  bool `json:"newDevice,omitempty" bson:"newDevice,omitempty"`
+	NewCountry bool `json:"newCountry,omitempty" bson:"newCountry,omitempty"`
+}
+
+// New returns an attempt to log in with username made by a client at the
+// given time, locating the client with Countries
+func New(username string, c Client, at time.Time) Login {
+	return Login{
+		Username:  truncate(username),
+		At:        at,
+		IP:        c.IP,
+		UserAgent: truncate(c.UserAgent),
+		Device:    HashDevice(c.Device),
+		Country:   Countries.Country(c.IP),
+	}
+}
+
+// Seen is what the earlier successful logins of a customer tell about a new
+// one
+type Seen struct {
+	// Logins is set when the customer logged in before, Device when it
+	// did from the same device
+	Logins bool
+	Device bool
+	// Located is set when the customer logged in from a known country
+	// before, Country when it did from the same country
+	Located bool
+	Country bool
+}
+
+// Flag flags a successful login from a new device or country. The first
+// login of a customer, and the first one located, are not flagged, as there
+// is nothing to tell them from.
+func (l *Login) Flag(s Seen) {
+	if !l.Success || l.CustomerID == "" || !s.Logins {
+		return
+	}
+	l.NewDevice = !s.Device
+	l.NewCountry = l.Country != "" && s.Located && !s.Country
+}
+
+// Flagged tells whether the customer is to be notified of the login
+func (l Login) Flagged() bool {
+	return l.NewDevice || l.NewCountry
+}
+
+// NewDevice returns a random device id
+func NewDevice() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashDevice returns the stored form of a device id. Clients without one
+// share the empty hash.
+func HashDevice(device string) string {
+	if device == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(device))
+	return hex.EncodeToString(sum[:16])
+}
+
+func truncate(s string) string {
+	if len(s) > maxField {
+		return s[:maxField]
+	}
+	return s
+}
+
+// Store keeps the login history
+type Store interface {
+	// RecordLogin stores an attempt to log in, flagging a successful one
+	// against the earlier successful logins of its customer. A flagged
+	// login is published in the same unit of work.
+	RecordLogin(l *Login) error
+	// Logins returns the logins of a customer, newest first, up to limit
+	// unless it is 0
+	Logins(customerID string, limit int) ([]Login, error)
+	// ExpireLogins removes the logins made before the given time,
+	// returning how many
+	ExpireLogins(before time.Time) (int, error)
+}
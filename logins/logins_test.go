@@ -0,0 +1,88 @@
+package logins
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/microservices-demo/user/events"
+)
+
+func TestFlag(t *testing.T) {
+	for _, c := range []struct {
+		name                  string
+		login                 Login
+		seen                  Seen
+		newDevice, newCountry bool
+	}{
+		{"first login", Login{CustomerID: "c", Success: true, Country: "NL"}, Seen{}, false, false},
+		{"known device and country", Login{CustomerID: "c", Success: true, Country: "NL"}, Seen{Logins: true, Device: true, Located: true, Country: true}, false, false},
+		{"new device", Login{CustomerID: "c", Success: true, Country: "NL"}, Seen{Logins: true, Located: true, Country: true}, true, false},
+		{"new country", Login{CustomerID: "c", Success: true, Country: "DE"}, Seen{Logins: true, Device: true, Located: true}, false, true},
+		{"first located", Login{CustomerID: "c", Success: true, Country: "DE"}, Seen{Logins: true, Device: true}, false, false},
+		{"not located", Login{CustomerID: "c", Success: true}, Seen{Logins: true, Device: true, Located: true}, false, false},
+		{"failed", Login{CustomerID: "c", Country: "DE"}, Seen{Logins: true, Located: true}, false, false},
+		{"unknown customer", Login{Success: true}, Seen{Logins: true}, false, false},
+	} {
+		l := c.login
+		l.Flag(c.seen)
+		if l.NewDevice != c.newDevice || l.NewCountry != c.newCountry {
+			t.Errorf("%v: expected new device %v and country %v, received %+v", c.name, c.newDevice, c.newCountry, l)
+		}
+		if l.Flagged() != (c.newDevice || c.newCountry) {
+			t.Errorf("%v: unexpected flagged %v", c.name, l.Flagged())
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	countries := Countries
+	defer func() { Countries = countries }()
+	Countries = &GeoIP{ranges: []ipRange{mustRange(t, "192.0.2.0", "192.0.2.255", "NL")}}
+
+	at := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	l := New("eve", Client{IP: "192.0.2.7", UserAgent: strings.Repeat("a", 1000), Device: "device"}, at)
+	if l.Country != "NL" || len(l.UserAgent) != maxField || !l.At.Equal(at) {
+		t.Errorf("unexpected login %+v", l)
+	}
+	if l.Device == "device" || l.Device != HashDevice("device") {
+		t.Errorf("expected the device to be hashed, received %v", l.Device)
+	}
+	if HashDevice("") != "" {
+		t.Error("expected no device without a cookie")
+	}
+}
+
+type notifications []events.CustomerLoginFlagged
+
+func (n *notifications) Notify(l events.CustomerLoginFlagged) error {
+	*n = append(*n, l)
+	return errors.New("mailer down")
+}
+
+func TestHandler(t *testing.T) {
+	e, err := events.New(events.CustomerLoginFlagged{Customer: events.Customer{CustomerID: "c"}, NewDevice: true}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n notifications
+	if err := Handler(&n, log.NewNopLogger())(e); err != nil {
+		t.Errorf("expected failed notifications to be dropped, received %v", err)
+	}
+	if len(n) != 1 || n[0].CustomerID != "c" || !n[0].NewDevice {
+		t.Errorf("unexpected notifications %+v", n)
+	}
+
+	var b bytes.Buffer
+	if err := NewLog(&b).Notify(n[0]); err != nil {
+		t.Fatal(err)
+	}
+	var logged events.CustomerLoginFlagged
+	if err := json.Unmarshal(b.Bytes(), &logged); err != nil || logged.CustomerID != "c" {
+		t.Errorf("unexpected notification logged %v, %v", b.String(), err)
+	}
+}
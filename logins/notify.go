@@ -0,0 +1,87 @@
+package logins
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/microservices-demo/user/events"
+)
+
+// Notifier tells customers about their flagged logins
+type Notifier interface {
+	Notify(events.CustomerLoginFlagged) error
+}
+
+// Log writes notifications as JSON lines, to a file or standard output
+type Log struct {
+	mtx sync.Mutex
+	w   io.Writer
+}
+
+// NewLog returns a notifier writing to w
+func NewLog(w io.Writer) *Log {
+	return &Log{w: w}
+}
+
+// Notify implements Notifier.
+func (l *Log) Notify(n events.CustomerLoginFlagged) error {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	_, err = l.w.Write(append(b, '\n'))
+	return err
+}
+
+// HTTP posts notifications as JSON to a URL, such as that of a mailer
+type HTTP struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewHTTP returns a notifier posting to url
+func NewHTTP(url string) *HTTP {
+	return &HTTP{URL: url, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Notify implements Notifier.
+func (h *HTTP) Notify(n events.CustomerLoginFlagged) error {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	resp, err := h.Client.Post(h.URL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("notifier responded %v", resp.Status)
+	}
+	return nil
+}
+
+// Handler returns a Bus handler notifying of the flagged logins published. A
+// notification that fails is logged and dropped rather than holding back the
+// events after it.
+func Handler(n Notifier, logger log.Logger) events.Handler {
+	return func(e events.Event) error {
+		var flagged events.CustomerLoginFlagged
+		if err := json.Unmarshal(e.Data, &flagged); err != nil {
+			logger.Log("event", e.ID, "err", err)
+			return nil
+		}
+		if err := n.Notify(flagged); err != nil {
+			logger.Log("event", e.ID, "customer", flagged.CustomerID, "err", err)
+		}
+		return nil
+	}
+}
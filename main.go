@@ -1,20 +1,32 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	corelog "log"
 
 	"github.com/go-kit/kit/log"
 	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
 	"github.com/microservices-demo/user/api"
+	"github.com/microservices-demo/user/attributes"
+	"github.com/microservices-demo/user/bulk"
 	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/db/cache"
 	"github.com/microservices-demo/user/db/mongodb"
+	"github.com/microservices-demo/user/dsar"
+	"github.com/microservices-demo/user/events"
+	"github.com/microservices-demo/user/logins"
+	"github.com/microservices-demo/user/users"
+	"github.com/microservices-demo/user/webhooks"
 	stdopentracing "github.com/opentracing/opentracing-go"
 	zipkin "github.com/openzipkin/zipkin-go-opentracing"
 	stdprometheus "github.com/prometheus/client_golang/prometheus"
@@ -23,8 +35,15 @@ import (
 )
 
 var (
-	port string
-	zip  string
+	port          string
+	zip           string
+	purgeInterval time.Duration
+	autoMigrate   bool
+	eventsTarget  string
+	loginNotifier string
+	cacheSize     int
+	cacheTTL      time.Duration
+	mongoStore    = &mongodb.Mongo{}
 )
 
 var (
@@ -43,12 +62,24 @@ func init() {
 	stdprometheus.MustRegister(HTTPLatency)
 	flag.StringVar(&zip, "zipkin", os.Getenv("ZIPKIN"), "Zipkin address")
 	flag.StringVar(&port, "port", "8084", "Port on which to run")
-	db.Register("mongodb", &mongodb.Mongo{})
+	flag.BoolVar(&autoMigrate, "auto-migrate", os.Getenv("AUTO_MIGRATE") != "false", "Apply pending schema migrations on start up")
+	flag.StringVar(&eventsTarget, "events", os.Getenv("EVENTS"), "Where domain events are published: log, file:<path> or nats://host:port/prefix")
+	flag.StringVar(&loginNotifier, "login-notifier", os.Getenv("LOGIN_NOTIFIER"), "Where customers are notified of logins from new devices or countries: log, file:<path> or an http(s) URL")
+	flag.IntVar(&cacheSize, "cache-size", 10000, "Number of customers cached, 0 to disable the cache")
+	flag.DurationVar(&cacheTTL, "cache-ttl", time.Minute, "How long a customer is served from the cache")
+	flag.DurationVar(&purgeInterval, "purge-interval", time.Hour, "How often deleted entities past the restore window are purged, 0 to never purge")
+	db.Register("mongodb", mongoStore)
 }
 
 func main() {
 
 	flag.Parse()
+	if err := attributes.Load(); err != nil {
+		corelog.Fatal(err)
+	}
+	if err := logins.Load(); err != nil {
+		corelog.Fatal(err)
+	}
 	// Mechanical stuff.
 	errc := make(chan error)
 	ctx := context.Background()
@@ -60,6 +91,7 @@ func main() {
 		logger = log.NewContext(logger).With("ts", log.DefaultTimestampUTC)
 		logger = log.NewContext(logger).With("caller", log.DefaultCaller)
 	}
+	mongoStore.Logger = log.NewContext(logger).With("db", "mongodb")
 
 	var tracer stdopentracing.Tracer
 	{
@@ -99,6 +131,37 @@ func main() {
 		}
 	}
 
+	if flag.Arg(0) == "migrate" {
+		os.Exit(migrate(logger, flag.Arg(1)))
+	}
+	if autoMigrate {
+		if code := migrate(logger, "up"); code != 0 {
+			os.Exit(code)
+		}
+	}
+	switch flag.Arg(0) {
+	case "export":
+		os.Exit(exportCustomers(logger, flag.Args()[1:]))
+	case "import":
+		os.Exit(importCustomers(logger, flag.Args()[1:]))
+	case "check":
+		os.Exit(checkConsistency(logger, flag.Args()[1:]))
+	case "attributes":
+		os.Exit(migrateAttributes(logger, flag.Args()[1:]))
+	}
+
+	// Cache customers, following the changes made by other replicas.
+	if cacheSize > 0 {
+		c := cache.New(db.DefaultDb, cacheSize, cacheTTL, kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "microservices_demo",
+			Subsystem: "user",
+			Name:      "cache_lookups_total",
+			Help:      "Number of customer cache lookups by kind and result.",
+		}, []string{"kind", "result"}))
+		db.DefaultDb = c
+		go c.Follow(db.Changes, time.Second, log.NewContext(logger).With("cache", "customers"), nil)
+	}
+
 	fieldKeys := []string{"method"}
 	// Service domain.
 	var service api.Service
@@ -146,6 +209,122 @@ func main() {
 		errc <- http.ListenAndServe(fmt.Sprintf(":%v", port), handler)
 	}()
 
+	// Purge deleted entities once they can no longer be restored.
+	if purgeInterval > 0 {
+		go func() {
+			logger := log.NewContext(logger).With("purger", "deleted")
+			for range time.Tick(purgeInterval) {
+				n, err := db.Purge()
+				if err != nil {
+					logger.Log("err", err)
+				}
+				if n > 0 {
+					logger.Log("purged", n)
+				}
+			}
+		}()
+	}
+
+	// Expire guest sessions with their addresses and cards.
+	if store, err := db.Guests(); err == nil && purgeInterval > 0 {
+		go func() {
+			logger := log.NewContext(logger).With("purger", "guests")
+			for range time.Tick(purgeInterval) {
+				n, err := store.ExpireGuests(time.Now())
+				if err != nil {
+					logger.Log("err", err)
+				}
+				if n > 0 {
+					logger.Log("expired", n)
+				}
+			}
+		}()
+	}
+
+	// Release usernames whose reservation after a change ended.
+	if store, err := db.Usernames(); err == nil && purgeInterval > 0 {
+		go func() {
+			logger := log.NewContext(logger).With("purger", "usernames")
+			for range time.Tick(purgeInterval) {
+				n, err := store.ReleaseUsernames(time.Now())
+				if err != nil {
+					logger.Log("err", err)
+				}
+				if n > 0 {
+					logger.Log("released", n)
+				}
+			}
+		}()
+	}
+
+	// Forget logins past their retention.
+	if store, err := db.Logins(); err == nil && purgeInterval > 0 {
+		go func() {
+			logger := log.NewContext(logger).With("purger", "logins")
+			for range time.Tick(purgeInterval) {
+				n, err := store.ExpireLogins(time.Now().Add(-logins.Retention))
+				if err != nil {
+					logger.Log("err", err)
+				}
+				if n > 0 {
+					logger.Log("expired", n)
+				}
+			}
+		}()
+	}
+
+	// Answer subject access requests in the background.
+	if store, err := db.AccessRequests(); err == nil {
+		worker := dsar.NewWorker(store, func(id string) (users.User, error) {
+			u, err := db.GetUser(id)
+			if err != nil {
+				return u, err
+			}
+			return u, db.GetUserAttributes(&u)
+		}, log.NewContext(logger).With("worker", "dsar"))
+		if store, err := db.Logins(); err == nil {
+			worker.Logins = func(id string) ([]logins.Login, error) { return store.Logins(id, 0) }
+		}
+		go worker.Run(nil)
+	}
+
+	// Relay domain events from the outbox to their publishers.
+	bus := events.NewBus()
+	if store, err := db.Webhooks(); err == nil {
+		dispatcher := webhooks.NewDispatcher(store, log.NewContext(logger).With("dispatcher", "webhooks"),
+			kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+				Namespace: "microservices_demo",
+				Subsystem: "user",
+				Name:      "webhook_deliveries_total",
+				Help:      "Number of webhook delivery attempts by subscription and outcome.",
+			}, []string{"subscription", "outcome"}),
+			kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+				Namespace: "microservices_demo",
+				Subsystem: "user",
+				Name:      "webhook_delivery_duration_seconds",
+				Help:      "Time (in seconds) spent on webhook delivery attempts.",
+				Buckets:   stdprometheus.DefBuckets,
+			}, []string{"subscription"}),
+		)
+		bus.Subscribe("", dispatcher.Handle)
+		go dispatcher.Run(nil)
+	}
+	if notifier, err := newLoginNotifier(loginNotifier); err != nil {
+		logger.Log("login-notifier", loginNotifier, "err", err)
+		os.Exit(1)
+	} else if notifier != nil {
+		bus.Subscribe(events.CustomerLoginFlagged{}.EventType(), logins.Handler(notifier, log.NewContext(logger).With("notifier", "logins")))
+	}
+	if outbox, ok := db.Unwrap(db.DefaultDb).(events.Outbox); ok {
+		publisher, err := eventPublisher(eventsTarget)
+		if err != nil {
+			logger.Log("events", eventsTarget, "err", err)
+			os.Exit(1)
+		}
+		relay := events.NewRelay(outbox, events.Fanout{bus, publisher}, log.NewContext(logger).With("relay", "events"))
+		go relay.Run(nil)
+	}
+
 	// Capture interrupts.
 	go func() {
 		c := make(chan os.Signal)
@@ -155,3 +334,224 @@ func main() {
 
 	logger.Log("exit", <-errc)
 }
+
+// eventPublisher returns the publisher for the -events flag: "log" writes
+// events to standard output, "file:<path>" appends them to a file and a
+// nats:// URL publishes them to NATS. Without a target events only reach
+// subscribers in this process.
+func eventPublisher(target string) (events.Publisher, error) {
+	switch {
+	case target == "":
+		return events.Fanout{}, nil
+	case target == "log":
+		return events.NewLog(os.Stdout), nil
+	case strings.HasPrefix(target, "file:"):
+		f, err := os.OpenFile(strings.TrimPrefix(target, "file:"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return events.NewLog(f), nil
+	case strings.HasPrefix(target, "nats:"):
+		return events.NewNATS(target)
+	}
+	return nil, fmt.Errorf("unknown events target %q", target)
+}
+
+// newLoginNotifier returns the notifier for the -login-notifier flag: "log"
+// writes notifications to standard output, "file:<path>" appends them to a
+// file and an http:// or https:// URL has them posted to it. Without a target
+// customers are not notified.
+func newLoginNotifier(target string) (logins.Notifier, error) {
+	switch {
+	case target == "":
+		return nil, nil
+	case target == "log":
+		return logins.NewLog(os.Stdout), nil
+	case strings.HasPrefix(target, "file:"):
+		f, err := os.OpenFile(strings.TrimPrefix(target, "file:"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return logins.NewLog(f), nil
+	case strings.HasPrefix(target, "http://"), strings.HasPrefix(target, "https://"):
+		return logins.NewHTTP(target), nil
+	}
+	return nil, fmt.Errorf("unknown login notifier %q", target)
+}
+
+// migrate runs the migrate subcommand: "up" applies the pending migrations,
+// "status" lists them. It returns the exit code.
+func migrate(logger log.Logger, command string) int {
+	logger = log.NewContext(logger).With("migrate", command)
+	runner, err := db.Migrations()
+	if err == db.ErrMigrationsUnsupported {
+		logger.Log("msg", "nothing to migrate", "database", "without migrations")
+		return 0
+	}
+	if err != nil {
+		logger.Log("err", err)
+		return 1
+	}
+
+	switch command {
+	case "up":
+		done, err := runner.Up()
+		for _, m := range done {
+			logger.Log("applied", m.Version, "description", m.Description)
+		}
+		if err != nil {
+			logger.Log("err", err)
+			return 1
+		}
+	case "status":
+		status, err := runner.Status()
+		if err != nil {
+			logger.Log("err", err)
+			return 1
+		}
+		for _, s := range status {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-25s  %v\n", s.Version, applied, s.Description)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "usage: %v migrate up|status\n", os.Args[0])
+		return 2
+	}
+	return 0
+}
+
+// exportCustomers runs the export subcommand, writing every customer as
+// NDJSON to standard output or the file given by -o. It returns the exit code.
+func exportCustomers(logger log.Logger, args []string) int {
+	logger = log.NewContext(logger).With("export", "customers")
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	cardsFlag := fs.String("cards", string(bulk.Masked), "How card numbers are exported: masked or encrypted with -card-key")
+	anonymize := fs.Bool("anonymize", false, "Anonymize customers following -anonymize-rules, with test card numbers")
+	out := fs.String("o", "", "File to write to instead of standard output")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	cards, err := bulk.ParseCards(*cardsFlag)
+	if err != nil {
+		logger.Log("err", err)
+		return 2
+	}
+	o := bulk.ExportOptions{Cards: cards}
+	if *anonymize {
+		o.Anonymizer, err = bulk.Anonymize()
+	} else if cards == bulk.Encrypted {
+		o.Key, err = bulk.CardKey()
+	}
+	if err != nil {
+		logger.Log("err", err)
+		return 1
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			logger.Log("err", err)
+			return 1
+		}
+		defer w.Close()
+	}
+	bw := bufio.NewWriter(w)
+	n, err := bulk.Export(bw, db.GetUsers, o)
+	if err == nil {
+		err = bw.Flush()
+	}
+	logger.Log("exported", n, "cards", cards, "anonymized", *anonymize)
+	if err != nil {
+		logger.Log("err", err)
+		return 1
+	}
+	return 0
+}
+
+// importCustomers runs the import subcommand, upserting the customers read
+// from the file given, or standard input, and printing the report. It
+// returns the exit code, 1 when any record failed.
+func importCustomers(logger log.Logger, args []string) int {
+	logger = log.NewContext(logger).With("import", "customers")
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "Check every record without writing any")
+	batch := fs.Int("batch", 100, "Number of customers upserted at once")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	key, err := bulk.CardKey()
+	if err != nil && err != bulk.ErrNoKey {
+		logger.Log("err", err)
+		return 1
+	}
+
+	r := os.Stdin
+	if fs.Arg(0) != "" && fs.Arg(0) != "-" {
+		if r, err = os.Open(fs.Arg(0)); err != nil {
+			logger.Log("err", err)
+			return 1
+		}
+		defer r.Close()
+	}
+	report, err := bulk.Import(r, db.UpsertUsers, bulk.Options{Batch: *batch, DryRun: *dryRun, Key: key})
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+	if err != nil {
+		logger.Log("err", err)
+		return 1
+	}
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// checkConsistency runs the check subcommand, printing what it found and
+// repaired. It returns 1 when inconsistencies are left unrepaired.
+func checkConsistency(logger log.Logger, args []string) int {
+	logger = log.NewContext(logger).With("check", "consistency")
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	repair := fs.Bool("repair", false, "Fix the inconsistencies found")
+	batch := fs.Int("batch", 100, "Number of inconsistencies repaired at once")
+	grace := fs.Duration("grace", db.CheckGrace, "How recent a change is left out of the check")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	report, err := db.Check(db.CheckOptions{Repair: *repair, Batch: *batch, Grace: *grace})
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+	if err != nil {
+		logger.Log("err", err)
+		return 1
+	}
+	if !*repair && report.Found() > 0 {
+		return 1
+	}
+	return 0
+}
+
+// migrateAttributes runs the attributes subcommand, migrating the profile
+// attributes of customers to the loaded schema and printing what it did. It
+// returns 1 when the migration failed.
+func migrateAttributes(logger log.Logger, args []string) int {
+	logger = log.NewContext(logger).With("migrate", "attributes")
+	fs := flag.NewFlagSet("attributes", flag.ContinueOnError)
+	batch := fs.Int("batch", 100, "Number of customers migrated at once")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	report, err := db.MigrateAttributes(attributes.Current, *batch)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+	if err != nil {
+		logger.Log("err", err)
+		return 1
+	}
+	return 0
+}
@@ -1,15 +1,60 @@
 package users
 
+import (
+	"fmt"
+	"time"
+)
+
+// Address types. Addresses stored before they had a type are both.
+const (
+	Shipping = "shipping"
+	Billing  = "billing"
+	Both     = "both"
+)
+
 type Address struct {
-	Street   string `json:"street" bson:"street,omitempty"`
-	Number   string `json:"number" bson:"number,omitempty"`
-	Country  string `json:"country" bson:"country,omitempty"`
-	City     string `json:"city" bson:"city,omitempty"`
-	PostCode string `json:"postcode" bson:"postcode,omitempty"`
-	ID       string `json:"id" bson:"-"`
-	Links    Links  `json:"_links"`
+	Street    string    `json:"street" bson:"street,omitempty"`
+	Number    string    `json:"number" bson:"number,omitempty"`
+	Country   string    `json:"country" bson:"country,omitempty"`
+	City      string    `json:"city" bson:"city,omitempty"`
+	PostCode  string    `json:"postcode" bson:"postcode,omitempty"`
+	Type      string    `json:"type,omitempty" bson:"type,omitempty"`
+	ID        string    `json:"id" bson:"-"`
+	Links     Links     `json:"_links"`
+	Version   int64     `json:"-" bson:"-"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
 }
 
 func (a *Address) AddLinks() {
 	a.Links.AddAddress(a.ID)
+	a.Links.AddVersion("address", a.ID, a.Version)
+}
+
+func (a *Address) Validate() error {
+	if a.Street == "" {
+		return fmt.Errorf(ErrMissingField, "Street")
+	}
+	if a.City == "" {
+		return fmt.Errorf(ErrMissingField, "City")
+	}
+	if a.Country == "" {
+		return fmt.Errorf(ErrMissingField, "Country")
+	}
+	switch a.Type {
+	case "", Shipping, Billing, Both:
+	default:
+		return fmt.Errorf(ErrInvalidField, "Type")
+	}
+	return nil
+}
+
+// Ships reports whether goods can be shipped to the address
+func (a Address) Ships() bool {
+	return a.Type != Billing
+}
+
+// Bills reports whether the address can be billed
+func (a Address) Bills() bool {
+	return a.Type != Shipping
 }
@@ -1,6 +1,7 @@
 package users
 
 import (
+	"fmt"
 	"reflect"
 	"testing"
 )
@@ -13,5 +14,43 @@ func TestAddLinksAdd(t *testing.T) {
 	if !reflect.DeepEqual(a.Links["address"], h) {
 		t.Error("expected equal address links")
 	}
+	if _, ok := a.Links["version"]; ok {
+		t.Error("expected no version link without a version")
+	}
+	a.Version = 3
+	a.AddLinks()
+	if a.Links["version"].Link != "http://mydomain/addresses/test?version=3" {
+		t.Errorf("expected a link pinned to the version, received %v", a.Links["version"])
+	}
+}
+
+func TestAddressType(t *testing.T) {
+	for _, c := range []struct {
+		Type         string
+		Ships, Bills bool
+	}{{"", true, true}, {Both, true, true}, {Shipping, true, false}, {Billing, false, true}} {
+		a := Address{Street: "street", City: "Amsterdam", Country: "Netherlands", Type: c.Type}
+		if a.Ships() != c.Ships || a.Bills() != c.Bills {
+			t.Errorf("unexpected uses of a %q address", c.Type)
+		}
+		if err := a.Validate(); err != nil {
+			t.Error(err)
+		}
+	}
+	a := Address{Street: "street", City: "Amsterdam", Country: "Netherlands", Type: "holiday"}
+	if err := a.Validate(); err == nil || err.Error() != fmt.Sprintf(ErrInvalidField, "Type") {
+		t.Error("expected an invalid type error")
+	}
+}
 
+func TestValidateAddress(t *testing.T) {
+	a := Address{Street: "street"}
+	if err := a.Validate(); err == nil || err.Error() != fmt.Sprintf(ErrMissingField, "City") {
+		t.Error("Expected missing city error")
+	}
+	a.City = "Amsterdam"
+	a.Country = "Netherlands"
+	if err := a.Validate(); err != nil {
+		t.Error(err)
+	}
 }
@@ -3,21 +3,47 @@ package users
 import (
 	"fmt"
 	"strings"
+	"time"
 )
 
 type Card struct {
 	LongNum string `json:"longNum" bson:"longNum"`
 	Expires string `json:"expires" bson:"expires"`
 	CCV     string `json:"ccv" bson:"ccv"`
-	ID      string `json:"id" bson:"-"`
-	Links   Links  `json:"_links" bson:"-"`
+	// BillingAddress is the id of the address the card bills to, if known
+	BillingAddress string    `json:"billingAddress,omitempty" bson:"billingAddress,omitempty"`
+	ID             string    `json:"id" bson:"-"`
+	Links          Links     `json:"_links" bson:"-"`
+	Version        int64     `json:"-" bson:"-"`
+	CreatedAt      time.Time `json:"createdAt" bson:"createdAt"`
+	UpdatedAt      time.Time `json:"updatedAt" bson:"updatedAt"`
 }
 
+func (c *Card) Validate() error {
+	if c.LongNum == "" {
+		return fmt.Errorf(ErrMissingField, "LongNum")
+	}
+	if strings.Trim(c.LongNum, "0123456789") != "" {
+		return fmt.Errorf(ErrInvalidField, "LongNum")
+	}
+	if c.Expires == "" {
+		return fmt.Errorf(ErrMissingField, "Expires")
+	}
+	return nil
+}
+
+// MaskCC hides all but the last four digits of the card number, and all of a
+// number that short
 func (c *Card) MaskCC() {
 	l := len(c.LongNum) - 4
+	if l < 0 {
+		c.LongNum = strings.Repeat("*", len(c.LongNum))
+		return
+	}
 	c.LongNum = fmt.Sprintf("%v%v", strings.Repeat("*", l), c.LongNum[l:])
 }
 
 func (c *Card) AddLinks() {
 	c.Links.AddCard(c.ID)
+	c.Links.AddVersion("card", c.ID, c.Version)
 }
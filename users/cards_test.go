@@ -1,6 +1,7 @@
 package users
 
 import (
+	"fmt"
 	"reflect"
 	"testing"
 )
@@ -25,3 +26,18 @@ func TestMaskCC(t *testing.T) {
 		t.Errorf("Expected matching CC number %v received %v", test1comp, test1)
 	}
 }
+
+func TestValidateCard(t *testing.T) {
+	c := Card{LongNum: "1234-5678"}
+	if err := c.Validate(); err == nil || err.Error() != fmt.Sprintf(ErrInvalidField, "LongNum") {
+		t.Error("Expected invalid card number error")
+	}
+	c.LongNum = "12345678"
+	if err := c.Validate(); err == nil || err.Error() != fmt.Sprintf(ErrMissingField, "Expires") {
+		t.Error("Expected missing expiry error")
+	}
+	c.Expires = "08/19"
+	if err := c.Validate(); err != nil {
+		t.Error(err)
+	}
+}
@@ -3,6 +3,7 @@ package users
 import (
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
 )
 
@@ -37,6 +38,37 @@ func (l *Links) AddAttrLink(attr string, corent string, id string) {
 	*l = nl
 }
 
+// AddPageLink adds a link to another page of the collection found at path,
+// params holding the page size, cursor and any filter of the listing
+func (l *Links) AddPageLink(rel, path string, params url.Values) {
+	link := fmt.Sprintf("http://%v/%v?%v", domain, path, params.Encode())
+	nl := *l
+	if nl == nil {
+		nl = make(Links)
+	}
+	nl[rel] = Href{link}
+	*l = nl
+}
+
+// AddPathLink adds a link to the resource found at path
+func (l *Links) AddPathLink(rel, path string) {
+	nl := *l
+	if nl == nil {
+		nl = make(Links)
+	}
+	nl[rel] = Href{fmt.Sprintf("http://%v/%v", domain, path)}
+	*l = nl
+}
+
+// AddVersion adds a link to the given version of an address or card, which
+// keeps resolving after it is edited or deleted
+func (l *Links) AddVersion(ent string, id string, version int64) {
+	if version <= 0 {
+		return
+	}
+	l.AddPathLink("version", fmt.Sprintf("%v/%v?version=%v", entitymap[ent], id, version))
+}
+
 func (l *Links) AddCustomer(id string) {
 	l.AddLink("customer", id)
 	l.AddAttrLink("address", "customer", id)
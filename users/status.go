@@ -0,0 +1,111 @@
+package users
+
+import (
+	"fmt"
+	"time"
+)
+
+// Account statuses. Customers stored before they had a status are active.
+const (
+	StatusPending   = "pending"
+	StatusActive    = "active"
+	StatusSuspended = "suspended"
+	StatusClosed    = "closed"
+)
+
+// transitions lists the statuses each status can move to. Closed accounts
+// stay closed.
+var transitions = map[string][]string{
+	StatusPending:   {StatusActive, StatusClosed},
+	StatusActive:    {StatusSuspended, StatusClosed},
+	StatusSuspended: {StatusActive, StatusClosed},
+}
+
+// Transition is one change of the status of a customer, with why and by whom
+// it was made
+type Transition struct {
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Reason string    `json:"reason"`
+	Actor  string    `json:"actor"`
+	At     time.Time `json:"at"`
+}
+
+// Validate checks the transition says where to, why and by whom
+func (t *Transition) Validate() error {
+	if t.To == "" {
+		return fmt.Errorf(ErrMissingField, "To")
+	}
+	if !ValidStatus(t.To) {
+		return fmt.Errorf(ErrInvalidField, "To")
+	}
+	if t.Reason == "" {
+		return fmt.Errorf(ErrMissingField, "Reason")
+	}
+	if t.Actor == "" {
+		return fmt.Errorf(ErrMissingField, "Actor")
+	}
+	return nil
+}
+
+// CanMove tells whether a customer can move from one status to another
+func CanMove(from, to string) error {
+	for _, next := range transitions[CurrentStatus(from)] {
+		if next == to {
+			return nil
+		}
+	}
+	return StatusError{Status: CurrentStatus(from), To: to}
+}
+
+// StatusError is returned when an account's status does not allow what was
+// asked of it: logging in, a write or a move to status To
+type StatusError struct {
+	Status string
+	To     string
+}
+
+func (e StatusError) Error() string {
+	if e.To != "" {
+		return fmt.Sprintf("Account can not move from %v to %v", e.Status, e.To)
+	}
+	return "Account is " + e.Status
+}
+
+// ValidStatus tells whether s is a status, the empty status being active
+func ValidStatus(s string) bool {
+	switch CurrentStatus(s) {
+	case StatusPending, StatusActive, StatusSuspended, StatusClosed:
+		return true
+	}
+	return false
+}
+
+// CurrentStatus returns the status stored as s
+func CurrentStatus(s string) string {
+	if s == "" {
+		return StatusActive
+	}
+	return s
+}
+
+// CanLogin tells whether a customer with the given status may log in, which
+// only active customers may
+func CanLogin(status string) error {
+	if s := CurrentStatus(status); s != StatusActive {
+		return StatusError{Status: s}
+	}
+	return nil
+}
+
+// CanWrite tells whether a customer with the given status, its addresses and
+// cards may be changed. Pending customers are still being set up; suspended and closed
+// ones are frozen.
+func CanWrite(status string) error {
+	switch s := CurrentStatus(status); s {
+	case StatusPending, StatusActive:
+		return nil
+	default:
+		return StatusError{Status: s}
+	}
+}
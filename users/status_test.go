@@ -0,0 +1,61 @@
+package users
+
+import "testing"
+
+func TestCanMove(t *testing.T) {
+	for _, c := range []struct {
+		from, to string
+		allowed  bool
+	}{
+		{"", StatusSuspended, true},
+		{StatusPending, StatusActive, true},
+		{StatusActive, StatusSuspended, true},
+		{StatusSuspended, StatusActive, true},
+		{StatusSuspended, StatusClosed, true},
+		{StatusActive, StatusActive, false},
+		{StatusActive, StatusPending, false},
+		{StatusClosed, StatusActive, false},
+	} {
+		err := CanMove(c.from, c.to)
+		if (err == nil) != c.allowed {
+			t.Errorf("%q to %q: expected allowed %v, received %v", c.from, c.to, c.allowed, err)
+		}
+		if e, ok := err.(StatusError); err != nil && (!ok || e.To != c.to) {
+			t.Errorf("expected a StatusError, received %v", err)
+		}
+	}
+}
+
+func TestCanLoginAndWrite(t *testing.T) {
+	for status, expected := range map[string][2]bool{
+		"":              {true, true},
+		StatusPending:   {false, true},
+		StatusActive:    {true, true},
+		StatusSuspended: {false, false},
+		StatusClosed:    {false, false},
+	} {
+		if login := CanLogin(status) == nil; login != expected[0] {
+			t.Errorf("%q: expected login %v", status, expected[0])
+		}
+		if write := CanWrite(status) == nil; write != expected[1] {
+			t.Errorf("%q: expected writes %v", status, expected[1])
+		}
+	}
+}
+
+func TestTransitionValidate(t *testing.T) {
+	valid := Transition{To: StatusSuspended, Reason: "chargebacks", Actor: "jane"}
+	if err := valid.Validate(); err != nil {
+		t.Error(err)
+	}
+	for _, tr := range []Transition{
+		{Reason: "chargebacks", Actor: "jane"},
+		{To: "frozen", Reason: "chargebacks", Actor: "jane"},
+		{To: StatusSuspended, Actor: "jane"},
+		{To: StatusSuspended, Reason: "chargebacks"},
+	} {
+		if tr.Validate() == nil {
+			t.Errorf("expected %+v to be refused", tr)
+		}
+	}
+}
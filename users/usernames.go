@@ -0,0 +1,71 @@
+package users
+
+import (
+	"flag"
+	"time"
+)
+
+var (
+	// UsernameReservation is how long a name a customer changed away from
+	// is kept from being taken by others
+	UsernameReservation = 90 * 24 * time.Hour
+	// UsernameGrace is how long a customer can still log in with the name
+	// it changed away from. It never outlasts the reservation.
+	UsernameGrace = 14 * 24 * time.Hour
+)
+
+func init() {
+	flag.DurationVar(&UsernameReservation, "username-reservation", UsernameReservation, "How long changed usernames are reserved for their previous holder")
+	flag.DurationVar(&UsernameGrace, "username-grace", UsernameGrace, "How long customers can log in with the username they changed")
+}
+
+// UsernameChange is one change of the username of a customer. From stays
+// reserved for the customer until ReservedUntil, and logs it in until
+// LoginUntil.
+type UsernameChange struct {
+	From          string    `json:"from" bson:"from"`
+	To            string    `json:"to" bson:"to"`
+	At            time.Time `json:"at" bson:"at"`
+	ReservedUntil time.Time `json:"reservedUntil" bson:"reservedUntil"`
+	LoginUntil    time.Time `json:"loginUntil" bson:"loginUntil"`
+}
+
+// Hold sets the time of the change and how long its old name is held
+func (c *UsernameChange) Hold(at time.Time) {
+	grace := UsernameGrace
+	if grace > UsernameReservation {
+		grace = UsernameReservation
+	}
+	c.At = at
+	c.ReservedUntil = at.Add(UsernameReservation)
+	c.LoginUntil = at.Add(grace)
+}
+
+// ReservedNames returns the canonical names held by a customer at the given
+// time: its current username and the names it changed away from that are
+// still reserved, without duplicates
+func ReservedNames(username string, changes []UsernameChange, at time.Time) []string {
+	names := []string{Canonical(username)}
+	seen := map[string]bool{names[0]: true}
+	for _, c := range changes {
+		key := Canonical(c.From)
+		if seen[key] || !at.Before(c.ReservedUntil) {
+			continue
+		}
+		seen[key] = true
+		names = append(names, key)
+	}
+	return names
+}
+
+// LogsIn tells whether name is a previous username of a customer that can
+// still log it in at the given time
+func LogsIn(name string, changes []UsernameChange, at time.Time) bool {
+	key := Canonical(name)
+	for _, c := range changes {
+		if Canonical(c.From) == key && at.Before(c.LoginUntil) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package users
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHold(t *testing.T) {
+	reservation, grace := UsernameReservation, UsernameGrace
+	defer func() { UsernameReservation, UsernameGrace = reservation, grace }()
+	at := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	UsernameReservation, UsernameGrace = 30*24*time.Hour, 7*24*time.Hour
+	var c UsernameChange
+	c.Hold(at)
+	if !c.At.Equal(at) || !c.ReservedUntil.Equal(at.AddDate(0, 0, 30)) || !c.LoginUntil.Equal(at.AddDate(0, 0, 7)) {
+		t.Errorf("unexpected change %+v", c)
+	}
+
+	UsernameGrace = 60 * 24 * time.Hour
+	c.Hold(at)
+	if !c.LoginUntil.Equal(c.ReservedUntil) {
+		t.Errorf("expected the grace to end with the reservation, received %+v", c)
+	}
+}
+
+func TestReservedNames(t *testing.T) {
+	at := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	changes := []UsernameChange{
+		{From: "Eve", To: "eve_b", ReservedUntil: at.Add(-time.Hour), LoginUntil: at.Add(-time.Hour)},
+		{From: "eve_b", To: "Eve_Berger", ReservedUntil: at.Add(time.Hour), LoginUntil: at.Add(-time.Minute)},
+		{From: "Eve_Berger", To: "EVE_B", ReservedUntil: at.Add(2 * time.Hour), LoginUntil: at.Add(time.Minute)},
+	}
+	if names := ReservedNames("EVE_B", changes, at); !reflect.DeepEqual(names, []string{"eve_b", "eve_berger"}) {
+		t.Errorf("unexpected reserved names %v", names)
+	}
+	for name, expected := range map[string]bool{
+		"eve":        false,
+		"eve_b":      false,
+		"eve_berger": true,
+		"EVE_BERGER": true,
+	} {
+		if LogsIn(name, changes, at) != expected {
+			t.Errorf("%q: expected login %v", name, expected)
+		}
+	}
+}
@@ -6,12 +6,16 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
 	"time"
+
+	"golang.org/x/text/unicode/norm"
 )
 
 var (
 	ErrNoCustomerInResponse = errors.New("Response has no matching customer")
 	ErrMissingField         = "Error missing %v"
+	ErrInvalidField         = "Error invalid %v"
 )
 
 type User struct {
@@ -23,8 +27,32 @@ type User struct {
 	Addresses []Address `json:"-,omitempty" bson:"-"`
 	Cards     []Card    `json:"-,omitempty" bson:"-"`
 	UserID    string    `json:"id" bson:"-"`
-	Links     Links     `json:"_links"`
-	Salt      string    `json:"-" bson:"salt"`
+	Defaults  Defaults  `json:"defaults" bson:"-"`
+	// Status is changed through transitions only, EmailVerified once the
+	// customer proved to receive mail at Email, which it can then log in
+	// with
+	Status        string `json:"status" bson:"status,omitempty"`
+	EmailVerified bool   `json:"emailVerified" bson:"emailVerified,omitempty"`
+	// UsernameChanges are the changes of Username, oldest first
+	UsernameChanges []UsernameChange `json:"-" bson:"usernameChanges,omitempty"`
+	// Attributes are the profile attributes allowed by the attributes
+	// schema, AttributesVersion the version of the schema they were last
+	// checked against
+	Attributes        map[string]interface{} `json:"attributes,omitempty" bson:"attributes,omitempty"`
+	AttributesVersion int64                  `json:"-" bson:"attributesVersion,omitempty"`
+	Links             Links                  `json:"_links"`
+	Salt              string                 `json:"-" bson:"salt"`
+	Version           int64                  `json:"-" bson:"-"`
+	CreatedAt         time.Time              `json:"createdAt" bson:"createdAt"`
+	UpdatedAt         time.Time              `json:"updatedAt" bson:"updatedAt"`
+}
+
+// Defaults are the ids of the addresses and card a customer uses unless told
+// otherwise. A customer holding an address or card that fits has a default.
+type Defaults struct {
+	ShippingAddress string `json:"shippingAddress,omitempty"`
+	BillingAddress  string `json:"billingAddress,omitempty"`
+	Card            string `json:"card,omitempty"`
 }
 
 func New() User {
@@ -49,6 +77,14 @@ func (u *User) Validate() error {
 	return nil
 }
 
+// Canonical returns the form in which usernames and emails are compared, so
+// that two customers can not register names differing only in case, spacing
+// or in how their characters are composed: "Eve_Berger", " eve_berger" and
+// the fullwidth "Ｅｖｅ_Ｂｅｒｇｅｒ" are the same login.
+func Canonical(s string) string {
+	return norm.NFKC.String(strings.ToLower(norm.NFKC.String(strings.TrimSpace(s))))
+}
+
 func (u *User) MaskCCs() {
 	for k, c := range u.Cards {
 		c.MaskCC()
@@ -60,6 +96,14 @@ func (u *User) AddLinks() {
 	u.Links.AddCustomer(u.UserID)
 }
 
+// PasswordHash returns the stored form of a password with the given salt
+func PasswordHash(password, salt string) string {
+	h := sha1.New()
+	io.WriteString(h, salt)
+	io.WriteString(h, password)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
 func (u *User) NewSalt() {
 	h := sha1.New()
 	io.WriteString(h, strconv.Itoa(int(time.Now().UnixNano())))
@@ -51,4 +51,21 @@ func TestMaskCCs(t *testing.T) {
 	if u.Cards[1].LongNum != "********pqrs" {
 		t.Error("Card two CC not masked")
 	}
+	short := Card{LongNum: "123"}
+	short.MaskCC()
+	if short.LongNum != "***" {
+		t.Errorf("expected a short number to be masked entirely, received %q", short.LongNum)
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	if Canonical(" Eve_Berger ") != Canonical("eve_berger") {
+		t.Error("expected names differing in case and spacing to be the same")
+	}
+	if Canonical("Ｅｖｅ_Ｂｅｒｇｅｒ") != "eve_berger" {
+		t.Errorf("expected fullwidth letters to be folded, received %q", Canonical("Ｅｖｅ_Ｂｅｒｇｅｒ"))
+	}
+	if Canonical("Zoe\u0301@example.com") != Canonical("zo\u00e9@EXAMPLE.com") {
+		t.Error("expected decomposed and composed accents to be the same")
+	}
 }
@@ -0,0 +1,41 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"time"
+)
+
+// VerificationTTL is how long an email verification can be completed
+var VerificationTTL = 48 * time.Hour
+
+func init() {
+	flag.DurationVar(&VerificationTTL, "email-verification-ttl", VerificationTTL, "How long email verification tokens can be used")
+}
+
+// EmailVerification is a token proving that whoever holds it received mail
+// at Email. The token is only known when the verification is started; only
+// its hash is stored.
+type EmailVerification struct {
+	Token     string    `json:"token,omitempty"`
+	Email     string    `json:"email"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// NewVerificationToken returns a random email verification token
+func NewVerificationToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashVerificationToken returns the stored form of a verification token
+func HashVerificationToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,206 @@
+package webhooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	"github.com/microservices-demo/user/events"
+)
+
+// Delivery outcomes counted per subscription
+const (
+	OutcomeDelivered = "delivered"
+	OutcomeFailed    = "failed"
+	OutcomeDead      = "dead"
+)
+
+// Dispatcher queues the events of a bus for their subscriptions and posts
+// the queued deliveries. A delivery is attempted until the endpoint answers
+// with a 2xx status, waiting twice as long after each failure, and is dead
+// after MaxAttempts.
+type Dispatcher struct {
+	Store  Store
+	Client *http.Client
+	Logger log.Logger
+	// Deliveries counts attempts by subscription and outcome, Latency
+	// observes their duration in seconds by subscription
+	Deliveries metrics.Counter
+	Latency    metrics.Histogram
+	// Interval is the pause between rounds when nothing is due
+	Interval time.Duration
+	// Batch is the number of deliveries attempted in a round
+	Batch       int
+	MaxAttempts int
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+
+	now func() time.Time
+}
+
+// NewDispatcher returns a dispatcher with default settings
+func NewDispatcher(s Store, logger log.Logger, deliveries metrics.Counter, latency metrics.Histogram) *Dispatcher {
+	return &Dispatcher{
+		Store:       s,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		Logger:      logger,
+		Deliveries:  deliveries,
+		Latency:     latency,
+		Interval:    time.Second,
+		Batch:       100,
+		MaxAttempts: 12,
+		MinBackoff:  10 * time.Second,
+		MaxBackoff:  time.Hour,
+		now:         time.Now,
+	}
+}
+
+// Handle queues an event for every subscription it matches. It is meant to
+// be subscribed to a Bus; queuing the same event again does nothing.
+func (d *Dispatcher) Handle(e events.Event) error {
+	subs, err := d.Store.GetSubscriptions()
+	if err != nil {
+		return err
+	}
+	deliveries := make([]Delivery, 0)
+	for _, s := range subs {
+		if s.Matches(e.Type) {
+			deliveries = append(deliveries, Delivery{
+				ID:             e.ID + "-" + s.ID,
+				SubscriptionID: s.ID,
+				Event:          e,
+				NextAttempt:    d.now(),
+			})
+		}
+	}
+	if len(deliveries) == 0 {
+		return nil
+	}
+	return d.Store.EnqueueDeliveries(deliveries...)
+}
+
+// Flush attempts up to Batch due deliveries, returning the number attempted
+func (d *Dispatcher) Flush() (int, error) {
+	subs, err := d.Store.GetSubscriptions()
+	if err != nil {
+		return 0, err
+	}
+	byID := make(map[string]Subscription, len(subs))
+	for _, s := range subs {
+		byID[s.ID] = s
+	}
+	attempted := 0
+	for attempted < d.Batch {
+		now := d.now()
+		delivery, err := d.Store.ClaimDelivery(now, now.Add(d.lease()))
+		if err != nil || delivery == nil {
+			return attempted, err
+		}
+		attempted++
+		s, ok := byID[delivery.SubscriptionID]
+		if !ok {
+			// The subscription was deleted after the delivery was claimed
+			if err := d.Store.CompleteDelivery(delivery.ID); err != nil {
+				return attempted, err
+			}
+			continue
+		}
+		if err := d.attempt(s, *delivery); err != nil {
+			return attempted, err
+		}
+	}
+	return attempted, nil
+}
+
+// Run flushes due deliveries every Interval until stop is closed
+func (d *Dispatcher) Run(stop <-chan struct{}) {
+	t := time.NewTicker(d.Interval)
+	defer t.Stop()
+	for {
+		if _, err := d.Flush(); err != nil {
+			d.Logger.Log("dispatcher", "webhooks", "err", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// attempt posts a delivery and records the outcome, returning an error only
+// when the outcome can not be saved
+func (d *Dispatcher) attempt(s Subscription, delivery Delivery) error {
+	begin := d.now()
+	status, err := d.post(s, delivery)
+	d.Latency.With("subscription", s.ID).Observe(d.now().Sub(begin).Seconds())
+	if err == nil {
+		d.Deliveries.With("subscription", s.ID, "outcome", OutcomeDelivered).Add(1)
+		return d.Store.CompleteDelivery(delivery.ID)
+	}
+
+	now := d.now()
+	delivery.Attempts++
+	delivery.LastStatus = status
+	delivery.LastError = err.Error()
+	outcome := OutcomeFailed
+	if delivery.Attempts >= d.MaxAttempts {
+		outcome = OutcomeDead
+		delivery.DeadAt = &now
+	} else {
+		delivery.NextAttempt = now.Add(d.backoff(delivery.Attempts))
+	}
+	d.Deliveries.With("subscription", s.ID, "outcome", outcome).Add(1)
+	d.Logger.Log("subscription", s.ID, "delivery", delivery.ID, "attempts", delivery.Attempts, "outcome", outcome, "err", err)
+	return d.Store.RescheduleDelivery(delivery)
+}
+
+// post sends the event of a delivery, signed with the subscription secret
+func (d *Dispatcher) post(s Subscription, delivery Delivery) (int, error) {
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, delivery.Event.Type)
+	req.Header.Set(DeliveryHeader, delivery.ID)
+	req.Header.Set(SignatureHeader, Sign(s.Secret, d.now(), body))
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint answered %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// backoff is the wait after the given number of failed attempts
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	wait := d.MinBackoff
+	for i := 1; i < attempts && wait < d.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > d.MaxBackoff {
+		wait = d.MaxBackoff
+	}
+	return wait
+}
+
+// lease is how long a claimed delivery is held back from other dispatchers,
+// enough for the attempt to time out
+func (d *Dispatcher) lease() time.Duration {
+	return d.Client.Timeout + time.Minute
+}
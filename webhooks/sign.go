@@ -0,0 +1,74 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers sent with every delivery
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	EventHeader     = "X-Webhook-Event"
+	DeliveryHeader  = "X-Webhook-Delivery"
+)
+
+var ErrInvalidSignature = errors.New("Invalid webhook signature")
+
+// Sign returns the signature header for a body sent at the given time:
+// t=<unix seconds>,v1=<hex HMAC-SHA256 of "<unix seconds>.<body>">. Signing
+// the time lets receivers reject replayed requests.
+func Sign(secret string, at time.Time, body []byte) string {
+	return fmt.Sprintf("t=%d,v1=%s", at.Unix(), hex.EncodeToString(mac(secret, at.Unix(), body)))
+}
+
+// Verify checks a signature header against the body, accepting it when it
+// was signed with secret no more than tolerance away from now
+func Verify(secret, signature string, body []byte, now time.Time, tolerance time.Duration) error {
+	var ts int64
+	var sums [][]byte
+	for _, part := range strings.Split(signature, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return ErrInvalidSignature
+		}
+		switch kv[0] {
+		case "t":
+			var err error
+			if ts, err = strconv.ParseInt(kv[1], 10, 64); err != nil {
+				return ErrInvalidSignature
+			}
+		case "v1":
+			sum, err := hex.DecodeString(kv[1])
+			if err != nil {
+				return ErrInvalidSignature
+			}
+			sums = append(sums, sum)
+		}
+	}
+	if ts == 0 {
+		return ErrInvalidSignature
+	}
+	if d := now.Sub(time.Unix(ts, 0)); d > tolerance || d < -tolerance {
+		return ErrInvalidSignature
+	}
+	expected := mac(secret, ts, body)
+	for _, sum := range sums {
+		if hmac.Equal(sum, expected) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+func mac(secret string, ts int64, body []byte) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(h, "%d.", ts)
+	h.Write(body)
+	return h.Sum(nil)
+}
@@ -0,0 +1,104 @@
+// Package webhooks delivers domain events to partner endpoints over HTTP.
+// Every event matching a subscription becomes a delivery, kept in a Store
+// until the endpoint accepts it. Failed deliveries are retried with
+// exponential backoff and end up as dead letters, which can be replayed.
+package webhooks
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/microservices-demo/user/events"
+)
+
+var (
+	ErrInvalidURL   = errors.New("Webhook URL must be an absolute http or https URL")
+	ErrInvalidEvent = errors.New("Webhook event filter must be an event type, a prefix ending in * or *")
+)
+
+// Subscription asks for the events matching its filter to be posted to URL.
+// An empty filter matches every event.
+type Subscription struct {
+	ID        string    `json:"id" bson:"-"`
+	URL       string    `json:"url" bson:"url"`
+	Events    []string  `json:"events" bson:"events"`
+	Secret    string    `json:"secret,omitempty" bson:"secret"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+// Validate checks the URL and event filter of a subscription
+func (s Subscription) Validate() error {
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidURL
+	}
+	for _, e := range s.Events {
+		if e == "" || strings.Contains(strings.TrimSuffix(e, "*"), "*") {
+			return ErrInvalidEvent
+		}
+	}
+	return nil
+}
+
+// Matches reports whether events of the given type are delivered to the
+// subscription. Filters are event types, such as CustomerRegistered, or
+// prefixes ending in *, such as Address*.
+func (s Subscription) Matches(eventType string) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, e := range s.Events {
+		if e == eventType || (strings.HasSuffix(e, "*") && strings.HasPrefix(eventType, strings.TrimSuffix(e, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewSecret returns a random secret to sign deliveries with
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Delivery is an event on its way to a subscription. It is dead once it
+// failed too many times, and stays so until it is replayed.
+type Delivery struct {
+	ID             string       `json:"id" bson:"-"`
+	SubscriptionID string       `json:"subscriptionId" bson:"subscriptionId"`
+	Event          events.Event `json:"event" bson:"event"`
+	Attempts       int          `json:"attempts" bson:"attempts"`
+	NextAttempt    time.Time    `json:"nextAttempt" bson:"nextAttempt"`
+	LastStatus     int          `json:"lastStatus,omitempty" bson:"lastStatus,omitempty"`
+	LastError      string       `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	DeadAt         *time.Time   `json:"deadAt,omitempty" bson:"deadAt,omitempty"`
+}
+
+// Store keeps subscriptions and their pending deliveries
+type Store interface {
+	CreateSubscription(*Subscription) error
+	GetSubscription(id string) (Subscription, error)
+	GetSubscriptions() ([]Subscription, error)
+	// DeleteSubscription removes a subscription and its deliveries
+	DeleteSubscription(id string) error
+	// EnqueueDeliveries adds deliveries, skipping the ones already queued
+	EnqueueDeliveries(...Delivery) error
+	// ClaimDelivery returns a live delivery due at now, holding it back from
+	// other dispatchers until the given time, or nil when none is due
+	ClaimDelivery(now, until time.Time) (*Delivery, error)
+	// RescheduleDelivery saves the outcome of a failed attempt
+	RescheduleDelivery(Delivery) error
+	// CompleteDelivery removes a delivery that no longer needs attempts
+	CompleteDelivery(id string) error
+	// DeadLetters returns the dead deliveries of a subscription
+	DeadLetters(subscriptionID string) ([]Delivery, error)
+	// ReplayDelivery makes a dead delivery due again at the given time
+	ReplayDelivery(subscriptionID, id string, at time.Time) error
+}
@@ -0,0 +1,254 @@
+package webhooks
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	"github.com/microservices-demo/user/events"
+)
+
+func TestValidate(t *testing.T) {
+	for _, s := range []Subscription{
+		{URL: "ftp://partner.example.com/hook"},
+		{URL: "/hook"},
+		{URL: "https://partner.example.com/hook", Events: []string{""}},
+		{URL: "https://partner.example.com/hook", Events: []string{"Card*Added"}},
+	} {
+		if s.Validate() == nil {
+			t.Errorf("expected %+v to be invalid", s)
+		}
+	}
+	s := Subscription{URL: "https://partner.example.com/hook", Events: []string{"Customer*", "CardAdded"}}
+	if err := s.Validate(); err != nil {
+		t.Errorf("expected %+v to be valid, received %v", s, err)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	s := Subscription{Events: []string{"Customer*", "CardAdded"}}
+	for eventType, expected := range map[string]bool{
+		"CustomerRegistered": true,
+		"CardAdded":          true,
+		"CardDeleted":        false,
+		"AddressAdded":       false,
+	} {
+		if s.Matches(eventType) != expected {
+			t.Errorf("expected match of %v to be %v", eventType, expected)
+		}
+	}
+	if !(Subscription{}).Matches("CardDeleted") {
+		t.Error("expected an empty filter to match every event")
+	}
+}
+
+func TestSignature(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	body := []byte(`{"id":"1"}`)
+	sig := Sign("secret", now, body)
+	if err := Verify("secret", sig, body, now.Add(time.Minute), 5*time.Minute); err != nil {
+		t.Errorf("expected signature to verify, received %v", err)
+	}
+	if Verify("other", sig, body, now, 5*time.Minute) == nil {
+		t.Error("expected signature with another secret to fail")
+	}
+	if Verify("secret", sig, []byte(`{"id":"2"}`), now, 5*time.Minute) == nil {
+		t.Error("expected signature of another body to fail")
+	}
+	if Verify("secret", sig, body, now.Add(time.Hour), 5*time.Minute) == nil {
+		t.Error("expected an old signature to fail")
+	}
+}
+
+type memoryStore struct {
+	subs       []Subscription
+	deliveries map[string]*Delivery
+}
+
+func newMemoryStore(subs ...Subscription) *memoryStore {
+	return &memoryStore{subs: subs, deliveries: make(map[string]*Delivery)}
+}
+
+func (m *memoryStore) CreateSubscription(s *Subscription) error {
+	m.subs = append(m.subs, *s)
+	return nil
+}
+
+func (m *memoryStore) GetSubscription(id string) (Subscription, error) {
+	for _, s := range m.subs {
+		if s.ID == id {
+			return s, nil
+		}
+	}
+	return Subscription{}, errors.New("not found")
+}
+
+func (m *memoryStore) GetSubscriptions() ([]Subscription, error) {
+	return m.subs, nil
+}
+
+func (m *memoryStore) DeleteSubscription(id string) error {
+	for i, s := range m.subs {
+		if s.ID == id {
+			m.subs = append(m.subs[:i], m.subs[i+1:]...)
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) EnqueueDeliveries(ds ...Delivery) error {
+	for _, d := range ds {
+		if _, ok := m.deliveries[d.ID]; !ok {
+			d := d
+			m.deliveries[d.ID] = &d
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) ClaimDelivery(now, until time.Time) (*Delivery, error) {
+	ids := make([]string, 0)
+	for id := range m.deliveries {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		d := m.deliveries[id]
+		if d.DeadAt == nil && !d.NextAttempt.After(now) {
+			claimed := *d
+			d.NextAttempt = until
+			return &claimed, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *memoryStore) RescheduleDelivery(d Delivery) error {
+	m.deliveries[d.ID] = &d
+	return nil
+}
+
+func (m *memoryStore) CompleteDelivery(id string) error {
+	delete(m.deliveries, id)
+	return nil
+}
+
+func (m *memoryStore) DeadLetters(subscriptionID string) ([]Delivery, error) {
+	dead := make([]Delivery, 0)
+	for _, d := range m.deliveries {
+		if d.SubscriptionID == subscriptionID && d.DeadAt != nil {
+			dead = append(dead, *d)
+		}
+	}
+	return dead, nil
+}
+
+func (m *memoryStore) ReplayDelivery(subscriptionID, id string, at time.Time) error {
+	d, ok := m.deliveries[id]
+	if !ok || d.SubscriptionID != subscriptionID || d.DeadAt == nil {
+		return errors.New("not found")
+	}
+	d.DeadAt, d.Attempts, d.NextAttempt = nil, 0, at
+	return nil
+}
+
+type counter struct {
+	labels []string
+	counts map[string]float64
+}
+
+func (c *counter) With(labelValues ...string) metrics.Counter {
+	return &counter{labels: labelValues, counts: c.counts}
+}
+
+func (c *counter) Add(delta float64) {
+	c.counts[c.labels[len(c.labels)-1]] += delta
+}
+
+type histogram struct{}
+
+func (h histogram) With(...string) metrics.Histogram { return h }
+func (h histogram) Observe(float64)                  {}
+
+func TestDispatcher(t *testing.T) {
+	var status int
+	var received []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := Verify("secret", r.Header.Get(SignatureHeader), body, time.Now(), time.Minute); err != nil {
+			t.Errorf("expected a signed delivery, received %v", err)
+		}
+		received = append(received, r)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	store := newMemoryStore(
+		Subscription{ID: "s1", URL: server.URL, Events: []string{"Card*"}, Secret: "secret"},
+		Subscription{ID: "s2", URL: server.URL, Events: []string{"CustomerRegistered"}, Secret: "secret"},
+	)
+	counts := &counter{counts: make(map[string]float64)}
+	d := NewDispatcher(store, log.NewNopLogger(), counts, histogram{})
+	d.MaxAttempts = 2
+	now := time.Now()
+	d.now = func() time.Time { return now }
+
+	e := events.Event{ID: "e1", Type: "CardAdded"}
+	d.Handle(e)
+	d.Handle(e)
+	if len(store.deliveries) != 1 {
+		t.Fatalf("expected one delivery for the matching subscription, received %v", len(store.deliveries))
+	}
+
+	status = http.StatusServiceUnavailable
+	d.Flush()
+	delivery := store.deliveries["e1-s1"]
+	if delivery.Attempts != 1 || delivery.LastStatus != 503 || !delivery.NextAttempt.Equal(now.Add(d.MinBackoff)) {
+		t.Errorf("expected a retry after the minimum backoff, received %+v", delivery)
+	}
+	if n, _ := d.Flush(); n != 0 {
+		t.Errorf("expected no attempt before the backoff, attempted %v", n)
+	}
+
+	now = now.Add(d.MinBackoff)
+	d.Flush()
+	if dead, _ := store.DeadLetters("s1"); len(dead) != 1 {
+		t.Fatalf("expected a dead letter after %v attempts", d.MaxAttempts)
+	}
+	if n, _ := d.Flush(); n != 0 {
+		t.Errorf("expected dead letters not to be attempted, attempted %v", n)
+	}
+
+	status = http.StatusNoContent
+	store.ReplayDelivery("s1", "e1-s1", now)
+	d.Flush()
+	if len(store.deliveries) != 0 {
+		t.Errorf("expected the replayed delivery to complete, remaining %v", store.deliveries)
+	}
+	if len(received) != 3 || received[2].Header.Get(EventHeader) != "CardAdded" || received[2].Header.Get(DeliveryHeader) != "e1-s1" {
+		t.Errorf("unexpected requests %v", len(received))
+	}
+	if counts.counts[OutcomeFailed] != 1 || counts.counts[OutcomeDead] != 1 || counts.counts[OutcomeDelivered] != 1 {
+		t.Errorf("unexpected outcomes %v", counts.counts)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	d := NewDispatcher(newMemoryStore(), log.NewNopLogger(), nil, nil)
+	for attempts, expected := range map[int]time.Duration{
+		1:  10 * time.Second,
+		2:  20 * time.Second,
+		4:  80 * time.Second,
+		20: time.Hour,
+	} {
+		if wait := d.backoff(attempts); wait != expected {
+			t.Errorf("expected backoff %v after %v attempts, received %v", expected, attempts, wait)
+		}
+	}
+}